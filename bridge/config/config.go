@@ -29,6 +29,11 @@ const (
 	EventGetChannelMembers = "get_channel_members"
 	EventNoticeIRC         = "notice_irc"
 	EventReaction          = "reaction"
+	EventNickChange        = "nick_change"
+	EventCommand           = "command"
+	// EventDirectMessage messages are sent privately to the user with UserID (and
+	// Username) of the bridge instead of to Channel, by the bridges that support it.
+	EventDirectMessage = "direct_message"
 )
 
 const ParentIDNotFound = "msg-parent-not-found"
@@ -46,9 +51,94 @@ type Message struct {
 	ParentID  string    `json:"parent_id"`
 	Timestamp time.Time `json:"timestamp"`
 	ID        string    `json:"id"`
+	Mentions  []Mention `json:"mentions,omitempty"`
 	Extra     map[string][]interface{}
 }
 
+// Mention is a user mentioned in the text of a message.
+type Mention struct {
+	Text     string `json:"text"`     // the mention as it appears in the text (eg @alice)
+	Username string `json:"username"` // the name of the mentioned user
+	UserID   string `json:"userid"`   // userid on the bridge
+	Account  string `json:"account"`  // the account UserID belongs to, empty if unknown
+}
+
+// Actions of a JoinLeaveInfo.
+const (
+	JoinLeaveJoin     = "join"
+	JoinLeaveLeave    = "leave"
+	JoinLeaveNetsplit = "netsplit" // a leave caused by a netsplit (IRC)
+)
+
+// JoinLeaveInfo describes who joined or left in a EventJoinLeave message, bridges
+// add it to Extra[EventJoinLeave] so the gateway can aggregate joins and leaves.
+type JoinLeaveInfo struct {
+	Nick   string
+	Action string
+	Remote string // Nick as it appears on the destination (RemoteNickFormat), filled in by the gateway
+}
+
+// NickChangeInfo describes a EventNickChange message, bridges add it to Extra[EventNickChange].
+// The gateway fills in RemoteOld and RemoteNew for the destination, so bridges relaying
+// users under their own name (IRC puppets) can rename them.
+type NickChangeInfo struct {
+	Old       string
+	New       string
+	RemoteOld string // Old as it appears on the destination (RemoteNickFormat)
+	RemoteNew string // New as it appears on the destination (RemoteNickFormat)
+}
+
+// Commands of a CommandInfo.
+const (
+	CommandStatus = "status"
+	CommandWho    = "who"
+	CommandMute   = "mute"
+	CommandUnmute = "unmute"
+)
+
+// CommandInfo is a command a user gave to the bridge (eg a Discord slash command) in a
+// EventCommand message, bridges add it to Extra[EventCommand]. The gateway runs it for the
+// gateways of the channel and sends the reply back in a EventCommand message with the same
+// CommandInfo, so the bridge knows what it answers.
+type CommandInfo struct {
+	ID   string // identifies the command on the bridge (eg the Discord interaction)
+	Name string
+	Args []string
+}
+
+// Extra keys of the embeds of a message.
+const (
+	// ExtraEmbed holds the EmbedInfo of the embeds of a message.
+	ExtraEmbed = "embed"
+	// ExtraEmbedText holds the text of a message with embeds without the embeds, which
+	// destinations showing the embeds send instead of the text of the message.
+	ExtraEmbedText = "embed_text"
+	// ExtraEmbedSource holds the text of a message with embeds as the bridge sent it, so
+	// that destinations can apply the changes of the gateway to ExtraEmbedText.
+	ExtraEmbedSource = "embed_source"
+)
+
+// EmbedInfo is the rich content of a message (attachments, Block Kit), bridges add it to
+// Extra[ExtraEmbed] for destinations that can show it as embed. The text of the message holds
+// the same content, for destinations that can't.
+type EmbedInfo struct {
+	Title    string
+	URL      string // the link of the title
+	Author   string
+	Text     string
+	Color    string // #rrggbb
+	ImageURL string
+	Footer   string
+	Fields   []EmbedField
+}
+
+// EmbedField is a named value of an EmbedInfo, Short fields can be shown side by side.
+type EmbedField struct {
+	Name  string
+	Value string
+	Short bool
+}
+
 func (m Message) ParentNotFound() bool {
 	return m.ParentID == ParentIDNotFound
 }
@@ -88,35 +178,61 @@ type ChannelMember struct {
 type ChannelMembers []ChannelMember
 
 type Protocol struct {
+	AcceptInvitesFrom      []string // matrix
 	AllowMention           []string // discord
+	AppServiceHSToken      string   // matrix
+	AppServiceListen       string   // matrix
+	AppServiceToken        string   // matrix
+	AppServiceUserPrefix   string   // matrix
+	AppToken               string   // slack
+	AttachmentMaxSize      int      // all protocols
+	AttachmentMode         string   // all protocols
+	AttachmentPreviewSize  int      // all protocols
 	AuthCode               string   // steam
+	Backfill               bool     // irc
+	BackfillLimit          int      // irc
 	BindAddress            string   // mattermost, slack // DEPRECATED
 	Buffer                 int      // api
 	Charset                string   // irc
 	ClientID               string   // msteams
 	ColorNicks             bool     // only irc for now
+	CryptoStore            string   // matrix
 	Debug                  bool     // general
+	DelayNoticeAfter       int      // all protocols
+	DelayNoticeFormat      string   // all protocols
 	DebugLevel             int      // only for irc now
 	DisableWebPagePreview  bool     // telegram
 	EditSuffix             string   // mattermost, slack, discord, telegram, gitter
 	EditDisable            bool     // mattermost, slack, discord, telegram, gitter
+	Encryption             bool     // matrix
+	EncryptionUnverified   bool     // matrix
+	EventsBindAddress      string   // slack
+	HideSedCorrections     bool     // irc
 	HTMLDisable            bool     // matrix
 	IconURL                string   // mattermost, slack
+	IdentityFile           string   // general
 	IgnoreFailureOnStart   bool     // general
 	IgnoreNicks            string   // all protocols
 	IgnoreMessages         string   // all protocols
 	Jid                    string   // xmpp
 	JoinDelay              string   // all protocols
+	JoinPartWindow         int      // all protocols
 	Label                  string   // all protocols
 	Login                  string   // mattermost, matrix
 	LogFile                string   // general
 	MediaDownloadBlackList []string
 	MediaDownloadPath      string // Basically MediaServerUpload, but instead of uploading it, just write it to a file on the same server.
 	MediaDownloadSize      int    // all protocols
+	MediaIndexFile         string // general, file to keep the index of the files on the mediaserver
 	MediaServerDownload    string
 	MediaServerUpload      string
 	MediaConvertTgs        string     // telegram
 	MediaConvertWebPToPNG  bool       // telegram
+	MediaAudioFormats      []string   // all protocols
+	MediaImageFormats      []string   // all protocols
+	MediaMaxImageSize      int        // all protocols
+	MediaStickerFormat     string     // all protocols
+	MediaStripMetadata     bool       // all protocols
 	MessageDelay           int        // IRC, time in millisecond to wait between messages
 	MessageFormat          string     // telegram
 	MessageLength          int        // IRC, max length of a message allowed
@@ -135,8 +251,15 @@ type Protocol struct {
 	NoSendJoinPart         bool       // all protocols
 	NoTLS                  bool       // mattermost, xmpp
 	Password               string     // IRC,mattermost,XMPP,matrix
+	PasteField             string     // IRC
+	PasteMinLines          int        // IRC
+	PasteURL               string     // IRC
 	PrefixMessagesWithNick bool       // mattemost, slack
 	PreserveThreading      bool       // slack
+	PuppetIdleTimeout      int        // IRC
+	PuppetMaxConnections   int        // IRC
+	PuppetPassword         string     // IRC
+	Puppets                bool       // IRC
 	Protocol               string     // all protocols
 	QuoteDisable           bool       // telegram
 	QuoteFormat            string     // telegram
@@ -147,9 +270,14 @@ type Protocol struct {
 	ReplaceNicks           [][]string // all protocols
 	RemoteNickFormat       string     // all protocols
 	RunCommands            []string   // IRC
+	SASLMechanism          string     // IRC
+	SedCorrections         bool       // IRC
 	Server                 string     // IRC,mattermost,XMPP,discord,matrix
 	SessionFile            string     // msteams,whatsapp
+	SigningSecret          string     // slack
+	SlashCommands          bool       // discord
 	ShowJoinPart           bool       // all protocols
+	ShowNickChange         bool       // all protocols
 	ShowTopicChange        bool       // slack
 	ShowUserTyping         bool       // slack
 	ShowEmbeds             bool       // discord
@@ -168,6 +296,7 @@ type Protocol struct {
 	UseAPI                 bool       // mattermost, slack
 	UseLocalAvatar         []string   // discord
 	UseSASL                bool       // IRC
+	UseThreads             bool       // matrix
 	UseTLS                 bool       // IRC
 	UseDiscriminator       bool       // discord
 	UseFirstName           bool       // telegram
@@ -175,8 +304,12 @@ type Protocol struct {
 	UseInsecureURL         bool       // telegram
 	UserName               string     // IRC
 	VerboseJoinPart        bool       // IRC
-	WebhookBindAddress     string     // mattermost, slack
-	WebhookURL             string     // mattermost, slack
+	WebhookBindAddress     string     // mattermost, slack, telegram
+	WebhookPoolSize        int        // discord
+	WebhookSecret          string     // telegram
+	WebhookTLSCert         string     // telegram
+	WebhookTLSKey          string     // telegram
+	WebhookURL             string     // mattermost, slack, telegram
 }
 
 type ChannelOptions struct {
@@ -193,11 +326,14 @@ type Bridge struct {
 }
 
 type Gateway struct {
-	Name   string
-	Enable bool
-	In     []Bridge
-	Out    []Bridge
-	InOut  []Bridge
+	Name            string
+	Enable          bool
+	MaxMessageAge   int
+	StalePolicy     string
+	StaleDigestSize int
+	In              []Bridge
+	Out             []Bridge
+	InOut           []Bridge
 }
 
 type Tengo struct {
@@ -207,6 +343,13 @@ type Tengo struct {
 	OutMessage       string
 }
 
+// Identity links the users of the same person on different accounts.
+type Identity struct {
+	Name   string   `json:"name"`   // display name used for all users
+	Avatar string   `json:"avatar"` // avatar URL used for all users
+	Users  []string `json:"users"`  // account:userid, eg slack.myteam:U0123
+}
+
 type SameChannelGateway struct {
 	Name     string
 	Enable   bool
@@ -236,6 +379,7 @@ type BridgeValues struct {
 	Tengo              Tengo
 	Gateway            []Gateway
 	SameChannelGateway []SameChannelGateway
+	Identity           []Identity
 }
 
 type Config interface {
@@ -0,0 +1,163 @@
+package bdiscord
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	cInteraction = "interaction"
+
+	bridgeCommand = "bridge"
+	// commandPermissions are the permissions members need to use the /bridge command by
+	// default, servers can change who may use it in their integration settings. Muting
+	// always needs them.
+	commandPermissions int64 = discordgo.PermissionManageMessages
+)
+
+// registerCommands registers the /bridge command in our guild.
+func (b *Bdiscord) registerCommands() error {
+	permissions := commandPermissions
+	dm := false
+	userOption := []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "user",
+			Description: "The name of the user on their bridge or of their identity, see /bridge who",
+			Required:    true,
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "account",
+			Description: "The account of the user, e.g. irc.libera, when the name is used on several",
+		},
+	}
+	_, err := b.c.ApplicationCommandCreate(b.userID, b.guildID, &discordgo.ApplicationCommand{
+		Name:                     bridgeCommand,
+		Description:              "Manage the bridging of this channel",
+		DefaultMemberPermissions: &permissions,
+		DMPermission:             &dm,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        config.CommandStatus,
+				Description: "Show the channels bridged with this channel",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        config.CommandWho,
+				Description: "Show who was active in the bridged channels recently",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        config.CommandMute,
+				Description: "Stop relaying the messages of a user",
+				Options:     userOption,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        config.CommandUnmute,
+				Description: "Relay the messages of a muted user again",
+				Options:     userOption,
+			},
+		},
+	})
+	return err
+}
+
+// interactionCreate passes the /bridge commands to the gateway, which replies later on.
+func (b *Bdiscord) interactionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.GuildID != b.guildID || i.Type != discordgo.InteractionApplicationCommand || i.Member == nil || i.Member.User == nil {
+		return
+	}
+	data := i.ApplicationCommandData()
+	if data.Name != bridgeCommand || len(data.Options) == 0 {
+		return
+	}
+	sub := data.Options[0]
+	info := config.CommandInfo{ID: i.ID, Name: sub.Name}
+	// the gateway expects the user first, then the account
+	for _, name := range []string{"user", "account"} {
+		for _, option := range sub.Options {
+			if option.Name == name {
+				info.Args = append(info.Args, option.StringValue())
+			}
+		}
+	}
+
+	if (info.Name == config.CommandMute || info.Name == config.CommandUnmute) && i.Member.Permissions&commandPermissions == 0 {
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "You need the Manage Messages permission to mute users.",
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			b.Log.Errorf("Could not respond to /%s %s: %s", bridgeCommand, info.Name, err)
+		}
+		return
+	}
+
+	// Discord wants a response within 3 seconds, the reply of the gateway edits it
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		b.Log.Errorf("Could not respond to /%s %s: %s", bridgeCommand, info.Name, err)
+		return
+	}
+	b.cache.Add(cInteraction+i.ID, i.Interaction)
+
+	rmsg := config.Message{
+		Account:  b.Account,
+		Event:    config.EventCommand,
+		Channel:  b.getChannelName(b.getParentChannelID(i.ChannelID)),
+		Username: memberName(i.Member),
+		UserID:   i.Member.User.ID,
+		Text:     strings.TrimSpace(fmt.Sprintf("/%s %s %s", bridgeCommand, info.Name, strings.Join(info.Args, " "))),
+		Extra:    map[string][]interface{}{config.EventCommand: {info}},
+	}
+	b.Log.Debugf("<= Sending command from %s on %s to gateway", rmsg.Username, b.Account)
+	b.Log.Debugf("<= Message is %#v", rmsg)
+	b.Remote <- rmsg
+}
+
+// handleCommandReply answers the command msg replies to.
+func (b *Bdiscord) handleCommandReply(msg *config.Message) error {
+	var info config.CommandInfo
+	for _, v := range msg.Extra[config.EventCommand] {
+		if i, ok := v.(config.CommandInfo); ok {
+			info = i
+		}
+	}
+	v, ok := b.cache.Get(cInteraction + info.ID)
+	if !ok {
+		return fmt.Errorf("unknown interaction %s", info.ID)
+	}
+	b.cache.Remove(cInteraction + info.ID)
+
+	text := msg.Text
+	if info.Name == config.CommandStatus {
+		text += b.queueStatus(b.getChannelID(msg.Channel))
+	}
+	text = helper.ClipMessage(text, MessageLength, b.GetString("MessageClipped"))
+	_, err := b.c.InteractionResponseEdit(v.(*discordgo.Interaction), &discordgo.WebhookEdit{Content: &text})
+	return err
+}
+
+// queueStatus returns the metrics of the webhook queue of channelID for the status command.
+func (b *Bdiscord) queueStatus(channelID string) string {
+	stats, ok := b.transmitter.Stats()[channelID]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("\nWebhooks: %d, %d queued, %d sent, %d failed, rate limited %d times (waited %s)",
+		stats.Webhooks, stats.Queued, stats.Sent, stats.Failed, stats.RateLimited, stats.Waited.Round(time.Second))
+}
@@ -0,0 +1,54 @@
+package bdiscord
+
+import (
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlashCommands(t *testing.T) {
+	fd := &fakeDiscord{}
+	b := newTestDiscord(t, fd, "SlashCommands=true")
+	command := func(id, name string, permissions int64, args ...string) {
+		option := &discordgo.ApplicationCommandInteractionDataOption{Name: name, Type: discordgo.ApplicationCommandOptionSubCommand}
+		for _, arg := range args {
+			option.Options = append(option.Options, &discordgo.ApplicationCommandInteractionDataOption{
+				Name: "user", Type: discordgo.ApplicationCommandOptionString, Value: arg,
+			})
+		}
+		b.interactionCreate(b.c, &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+			ID: id, AppID: "a1", Token: "token" + id, Type: discordgo.InteractionApplicationCommand, GuildID: "g1", ChannelID: "c1",
+			Member: &discordgo.Member{User: &discordgo.User{ID: "u1", Username: "alice"}, Permissions: permissions},
+			Data:   discordgo.ApplicationCommandInteractionData{Name: bridgeCommand, Options: []*discordgo.ApplicationCommandInteractionDataOption{option}},
+		}})
+	}
+
+	// commands are deferred and passed to the gateway
+	command("i1", config.CommandMute, discordgo.PermissionManageMessages, "bob")
+	assert.Equal(t, "POST interactions/i1/tokeni1/callback", fd.lastRequest())
+	require.Len(t, b.Remote, 1)
+	rmsg := <-b.Remote
+	assert.Equal(t, config.EventCommand, rmsg.Event)
+	assert.Equal(t, "general", rmsg.Channel)
+	assert.Equal(t, "alice", rmsg.Username)
+	assert.Equal(t, "/bridge mute bob", rmsg.Text)
+	info := config.CommandInfo{ID: "i1", Name: config.CommandMute, Args: []string{"bob"}}
+	assert.Equal(t, []interface{}{info}, rmsg.Extra[config.EventCommand])
+
+	// the reply of the gateway edits the response
+	_, err := b.Send(config.Message{Event: config.EventCommand, Text: "Muted bob", Channel: "general", Extra: rmsg.Extra})
+	require.NoError(t, err)
+	assert.Equal(t, "PATCH webhooks/a1/tokeni1/messages/@original", fd.lastRequest())
+	_, err = b.Send(config.Message{Event: config.EventCommand, Text: "Muted bob", Channel: "general", Extra: rmsg.Extra})
+	assert.Error(t, err, "interactions are answered once")
+
+	// muting needs permissions
+	command("i2", config.CommandMute, 0, "bob")
+	assert.Equal(t, "POST interactions/i2/tokeni2/callback", fd.lastRequest())
+	assert.Empty(t, b.Remote)
+	command("i3", config.CommandStatus, 0)
+	assert.Len(t, b.Remote, 1)
+}
@@ -31,6 +31,7 @@ type Bdiscord struct {
 	channelsMutex  sync.RWMutex
 	channels       []*discordgo.Channel
 	channelInfoMap map[string]*config.ChannelInfo
+	threads        map[string]*discordgo.Channel
 
 	membersMutex  sync.RWMutex
 	userMemberMap map[string]*discordgo.Member
@@ -56,6 +57,7 @@ func New(cfg *bridge.Config) bridge.Bridger {
 	b.userMemberMap = make(map[string]*discordgo.Member)
 	b.nickMemberMap = make(map[string]*discordgo.Member)
 	b.channelInfoMap = make(map[string]*config.ChannelInfo)
+	b.threads = make(map[string]*discordgo.Channel)
 
 	b.useAutoWebhooks = b.GetBool("AutoWebhooks")
 	if b.useAutoWebhooks {
@@ -167,6 +169,9 @@ func (b *Bdiscord) Connect() error {
 	// Initialise webhook management
 	b.transmitter = transmitter.New(b.c, b.guildID, "matterbridge", b.useAutoWebhooks)
 	b.transmitter.Log = b.Log
+	if poolSize := b.GetInt("WebhookPoolSize"); poolSize > 0 {
+		b.transmitter.PoolSize = poolSize
+	}
 
 	var webhookChannelIDs []string
 	for _, channel := range b.Channels {
@@ -203,6 +208,16 @@ func (b *Bdiscord) Connect() error {
 		}
 	}
 
+	// Threads are channels of their own, we map them to the channel they're in
+	threads, err := b.c.GuildThreadsActive(b.guildID)
+	if err != nil {
+		b.Log.Errorf("Could not get active threads: %s", err)
+	} else {
+		for _, thread := range threads.Threads {
+			b.addThread(thread)
+		}
+	}
+
 	// Obtaining guild members and initializing nickname mapping.
 	b.membersMutex.Lock()
 	defer b.membersMutex.Unlock()
@@ -231,6 +246,16 @@ func (b *Bdiscord) Connect() error {
 	b.c.AddHandler(b.memberAdd)
 	b.c.AddHandler(b.memberRemove)
 	b.c.AddHandler(b.memberUpdate)
+	b.c.AddHandler(b.threadCreate)
+	b.c.AddHandler(b.threadUpdate)
+	b.c.AddHandler(b.threadDelete)
+	b.c.AddHandler(b.threadListSync)
+	if b.GetBool("SlashCommands") {
+		b.c.AddHandler(b.interactionCreate)
+		if err := b.registerCommands(); err != nil {
+			b.Log.Errorf("Could not register the /%s command, was the bot invited with the applications.commands scope? %s", bridgeCommand, err)
+		}
+	}
 	if b.GetInt("debuglevel") == 1 {
 		b.c.AddHandler(b.messageEvent)
 	}
@@ -253,6 +278,14 @@ func (b *Bdiscord) JoinChannel(channel config.ChannelInfo) error {
 func (b *Bdiscord) Send(msg config.Message) (string, error) {
 	b.Log.Debugf("=> Receiving %#v", msg)
 
+	if msg.Event == config.EventCommand {
+		return "", b.handleCommandReply(&msg)
+	}
+
+	if msg.Event == config.EventDirectMessage {
+		return b.sendDirectMessage(&msg)
+	}
+
 	channelID := b.getChannelID(msg.Channel)
 	if channelID == "" {
 		return "", fmt.Errorf("Could not find channelID for %v", msg.Channel)
@@ -276,13 +309,40 @@ func (b *Bdiscord) Send(msg config.Message) (string, error) {
 		msg.ParentID = ""
 	}
 
+	threadID := b.getThreadID(&msg, channelID)
+	if threadID == "" && msg.ID == "" && b.isForum(channelID) {
+		return b.handleForumPost(&msg, channelID)
+	}
+
+	return b.sendMessage(&msg, channelID, threadID)
+}
+
+// sendMessage sends msg to channelID, or to its thread threadID if that's not empty.
+func (b *Bdiscord) sendMessage(msg *config.Message, channelID, threadID string) (string, error) {
+	// in a thread the thread is the reply
+	if threadID != "" {
+		msg.ParentID = ""
+	}
+
+	var (
+		id  string
+		err error
+	)
 	// Use webhook to send the message
-	useWebhooks := b.shouldMessageUseWebhooks(&msg)
+	useWebhooks := b.shouldMessageUseWebhooks(msg)
 	if useWebhooks && msg.Event != config.EventMsgDelete && msg.ParentID == "" {
-		return b.handleEventWebhook(&msg, channelID)
+		id, err = b.handleEventWebhook(msg, channelID, threadID)
+	} else if threadID != "" {
+		id, err = b.handleEventBotUser(msg, threadID)
+	} else {
+		id, err = b.handleEventBotUser(msg, channelID)
 	}
 
-	return b.handleEventBotUser(&msg, channelID)
+	// remember the thread for replies, edits and deletions
+	if threadID != "" && id != "" {
+		b.cache.Add(cThread+id, threadID)
+	}
+	return id, err
 }
 
 // handleEventDirect handles events via the bot user
@@ -327,8 +387,13 @@ func (b *Bdiscord) handleEventBotUser(msg *config.Message, channelID string) (st
 		}
 	}
 
+	// edits keep the text with the content of the embeds
+	var msgEmbeds []*discordgo.MessageEmbed
+	if e, text, ok := embeds(msg); ok && msg.ID == "" {
+		msg.Text, msgEmbeds = text, e
+	}
 	msg.Text = helper.ClipMessage(msg.Text, MessageLength, b.GetString("MessageClipped"))
-	msg.Text = b.replaceUserMentions(msg.Text)
+	msg.Text = b.replaceUserMentions(msg.Text, msg.Mentions)
 
 	// Edit message
 	if msg.ID != "" {
@@ -338,6 +403,7 @@ func (b *Bdiscord) handleEventBotUser(msg *config.Message, channelID string) (st
 
 	m := discordgo.MessageSend{
 		Content:         msg.Username + msg.Text,
+		Embeds:          msgEmbeds,
 		AllowedMentions: b.getAllowedMentions(),
 	}
 
@@ -358,9 +424,24 @@ func (b *Bdiscord) handleEventBotUser(msg *config.Message, channelID string) (st
 	return res.ID, nil
 }
 
+// sendDirectMessage sends msg to the user with its UserID in a DM.
+func (b *Bdiscord) sendDirectMessage(msg *config.Message) (string, error) {
+	channel, err := b.c.UserChannelCreate(msg.UserID)
+	if err != nil {
+		return "", err
+	}
+	text := helper.ClipMessage(msg.Text, MessageLength, b.GetString("MessageClipped"))
+	res, err := b.c.ChannelMessageSend(channel.ID, text)
+	if err != nil {
+		return "", err
+	}
+	return res.ID, nil
+}
+
 // handleUploadFile handles native upload of files
 func (b *Bdiscord) handleUploadFile(msg *config.Message, channelID string) (string, error) {
-	for _, f := range msg.Extra["file"] {
+	var mID string
+	for i, f := range msg.Extra["file"] {
 		fi := f.(config.FileInfo)
 		file := discordgo.File{
 			Name:        fi.Name,
@@ -374,7 +455,10 @@ func (b *Bdiscord) handleUploadFile(msg *config.Message, channelID string) (stri
 		}
 		res, err := b.c.ChannelMessageSendComplex(channelID, &m)
 		if err != nil {
-			return "", fmt.Errorf("file upload failed: %s", err)
+			return mID, &helper.UploadError{ID: mID, Text: i > 0, Files: helper.FileNames(msg.Extra["file"][i:]), Err: err}
+		}
+		if mID == "" {
+			mID = res.ID
 		}
 
 		// link file_upload_nativeID (file ID from the original bridge) to our upload id
@@ -0,0 +1,100 @@
+package bdiscord
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/bwmarrin/discordgo"
+)
+
+// Limits of Discord embeds.
+const (
+	maxEmbeds            = 10
+	maxEmbedFields       = 25
+	maxEmbedTitle        = 256
+	maxEmbedDescription  = 4096
+	maxEmbedFieldName    = 256
+	maxEmbedFieldValue   = 1024
+	maxEmbedFooterLength = 2048
+)
+
+// embeds returns the embeds other bridges added to msg as Discord embeds and the text to
+// send with them, which doesn't repeat their content. That's the text of msg with the text
+// the bridge sent replaced by the text without the embeds, or the text of msg if the gateway
+// changed the text the bridge sent. Returns false if msg has no embeds.
+func embeds(msg *config.Message) ([]*discordgo.MessageEmbed, string, bool) {
+	var res []*discordgo.MessageEmbed
+	for _, e := range msg.Extra[config.ExtraEmbed] {
+		info, ok := e.(config.EmbedInfo)
+		if !ok || len(res) == maxEmbeds {
+			continue
+		}
+		res = append(res, toEmbed(&info))
+	}
+	if len(res) == 0 {
+		return nil, "", false
+	}
+	text, source := lastString(msg.Extra[config.ExtraEmbedText]), lastString(msg.Extra[config.ExtraEmbedSource])
+	if source == "" || !strings.Contains(msg.Text, source) {
+		return res, msg.Text, true
+	}
+	return res, strings.Replace(msg.Text, source, text, 1), true
+}
+
+// lastString returns the last string of values.
+func lastString(values []interface{}) string {
+	res := ""
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			res = s
+		}
+	}
+	return res
+}
+
+// toEmbed converts info to a Discord embed.
+func toEmbed(info *config.EmbedInfo) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		URL:         info.URL,
+		Title:       clipEmbed(info.Title, maxEmbedTitle),
+		Description: clipEmbed(info.Text, maxEmbedDescription),
+	}
+	if color, err := strconv.ParseInt(strings.TrimPrefix(info.Color, "#"), 16, 32); err == nil {
+		embed.Color = int(color)
+	}
+	if info.Author != "" {
+		embed.Author = &discordgo.MessageEmbedAuthor{Name: clipEmbed(info.Author, maxEmbedTitle)}
+	}
+	if info.ImageURL != "" {
+		embed.Image = &discordgo.MessageEmbedImage{URL: info.ImageURL}
+	}
+	if info.Footer != "" {
+		embed.Footer = &discordgo.MessageEmbedFooter{Text: clipEmbed(info.Footer, maxEmbedFooterLength)}
+	}
+	for i, field := range info.Fields {
+		if i == maxEmbedFields {
+			break
+		}
+		// Discord rejects fields without name or value
+		name, value := field.Name, field.Value
+		if name == "" {
+			name = "\u200b"
+		}
+		if value == "" {
+			value = "\u200b"
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   clipEmbed(name, maxEmbedFieldName),
+			Value:  clipEmbed(value, maxEmbedFieldValue),
+			Inline: field.Short,
+		})
+	}
+	return embed
+}
+
+// clipEmbed clips text of an embed to length.
+func clipEmbed(text string, length int) string {
+	return helper.ClipMessage(text, length, "...")
+}
@@ -0,0 +1,98 @@
+package bdiscord
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeds(t *testing.T) {
+	_, _, ok := embeds(&config.Message{Text: "hello"})
+	assert.False(t, ok)
+
+	msg := &config.Message{
+		Text: "deploy failed\n*CI build #42*\nTests failed",
+		Extra: map[string][]interface{}{
+			config.ExtraEmbed: {config.EmbedInfo{
+				Title:  "CI build #42",
+				URL:    "https://ci.example.com/42",
+				Text:   "Tests failed",
+				Color:  "#a30200",
+				Footer: strings.Repeat("x", 3000),
+				Fields: []config.EmbedField{{Name: "Branch", Value: "main", Short: true}, {Name: "Empty"}},
+			}},
+			config.ExtraEmbedText:   {"deploy failed"},
+			config.ExtraEmbedSource: {"deploy failed\n*CI build #42*\nTests failed"},
+		},
+	}
+	res, text, ok := embeds(msg)
+	assert.True(t, ok)
+	assert.Equal(t, "deploy failed", text)
+	assert.Len(t, res, 1)
+	assert.Equal(t, "CI build #42", res[0].Title)
+	assert.Equal(t, "https://ci.example.com/42", res[0].URL)
+	assert.Equal(t, "Tests failed", res[0].Description)
+	assert.Equal(t, 0xa30200, res[0].Color)
+	assert.Len(t, res[0].Footer.Text, maxEmbedFooterLength)
+	assert.Equal(t, []*discordgo.MessageEmbedField{
+		{Name: "Branch", Value: "main", Inline: true},
+		{Name: "Empty", Value: "\u200b"},
+	}, res[0].Fields)
+}
+
+func TestEmbedsText(t *testing.T) {
+	extra := map[string][]interface{}{
+		config.ExtraEmbed:       {config.EmbedInfo{Title: "CI build #42", Text: "Tests failed"}},
+		config.ExtraEmbedText:   {"deploy failed"},
+		config.ExtraEmbedSource: {"deploy failed\n*CI build #42*\nTests failed"},
+	}
+	for _, tc := range []struct {
+		text, expected string
+	}{
+		// the gateway added a delay notice and the URL of a file
+		{"deploy failed\n*CI build #42*\nTests failed (delayed 5m)\nhttps://media.example.com/log.txt", "deploy failed (delayed 5m)\nhttps://media.example.com/log.txt"},
+		// the gateway changed the text with ReplaceMessages or tengo
+		{"deploy FAILED\n*CI build #42*\nTests failed", "deploy FAILED\n*CI build #42*\nTests failed"},
+	} {
+		_, text, ok := embeds(&config.Message{Text: tc.text, Extra: extra})
+		assert.True(t, ok)
+		assert.Equal(t, tc.expected, text)
+	}
+
+	// without the text the bridge sent, the text of the message is kept
+	_, text, _ := embeds(&config.Message{Text: "deploy failed\nTests failed", Extra: map[string][]interface{}{
+		config.ExtraEmbed:     {config.EmbedInfo{Text: "Tests failed"}},
+		config.ExtraEmbedText: {"deploy failed"},
+	}})
+	assert.Equal(t, "deploy failed\nTests failed", text)
+}
+
+func TestWebhookEmbeds(t *testing.T) {
+	fd := &fakeDiscord{}
+	b := newTestDiscord(t, fd, "")
+	b.transmitter.AddWebhook("c1", &discordgo.Webhook{ID: "w1", Token: "secret", ChannelID: "c1"})
+	b.useAutoWebhooks = true
+
+	long := strings.Repeat("x", MessageLength+100)
+	_, err := b.Send(config.Message{
+		Channel: "general", Username: "alerts",
+		Text: long + "\n*CI build #42*\nTests failed",
+		Extra: map[string][]interface{}{
+			config.ExtraEmbed:       {config.EmbedInfo{Title: "CI build #42", Text: "Tests failed"}},
+			config.ExtraEmbedText:   {long},
+			config.ExtraEmbedSource: {long + "\n*CI build #42*\nTests failed"},
+		},
+	})
+	require.NoError(t, err)
+	var params discordgo.WebhookParams
+	require.NoError(t, json.Unmarshal([]byte(fd.bodies[len(fd.bodies)-1]), &params))
+	assert.LessOrEqual(t, len(params.Content), MessageLength, "the embed text is clipped")
+	assert.NotContains(t, params.Content, "CI build")
+	require.Len(t, params.Embeds, 1)
+	assert.Equal(t, "CI build #42", params.Embeds[0].Title)
+}
@@ -12,7 +12,7 @@ func (b *Bdiscord) messageDelete(s *discordgo.Session, m *discordgo.MessageDelet
 		return
 	}
 	rmsg := config.Message{Account: b.Account, ID: m.ID, Event: config.EventMsgDelete, Text: config.EventMsgDelete}
-	rmsg.Channel = b.getChannelName(m.ChannelID)
+	rmsg.Channel = b.getChannelName(b.getParentChannelID(m.ChannelID))
 
 	b.Log.Debugf("<= Sending message from %s to gateway", b.Account)
 	b.Log.Debugf("<= Message is %#v", rmsg)
@@ -25,13 +25,14 @@ func (b *Bdiscord) messageDeleteBulk(s *discordgo.Session, m *discordgo.MessageD
 		b.Log.Debugf("Ignoring messageDeleteBulk because it originates from a different guild")
 		return
 	}
+	channel := b.getChannelName(b.getParentChannelID(m.ChannelID))
 	for _, msgID := range m.Messages {
 		rmsg := config.Message{
 			Account: b.Account,
 			ID:      msgID,
 			Event:   config.EventMsgDelete,
 			Text:    config.EventMsgDelete,
-			Channel: b.getChannelName(m.ChannelID),
+			Channel: channel,
 		}
 
 		b.Log.Debugf("<= Sending message from %s to gateway", b.Account)
@@ -59,7 +60,7 @@ func (b *Bdiscord) messageTyping(s *discordgo.Session, m *discordgo.TypingStart)
 	}
 
 	rmsg := config.Message{Account: b.Account, Event: config.EventUserTyping}
-	rmsg.Channel = b.getChannelName(m.ChannelID)
+	rmsg.Channel = b.getChannelName(b.getParentChannelID(m.ChannelID))
 	b.Remote <- rmsg
 }
 
@@ -97,6 +98,10 @@ func (b *Bdiscord) messageCreate(s *discordgo.Session, m *discordgo.MessageCreat
 	if m.Author.Bot && b.transmitter.HasWebhook(m.Author.ID) {
 		return
 	}
+	// the thread itself is relayed by its messages
+	if m.Type == discordgo.MessageTypeThreadCreated || m.Type == discordgo.MessageTypeThreadStarterMessage {
+		return
+	}
 
 	// add the url of the attachments to content
 	if len(m.Attachments) > 0 {
@@ -105,7 +110,10 @@ func (b *Bdiscord) messageCreate(s *discordgo.Session, m *discordgo.MessageCreat
 		}
 	}
 
-	rmsg := config.Message{Account: b.Account, Avatar: "https://cdn.discordapp.com/avatars/" + m.Author.ID + "/" + m.Author.Avatar + ".jpg", UserID: m.Author.ID, ID: m.ID}
+	rmsg := config.Message{Account: b.Account, Avatar: "https://cdn.discordapp.com/avatars/" + m.Author.ID + "/" + m.Author.Avatar + ".jpg", UserID: m.Author.ID, ID: m.ID, Timestamp: m.Timestamp}
+	if m.EditedTimestamp != nil {
+		rmsg.Timestamp = *m.EditedTimestamp
+	}
 
 	b.Log.Debugf("== Receiving event %#v", m.Message)
 
@@ -116,10 +124,16 @@ func (b *Bdiscord) messageCreate(s *discordgo.Session, m *discordgo.MessageCreat
 			b.Log.Errorf("ContentWithMoreMentionsReplaced failed: %s", err)
 			rmsg.Text = m.ContentWithMentionsReplaced()
 		}
+		rmsg.Mentions = b.getMentions(m.Message)
 	}
 
-	// set channel name
-	rmsg.Channel = b.getChannelName(m.ChannelID)
+	// set channel name, messages in threads are in the channel of the thread
+	channelID := m.ChannelID
+	thread := b.getThread(m.ChannelID)
+	if thread != nil {
+		channelID = thread.ParentID
+	}
+	rmsg.Channel = b.getChannelName(channelID)
 
 	fromWebhook := m.WebhookID != ""
 	if !fromWebhook && !b.GetBool("UseUserName") {
@@ -153,9 +167,21 @@ func (b *Bdiscord) messageCreate(s *discordgo.Session, m *discordgo.MessageCreat
 	// Replace emotes
 	rmsg.Text = replaceEmotes(rmsg.Text)
 
-	// Add our parent id if it exists, and if it's not referring to a message in another channel
-	if ref := m.MessageReference; ref != nil && ref.ChannelID == m.ChannelID {
-		rmsg.ParentID = ref.MessageID
+	switch {
+	case thread != nil && m.ID == thread.ID:
+		// the first message of a forum post, the post has a name
+		if b.isForum(thread.ParentID) {
+			rmsg.Text = thread.Name + "\n" + rmsg.Text
+		}
+	case thread != nil:
+		// messages in a thread reply to the message it was started from, which has its ID
+		rmsg.ParentID = thread.ID
+		b.cache.Add(cThread+m.ID, thread.ID)
+	default:
+		// Add our parent id if it exists, and if it's not referring to a message in another channel
+		if ref := m.MessageReference; ref != nil && ref.ChannelID == m.ChannelID {
+			rmsg.ParentID = ref.MessageID
+		}
 	}
 
 	b.Log.Debugf("<= Sending message from %s on %s to gateway", m.Author.Username, b.Account)
@@ -173,8 +199,7 @@ func (b *Bdiscord) memberUpdate(s *discordgo.Session, m *discordgo.GuildMemberUp
 	}
 
 	b.membersMutex.Lock()
-	defer b.membersMutex.Unlock()
-
+	var oldName string
 	if currMember, ok := b.userMemberMap[m.Member.User.ID]; ok {
 		b.Log.Debugf(
 			"%s: memberupdate: user %s (nick %s) changes nick to %s",
@@ -183,6 +208,7 @@ func (b *Bdiscord) memberUpdate(s *discordgo.Session, m *discordgo.GuildMemberUp
 			b.userMemberMap[m.Member.User.ID].Nick,
 			m.Member.Nick,
 		)
+		oldName = memberName(currMember)
 		delete(b.nickMemberMap, currMember.User.Username)
 		delete(b.nickMemberMap, currMember.Nick)
 		delete(b.userMemberMap, m.Member.User.ID)
@@ -192,6 +218,25 @@ func (b *Bdiscord) memberUpdate(s *discordgo.Session, m *discordgo.GuildMemberUp
 	if m.Member.Nick != "" {
 		b.nickMemberMap[m.Member.Nick] = m.Member
 	}
+	b.membersMutex.Unlock()
+
+	// with UseUserName users are relayed with their username, which doesn't change here
+	newName := memberName(m.Member)
+	if oldName == "" || oldName == newName || b.GetBool("UseUserName") {
+		return
+	}
+	// a nick change is for the whole guild, the gateway relays it to all channels
+	rmsg := config.Message{
+		Account:  b.Account,
+		Event:    config.EventNickChange,
+		Username: "system",
+		UserID:   m.Member.User.ID,
+		Text:     oldName + " is now known as " + newName,
+		Extra:    map[string][]interface{}{config.EventNickChange: {config.NickChangeInfo{Old: oldName, New: newName}}},
+	}
+	b.Log.Debugf("<= Sending message from %s to gateway", b.Account)
+	b.Log.Debugf("<= Message is %#v", rmsg)
+	b.Remote <- rmsg
 }
 
 func (b *Bdiscord) memberAdd(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
@@ -216,6 +261,7 @@ func (b *Bdiscord) memberAdd(s *discordgo.Session, m *discordgo.GuildMemberAdd)
 		Event:    config.EventJoinLeave,
 		Username: "system",
 		Text:     username + " joins",
+		Extra:    map[string][]interface{}{config.EventJoinLeave: {config.JoinLeaveInfo{Nick: username, Action: config.JoinLeaveJoin}}},
 	}
 	b.Log.Debugf("<= Sending message from %s to gateway", b.Account)
 	b.Log.Debugf("<= Message is %#v", rmsg)
@@ -244,6 +290,7 @@ func (b *Bdiscord) memberRemove(s *discordgo.Session, m *discordgo.GuildMemberRe
 		Event:    config.EventJoinLeave,
 		Username: "system",
 		Text:     username + " leaves",
+		Extra:    map[string][]interface{}{config.EventJoinLeave: {config.JoinLeaveInfo{Nick: username, Action: config.JoinLeaveLeave}}},
 	}
 	b.Log.Debugf("<= Sending message from %s to gateway", b.Account)
 	b.Log.Debugf("<= Message is %#v", rmsg)
@@ -6,6 +6,8 @@ import (
 	"strings"
 	"unicode"
 
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
 	"github.com/bwmarrin/discordgo"
 )
 
@@ -64,6 +66,14 @@ func (b *Bdiscord) getNick(user *discordgo.User, guildID string) string {
 	return user.Username
 }
 
+// memberName returns the name member is shown with, its nick in the guild if it has one.
+func memberName(member *discordgo.Member) string {
+	if member.Nick != "" {
+		return member.Nick
+	}
+	return member.User.Username
+}
+
 func (b *Bdiscord) getGuildMemberByNick(nick string) (*discordgo.Member, error) {
 	b.membersMutex.RLock()
 	defer b.membersMutex.RUnlock()
@@ -86,7 +96,7 @@ func (b *Bdiscord) getChannelID(name string) string {
 		return idcheck[1]
 	}
 	for _, channel := range b.channels {
-		if channel.Name == name && channel.Type == discordgo.ChannelTypeGuildText {
+		if channel.Name == name && (channel.Type == discordgo.ChannelTypeGuildText || channel.Type == discordgo.ChannelTypeGuildForum) {
 			return channel.ID
 		}
 	}
@@ -183,7 +193,31 @@ func (b *Bdiscord) replaceChannelMentions(text string) string {
 	return channelMentionRE.ReplaceAllStringFunc(text, replaceChannelMentionFunc)
 }
 
-func (b *Bdiscord) replaceUserMentions(text string) string {
+// getMentions returns the users mentioned in m, with the text ContentWithMoreMentionsReplaced
+// replaces their mention with.
+func (b *Bdiscord) getMentions(m *discordgo.Message) []config.Mention {
+	mentions := make([]config.Mention, 0, len(m.Mentions))
+	for _, user := range m.Mentions {
+		username := user.Username
+		if strings.Contains(m.Content, "<@!"+user.ID+">") {
+			username = b.getNick(user, m.GuildID)
+		}
+		mentions = append(mentions, config.Mention{
+			Text:     "@" + username,
+			Username: username,
+			UserID:   user.ID,
+			Account:  b.Account,
+		})
+	}
+	return mentions
+}
+
+// replaceUserMentions replaces the mentions of users of this bridge and the @nick of guild
+// members in text with Discord mentions.
+func (b *Bdiscord) replaceUserMentions(text string, mentions []config.Mention) string {
+	text = helper.ReplaceMentions(text, b.Account, mentions, func(m config.Mention) string {
+		return "<@" + m.UserID + ">"
+	})
 	replaceUserMentionFunc := func(match string) string {
 		var (
 			err      error
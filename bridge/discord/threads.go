@@ -0,0 +1,263 @@
+package bdiscord
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	cThread = "thread"
+
+	// threadNameLength is the maximum length of the name of threads.
+	threadNameLength = 100
+	// threadArchiveDuration is the number of minutes without activity after which the threads we start are archived.
+	threadArchiveDuration = 1440
+)
+
+func (b *Bdiscord) threadCreate(s *discordgo.Session, m *discordgo.ThreadCreate) {
+	if m.GuildID != b.guildID {
+		return
+	}
+	b.addThread(m.Channel)
+}
+
+func (b *Bdiscord) threadUpdate(s *discordgo.Session, m *discordgo.ThreadUpdate) {
+	if m.GuildID != b.guildID {
+		return
+	}
+	b.addThread(m.Channel)
+}
+
+func (b *Bdiscord) threadDelete(s *discordgo.Session, m *discordgo.ThreadDelete) {
+	if m.GuildID != b.guildID {
+		return
+	}
+	b.channelsMutex.Lock()
+	defer b.channelsMutex.Unlock()
+	delete(b.threads, m.ID)
+}
+
+// threadListSync is sent when we gain access to channels, with their active threads.
+func (b *Bdiscord) threadListSync(s *discordgo.Session, m *discordgo.ThreadListSync) {
+	if m.GuildID != b.guildID {
+		return
+	}
+	for _, thread := range m.Threads {
+		b.addThread(thread)
+	}
+}
+
+func (b *Bdiscord) addThread(thread *discordgo.Channel) {
+	b.channelsMutex.Lock()
+	defer b.channelsMutex.Unlock()
+	b.threads[thread.ID] = thread
+}
+
+// lookupThread returns the thread with id if we know about it.
+func (b *Bdiscord) lookupThread(id string) *discordgo.Channel {
+	b.channelsMutex.RLock()
+	defer b.channelsMutex.RUnlock()
+	return b.threads[id]
+}
+
+// getThread returns the thread with id, or nil if id isn't a thread of our guild. Threads we
+// didn't see being created (e.g. archived ones) are looked up.
+func (b *Bdiscord) getThread(id string) *discordgo.Channel {
+	b.channelsMutex.RLock()
+	thread, ok := b.threads[id]
+	if !ok {
+		for _, channel := range b.channels {
+			if channel.ID == id {
+				b.channelsMutex.RUnlock()
+				return nil
+			}
+		}
+	}
+	b.channelsMutex.RUnlock()
+	if ok {
+		return thread
+	}
+
+	channel, err := b.c.Channel(id)
+	if err != nil {
+		b.Log.Debugf("Could not get channel %s: %s", id, err)
+		return nil
+	}
+	if channel.GuildID != b.guildID {
+		return nil
+	}
+	if !channel.IsThread() {
+		// a channel created after we connected
+		b.channelsMutex.Lock()
+		b.channels = append(b.channels, channel)
+		b.channelsMutex.Unlock()
+		return nil
+	}
+	b.addThread(channel)
+	return channel
+}
+
+// getParentChannelID returns the ID of the channel the thread with id is in, or id itself
+// if it's not a thread.
+func (b *Bdiscord) getParentChannelID(id string) string {
+	if thread := b.getThread(id); thread != nil {
+		return thread.ParentID
+	}
+	return id
+}
+
+func (b *Bdiscord) isForum(channelID string) bool {
+	b.channelsMutex.RLock()
+	defer b.channelsMutex.RUnlock()
+
+	for _, channel := range b.channels {
+		if channel.ID == channelID {
+			return channel.Type == discordgo.ChannelTypeGuildForum
+		}
+	}
+	return false
+}
+
+// getThreadID returns the ID of the thread of channelID msg goes to, or "" if it goes to the
+// channel itself. Edits and deletions go to the thread their message is in and replies go to
+// the thread of their parent message, which is started by the first reply.
+func (b *Bdiscord) getThreadID(msg *config.Message, channelID string) string {
+	if msg.ID != "" {
+		if threadID, ok := b.cache.Get(cThread + msg.ID); ok {
+			return threadID.(string)
+		}
+		return ""
+	}
+	if !msg.ParentValid() {
+		return ""
+	}
+	// replies to messages in threads
+	if threadID, ok := b.cache.Get(cThread + msg.ParentID); ok {
+		return threadID.(string)
+	}
+	// the message a thread was started from, and the first message of forum posts, has the
+	// ID of the thread
+	if b.isForum(channelID) || b.lookupThread(msg.ParentID) != nil {
+		return msg.ParentID
+	}
+	// only messages start threads
+	if msg.Event != "" && msg.Event != config.EventUserAction {
+		return ""
+	}
+	threadID, err := b.startThread(channelID, msg.ParentID)
+	if err != nil {
+		b.Log.Warnf("Could not start a thread on message %s, sending a reply instead: %s", msg.ParentID, err)
+		return ""
+	}
+	return threadID
+}
+
+// startThread starts a thread on the message messageID of channelID, named after the message.
+func (b *Bdiscord) startThread(channelID, messageID string) (string, error) {
+	name := ""
+	if parent, err := b.c.ChannelMessage(channelID, messageID); err == nil {
+		name = parent.Content
+	}
+	thread, err := b.c.MessageThreadStartComplex(channelID, messageID, &discordgo.ThreadStart{
+		Name:                threadName(name),
+		AutoArchiveDuration: threadArchiveDuration,
+	})
+	if err != nil {
+		// someone was faster, the thread has the ID of the message
+		if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeThreadAlreadyCreatedForThisMessage {
+			return messageID, nil
+		}
+		return "", err
+	}
+	b.Log.Debugf("Started thread %s on message %s", thread.ID, messageID)
+	b.addThread(thread)
+	return thread.ID, nil
+}
+
+// handleForumPost starts a post in the forum channelID with msg, every message sent to a
+// forum is a post of its own. The post is named after its text and has the ID of its first
+// message.
+func (b *Bdiscord) handleForumPost(msg *config.Message, channelID string) (string, error) {
+	// forums only have posts, other events are dropped
+	if msg.Event != "" && msg.Event != config.EventUserAction {
+		b.Log.Debugf("Not posting %s event to forum %s", msg.Event, channelID)
+		return "", nil
+	}
+
+	name := msg.Text
+	if name == "" && msg.Extra != nil && len(msg.Extra["file"]) > 0 {
+		name = msg.Extra["file"][0].(config.FileInfo).Name
+	}
+	if name == "" {
+		return "", nil
+	}
+	name = threadName(name)
+	text := helper.ClipMessage(msg.Text, MessageLength, b.GetString("MessageClipped"))
+	text = b.replaceUserMentions(text, msg.Mentions)
+	if text == "" {
+		text = name
+	}
+
+	var postID string
+	if b.shouldMessageUseWebhooks(msg) {
+		username := msg.Username
+		if len(username) > 32 {
+			username = username[0:32]
+		}
+		if msg.Avatar == "" {
+			msg.Avatar = b.maybeGetLocalAvatar(msg)
+		}
+		res, err := b.transmitter.StartThread(channelID, name, &discordgo.WebhookParams{
+			Content:         text,
+			Username:        username,
+			AvatarURL:       msg.Avatar,
+			AllowedMentions: b.getAllowedMentions(),
+		})
+		if err != nil {
+			return "", err
+		}
+		postID = res.ID
+	} else {
+		thread, err := b.c.ForumThreadStartComplex(channelID, &discordgo.ThreadStart{
+			Name:                name,
+			AutoArchiveDuration: threadArchiveDuration,
+		}, &discordgo.MessageSend{
+			Content:         msg.Username + text,
+			AllowedMentions: b.getAllowedMentions(),
+		})
+		if err != nil {
+			return "", err
+		}
+		b.addThread(thread)
+		postID = thread.ID
+	}
+	b.cache.Add(cThread+postID, postID)
+
+	// the files of the message follow in the post
+	if msg.Extra != nil && len(msg.Extra["file"]) > 0 {
+		msg.Text = ""
+		if _, err := b.sendMessage(msg, channelID, postID); err != nil {
+			return postID, err
+		}
+	}
+	return postID, nil
+}
+
+// threadName returns the name of a thread for a message with text: its first line.
+func threadName(text string) string {
+	name := strings.TrimSpace(text)
+	if i := strings.IndexByte(name, '\n'); i >= 0 {
+		name = strings.TrimSpace(name[:i])
+	}
+	if utf8.RuneCountInString(name) > threadNameLength {
+		name = string([]rune(name)[:threadNameLength-3]) + "..."
+	}
+	if name == "" {
+		return "Thread"
+	}
+	return name
+}
@@ -0,0 +1,176 @@
+package bdiscord
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/discord/transmitter"
+	"github.com/bwmarrin/discordgo"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDiscord is a stand-in for the Discord API of the guild g1 with the text channel
+// #general (c1) and the forum #ideas (f1). Uploads of the file failFile fail.
+type fakeDiscord struct {
+	sync.Mutex
+
+	requests []string
+	bodies   []string
+	failFile string
+}
+
+func (fd *fakeDiscord) RoundTrip(r *http.Request) (*http.Response, error) {
+	fd.Lock()
+	defer fd.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/api/v"+discordgo.APIVersion+"/")
+	if r.URL.RawQuery != "" {
+		p += "?" + r.URL.RawQuery
+	}
+	fd.requests = append(fd.requests, r.Method+" "+p)
+	var body []byte
+	if r.Body != nil {
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+	fd.bodies = append(fd.bodies, string(body))
+
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case fd.failFile != "" && strings.Contains(string(body), `filename="`+fd.failFile+`"`):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.WriteString(`{"code":40005,"message":"Request entity too large"}`) //nolint:errcheck
+	case r.Method == http.MethodGet && p == "channels/c1/messages/m1":
+		w.WriteString(`{"id":"m1","channel_id":"c1","content":"what do you think?\nmore"}`) //nolint:errcheck
+	case r.Method == http.MethodPost && p == "channels/c1/messages/m1/threads":
+		w.WriteString(`{"id":"m1","guild_id":"g1","parent_id":"c1","type":11,"name":"what do you think?"}`) //nolint:errcheck
+	case r.Method == http.MethodPost && p == "channels/f1/threads":
+		w.WriteString(`{"id":"p2","guild_id":"g1","parent_id":"f1","type":11,"name":"new idea"}`) //nolint:errcheck
+	case r.Method == http.MethodPost && strings.HasSuffix(p, "/messages"):
+		w.WriteString(`{"id":"sent","channel_id":"` + strings.Split(p, "/")[1] + `"}`) //nolint:errcheck
+	case r.Method == http.MethodPatch && strings.Contains(p, "/messages/"):
+		w.WriteString(`{"id":"` + p[strings.LastIndex(p, "/")+1:] + `"}`) //nolint:errcheck
+	case r.Method == http.MethodPost && strings.HasPrefix(p, "interactions/"):
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && strings.HasPrefix(p, "webhooks/"):
+		w.WriteString(`{"id":"hooked"}`) //nolint:errcheck
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.WriteString(`{"code":0,"message":"404: Not Found"}`) //nolint:errcheck
+	}
+	return w.Result(), nil
+}
+
+func (fd *fakeDiscord) lastRequest() string {
+	fd.Lock()
+	defer fd.Unlock()
+	return fd.requests[len(fd.requests)-1]
+}
+
+func newTestDiscord(t *testing.T, fd *fakeDiscord, extra string) *Bdiscord {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	cfg := config.NewConfigFromString(logger, []byte(`
+[discord.test]
+Server="g1"
+`+extra))
+	b := New(&bridge.Config{
+		Bridge: &bridge.Bridge{Account: "discord.test", Log: logrus.NewEntry(logger), Config: cfg, General: &config.Protocol{}},
+		Remote: make(chan config.Message, 10),
+	}).(*Bdiscord)
+
+	var err error
+	b.c, err = discordgo.New("Bot token")
+	require.NoError(t, err)
+	b.c.Client = &http.Client{Transport: fd}
+	b.guildID = "g1"
+	b.nick = "bridge"
+	b.channels = []*discordgo.Channel{
+		{ID: "c1", GuildID: "g1", Name: "general", Type: discordgo.ChannelTypeGuildText},
+		{ID: "f1", GuildID: "g1", Name: "ideas", Type: discordgo.ChannelTypeGuildForum},
+	}
+	b.transmitter = transmitter.New(b.c, b.guildID, "matterbridge", false)
+	b.userMemberMap["u1"] = &discordgo.Member{User: &discordgo.User{ID: "u1", Username: "alice"}}
+	return b
+}
+
+func TestReceiveThreads(t *testing.T) {
+	b := newTestDiscord(t, &fakeDiscord{}, "")
+	b.addThread(&discordgo.Channel{ID: "t1", GuildID: "g1", ParentID: "c1", Type: discordgo.ChannelTypeGuildPublicThread, Name: "question"})
+	b.addThread(&discordgo.Channel{ID: "p1", GuildID: "g1", ParentID: "f1", Type: discordgo.ChannelTypeGuildPublicThread, Name: "Dark mode"})
+	receive := func(id, channelID, text string) config.Message {
+		b.messageCreate(b.c, &discordgo.MessageCreate{Message: &discordgo.Message{
+			ID: id, ChannelID: channelID, GuildID: "g1", Content: text, Author: &discordgo.User{ID: "u1", Username: "alice"},
+		}})
+		require.Len(t, b.Remote, 1)
+		return <-b.Remote
+	}
+
+	rmsg := receive("m2", "t1", "an answer")
+	assert.Equal(t, "general", rmsg.Channel)
+	assert.Equal(t, "t1", rmsg.ParentID, "messages in threads reply to the message the thread was started from")
+
+	rmsg = receive("p1", "p1", "could we have it?")
+	assert.Equal(t, "ideas", rmsg.Channel)
+	assert.Equal(t, "Dark mode\ncould we have it?", rmsg.Text)
+	assert.Empty(t, rmsg.ParentID)
+
+	rmsg = receive("m3", "p1", "+1")
+	assert.Equal(t, "ideas", rmsg.Channel)
+	assert.Equal(t, "p1", rmsg.ParentID)
+
+	b.messageCreate(b.c, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ID: "m4", ChannelID: "c1", GuildID: "g1", Type: discordgo.MessageTypeThreadCreated, Content: "question", Author: &discordgo.User{ID: "u1", Username: "alice"},
+	}})
+	assert.Empty(t, b.Remote)
+}
+
+func TestSendThreads(t *testing.T) {
+	fd := &fakeDiscord{}
+	b := newTestDiscord(t, fd, "")
+
+	// the first reply starts a thread on its parent, named after it
+	id, err := b.Send(config.Message{Text: "I agree", Channel: "general", Username: "bob: ", ParentID: "m1"})
+	require.NoError(t, err)
+	assert.Equal(t, "sent", id)
+	assert.Contains(t, fd.requests, "POST channels/c1/messages/m1/threads")
+	assert.Equal(t, "what do you think?", b.lookupThread("m1").Name)
+	assert.Equal(t, "POST channels/m1/messages", fd.lastRequest())
+
+	// replies to messages in the thread go to the thread too, and so do their edits
+	_, err = b.Send(config.Message{Text: "me too", Channel: "general", Username: "carol: ", ParentID: "sent"})
+	require.NoError(t, err)
+	assert.Equal(t, "POST channels/m1/messages", fd.lastRequest())
+	_, err = b.Send(config.Message{Text: "me too!", Channel: "general", Username: "carol: ", ID: "sent"})
+	require.NoError(t, err)
+	assert.Equal(t, "PATCH channels/m1/messages/sent", fd.lastRequest())
+
+	// messages to forums start a post
+	id, err = b.Send(config.Message{Text: "new idea\nwith details", Channel: "ideas", Username: "bob: "})
+	require.NoError(t, err)
+	assert.Equal(t, "p2", id)
+	assert.Equal(t, "POST channels/f1/threads", fd.lastRequest())
+	_, err = b.Send(config.Message{Text: "nice", Channel: "ideas", Username: "carol: ", ParentID: "p2"})
+	require.NoError(t, err)
+	assert.Equal(t, "POST channels/p2/messages", fd.lastRequest())
+
+	// webhooks send to the thread
+	b.transmitter.AddWebhook("c1", &discordgo.Webhook{ID: "w1", Token: "secret", ChannelID: "c1"})
+	b.useAutoWebhooks = true
+	_, err = b.Send(config.Message{Text: "with a webhook", Channel: "general", Username: "dave", ParentID: "m1"})
+	require.NoError(t, err)
+	assert.Equal(t, "POST webhooks/w1/secret?thread_id=m1&wait=true", fd.lastRequest())
+}
+
+func TestThreadName(t *testing.T) {
+	assert.Equal(t, "Thread", threadName(" \n"))
+	assert.Equal(t, "first line", threadName("  first line \nsecond line"))
+	assert.Equal(t, strings.Repeat("é", 97)+"...", threadName(strings.Repeat("é", 101)))
+}
@@ -0,0 +1,277 @@
+package transmitter
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// queueSize is the number of messages a channel's queue holds before sending blocks.
+	queueSize = 100
+	// maxRateLimitRetries is how often a message Discord rejected because of rate limits is retried.
+	maxRateLimitRetries = 3
+)
+
+// QueueStats are the metrics of the send queue of a channel.
+type QueueStats struct {
+	// Webhooks is the number of webhooks in the channel's pool.
+	Webhooks int
+	// Queued is the number of messages waiting to be sent, including the one being sent.
+	Queued int
+	// Sent is the number of messages sent or edited.
+	Sent int
+	// Failed is the number of messages that could not be sent or edited.
+	Failed int
+	// RateLimited is the number of requests Discord rejected because of rate limits.
+	RateLimited int
+	// Waited is the time spent waiting for rate limits.
+	Waited time.Duration
+}
+
+// A channel is the webhook pool and send queue of a channel.
+type channel struct {
+	id       string
+	webhooks []*webhook // guarded by Transmitter.mutex
+	queue    chan *job
+
+	statsMutex sync.Mutex
+	stats      QueueStats
+}
+
+// A job is a message to send with a webhook: a new message, the first message of a forum
+// post (threadName) or the edit of a message (messageID).
+type job struct {
+	threadID   string
+	threadName string
+	messageID  string
+	params     *discordgo.WebhookParams
+
+	msg  *discordgo.Message
+	err  error
+	done chan struct{}
+}
+
+// A webhook is a webhook of a channel's pool, with the rate limit bucket Discord told us
+// about in the headers of its last response.
+type webhook struct {
+	*discordgo.Webhook
+
+	mutex     sync.Mutex
+	remaining int
+	reset     time.Time
+}
+
+// update updates the bucket of the webhook from the rate limit headers of a response.
+func (wh *webhook) update(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	resetAfter, err := strconv.ParseFloat(header.Get("X-RateLimit-Reset-After"), 64)
+	if err != nil {
+		return
+	}
+
+	wh.mutex.Lock()
+	defer wh.mutex.Unlock()
+	wh.remaining = remaining
+	wh.reset = time.Now().Add(time.Duration(resetAfter * float64(time.Second)))
+}
+
+// limit marks the webhook as rate limited for d.
+func (wh *webhook) limit(d time.Duration) {
+	wh.mutex.Lock()
+	defer wh.mutex.Unlock()
+	wh.remaining = 0
+	wh.reset = time.Now().Add(d)
+}
+
+// wait returns how long a request with the webhook has to wait for its rate limit.
+func (wh *webhook) wait() time.Duration {
+	wh.mutex.Lock()
+	defer wh.mutex.Unlock()
+	if wh.remaining > 0 {
+		return 0
+	}
+	if wait := time.Until(wh.reset); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// bucketTransport updates the bucket of a webhook from the responses to its requests.
+type bucketTransport struct {
+	http.RoundTripper
+	wh *webhook
+}
+
+func (bt bucketTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := bt.RoundTripper.RoundTrip(r)
+	if err == nil {
+		bt.wh.update(resp.Header)
+	}
+	return resp, err
+}
+
+// Stats returns the metrics of the send queues, by channel ID.
+func (t *Transmitter) Stats() map[string]QueueStats {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	stats := make(map[string]QueueStats, len(t.channels))
+	for id, ch := range t.channels {
+		ch.statsMutex.Lock()
+		s := ch.stats
+		ch.statsMutex.Unlock()
+		s.Webhooks = len(ch.webhooks)
+		stats[id] = s
+	}
+	return stats
+}
+
+// enqueue queues j on the queue of channelID and waits until it's done.
+func (t *Transmitter) enqueue(channelID string, j *job) (*discordgo.Message, error) {
+	t.mutex.Lock()
+	ch := t.getChannel(channelID)
+	t.mutex.Unlock()
+
+	ch.statsMutex.Lock()
+	ch.stats.Queued++
+	ch.statsMutex.Unlock()
+
+	j.done = make(chan struct{})
+	ch.queue <- j
+	<-j.done
+	return j.msg, j.err
+}
+
+// run sends the queued messages of ch one at a time, so they arrive in order.
+func (t *Transmitter) run(ch *channel) {
+	for j := range ch.queue {
+		j.msg, j.err = t.execute(ch, j)
+
+		ch.statsMutex.Lock()
+		ch.stats.Queued--
+		if j.err != nil {
+			ch.stats.Failed++
+		} else {
+			ch.stats.Sent++
+		}
+		ch.statsMutex.Unlock()
+		close(j.done)
+	}
+}
+
+// execute sends j with a webhook of the pool of ch, waiting for its rate limit if needed.
+func (t *Transmitter) execute(ch *channel, j *job) (*discordgo.Message, error) {
+	for retries := 0; ; retries++ {
+		wh := t.pickWebhook(ch, j)
+		if wh == nil {
+			return nil, ErrWebhookNotFound
+		}
+		if wait := wh.wait(); wait > 0 {
+			t.Log.Debugf("Waiting %s for the rate limit of webhook %s of channel %s", wait, wh.ID, ch.id)
+			ch.statsMutex.Lock()
+			ch.stats.Waited += wait
+			ch.statsMutex.Unlock()
+			time.Sleep(wait)
+		}
+
+		msg, err := t.request(wh, j)
+		var rateLimitErr *discordgo.RateLimitError
+		if errors.As(err, &rateLimitErr) && retries < maxRateLimitRetries {
+			t.Log.Debugf("Webhook %s of channel %s is rate limited for %s", wh.ID, ch.id, rateLimitErr.RetryAfter)
+			wh.limit(rateLimitErr.RetryAfter)
+			ch.statsMutex.Lock()
+			ch.stats.RateLimited++
+			ch.statsMutex.Unlock()
+			continue
+		}
+		if err == nil && msg != nil {
+			t.messageWebhooks.Add(msg.ID, wh.ID)
+		}
+		return msg, err
+	}
+}
+
+// pickWebhook returns the webhook of the pool of ch to send j with. Edits use the webhook
+// that sent the message, other messages the first webhook that isn't rate limited. When
+// they all are, the pool grows up to PoolSize, or else the one available first is used.
+func (t *Transmitter) pickWebhook(ch *channel, j *job) *webhook {
+	t.mutex.RLock()
+	webhooks := ch.webhooks
+	t.mutex.RUnlock()
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	if j.messageID != "" {
+		if id, ok := t.messageWebhooks.Get(j.messageID); ok {
+			for _, wh := range webhooks {
+				if wh.ID == id {
+					return wh
+				}
+			}
+		}
+		return webhooks[0]
+	}
+
+	first := webhooks[0]
+	for _, wh := range webhooks {
+		wait := wh.wait()
+		if wait == 0 {
+			return wh
+		}
+		if wait < first.wait() {
+			first = wh
+		}
+	}
+
+	if t.autoCreate && len(webhooks) < t.PoolSize {
+		wh, err := t.createWebhook(ch.id)
+		if err == nil {
+			return wh
+		}
+		t.Log.Errorf("Could not grow the webhook pool of channel %s: %s", ch.id, err)
+	}
+	return first
+}
+
+// request sends j with wh, without waiting for rate limits.
+func (t *Transmitter) request(wh *webhook, j *job) (*discordgo.Message, error) {
+	client := *t.session.Client
+	if client.Transport == nil {
+		client.Transport = http.DefaultTransport
+	}
+	client.Transport = bucketTransport{client.Transport, wh}
+	options := []discordgo.RequestOption{discordgo.WithClient(&client), discordgo.WithRetryOnRatelimit(false)}
+
+	uri := discordgo.EndpointWebhookToken(wh.ID, wh.Token)
+	switch {
+	case j.messageID != "":
+		uri += "/messages/" + j.messageID
+		if j.threadID != "" {
+			uri += "?thread_id=" + j.threadID
+		}
+		_, err := t.session.RequestWithBucketID("PATCH", uri, j.params, "", options...)
+		return nil, err
+	case j.threadName != "":
+		body, err := t.session.RequestWithBucketID("POST", uri+"?wait=true", &forumPostParams{j.params, j.threadName}, "", options...)
+		if err != nil {
+			return nil, err
+		}
+		var msg *discordgo.Message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	default:
+		return t.session.WebhookThreadExecute(wh.ID, wh.Token, true, j.threadID, j.params, options...)
+	}
+}
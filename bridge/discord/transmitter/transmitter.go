@@ -5,7 +5,9 @@
 //
 // - Creating new webhooks, whenever necessary
 // - Loading webhooks that we have previously created
-// - Sending new messages
+// - Sending new messages, to channels or to their threads
+// - Sending messages in order, with a pool of webhooks per channel to avoid waiting for rate limits
+// - Starting posts in forum channels
 // - Editing messages, via message ID
 // - Deleting messages, via message ID
 //
@@ -21,6 +23,7 @@ import (
 	"time"
 
 	"github.com/bwmarrin/discordgo"
+	lru "github.com/hashicorp/golang-lru"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -31,8 +34,14 @@ type Transmitter struct {
 	title      string
 	autoCreate bool
 
-	// channelWebhooks maps from a channel ID to a webhook instance
-	channelWebhooks map[string]*discordgo.Webhook
+	// PoolSize is the number of webhooks a channel's pool grows to, when sending has to wait
+	// for the rate limits of the webhooks in the pool. Only used with autoCreate.
+	PoolSize int
+
+	// channels maps from a channel ID to its webhook pool and send queue
+	channels map[string]*channel
+	// messageWebhooks maps from a message ID to the webhook that sent it
+	messageWebhooks *lru.Cache
 
 	mutex sync.RWMutex
 
@@ -50,26 +59,30 @@ var ErrPermissionDenied = errors.New("missing 'Manage Webhooks' permission")
 
 // New returns a new Transmitter given a Discord session, guild ID, and title.
 func New(session *discordgo.Session, guild string, title string, autoCreate bool) *Transmitter {
+	messageWebhooks, _ := lru.New(5000) // only fails for a negative size
 	return &Transmitter{
 		session:    session,
 		guild:      guild,
 		title:      title,
 		autoCreate: autoCreate,
 
-		channelWebhooks: make(map[string]*discordgo.Webhook),
+		PoolSize: 1,
+
+		channels:        make(map[string]*channel),
+		messageWebhooks: messageWebhooks,
 
 		Log: log.NewEntry(log.StandardLogger()),
 	}
 }
 
 // Send transmits a message to the given channel with the provided webhook data, and waits until Discord responds with message data.
-func (t *Transmitter) Send(channelID string, params *discordgo.WebhookParams) (*discordgo.Message, error) {
-	wh, err := t.getOrCreateWebhook(channelID)
-	if err != nil {
+// If threadID is not empty, the message is sent to that thread of the channel instead.
+func (t *Transmitter) Send(channelID string, threadID string, params *discordgo.WebhookParams) (*discordgo.Message, error) {
+	if err := t.ensureWebhook(channelID); err != nil {
 		return nil, err
 	}
 
-	msg, err := t.session.WebhookExecute(wh.ID, wh.Token, true, params)
+	msg, err := t.enqueue(channelID, &job{threadID: threadID, params: params})
 	if err != nil {
 		return nil, fmt.Errorf("execute failed: %w", err)
 	}
@@ -77,21 +90,36 @@ func (t *Transmitter) Send(channelID string, params *discordgo.WebhookParams) (*
 	return msg, nil
 }
 
-// Edit will edit a message in a channel, if possible.
-func (t *Transmitter) Edit(channelID string, messageID string, params *discordgo.WebhookParams) error {
-	wh := t.getWebhook(channelID)
+// forumPostParams are the webhook parameters of a message starting a forum post.
+type forumPostParams struct {
+	*discordgo.WebhookParams
+	ThreadName string `json:"thread_name"`
+}
 
-	if wh == nil {
-		return ErrWebhookNotFound
+// StartThread starts a post with the given name in the given forum channel, with the message of the provided webhook data.
+// The ID of the post (a thread) is the ID of the returned message.
+func (t *Transmitter) StartThread(channelID string, name string, params *discordgo.WebhookParams) (*discordgo.Message, error) {
+	if err := t.ensureWebhook(channelID); err != nil {
+		return nil, err
 	}
 
-	uri := discordgo.EndpointWebhookToken(wh.ID, wh.Token) + "/messages/" + messageID
-	_, err := t.session.RequestWithBucketID("PATCH", uri, params, discordgo.EndpointWebhookToken("", ""))
+	msg, err := t.enqueue(channelID, &job{threadName: name, params: params})
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("execute failed: %w", err)
 	}
 
-	return nil
+	return msg, nil
+}
+
+// Edit will edit a message in a channel, or in the given thread of the channel, if possible.
+// Messages can only be edited by the webhook that sent them.
+func (t *Transmitter) Edit(channelID string, threadID string, messageID string, params *discordgo.WebhookParams) error {
+	if t.getWebhook(channelID) == nil {
+		return ErrWebhookNotFound
+	}
+
+	_, err := t.enqueue(channelID, &job{threadID: threadID, messageID: messageID, params: params})
+	return err
 }
 
 // HasWebhook checks whether the transmitter is using a particular webhook.
@@ -99,24 +127,25 @@ func (t *Transmitter) HasWebhook(id string) bool {
 	t.mutex.RLock()
 	defer t.mutex.RUnlock()
 
-	for _, wh := range t.channelWebhooks {
-		if wh.ID == id {
-			return true
+	for _, ch := range t.channels {
+		for _, wh := range ch.webhooks {
+			if wh.ID == id {
+				return true
+			}
 		}
 	}
 
 	return false
 }
 
-// AddWebhook allows you to register a channel's webhook with the transmitter.
+// AddWebhook allows you to register a channel's webhook with the transmitter, it's added to the channel's pool.
+// Returns true if the webhook replaced one with the same ID.
 func (t *Transmitter) AddWebhook(channelID string, webhook *discordgo.Webhook) bool {
 	t.Log.Debugf("Manually added webhook %#v to channel %#v", webhook.ID, channelID)
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	_, replaced := t.channelWebhooks[channelID]
-	t.channelWebhooks[channelID] = webhook
-	return replaced
+	return t.addWebhook(channelID, webhook)
 }
 
 // RefreshGuildWebhooks loads "relevant" webhooks into the transmitter, with careful permission handling.
@@ -138,7 +167,7 @@ func (t *Transmitter) AddWebhook(channelID string, webhook *discordgo.Webhook) b
 // 1. it will load any "relevant" webhooks in each channel
 // 2. a single error will be returned if any error occurs (incl. if there is no permission for any of these channels)
 //
-// If any channel has more than one "relevant" webhook, it will randomly pick one.
+// If any channel has more than one "relevant" webhook, they are all added to its pool.
 func (t *Transmitter) RefreshGuildWebhooks(channelIDs []string) error {
 	t.Log.Debugln("Refreshing guild webhooks")
 
@@ -170,46 +199,71 @@ func (t *Transmitter) RefreshGuildWebhooks(channelIDs []string) error {
 	return nil
 }
 
-// createWebhook creates a webhook for a specific channel.
-func (t *Transmitter) createWebhook(channel string) (*discordgo.Webhook, error) {
+// createWebhook creates a webhook for a specific channel and adds it to the channel's pool.
+func (t *Transmitter) createWebhook(channel string) (*webhook, error) {
+	t.Log.Infof("Creating a webhook for %s\n", channel)
+	wh, err := t.session.WebhookCreate(channel, t.title+time.Now().Format(" 3:04:05PM"), "")
+	if err != nil {
+		return nil, fmt.Errorf("could not create webhook: %w", err)
+	}
+
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	wh, err := t.session.WebhookCreate(channel, t.title+time.Now().Format(" 3:04:05PM"), "")
-	if err != nil {
-		return nil, err
+	t.addWebhook(channel, wh)
+	ch := t.channels[channel]
+	return ch.webhooks[len(ch.webhooks)-1], nil
+}
+
+// addWebhook adds wh to the pool of channelID, the caller holds the lock.
+func (t *Transmitter) addWebhook(channelID string, wh *discordgo.Webhook) bool {
+	ch := t.getChannel(channelID)
+	for i := range ch.webhooks {
+		if ch.webhooks[i].ID == wh.ID {
+			ch.webhooks[i] = &webhook{Webhook: wh}
+			return true
+		}
 	}
+	ch.webhooks = append(ch.webhooks, &webhook{Webhook: wh})
+	return false
+}
 
-	t.channelWebhooks[channel] = wh
-	return wh, nil
+// getChannel returns the pool and queue of channelID, the caller holds the lock.
+func (t *Transmitter) getChannel(channelID string) *channel {
+	ch, ok := t.channels[channelID]
+	if !ok {
+		ch = &channel{id: channelID, queue: make(chan *job, queueSize)}
+		t.channels[channelID] = ch
+		go t.run(ch)
+	}
+	return ch
 }
 
-func (t *Transmitter) getWebhook(channel string) *discordgo.Webhook {
+// getWebhook returns the first webhook of the pool of channel.
+func (t *Transmitter) getWebhook(channel string) *webhook {
 	t.mutex.RLock()
 	defer t.mutex.RUnlock()
 
-	return t.channelWebhooks[channel]
+	if ch, ok := t.channels[channel]; ok && len(ch.webhooks) > 0 {
+		return ch.webhooks[0]
+	}
+	return nil
 }
 
-func (t *Transmitter) getOrCreateWebhook(channelID string) (*discordgo.Webhook, error) {
-	// If we have a webhook for this channel, immediately return it
-	wh := t.getWebhook(channelID)
-	if wh != nil {
-		return wh, nil
+// ensureWebhook makes sure the pool of channelID has a webhook.
+func (t *Transmitter) ensureWebhook(channelID string) error {
+	// If we have a webhook for this channel, immediately return
+	if t.getWebhook(channelID) != nil {
+		return nil
 	}
 
 	// Early exit if we don't want to automatically create one
 	if !t.autoCreate {
-		return nil, ErrWebhookNotFound
-	}
-
-	t.Log.Infof("Creating a webhook for %s\n", channelID)
-	wh, err := t.createWebhook(channelID)
-	if err != nil {
-		return nil, fmt.Errorf("could not create webhook: %w", err)
+		return ErrWebhookNotFound
 	}
 
-	return wh, nil
+	_, err := t.createWebhook(channelID)
+	return err
 }
 
 // fetchChannelsHooks fetches hooks for the given channelIDs and calls assignHooksByAppID for each channel's hooks
@@ -247,7 +301,7 @@ func (t *Transmitter) assignHooksByAppID(hooks []*discordgo.Webhook, appID strin
 			continue
 		}
 
-		t.channelWebhooks[wh.ChannelID] = wh
+		t.addWebhook(wh.ChannelID, wh)
 		t.Log.WithFields(log.Fields{
 			"id":      wh.ID,
 			"name":    wh.Name,
@@ -0,0 +1,117 @@
+package transmitter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDiscord is a stand-in for the Discord API, its webhooks can send one message every
+// 100ms. The webhook w3 is rate limited for its first request.
+type fakeDiscord struct {
+	sync.Mutex
+
+	webhooks int
+	messages int
+	requests []string
+}
+
+func (fd *fakeDiscord) RoundTrip(r *http.Request) (*http.Response, error) {
+	fd.Lock()
+	defer fd.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/api/v"+discordgo.APIVersion+"/")
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(p, "/webhooks"):
+		fd.webhooks++
+		id := strconv.Itoa(fd.webhooks + 1)
+		w.WriteString(`{"id":"w` + id + `","token":"t` + id + `","channel_id":"` + strings.Split(p, "/")[1] + `"}`) //nolint:errcheck
+	case strings.HasPrefix(p, "webhooks/"):
+		webhookID := strings.Split(p, "/")[1]
+		fd.requests = append(fd.requests, r.Method+" "+webhookID)
+		if webhookID == "w3" && len(fd.requests) == 1 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset-After", "0.01")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.WriteString(`{"message":"You are being rate limited.","retry_after":0.01}`) //nolint:errcheck
+			break
+		}
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset-After", "0.1")
+		messageID := strings.TrimPrefix(p, "webhooks/"+webhookID+"/t"+webhookID[1:]+"/messages/")
+		if r.Method == http.MethodPost {
+			fd.messages++
+			messageID = "m" + strconv.Itoa(fd.messages)
+		}
+		w.WriteString(`{"id":"` + messageID + `"}`) //nolint:errcheck
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.WriteString(`{"code":0,"message":"404: Not Found"}`) //nolint:errcheck
+	}
+	return w.Result(), nil
+}
+
+func newTestTransmitter(t *testing.T, fd *fakeDiscord) *Transmitter {
+	session, err := discordgo.New("Bot token")
+	require.NoError(t, err)
+	session.Client = &http.Client{Transport: fd}
+	tm := New(session, "g1", "matterbridge", true)
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	tm.Log = logrus.NewEntry(logger)
+	return tm
+}
+
+func TestWebhookPool(t *testing.T) {
+	fd := &fakeDiscord{}
+	tm := newTestTransmitter(t, fd)
+	tm.PoolSize = 2
+	tm.AddWebhook("c1", &discordgo.Webhook{ID: "w1", Token: "t1", ChannelID: "c1"})
+
+	// the pool grows when its webhooks are rate limited
+	for i := 1; i <= 3; i++ {
+		msg, err := tm.Send("c1", "", &discordgo.WebhookParams{Content: strconv.Itoa(i)})
+		require.NoError(t, err)
+		assert.Equal(t, "m"+strconv.Itoa(i), msg.ID)
+	}
+	assert.Equal(t, []string{"POST w1", "POST w2", "POST w1"}, fd.requests, "the third message waits for w1")
+	assert.True(t, tm.HasWebhook("w2"))
+
+	// messages are edited by the webhook that sent them
+	require.NoError(t, tm.Edit("c1", "", "m2", &discordgo.WebhookParams{Content: "2!"}))
+	assert.Equal(t, "PATCH w2", fd.requests[3])
+
+	stats := tm.Stats()["c1"]
+	assert.Equal(t, 2, stats.Webhooks)
+	assert.Equal(t, 0, stats.Queued)
+	assert.Equal(t, 4, stats.Sent)
+	assert.Equal(t, 0, stats.RateLimited)
+	assert.NotZero(t, stats.Waited)
+}
+
+func TestRateLimited(t *testing.T) {
+	fd := &fakeDiscord{}
+	tm := newTestTransmitter(t, fd)
+	tm.AddWebhook("c2", &discordgo.Webhook{ID: "w3", Token: "t3", ChannelID: "c2"})
+
+	// rejected messages are sent again after the rate limit
+	msg, err := tm.Send("c2", "", &discordgo.WebhookParams{Content: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "m1", msg.ID)
+	assert.Equal(t, []string{"POST w3", "POST w3"}, fd.requests)
+
+	stats := tm.Stats()["c2"]
+	assert.Equal(t, 1, stats.Webhooks)
+	assert.Equal(t, 1, stats.Sent)
+	assert.Equal(t, 1, stats.RateLimited)
+}
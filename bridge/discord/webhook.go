@@ -43,9 +43,10 @@ func (b *Bdiscord) maybeGetLocalAvatar(msg *config.Message) string {
 }
 
 // webhookSend send one or more message via webhook, taking care of file
-// uploads (from slack, telegram or mattermost).
+// uploads (from slack, telegram or mattermost). The message goes to the thread threadID of
+// the channel if it's not empty, with msgEmbeds.
 // Returns messageID and error.
-func (b *Bdiscord) webhookSend(msg *config.Message, channelID string) (*discordgo.Message, error) {
+func (b *Bdiscord) webhookSend(msg *config.Message, msgEmbeds []*discordgo.MessageEmbed, channelID, threadID string) (*discordgo.Message, error) {
 	var (
 		res  *discordgo.Message
 		res2 *discordgo.Message
@@ -59,22 +60,26 @@ func (b *Bdiscord) webhookSend(msg *config.Message, channelID string) (*discordg
 
 	// WebhookParams can have either `Content` or `File`.
 
+	params := &discordgo.WebhookParams{
+		Content:         msg.Text,
+		Username:        msg.Username,
+		AvatarURL:       msg.Avatar,
+		Embeds:          msgEmbeds,
+		AllowedMentions: b.getAllowedMentions(),
+	}
+
 	// We can't send empty messages.
-	if msg.Text != "" {
-		res, err = b.transmitter.Send(
-			channelID,
-			&discordgo.WebhookParams{
-				Content:         msg.Text,
-				Username:        msg.Username,
-				AvatarURL:       msg.Avatar,
-				AllowedMentions: b.getAllowedMentions(),
-			},
-		)
+	if params.Content != "" || len(params.Embeds) > 0 {
+		res, err = b.transmitter.Send(channelID, threadID, params)
 		if err != nil {
-			b.Log.Errorf("Could not send text (%s) for message %#v: %s", msg.Text, msg, err)
+			return nil, err
 		}
 	}
 
+	var (
+		failed    []string
+		uploadErr error
+	)
 	if msg.Extra != nil {
 		for _, f := range msg.Extra["file"] {
 			fi := f.(config.FileInfo)
@@ -87,6 +92,7 @@ func (b *Bdiscord) webhookSend(msg *config.Message, channelID string) (*discordg
 
 			res2, err = b.transmitter.Send(
 				channelID,
+				threadID,
 				&discordgo.WebhookParams{
 					Username:        msg.Username,
 					AvatarURL:       msg.Avatar,
@@ -96,21 +102,32 @@ func (b *Bdiscord) webhookSend(msg *config.Message, channelID string) (*discordg
 				},
 			)
 			if err != nil {
-				b.Log.Errorf("Could not send file %#v for message %#v: %s", file, msg, err)
+				b.Log.Errorf("Could not send file %s for message %#v: %s", fi.Name, msg, err)
+				failed = append(failed, fi.Name)
+				if uploadErr == nil {
+					uploadErr = err
+				}
+				continue
+			}
+			if res == nil {
+				res = res2
 			}
 		}
 	}
 
-	if msg.Text == "" {
-		res = res2
+	if len(failed) > 0 {
+		err := &helper.UploadError{Text: res != nil, Files: failed, Err: uploadErr}
+		if res != nil {
+			err.ID = res.ID
+		}
+		return res, err
 	}
-
-	return res, err
+	return res, nil
 }
 
-func (b *Bdiscord) handleEventWebhook(msg *config.Message, channelID string) (string, error) {
+func (b *Bdiscord) handleEventWebhook(msg *config.Message, channelID, threadID string) (string, error) {
 	// skip events
-	if msg.Event != "" && msg.Event != config.EventUserAction && msg.Event != config.EventJoinLeave && msg.Event != config.EventTopicChange {
+	if msg.Event != "" && msg.Event != config.EventUserAction && msg.Event != config.EventJoinLeave && msg.Event != config.EventTopicChange && msg.Event != config.EventNickChange {
 		return "", nil
 	}
 
@@ -120,8 +137,13 @@ func (b *Bdiscord) handleEventWebhook(msg *config.Message, channelID string) (st
 		return "", nil
 	}
 
+	// edits keep the text with the content of the embeds
+	var msgEmbeds []*discordgo.MessageEmbed
+	if e, text, ok := embeds(msg); ok && msg.ID == "" {
+		msg.Text, msgEmbeds = text, e
+	}
 	msg.Text = helper.ClipMessage(msg.Text, MessageLength, b.GetString("MessageClipped"))
-	msg.Text = b.replaceUserMentions(msg.Text)
+	msg.Text = b.replaceUserMentions(msg.Text, msg.Mentions)
 	// discord username must be [0..32] max
 	if len(msg.Username) > 32 {
 		msg.Username = msg.Username[0:32]
@@ -129,7 +151,7 @@ func (b *Bdiscord) handleEventWebhook(msg *config.Message, channelID string) (st
 
 	if msg.ID != "" {
 		b.Log.Debugf("Editing webhook message")
-		err := b.transmitter.Edit(channelID, msg.ID, &discordgo.WebhookParams{
+		err := b.transmitter.Edit(channelID, threadID, msg.ID, &discordgo.WebhookParams{
 			Content:         msg.Text,
 			Username:        msg.Username,
 			AllowedMentions: b.getAllowedMentions(),
@@ -141,7 +163,7 @@ func (b *Bdiscord) handleEventWebhook(msg *config.Message, channelID string) (st
 	}
 
 	b.Log.Debugf("Processing webhook sending for message %#v", msg)
-	discordMsg, err := b.webhookSend(msg, channelID)
+	discordMsg, err := b.webhookSend(msg, msgEmbeds, channelID, threadID)
 	if err != nil {
 		b.Log.Errorf("Could not broadcast via webhook for message %#v: %s", msg, err)
 		return "", err
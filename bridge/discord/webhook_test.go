@@ -0,0 +1,39 @@
+package bdiscord
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookUploadError(t *testing.T) {
+	fd := &fakeDiscord{failFile: "big.png"}
+	b := newTestDiscord(t, fd, "")
+	b.transmitter.AddWebhook("c1", &discordgo.Webhook{ID: "w1", Token: "secret", ChannelID: "c1"})
+	b.useAutoWebhooks = true
+
+	// the first file fails, the second one is uploaded
+	big, small := []byte("big"), []byte("small")
+	_, err := b.Send(config.Message{
+		Channel: "general", Username: "dave",
+		Extra: map[string][]interface{}{"file": {
+			config.FileInfo{Name: "big.png", Data: &big},
+			config.FileInfo{Name: "small.png", Data: &small},
+		}},
+	})
+	var uploadErr *helper.UploadError
+	require.True(t, errors.As(err, &uploadErr))
+	assert.Equal(t, []string{"big.png"}, uploadErr.Files)
+	assert.True(t, uploadErr.Text)
+	assert.Equal(t, "hooked", uploadErr.ID)
+	require.Error(t, uploadErr.Err, "the error of the failed upload is kept")
+	assert.Contains(t, err.Error(), "file upload failed: ")
+	assert.Equal(t, uploadErr.Err, errors.Unwrap(uploadErr))
+
+	assert.Equal(t, "file upload failed", (&helper.UploadError{}).Error())
+}
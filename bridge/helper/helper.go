@@ -196,6 +196,40 @@ func HandleDownloadData2(logger *logrus.Entry, msg *config.Message, name, id, co
 
 var emptyLineMatcher = regexp.MustCompile("\n+")
 
+// UploadError is returned by the Send of bridges that could not upload the files of a
+// message, the gateway sends links to the files on the mediaserver instead.
+type UploadError struct {
+	// ID is the ID of the message delivered before the upload failed (eg the text), if any.
+	ID string
+	// Text is true if the text of the message, or the comments of its files, was delivered.
+	Text bool
+	// Files are the names of the files that weren't uploaded, all of them if empty.
+	Files []string
+	Err   error
+}
+
+func (e *UploadError) Error() string {
+	if e.Err == nil {
+		return "file upload failed"
+	}
+	return "file upload failed: " + e.Err.Error()
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// FileNames returns the names of the files of a "file" Extra.
+func FileNames(files []interface{}) []string {
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if fi, ok := f.(config.FileInfo); ok {
+			names = append(names, fi.Name)
+		}
+	}
+	return names
+}
+
 // RemoveEmptyNewLines collapses consecutive newline characters into a single one and
 // trims any preceding or trailing newline characters as well.
 func RemoveEmptyNewLines(msg string) string {
@@ -219,6 +253,36 @@ func ClipMessage(text string, length int, clippingMessage string) string {
 	return text
 }
 
+// ReplaceMentions replaces the first occurrence of the text of every mention of a user of
+// account in text with the result of native, which returns the native mention of the user.
+func ReplaceMentions(text, account string, mentions []config.Mention, native func(config.Mention) string) string {
+	var todo []config.Mention
+	for _, m := range mentions {
+		if m.Account == account && m.UserID != "" && m.Text != "" {
+			todo = append(todo, m)
+		}
+	}
+	var sb strings.Builder
+	for len(todo) > 0 {
+		// replace the mentions in the order they appear, so we don't replace text we inserted
+		first, idx := -1, -1
+		for i, m := range todo {
+			if j := strings.Index(text, m.Text); j >= 0 && (idx < 0 || j < idx) {
+				first, idx = i, j
+			}
+		}
+		if first < 0 {
+			break
+		}
+		sb.WriteString(text[:idx])
+		sb.WriteString(native(todo[first]))
+		text = text[idx+len(todo[first].Text):]
+		todo = append(todo[:first], todo[first+1:]...)
+	}
+	sb.WriteString(text)
+	return sb.String()
+}
+
 // ParseMarkdown takes in an input string as markdown and parses it to html
 func ParseMarkdown(input string) string {
 	extensions := parser.HardLineBreak | parser.NoIntraEmphasis | parser.FencedCode
@@ -1,10 +1,22 @@
 package helper
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/42wim/matterbridge/bridge/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -125,3 +137,115 @@ func TestConvertWebPToPNG(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func testImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func TestConvertImage(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, testImage(200, 100)))
+	data := buf.Bytes()
+	assert.Equal(t, ImageFormatPNG, DetectImageFormat(data))
+	assert.True(t, NeedsScaling(data, 50))
+	assert.False(t, NeedsScaling(data, 200))
+
+	assert.NoError(t, ConvertImage(&data, ImageFormatJPEG, 50))
+	assert.Equal(t, ImageFormatJPEG, DetectImageFormat(data))
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, 50, cfg.Width)
+	assert.Equal(t, 25, cfg.Height)
+
+	assert.Error(t, ConvertImage(&data, ImageFormatWebP, 0))
+}
+
+func TestStripImageMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, testImage(4, 4)))
+	orig := buf.Bytes()
+
+	// insert a tEXt chunk right after the IHDR chunk
+	text := []byte("tEXtComment\x00secret location")
+	chunk := make([]byte, 4, 12+len(text)-4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(text)-4))
+	chunk = append(chunk, text...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(text))
+	ihdrEnd := 8 + 12 + 13
+	data := append(append(append([]byte{}, orig[:ihdrEnd]...), chunk...), orig[ihdrEnd:]...)
+
+	assert.NoError(t, StripImageMetadata(&data))
+	assert.Equal(t, orig, data)
+
+	buf.Reset()
+	assert.NoError(t, jpeg.Encode(&buf, testImage(4, 4), nil))
+	orig = buf.Bytes()
+	exif := append([]byte{0xFF, 0xE1, 0x00, 0x0E}, []byte("Exif\x00\x00secret")...)
+	data = append(append(append([]byte{}, orig[:2]...), exif...), orig[2:]...)
+
+	assert.NoError(t, StripImageMetadata(&data))
+	assert.Equal(t, orig, data)
+}
+
+func TestAudioFormat(t *testing.T) {
+	assert.Equal(t, "ogg", AudioFormat("voice.OGA"))
+	assert.Equal(t, "mp3", AudioFormat("song.mp3"))
+	assert.Equal(t, "", AudioFormat("picture.png"))
+	assert.Equal(t, "", AudioFormat("noextension"))
+}
+
+func TestPaste(t *testing.T) {
+	var received string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if field := r.FormValue("sprunge"); field != "" {
+			received = field
+		} else {
+			body, _ := ioutil.ReadAll(r.Body)
+			received = string(body)
+		}
+		fmt.Fprintln(w, "https://paste.example.com/abc")
+	}))
+	defer ts.Close()
+
+	url, err := Paste("line 1\nline 2", ts.URL, "", &config.Protocol{})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://paste.example.com/abc", url)
+	assert.Equal(t, "line 1\nline 2", received)
+
+	url, err = Paste("form", ts.URL, "sprunge", &config.Protocol{})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://paste.example.com/abc", url)
+	assert.Equal(t, "form", received)
+
+	dir, err := ioutil.TempDir("", "matterbridge-paste")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	general := &config.Protocol{MediaDownloadPath: dir, MediaServerDownload: "https://media.example.com"}
+	url, err = Paste("stored", PasteMediaServer, "", general)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^https://media.example.com/[0-9a-f]{64}/paste.txt$`, url)
+	data, err := ioutil.ReadFile(dir + strings.TrimPrefix(url, general.MediaServerDownload))
+	assert.NoError(t, err)
+	assert.Equal(t, "stored", string(data))
+}
+
+func TestReplaceMentions(t *testing.T) {
+	mentions := []config.Mention{
+		{Text: "@bob", Username: "bob", UserID: "U2", Account: "slack.test"},
+		{Text: "@alice", Username: "alice", UserID: "U1", Account: "slack.test"},
+		{Text: "@carol", Username: "carol"},
+		{Text: "U1", Username: "U1", UserID: "U3", Account: "slack.test"},
+	}
+	native := func(m config.Mention) string {
+		return "<@" + m.UserID + ">"
+	}
+	assert.Equal(t, "<@U1>: <@U2> and @carol, <@U3> @bob",
+		ReplaceMentions("@alice: @bob and @carol, U1 @bob", "slack.test", mentions, native))
+	assert.Equal(t, "@alice: @bob", ReplaceMentions("@alice: @bob", "discord.test", mentions, native))
+}
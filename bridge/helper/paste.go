@@ -0,0 +1,113 @@
+package helper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+)
+
+// PasteMediaServer is the PasteURL that stores pastes on the mediaserver
+// (MediaServerUpload or MediaDownloadPath) instead of a paste service.
+const PasteMediaServer = "mediaserver"
+
+const pasteName = "paste.txt"
+
+// Paste stores text on a paste service and returns the URL of the paste.
+// pasteURL is either PasteMediaServer or the URL of a pastebin-compatible service
+// which returns the URL of the paste in its response. The text is posted as the
+// request body, or as the form field named field if it's not empty.
+func Paste(text, pasteURL, field string, general *config.Protocol) (string, error) {
+	if pasteURL == PasteMediaServer {
+		return pasteMediaServer(text, general)
+	}
+
+	var (
+		body        bytes.Buffer
+		contentType = "text/plain; charset=utf-8"
+	)
+	if field != "" {
+		w := multipart.NewWriter(&body)
+		if err := w.WriteField(field, text); err != nil {
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+		contentType = w.FormDataContentType()
+	} else {
+		body.WriteString(text)
+	}
+
+	client := &http.Client{
+		Timeout: time.Second * 5,
+	}
+	req, err := http.NewRequest("POST", pasteURL, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", fmt.Errorf("paste failed: %s", resp.Status)
+	}
+	url := strings.TrimSpace(strings.SplitN(strings.TrimSpace(string(data)), "\n", 2)[0])
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return "", fmt.Errorf("paste failed: no URL in response %q", url)
+	}
+	return url, nil
+}
+
+// pasteMediaServer stores text as <sha256>/paste.txt, like the gateway stores files.
+func pasteMediaServer(text string, general *config.Protocol) (string, error) {
+	if general.MediaServerDownload == "" {
+		return "", errors.New("paste failed: MediaServerDownload isn't configured")
+	}
+	sha := fmt.Sprintf("%x", sha256.Sum256([]byte(text)))
+	switch {
+	case general.MediaDownloadPath != "":
+		dir := general.MediaDownloadPath + "/" + sha
+		if err := os.Mkdir(dir, os.ModePerm); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+		if err := ioutil.WriteFile(dir+"/"+pasteName, []byte(text), os.ModePerm); err != nil {
+			return "", err
+		}
+	case general.MediaServerUpload != "":
+		client := &http.Client{
+			Timeout: time.Second * 5,
+		}
+		req, err := http.NewRequest("PUT", general.MediaServerUpload+"/"+sha+"/"+pasteName, strings.NewReader(text))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "binary/octet-stream")
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			return "", fmt.Errorf("paste failed: %s", resp.Status)
+		}
+	default:
+		return "", errors.New("paste failed: no MediaServerUpload or MediaDownloadPath configured")
+	}
+	return general.MediaServerDownload + "/" + sha + "/" + pasteName, nil
+}
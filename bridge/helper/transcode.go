@@ -0,0 +1,319 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	// register the webp decoder for image.Decode
+	_ "golang.org/x/image/webp"
+)
+
+// Image formats known to the transcoding helpers.
+const (
+	ImageFormatPNG  = "png"
+	ImageFormatJPEG = "jpeg"
+	ImageFormatGIF  = "gif"
+	ImageFormatWebP = "webp"
+	ImageFormatHEIC = "heic"
+)
+
+var errUnsupportedImage = errors.New("unsupported image format")
+
+// DetectImageFormat returns the format of the image in data (one of the
+// ImageFormat constants) or an empty string if data is not a known image.
+func DetectImageFormat(data []byte) string {
+	if isHEIC(data) {
+		return ImageFormatHEIC
+	}
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	return format
+}
+
+// isHEIC checks for an ISO-BMFF "ftyp" box with one of the HEIF brands.
+func isHEIC(data []byte) bool {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	switch string(data[8:12]) {
+	case "heic", "heix", "hevc", "heim", "heis", "mif1", "msf1":
+		return true
+	}
+	return false
+}
+
+// CanEncodeImage returns true if ConvertImage can produce the given format.
+func CanEncodeImage(format string) bool {
+	switch format {
+	case ImageFormatPNG, ImageFormatJPEG, ImageFormatGIF:
+		return true
+	}
+	return false
+}
+
+// ImageExtension returns the file extension (with leading dot) for an image format.
+func ImageExtension(format string) string {
+	if format == ImageFormatJPEG {
+		return ".jpg"
+	}
+	return "." + format
+}
+
+// ConvertImage decodes the image in data and re-encodes it as format, which
+// must be one CanEncodeImage accepts. If maxSize is non-zero the image is
+// downscaled (keeping its aspect ratio) so that no side exceeds maxSize pixels.
+// Re-encoding drops all metadata (EXIF, XMP, text chunks) of the original.
+func ConvertImage(data *[]byte, format string, maxSize int) error {
+	if !CanEncodeImage(format) {
+		return fmt.Errorf("%w: can not encode %s", errUnsupportedImage, format)
+	}
+	src, _, err := image.Decode(bytes.NewReader(*data))
+	if err != nil {
+		return err
+	}
+	src = ScaleImage(src, maxSize)
+
+	var w bytes.Buffer
+	switch format {
+	case ImageFormatPNG:
+		err = png.Encode(&w, src)
+	case ImageFormatJPEG:
+		err = jpeg.Encode(&w, src, &jpeg.Options{Quality: 90})
+	case ImageFormatGIF:
+		err = gif.Encode(&w, src, nil)
+	}
+	if err != nil {
+		return err
+	}
+	*data = w.Bytes()
+	return nil
+}
+
+// NeedsScaling returns true if the image in data has a side larger than maxSize pixels.
+func NeedsScaling(data []byte, maxSize int) bool {
+	if maxSize <= 0 {
+		return false
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	return cfg.Width > maxSize || cfg.Height > maxSize
+}
+
+// ScaleImage downscales src so that no side exceeds maxSize pixels, averaging
+// the source pixels covered by every destination pixel. Images that already
+// fit (or a maxSize of 0) are returned unchanged.
+func ScaleImage(src image.Image, maxSize int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if maxSize <= 0 || (w <= maxSize && h <= maxSize) {
+		return src
+	}
+	nw, nh := maxSize, maxSize
+	if w > h {
+		nh = h * maxSize / w
+	} else {
+		nw = w * maxSize / h
+	}
+	if nw < 1 {
+		nw = 1
+	}
+	if nh < 1 {
+		nh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, nw, nh))
+	for y := 0; y < nh; y++ {
+		y0, y1 := b.Min.Y+y*h/nh, b.Min.Y+(y+1)*h/nh
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < nw; x++ {
+			x0, x1 := b.Min.X+x*w/nw, b.Min.X+(x+1)*w/nw
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// StripImageMetadata removes EXIF, XMP, IPTC and comment metadata (which may
+// contain the location a picture was taken) from JPEG and PNG data without
+// re-encoding the image. Other formats are left untouched.
+func StripImageMetadata(data *[]byte) error {
+	switch DetectImageFormat(*data) {
+	case ImageFormatJPEG:
+		return stripJPEGMetadata(data)
+	case ImageFormatPNG:
+		return stripPNGMetadata(data)
+	}
+	return nil
+}
+
+// stripJPEGMetadata drops the APP1 (EXIF/XMP), APP13 (IPTC) and COM segments.
+func stripJPEGMetadata(data *[]byte) error {
+	in := *data
+	if len(in) < 2 || in[0] != 0xFF || in[1] != 0xD8 {
+		return fmt.Errorf("%w: not a jpeg", errUnsupportedImage)
+	}
+	out := []byte{0xFF, 0xD8}
+	i := 2
+	for i+4 <= len(in) {
+		if in[i] != 0xFF {
+			return errors.New("jpeg: invalid segment marker")
+		}
+		marker := in[i+1]
+		// start of scan, the remainder is entropy coded image data
+		if marker == 0xDA {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(in[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(in) {
+			return errors.New("jpeg: invalid segment length")
+		}
+		if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+			out = append(out, in[i:end]...)
+		}
+		i = end
+	}
+	*data = append(out, in[i:]...)
+	return nil
+}
+
+// stripPNGMetadata drops the eXIf, tEXt, zTXt, iTXt and tIME chunks.
+func stripPNGMetadata(data *[]byte) error {
+	const pngHeader = "\x89PNG\r\n\x1a\n"
+	in := *data
+	if !bytes.HasPrefix(in, []byte(pngHeader)) {
+		return fmt.Errorf("%w: not a png", errUnsupportedImage)
+	}
+	out := []byte(pngHeader)
+	i := len(pngHeader)
+	for i+12 <= len(in) {
+		length := int(binary.BigEndian.Uint32(in[i : i+4]))
+		end := i + 12 + length
+		if end > len(in) {
+			return errors.New("png: invalid chunk length")
+		}
+		chunk := in[i:end]
+		typ := string(in[i+4 : i+8])
+		// make sure we don't copy a corrupted chunk
+		if crc32.ChecksumIEEE(chunk[4:8+length]) != binary.BigEndian.Uint32(chunk[8+length:]) {
+			return errors.New("png: invalid chunk checksum")
+		}
+		switch typ {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, chunk...)
+		}
+		i = end
+	}
+	*data = out
+	return nil
+}
+
+// audioExtensions maps the file extensions of audio files to their format.
+var audioExtensions = map[string]string{
+	".aac":  "aac",
+	".amr":  "amr",
+	".flac": "flac",
+	".m4a":  "m4a",
+	".mp3":  "mp3",
+	".oga":  "ogg",
+	".ogg":  "ogg",
+	".opus": "opus",
+	".wav":  "wav",
+	".weba": "weba",
+}
+
+// AudioFormat returns the audio format for a filename, or an empty string if
+// the name doesn't have an audio extension.
+func AudioFormat(name string) string {
+	name = strings.ToLower(name)
+	if i := strings.LastIndex(name, "."); i != -1 {
+		return audioExtensions[name[i:]]
+	}
+	return ""
+}
+
+// CanConvertWithFFmpeg checks whether the external ffmpeg command used by ConvertWithFFmpeg works.
+func CanConvertWithFFmpeg() error {
+	return exec.Command("ffmpeg", "-version").Run()
+}
+
+// ConvertWithFFmpeg converts data (a file with extension inputExt) to outputFormat
+// using the external ffmpeg command. This is used for audio and for HEIC images,
+// for which no decoder is available in Go.
+func ConvertWithFFmpeg(data *[]byte, inputExt, outputFormat string, logger *logrus.Entry) error {
+	tmpInFile, err := ioutil.TempFile(os.TempDir(), "matterbridge-ffmpeg-input-*"+inputExt)
+	if err != nil {
+		return err
+	}
+	tmpInFileName := tmpInFile.Name()
+	defer func() {
+		if removeErr := os.Remove(tmpInFileName); removeErr != nil {
+			logger.Errorf("Could not delete temporary (input) file %s: %v", tmpInFileName, removeErr)
+		}
+	}()
+	tmpOutFileName := tmpInFileName + "." + outputFormat
+	defer func() {
+		if removeErr := os.Remove(tmpOutFileName); removeErr != nil && !os.IsNotExist(removeErr) {
+			logger.Errorf("Could not delete temporary (output) file %s: %v", tmpOutFileName, removeErr)
+		}
+	}()
+
+	if _, writeErr := tmpInFile.Write(*data); writeErr != nil {
+		return writeErr
+	}
+	if closeErr := tmpInFile.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	// -map_metadata -1 drops all metadata of the input
+	cmd := exec.Command("ffmpeg", "-nostdin", "-loglevel", "error", "-i", tmpInFileName, "-map_metadata", "-1", tmpOutFileName)
+	if output, runErr := cmd.CombinedOutput(); runErr != nil {
+		return fmt.Errorf("ffmpeg failed: %s %s", runErr, strings.TrimSpace(string(output)))
+	}
+	dataContents, err := ioutil.ReadFile(tmpOutFileName)
+	if err != nil {
+		return err
+	}
+	*data = dataContents
+	return nil
+}
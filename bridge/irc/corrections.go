@@ -0,0 +1,89 @@
+package birc
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// sedRE matches sed-style corrections like s/teh/the/ with optional g and i flags.
+var sedRE = regexp.MustCompile(`^s/((?:[^/\\]|\\.)+)/((?:[^/\\]|\\.)*)(?:/([gi]*))?$`)
+
+// maxRecentMessages is the number of messages per user that can be corrected.
+const maxRecentMessages = 10
+
+type recentMessage struct {
+	id   string
+	text string
+}
+
+// recentMessages keeps the last messages of every user per channel, so
+// corrections can be turned into edits of the message they correct.
+type recentMessages struct {
+	sync.Mutex
+
+	messages map[string][]recentMessage
+}
+
+func newRecentMessages() *recentMessages {
+	return &recentMessages{messages: make(map[string][]recentMessage)}
+}
+
+// add remembers the message with ID id sent by the user with key.
+func (r *recentMessages) add(key, id, text string) {
+	r.Lock()
+	defer r.Unlock()
+	msgs := append(r.messages[key], recentMessage{id: id, text: text})
+	if len(msgs) > maxRecentMessages {
+		msgs = msgs[1:]
+	}
+	r.messages[key] = msgs
+}
+
+// correct applies the correction in text to the most recent message of the user with
+// key it changes. Returns the ID and corrected text of that message, or false if text
+// isn't a correction or doesn't apply to any message.
+func (r *recentMessages) correct(key, text string) (string, string, bool) {
+	match := sedRE.FindStringSubmatch(text)
+	if match == nil {
+		return "", "", false
+	}
+	pattern := match[1]
+	if strings.Contains(match[3], "i") {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		re = regexp.MustCompile(regexp.QuoteMeta(match[1]))
+	}
+	replacement := strings.ReplaceAll(match[2], `\/`, "/")
+	global := strings.Contains(match[3], "g")
+
+	r.Lock()
+	defer r.Unlock()
+	msgs := r.messages[key]
+	for i := len(msgs) - 1; i >= 0; i-- {
+		corrected, ok := applyCorrection(re, msgs[i].text, replacement, global)
+		if !ok {
+			continue
+		}
+		msgs[i].text = corrected
+		return msgs[i].id, corrected, true
+	}
+	return "", "", false
+}
+
+// applyCorrection replaces the first (or every if global is set) match of re in text.
+func applyCorrection(re *regexp.Regexp, text, replacement string, global bool) (string, bool) {
+	if global {
+		if !re.MatchString(text) {
+			return text, false
+		}
+		return re.ReplaceAllLiteralString(text, replacement), true
+	}
+	loc := re.FindStringIndex(text)
+	if loc == nil {
+		return text, false
+	}
+	return text[:loc[0]] + replacement + text[loc[1]:], true
+}
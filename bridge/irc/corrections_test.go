@@ -0,0 +1,41 @@
+package birc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorrections(t *testing.T) {
+	r := newRecentMessages()
+	r.add("#test wim", "1", "teh quick brown fox")
+	r.add("#test wim", "2", "jumps over teh lazy dog, teh end")
+	r.add("#test other", "3", "i like teh cake")
+
+	testcases := []struct {
+		text string
+		id   string
+		out  string
+		ok   bool
+	}{
+		{"s/brwn/brown/", "", "", false},
+		{"just a message", "", "", false},
+		{"s/teh/the/", "2", "jumps over the lazy dog, teh end", true},
+		{"s/teh/the/g", "2", "jumps over the lazy dog, the end", true},
+		{"s/teh/the", "1", "the quick brown fox", true},
+		{"s/QUICK/slow/i", "1", "the slow brown fox", true},
+		{"s/fox$/cat\\/dog/", "1", "the slow brown cat/dog", true},
+		{"s/(/x/", "", "", false},
+	}
+	for _, tc := range testcases {
+		id, out, ok := r.correct("#test wim", tc.text)
+		assert.Equal(t, tc.ok, ok, tc.text)
+		assert.Equal(t, tc.id, id, tc.text)
+		assert.Equal(t, tc.out, out, tc.text)
+	}
+
+	// corrections only apply to the messages of the same user
+	_, out, ok := r.correct("#test other", "s/cake/pie/")
+	assert.True(t, ok)
+	assert.Equal(t, "i like teh pie", out)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -19,6 +20,21 @@ import (
 	_ "github.com/paulrosania/go-charset/data"
 )
 
+const (
+	defaultPasteMinLines = 3
+	pastePreviewLength   = 80
+	// eventQueueSize is how many messages and events are queued for the gateway, enough
+	// for the quits of a netsplit.
+	eventQueueSize = 1000
+)
+
+// addressRE matches messages addressed to a nick, like "nick: hello" or "nick, hello".
+var addressRE = regexp.MustCompile(`^([^\s:,]+)[:,]\s`)
+
+// netsplitRE matches the quit message of users who quit because of a netsplit,
+// which are the names of the two servers that split.
+var netsplitRE = regexp.MustCompile(`^[^\s.]+(\.[^\s.]+)+ [^\s.]+(\.[^\s.]+)+$`)
+
 func (b *Birc) handleCharset(msg *config.Message) error {
 	if b.GetString("Charset") != "" {
 		switch b.GetString("Charset") {
@@ -45,7 +61,7 @@ func (b *Birc) handleFiles(msg *config.Message) bool {
 		return false
 	}
 	for _, rmsg := range helper.HandleExtra(msg, b.General) {
-		b.Local <- rmsg
+		b.queue(rmsg)
 	}
 	if len(msg.Extra["file"]) == 0 {
 		return false
@@ -61,11 +77,54 @@ func (b *Birc) handleFiles(msg *config.Message) bool {
 				msg.Text = fi.Comment + " : " + fi.URL
 			}
 		}
-		b.Local <- config.Message{Text: msg.Text, Username: msg.Username, Channel: msg.Channel, Event: msg.Event}
+		b.queue(config.Message{Text: msg.Text, Username: msg.Username, Channel: msg.Channel, Event: msg.Event})
 	}
 	return true
 }
 
+// handlePaste uploads text to PasteURL if the message is longer than PasteMinLines lines or
+// contains a code block. Returns a line with a preview of the message and the link to the paste.
+func (b *Birc) handlePaste(text string, msg *config.Message) (string, bool) {
+	pasteURL := b.GetString("PasteURL")
+	if pasteURL == "" {
+		return "", false
+	}
+	minLines := b.GetInt("PasteMinLines")
+	if minLines == 0 {
+		minLines = defaultPasteMinLines
+	}
+	lines := len(helper.GetSubLines(msg.Text, b.MessageLength, ""))
+	if lines <= minLines && !strings.Contains(text, "```") {
+		return "", false
+	}
+	url, err := helper.Paste(text, pasteURL, b.GetString("PasteField"), b.General)
+	if err != nil {
+		b.Log.Errorf("pasting message to %s failed: %s", pasteURL, err)
+		return "", false
+	}
+	b.Log.Debugf("pasted %d lines to %s", lines, url)
+	return pastePreview(msg.Text, lines, url), true
+}
+
+// pastePreview returns the first line of text (skipping code block markers) followed by a link to the paste.
+func pastePreview(text string, lines int, url string) string {
+	preview := ""
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "```") {
+			preview = line
+			break
+		}
+	}
+	if runes := []rune(preview); len(runes) > pastePreviewLength {
+		preview = string(runes[:pastePreviewLength]) + "..."
+	}
+	if lines == 1 {
+		return fmt.Sprintf("%s [%s]", preview, url)
+	}
+	return fmt.Sprintf("%s [%d lines: %s]", preview, lines, url)
+}
+
 func (b *Birc) handleInvite(client *girc.Client, event girc.Event) {
 	if len(event.Params) != 2 {
 		return
@@ -88,8 +147,10 @@ func (b *Birc) handleJoinPart(client *girc.Client, event girc.Event) {
 	channel := strings.ToLower(event.Params[0])
 	if event.Command == "KICK" && event.Params[1] == b.Nick {
 		b.Log.Infof("Got kicked from %s by %s", channel, event.Source.Name)
-		time.Sleep(time.Duration(b.GetInt("RejoinDelay")) * time.Second)
-		b.Remote <- config.Message{Username: "system", Text: "rejoin", Channel: channel, Account: b.Account, Event: config.EventRejoinChannels}
+		go func() {
+			time.Sleep(time.Duration(b.GetInt("RejoinDelay")) * time.Second)
+			b.Remote <- config.Message{Username: "system", Text: "rejoin", Channel: channel, Account: b.Account, Event: config.EventRejoinChannels}
+		}()
 		return
 	}
 	if event.Command == "QUIT" {
@@ -99,24 +160,103 @@ func (b *Birc) handleJoinPart(client *girc.Client, event girc.Event) {
 			return
 		}
 	}
-	if event.Source.Name != b.Nick {
+	if event.Command == "QUIT" {
+		// relayed by handleQuit
+		return
+	}
+	if event.Source.Name != b.Nick && !b.puppets.isPuppet(event.Source.Name) {
 		if b.GetBool("nosendjoinpart") {
 			return
 		}
-		msg := config.Message{Username: "system", Text: event.Source.Name + " " + strings.ToLower(event.Command) + "s", Channel: channel, Account: b.Account, Event: config.EventJoinLeave}
-		if b.GetBool("verbosejoinpart") {
-			b.Log.Debugf("<= Sending verbose JOIN_LEAVE event from %s to gateway", b.Account)
-			msg = config.Message{Username: "system", Text: event.Source.Name + " (" + event.Source.Ident + "@" + event.Source.Host + ") " + strings.ToLower(event.Command) + "s", Channel: channel, Account: b.Account, Event: config.EventJoinLeave}
-		} else {
-			b.Log.Debugf("<= Sending JOIN_LEAVE event from %s to gateway", b.Account)
-		}
-		b.Log.Debugf("<= Message is %#v", msg)
-		b.Remote <- msg
+		b.sendJoinPart(event, channel)
 		return
 	}
 	b.Log.Debugf("handle %#v", event)
 }
 
+// handleQuit relays the QUIT of a user to the channels they were in. It's a synchronous
+// ALL_EVENTS handler, so it runs before girc forgets the channels of the user.
+func (b *Birc) handleQuit(client *girc.Client, event girc.Event) {
+	if event.Command != girc.QUIT || event.Source == nil || event.Source.Name == b.Nick || b.GetBool("nosendjoinpart") {
+		return
+	}
+	user := client.LookupUser(event.Source.Name)
+	if user == nil || b.puppets.isPuppet(event.Source.Name) {
+		return
+	}
+	for _, channel := range user.ChannelList {
+		b.sendJoinPart(event, strings.ToLower(channel))
+	}
+}
+
+// handleNick relays the nick change of a user to the channels they are in. Like handleQuit
+// it runs before girc updates its state, so the user is still known by the old nick, and
+// the change is queued before the messages sent with the new nick.
+func (b *Birc) handleNick(client *girc.Client, event girc.Event) {
+	if event.Command != girc.NICK || event.Source == nil || event.Source.Name == b.Nick || len(event.Params) == 0 {
+		return
+	}
+	user := client.LookupUser(event.Source.Name)
+	if user == nil || b.puppets.isPuppet(event.Source.Name) {
+		return
+	}
+	info := config.NickChangeInfo{Old: event.Source.Name, New: event.Last()}
+	for _, channel := range user.ChannelList {
+		msg := config.Message{
+			Username:  "system",
+			Text:      info.Old + " is now known as " + info.New,
+			Channel:   strings.ToLower(channel),
+			Account:   b.Account,
+			UserID:    event.Source.Ident + "@" + event.Source.Host,
+			Timestamp: event.Timestamp,
+			Event:     config.EventNickChange,
+			Extra:     map[string][]interface{}{config.EventNickChange: {info}},
+		}
+		b.Log.Debugf("<= Sending NICK_CHANGE event from %s to gateway", b.Account)
+		b.events <- msg
+	}
+}
+
+// sendJoinPart sends the JOIN, PART, QUIT or KICK event on channel to the gateway.
+func (b *Birc) sendJoinPart(event girc.Event, channel string) {
+	text := event.Source.Name + " " + strings.ToLower(event.Command) + "s"
+	if b.GetBool("verbosejoinpart") {
+		b.Log.Debugf("<= Sending verbose JOIN_LEAVE event from %s to gateway", b.Account)
+		text = event.Source.Name + " (" + event.Source.Ident + "@" + event.Source.Host + ") " + strings.ToLower(event.Command) + "s"
+	} else {
+		b.Log.Debugf("<= Sending JOIN_LEAVE event from %s to gateway", b.Account)
+	}
+	info := config.JoinLeaveInfo{Nick: event.Source.Name, Action: config.JoinLeaveLeave}
+	switch {
+	case event.Command == girc.JOIN:
+		info.Action = config.JoinLeaveJoin
+	case event.Command == girc.KICK && len(event.Params) > 1:
+		info.Nick = event.Params[1]
+	case event.Command == girc.QUIT && netsplitRE.MatchString(event.Last()):
+		info.Action = config.JoinLeaveNetsplit
+	}
+	msg := config.Message{
+		Username: "system",
+		Text:     text,
+		Channel:  channel,
+		Account:  b.Account,
+		Event:    config.EventJoinLeave,
+		Extra:    map[string][]interface{}{config.EventJoinLeave: {info}},
+	}
+	b.Log.Debugf("<= Message is %#v", msg)
+	b.events <- msg
+}
+
+// relayEvents sends the queued messages and events to the gateway. The handlers queue
+// them as they come in, so they're relayed in order without blocking the handling of
+// other events while the gateway is busy. Messages are handled in the background after
+// the events before them were queued, so they're relayed after them too.
+func (b *Birc) relayEvents() {
+	for msg := range b.events {
+		b.Remote <- msg
+	}
+}
+
 func (b *Birc) handleNewConnection(client *girc.Client, event girc.Event) {
 	b.Log.Debug("Registering callbacks")
 	i := b.i
@@ -124,12 +264,13 @@ func (b *Birc) handleNewConnection(client *girc.Client, event girc.Event) {
 
 	i.Handlers.AddBg("PRIVMSG", b.handlePrivMsg)
 	i.Handlers.AddBg("CTCP_ACTION", b.handlePrivMsg)
+	i.Handlers.AddBg(girc.CAP_TAGMSG, b.handleTagMsg)
 	i.Handlers.Add(girc.RPL_TOPICWHOTIME, b.handleTopicWhoTime)
 	i.Handlers.AddBg(girc.NOTICE, b.handleNotice)
-	i.Handlers.AddBg("JOIN", b.handleJoinPart)
-	i.Handlers.AddBg("PART", b.handleJoinPart)
-	i.Handlers.AddBg("QUIT", b.handleJoinPart)
-	i.Handlers.AddBg("KICK", b.handleJoinPart)
+	i.Handlers.Add("JOIN", b.handleJoinPart)
+	i.Handlers.Add("PART", b.handleJoinPart)
+	i.Handlers.Add("QUIT", b.handleJoinPart)
+	i.Handlers.Add("KICK", b.handleJoinPart)
 	i.Handlers.Add("INVITE", b.handleInvite)
 }
 
@@ -191,6 +332,15 @@ func (b *Birc) handlePrivMsg(client *girc.Client, event girc.Event) {
 		Account:  b.Account,
 		UserID:   event.Source.Ident + "@" + event.Source.Host,
 	}
+	b.setMessageTags(&rmsg, &event)
+
+	if b.GetBool("Backfill") {
+		_, serverTime := event.Tags.Get("time")
+		if b.history.duplicate(rmsg.Channel, rmsg.ID, rmsg.Timestamp, serverTime) {
+			b.Log.Debugf("ignoring already relayed message %s on %s", rmsg.ID, rmsg.Channel)
+			return
+		}
+	}
 
 	b.Log.Debugf("== Receiving PRIVMSG: %s %s %#v", event.Source.Name, event.Last(), event)
 
@@ -237,8 +387,42 @@ func (b *Birc) handlePrivMsg(client *girc.Client, event girc.Event) {
 		rmsg.Text = string(output)
 	}
 
+	// IRC doesn't have mentions, but addressing a nick highlights it
+	if match := addressRE.FindStringSubmatch(rmsg.Text); match != nil {
+		rmsg.Mentions = []config.Mention{{Text: match[1], Username: match[1]}}
+	}
+
+	if b.GetBool("SedCorrections") && rmsg.Event == "" && b.handleCorrection(rmsg) {
+		return
+	}
+
 	b.Log.Debugf("<= Sending message from %s on %s to gateway", event.Params[0], b.Account)
-	b.Remote <- rmsg
+	b.events <- rmsg
+}
+
+// handleCorrection sends sed-style corrections (s/teh/the/) of one of the recent messages of
+// the user as an edit of that message and remembers all other messages.
+// Returns false if rmsg (the correction) still has to be relayed.
+func (b *Birc) handleCorrection(rmsg config.Message) bool {
+	key := rmsg.Channel + " " + rmsg.Username
+	id, text, ok := b.recent.correct(key, rmsg.Text)
+	if !ok {
+		// we need an ID to be able to edit the message later
+		if rmsg.ID == "" {
+			rmsg.ID = b.msgIDs.newID()
+		}
+		b.recent.add(key, rmsg.ID, rmsg.Text)
+		b.Log.Debugf("<= Sending message from %s on %s to gateway", rmsg.Channel, b.Account)
+		b.events <- rmsg
+		return true
+	}
+
+	edit := rmsg
+	edit.ID = id
+	edit.Text = text
+	b.Log.Debugf("<= Sending correction of %s from %s on %s to gateway as edit", id, rmsg.Channel, b.Account)
+	b.events <- edit
+	return b.GetBool("HideSedCorrections")
 }
 
 func (b *Birc) handleRunCommands() {
@@ -0,0 +1,20 @@
+package birc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPastePreview(t *testing.T) {
+	assert.Equal(t, "panic: oops [40 lines: https://paste.rs/abc]",
+		pastePreview("```\n\npanic: oops\ngoroutine 1", 40, "https://paste.rs/abc"))
+	assert.Equal(t, "one long line [https://paste.rs/abc]",
+		pastePreview("one long line", 1, "https://paste.rs/abc"))
+
+	long := ""
+	for i := 0; i < 10; i++ {
+		long += "0123456789"
+	}
+	assert.Equal(t, long[:pastePreviewLength]+"... [2 lines: url]", pastePreview(long, 2, "url"))
+}
@@ -0,0 +1,102 @@
+package birc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	defaultBackfillLimit = 100
+	// backfillWindow is how long after requesting the history we drop messages
+	// without msgid that are older than the last message we've seen.
+	backfillWindow = 30 * time.Second
+)
+
+// history keeps track of the messages we've seen per channel, so we can request
+// the ones we missed after a reconnect and drop the ones we already relayed.
+type history struct {
+	sync.Mutex
+
+	lastSeen    map[string]time.Time
+	backfilling map[string]time.Time
+	seen        *lru.Cache
+}
+
+func newHistory() *history {
+	seen, _ := lru.New(5000)
+	return &history{
+		lastSeen:    make(map[string]time.Time),
+		backfilling: make(map[string]time.Time),
+		seen:        seen,
+	}
+}
+
+// duplicate records the message with msgid sent at ts on channel and returns true if we
+// already have seen it. Messages without msgid are only checked (on their server-time
+// timestamp) while we're backfilling.
+func (h *history) duplicate(channel, msgid string, ts time.Time, serverTime bool) bool {
+	h.Lock()
+	defer h.Unlock()
+	if msgid != "" {
+		if ok, _ := h.seen.ContainsOrAdd(msgid, struct{}{}); ok {
+			return true
+		}
+	} else if serverTime && time.Now().Before(h.backfilling[channel]) && !ts.After(h.lastSeen[channel]) {
+		return true
+	}
+	if ts.After(h.lastSeen[channel]) {
+		h.lastSeen[channel] = ts
+	}
+	return false
+}
+
+// startBackfill returns the time of the last message we've seen on channel, or
+// false if we haven't seen any.
+func (h *history) startBackfill(channel string) (time.Time, bool) {
+	h.Lock()
+	defer h.Unlock()
+	since, ok := h.lastSeen[channel]
+	if ok {
+		h.backfilling[channel] = time.Now().Add(backfillWindow)
+	}
+	return since, ok
+}
+
+// backfillCaps returns the capabilities we need to backfill, only requested when
+// Backfill is enabled as ZNC doesn't replay its buffer on join with znc.in/playback.
+func (b *Birc) backfillCaps() map[string][]string {
+	if !b.GetBool("Backfill") {
+		return nil
+	}
+	return map[string][]string{"draft/chathistory": nil, "znc.in/playback": nil}
+}
+
+// requestBackfill requests the messages sent on channel since the last message we've
+// seen, using draft/chathistory (soju, ergo) or the ZNC playback module.
+func (b *Birc) requestBackfill(channel string) {
+	if !b.GetBool("Backfill") {
+		return
+	}
+	since, ok := b.history.startBackfill(strings.ToLower(channel))
+	if !ok {
+		return
+	}
+	limit := b.GetInt("BackfillLimit")
+	if limit == 0 {
+		limit = defaultBackfillLimit
+	}
+	switch {
+	case b.i.HasCapability("draft/chathistory"):
+		b.Log.Debugf("requesting history of %s since %s", channel, since)
+		b.i.Cmd.SendRawf("CHATHISTORY AFTER %s timestamp=%s %d", channel, since.UTC().Format("2006-01-02T15:04:05.000Z"), limit) //nolint:errcheck
+	case b.i.HasCapability("znc.in/playback"):
+		b.Log.Debugf("requesting playback of %s since %s", channel, since)
+		b.i.Cmd.Message("*playback", fmt.Sprintf("PLAY %s %d.%03d", channel, since.Unix(), since.Nanosecond()/int(time.Millisecond)))
+	default:
+		b.Log.Debugf("server doesn't support draft/chathistory or znc.in/playback, not backfilling %s", channel)
+	}
+}
@@ -0,0 +1,32 @@
+package birc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryDuplicate(t *testing.T) {
+	h := newHistory()
+	now := time.Now()
+
+	_, ok := h.startBackfill("#test")
+	assert.False(t, ok)
+
+	assert.False(t, h.duplicate("#test", "a", now.Add(-time.Minute), true))
+	assert.False(t, h.duplicate("#test", "", now, true))
+	assert.True(t, h.duplicate("#test", "a", now.Add(-time.Minute), true))
+
+	// messages without msgid are only checked while backfilling
+	assert.False(t, h.duplicate("#test", "", now, true))
+
+	since, ok := h.startBackfill("#test")
+	assert.True(t, ok)
+	assert.Equal(t, now, since)
+	assert.True(t, h.duplicate("#test", "", now, true))
+	assert.False(t, h.duplicate("#test", "", now, false))
+	assert.False(t, h.duplicate("#other", "", now, true))
+	assert.False(t, h.duplicate("#test", "", now.Add(time.Second), true))
+	assert.True(t, h.duplicate("#test", "", now, true))
+}
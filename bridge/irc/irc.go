@@ -10,6 +10,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/42wim/matterbridge/bridge"
@@ -32,6 +33,13 @@ type Birc struct {
 	FirstConnection, authDone                 bool
 	MessageDelay, MessageQueue, MessageLength int
 	channels                                  map[string]bool
+	msgIDs                                    *msgIDMap
+	recent                                    *recentMessages
+	puppets                                   *puppetPool
+	history                                   *history
+	channelKeys                               map[string]string
+	channelKeysMutex                          sync.RWMutex
+	events                                    chan config.Message // messages and JOIN/PART/QUIT/KICK/NICK events, relayed in order
 
 	*bridge.Config
 }
@@ -43,6 +51,13 @@ func New(cfg *bridge.Config) bridge.Bridger {
 	b.names = make(map[string][]string)
 	b.connected = make(chan error)
 	b.channels = make(map[string]bool)
+	b.msgIDs = newMsgIDMap()
+	b.recent = newRecentMessages()
+	b.puppets = newPuppetPool()
+	b.history = newHistory()
+	b.channelKeys = make(map[string]string)
+	b.events = make(chan config.Message, eventQueueSize)
+	go b.relayEvents()
 
 	if b.GetInt("MessageDelay") == 0 {
 		b.MessageDelay = 1300
@@ -73,8 +88,9 @@ func (b *Birc) Command(msg *config.Message) string {
 }
 
 func (b *Birc) Connect() error {
-	if b.GetBool("UseSASL") && b.GetString("TLSClientCertificate") != "" {
-		return errors.New("you can't enable SASL and TLSClientCertificate at the same time")
+	if mech := b.GetString("SASLMechanism"); b.GetBool("UseSASL") && b.GetString("TLSClientCertificate") != "" &&
+		(mech == "" || strings.EqualFold(mech, saslPlain)) {
+		return errors.New("you can't enable SASL PLAIN and TLSClientCertificate at the same time, use SASLMechanism EXTERNAL")
 	}
 
 	b.Local = make(chan config.Message, b.MessageQueue+10)
@@ -86,9 +102,8 @@ func (b *Birc) Connect() error {
 	}
 
 	if b.GetBool("UseSASL") {
-		i.Config.SASL = &girc.SASLPlain{
-			User: b.GetString("NickServNick"),
-			Pass: b.GetString("NickServPassword"),
+		if i.Config.SASL, err = b.getSASL(); err != nil {
+			return err
 		}
 	}
 
@@ -109,11 +124,18 @@ func (b *Birc) Connect() error {
 	if b.GetInt("DebugLevel") == 0 {
 		i.Handlers.Clear(girc.ALL_EVENTS)
 	}
+	i.Handlers.AddBg(girc.ALL_EVENTS, b.handleEcho)
+	i.Handlers.Add(girc.ALL_EVENTS, b.handleQuit)
+	i.Handlers.Add(girc.ALL_EVENTS, b.handleNick)
 	go b.doSend()
+	if b.GetBool("Puppets") {
+		go b.reapPuppets()
+	}
 	return nil
 }
 
 func (b *Birc) Disconnect() error {
+	b.quitPuppets()
 	b.i.Close()
 	close(b.Local)
 	return nil
@@ -121,6 +143,9 @@ func (b *Birc) Disconnect() error {
 
 func (b *Birc) JoinChannel(channel config.ChannelInfo) error {
 	b.channels[channel.Name] = true
+	b.channelKeysMutex.Lock()
+	b.channelKeys[channel.Name] = channel.Options.Key
+	b.channelKeysMutex.Unlock()
 	// need to check if we have nickserv auth done before joining channels
 	for {
 		if b.authDone {
@@ -134,6 +159,7 @@ func (b *Birc) JoinChannel(channel config.ChannelInfo) error {
 	} else {
 		b.i.Cmd.Join(channel.Name)
 	}
+	b.requestBackfill(channel.Name)
 	return nil
 }
 
@@ -151,11 +177,37 @@ func (b *Birc) Send(msg config.Message) (string, error) {
 		return "", nil
 	}
 
+	if msg.Event == config.EventDirectMessage {
+		b.i.Cmd.Message(msg.Username, msg.Text)
+		return "", nil
+	}
+
+	// puppets join and part with their user, the bot only relays the joins/parts of others
+	if msg.Event == config.EventJoinLeave && b.followJoinLeave(&msg) {
+		return "", nil
+	}
+
+	// rename the puppet of the user, the change itself is only relayed when configured
+	if msg.Event == config.EventNickChange {
+		b.renamePuppet(&msg)
+		if !b.GetBool("ShowNickChange") {
+			return "", nil
+		}
+	}
+
 	// Execute a command
 	if strings.HasPrefix(msg.Text, "!") {
 		b.Command(&msg)
 	}
 
+	// mention IRC users by their nick, which highlights them
+	msg.Text = helper.ReplaceMentions(msg.Text, b.Account, msg.Mentions, func(m config.Mention) string {
+		return m.Username
+	})
+
+	// keep the utf-8 text for the paste service
+	text := msg.Text
+
 	// convert to specified charset
 	if err := b.handleCharset(&msg); err != nil {
 		return "", err
@@ -166,6 +218,20 @@ func (b *Birc) Send(msg config.Message) (string, error) {
 		return "", nil
 	}
 
+	// reactions can only be sent as tags
+	if msg.Event == config.EventReaction {
+		if !b.sendReaction(&msg) {
+			b.Log.Debugf("Can't send reaction %s to %s, dropping", msg.Text, msg.Channel)
+		}
+		return "", nil
+	}
+
+	// the ID of edits (IRC doesn't have them) is the one of the original message
+	msg.ID = ""
+	if b.trackIDs() {
+		msg.ID = b.msgIDs.newID()
+	}
+
 	var msgLines []string
 	if b.GetBool("StripMarkdown") {
 		msg.Text = stripmd.Strip(msg.Text)
@@ -176,16 +242,19 @@ func (b *Birc) Send(msg config.Message) (string, error) {
 	} else {
 		msgLines = helper.GetSubLines(msg.Text, 0, b.GetString("MessageClipped"))
 	}
+	if line, ok := b.handlePaste(text, &msg); ok {
+		msgLines = []string{line}
+	}
 	for i := range msgLines {
-		if len(b.Local) >= b.MessageQueue {
+		msg.Text = msgLines[i]
+		if !b.queue(msg) {
 			b.Log.Debugf("flooding, dropping message (queue at %d)", len(b.Local))
 			return "", nil
 		}
-
-		msg.Text = msgLines[i]
-		b.Local <- msg
+		// only the first line is a reply
+		msg.ParentID = ""
 	}
-	return "", nil
+	return msg.ID, nil
 }
 
 func (b *Birc) doConnect() {
@@ -226,6 +295,7 @@ func (b *Birc) doSend() {
 	throttle := time.NewTicker(rate)
 	for msg := range b.Local {
 		<-throttle.C
+		tags := b.replyTags(&msg)
 		username := msg.Username
 		// Optional support for the proposed RELAYMSG extension, described at
 		// https://github.com/jlu5/ircv3-specifications/blob/master/extensions/relaymsg.md
@@ -241,41 +311,51 @@ func (b *Birc) doSend() {
 			}
 
 			if msg.Event == config.EventUserAction {
-				b.i.Cmd.SendRawf("RELAYMSG %s %s :\x01ACTION %s\x01", msg.Channel, username, text) //nolint:errcheck
+				text = "\x01ACTION " + text + "\x01"
 			} else {
 				b.Log.Debugf("Sending RELAYMSG to channel %s: nick=%s", msg.Channel, username)
-				b.i.Cmd.SendRawf("RELAYMSG %s %s :%s", msg.Channel, username, text) //nolint:errcheck
 			}
+			b.i.Cmd.SendRawf("%sRELAYMSG %s %s :%s", rawTags(tags), msg.Channel, username, text) //nolint:errcheck
+			b.sentLine(&msg, strings.TrimPrefix(text, ":"))
 		} else {
 			if b.GetBool("Colornicks") {
 				checksum := crc32.ChecksumIEEE([]byte(msg.Username))
 				colorCode := checksum%14 + 2 // quick fix - prevent white or black color codes
 				username = fmt.Sprintf("\x03%02d%s\x0F", colorCode, msg.Username)
 			}
+			event := &girc.Event{Command: girc.PRIVMSG, Params: []string{msg.Channel, username + msg.Text}, Tags: tags}
 			switch msg.Event {
 			case config.EventUserAction:
-				b.i.Cmd.Action(msg.Channel, username+msg.Text)
+				event.Params[1] = "\x01ACTION " + username + msg.Text + "\x01"
 			case config.EventNoticeIRC:
 				b.Log.Debugf("Sending notice to channel %s", msg.Channel)
-				b.i.Cmd.Notice(msg.Channel, username+msg.Text)
+				event.Command = girc.NOTICE
 			default:
 				b.Log.Debugf("Sending to channel %s", msg.Channel)
-				b.i.Cmd.Message(msg.Channel, username+msg.Text)
 			}
+			b.i.Send(event)
+			b.sentLine(&msg, event.Params[1])
 		}
 	}
 }
 
-// validateInput validates the server/port/nick configuration. Returns a *girc.Client if successful
-func (b *Birc) getClient() (*girc.Client, error) {
-	server, portstr, err := net.SplitHostPort(b.GetString("Server"))
-	if err != nil {
-		return nil, err
+// sentLine records a line we sent for msg, so we can find its msgid when it's echoed.
+func (b *Birc) sentLine(msg *config.Message, text string) {
+	if msg.ID != "" {
+		b.msgIDs.sent(msg.ID, msg.Channel, text)
 	}
-	port, err := strconv.Atoi(portstr)
-	if err != nil {
-		return nil, err
+}
+
+// rawTags returns tags formatted to prefix a raw IRC line.
+func rawTags(tags girc.Tags) string {
+	if len(tags) == 0 {
+		return ""
 	}
+	return tags.String() + " "
+}
+
+// validateInput validates the server/port/nick configuration. Returns a *girc.Client if successful
+func (b *Birc) getClient() (*girc.Client, error) {
 	user := b.GetString("UserName")
 	if user == "" {
 		user = b.GetString("Nick")
@@ -292,6 +372,27 @@ func (b *Birc) getClient() (*girc.Client, error) {
 	if realName == "" {
 		realName = b.GetString("Nick")
 	}
+	i, err := b.newClient(b.GetString("Nick"), user, realName, b.GetString("Password"))
+	if err != nil {
+		return nil, err
+	}
+	for capability, params := range b.backfillCaps() {
+		i.Config.SupportedCaps[capability] = params
+	}
+	return i, nil
+}
+
+// newClient returns a *girc.Client for the configured server with the given nick, user,
+// realname and server password.
+func (b *Birc) newClient(nick, user, realName, password string) (*girc.Client, error) {
+	server, portstr, err := net.SplitHostPort(b.GetString("Server"))
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return nil, err
+	}
 
 	debug := ioutil.Discard
 	if b.GetInt("DebugLevel") == 2 {
@@ -312,9 +413,9 @@ func (b *Birc) getClient() (*girc.Client, error) {
 
 	i := girc.New(girc.Config{
 		Server:     server,
-		ServerPass: b.GetString("Password"),
+		ServerPass: password,
 		Port:       port,
-		Nick:       b.GetString("Nick"),
+		Nick:       nick,
 		User:       user,
 		Name:       realName,
 		SSL:        b.GetBool("UseTLS"),
@@ -324,7 +425,7 @@ func (b *Birc) getClient() (*girc.Client, error) {
 		// skip gIRC internal rate limiting, since we have our own throttling
 		AllowFlood:    true,
 		Debug:         debug,
-		SupportedCaps: map[string][]string{"overdrivenetworks.com/relaymsg": nil, "draft/relaymsg": nil},
+		SupportedCaps: map[string][]string{"overdrivenetworks.com/relaymsg": nil, "draft/relaymsg": nil, "echo-message": nil},
 	})
 	return i, nil
 }
@@ -361,9 +462,9 @@ func (b *Birc) skipPrivMsg(event girc.Event) bool {
 	if event.Params[0] == b.Nick {
 		return true
 	}
-	// don't forward message from ourself
+	// don't forward message from ourself or our puppets
 	if event.Source != nil {
-		if event.Source.Name == b.Nick {
+		if event.Source.Name == b.Nick || b.puppets.isPuppet(event.Source.Name) {
 			return true
 		}
 	}
@@ -403,7 +504,12 @@ func (b *Birc) getTLSConfig() (*tls.Config, error) {
 	}
 
 	if filename := b.GetString("TLSClientCertificate"); filename != "" {
-		cert, err := tls.LoadX509KeyPair(filename, filename)
+		// the key can be in the same file as the certificate
+		keyFilename := b.GetString("TLSClientKey")
+		if keyFilename == "" {
+			keyFilename = filename
+		}
+		cert, err := tls.LoadX509KeyPair(filename, keyFilename)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,362 @@
+package birc
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/lrstanley/girc"
+)
+
+const (
+	defaultPuppetMaxConnections = 20
+	defaultPuppetIdleTimeout    = 3600
+	defaultPuppetNickLength     = 16
+	// puppetConnectTimeout is how long messages wait for a puppet to connect
+	// before they're sent by the bot instead.
+	puppetConnectTimeout = 30 * time.Second
+)
+
+// puppet is an IRC connection relaying the messages of one remote user under their own nick.
+type puppet struct {
+	client   *girc.Client
+	username string
+	queue    chan config.Message
+	ready    chan struct{}
+	done     chan struct{}
+	lastUsed time.Time
+}
+
+// puppetPool keeps the puppets by the (RemoteNickFormat formatted) username they relay for.
+type puppetPool struct {
+	sync.Mutex
+
+	puppets map[string]*puppet
+}
+
+func newPuppetPool() *puppetPool {
+	return &puppetPool{puppets: make(map[string]*puppet)}
+}
+
+// isPuppet returns true if nick is the nick of one of our puppets.
+func (pp *puppetPool) isPuppet(nick string) bool {
+	pp.Lock()
+	defer pp.Unlock()
+	for _, p := range pp.puppets {
+		if strings.EqualFold(p.client.GetNick(), nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// remove removes p from the pool and stops sending messages with it.
+func (pp *puppetPool) remove(p *puppet) {
+	pp.Lock()
+	defer pp.Unlock()
+	if pp.puppets[p.username] != p {
+		return
+	}
+	delete(pp.puppets, p.username)
+	close(p.done)
+}
+
+// usePuppets returns true if msg should be sent by a puppet.
+func (b *Birc) usePuppets(msg *config.Message) bool {
+	if !b.GetBool("Puppets") || msg.Username == "" {
+		return false
+	}
+	switch msg.Event {
+	case "", config.EventUserAction, config.EventNoticeIRC:
+		return true
+	}
+	return false
+}
+
+// getPuppet returns the puppet for username, connecting a new one if needed.
+// Returns nil if we already have PuppetMaxConnections puppets.
+func (b *Birc) getPuppet(username string) *puppet {
+	b.puppets.Lock()
+	defer b.puppets.Unlock()
+	if p, ok := b.puppets.puppets[username]; ok {
+		p.lastUsed = time.Now()
+		return p
+	}
+
+	max := b.GetInt("PuppetMaxConnections")
+	if max == 0 {
+		max = defaultPuppetMaxConnections
+	}
+	if len(b.puppets.puppets) >= max {
+		b.Log.Debugf("PuppetMaxConnections %d reached, sending as %s", max, b.Nick)
+		return nil
+	}
+
+	nick := b.puppetNick(username)
+	// puppets don't log in with the password of the bot, which may be an account password
+	client, err := b.newClient(nick, "matterbridge", username+" (relayed by "+b.Nick+")", b.GetString("PuppetPassword"))
+	if err != nil {
+		b.Log.Errorf("creating puppet for %s failed: %s", username, err)
+		return nil
+	}
+	// don't authenticate puppets with the certificate of the bot
+	client.Config.TLSConfig.Certificates = nil
+	p := &puppet{
+		client:   client,
+		username: username,
+		queue:    make(chan config.Message, b.MessageQueue+10),
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
+		lastUsed: time.Now(),
+	}
+	client.Handlers.Add(girc.RPL_WELCOME, func(client *girc.Client, event girc.Event) {
+		select {
+		case <-p.ready:
+		default:
+			close(p.ready)
+		}
+	})
+	b.puppets.puppets[username] = p
+	b.Log.Infof("Connecting puppet %s for %s", nick, username)
+
+	go b.connectPuppet(p)
+	go b.puppetSend(p)
+	return p
+}
+
+// lookupPuppet returns the puppet for username, if it's connected.
+func (b *Birc) lookupPuppet(username string) *puppet {
+	b.puppets.Lock()
+	defer b.puppets.Unlock()
+	return b.puppets.puppets[username]
+}
+
+// followJoinLeave has the puppets of the users who joined or left in msg join or part the
+// channel. Returns true if puppets followed all of them, otherwise the bot relays msg.
+func (b *Birc) followJoinLeave(msg *config.Message) bool {
+	if !b.GetBool("Puppets") {
+		return false
+	}
+	var infos []config.JoinLeaveInfo
+	for _, v := range msg.Extra[config.EventJoinLeave] {
+		info, ok := v.(config.JoinLeaveInfo)
+		if !ok || info.Remote == "" {
+			return false
+		}
+		infos = append(infos, info)
+	}
+	followed := len(infos) > 0
+	for _, info := range infos {
+		var p *puppet
+		if info.Action == config.JoinLeaveJoin {
+			p = b.getPuppet(info.Remote)
+		} else {
+			p = b.lookupPuppet(info.Remote)
+		}
+		if p == nil {
+			followed = false
+			continue
+		}
+		select {
+		case p.queue <- config.Message{Channel: msg.Channel, Event: config.EventJoinLeave, Text: info.Action}:
+		default:
+			followed = false
+		}
+	}
+	return followed
+}
+
+// renamePuppet changes the nick of the puppet of the user who changed their nick in msg.
+func (b *Birc) renamePuppet(msg *config.Message) {
+	if !b.GetBool("Puppets") {
+		return
+	}
+	for _, v := range msg.Extra[config.EventNickChange] {
+		info, ok := v.(config.NickChangeInfo)
+		if !ok || info.RemoteOld == "" || info.RemoteNew == "" {
+			continue
+		}
+		b.puppets.Lock()
+		p, ok := b.puppets.puppets[info.RemoteOld]
+		if _, taken := b.puppets.puppets[info.RemoteNew]; ok && !taken {
+			delete(b.puppets.puppets, info.RemoteOld)
+			p.username = info.RemoteNew
+			b.puppets.puppets[info.RemoteNew] = p
+		} else {
+			ok = false
+		}
+		b.puppets.Unlock()
+		if ok {
+			nick := b.puppetNick(info.RemoteNew)
+			b.Log.Debugf("renaming puppet %s to %s", p.client.GetNick(), nick)
+			p.client.Cmd.Nick(nick)
+		}
+	}
+}
+
+// puppetNick returns a valid IRC nick for username.
+func (b *Birc) puppetNick(username string) string {
+	nick := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("-_[]{}\\`^|", r):
+			return r
+		}
+		return -1
+	}, sanitizeNick(strings.TrimSpace(username)))
+	nick = strings.TrimLeft(nick, "-0123456789")
+	if nick == "" {
+		nick = "matterbridge"
+	}
+	length, ok := b.i.GetServerOptionInt("NICKLEN")
+	if !ok || length <= 0 {
+		length = defaultPuppetNickLength
+	}
+	// leave some room for the _ girc appends on nick collisions
+	if len(nick) > length-2 && length > 2 {
+		nick = nick[:length-2]
+	}
+	return nick
+}
+
+// connectPuppet connects p, it's removed from the pool when it's disconnected.
+func (b *Birc) connectPuppet(p *puppet) {
+	if err := p.client.Connect(); err != nil {
+		b.Log.Errorf("puppet %s for %s disconnected: %s", p.client.GetNick(), p.username, err)
+	} else {
+		b.Log.Debugf("puppet %s for %s disconnected", p.client.GetNick(), p.username)
+	}
+	b.puppets.remove(p)
+}
+
+// puppetSend sends the messages queued for p, joining channels as needed. If p can't
+// connect its messages are sent by the bot instead.
+func (b *Birc) puppetSend(p *puppet) {
+	select {
+	case <-p.ready:
+	case <-p.done:
+	case <-time.After(puppetConnectTimeout):
+		b.Log.Errorf("puppet for %s didn't connect in time, sending as %s", p.username, b.Nick)
+		b.puppets.remove(p)
+		p.client.Close()
+	}
+
+	throttle := time.NewTicker(time.Millisecond * time.Duration(b.MessageDelay))
+	defer throttle.Stop()
+	for {
+		var msg config.Message
+		select {
+		case <-p.done:
+			// send what's left as the bot
+			for {
+				select {
+				case msg := <-p.queue:
+					b.queueLocal(msg)
+				default:
+					return
+				}
+			}
+		case msg = <-p.queue:
+		}
+		<-throttle.C
+		// followJoinLeave queues the joins/parts of the user with the action as text
+		if msg.Event == config.EventJoinLeave {
+			if msg.Text == config.JoinLeaveJoin {
+				b.puppetJoin(p, msg.Channel)
+			} else if p.client.IsInChannel(msg.Channel) {
+				b.Log.Debugf("Parting %s with puppet %s", msg.Channel, p.client.GetNick())
+				p.client.Cmd.Part(msg.Channel)
+			}
+			continue
+		}
+		b.puppetJoin(p, msg.Channel)
+		event := &girc.Event{Command: girc.PRIVMSG, Params: []string{msg.Channel, msg.Text}, Tags: b.replyTags(&msg)}
+		switch msg.Event {
+		case config.EventUserAction:
+			event.Params[1] = "\x01ACTION " + msg.Text + "\x01"
+		case config.EventNoticeIRC:
+			event.Command = girc.NOTICE
+		}
+		b.Log.Debugf("Sending to channel %s as puppet %s", msg.Channel, p.client.GetNick())
+		p.client.Send(event)
+		b.sentLine(&msg, event.Params[1])
+	}
+}
+
+// puppetJoin joins p to channel if it isn't in it yet.
+func (b *Birc) puppetJoin(p *puppet, channel string) {
+	if p.client.IsInChannel(channel) {
+		return
+	}
+	b.channelKeysMutex.RLock()
+	key := b.channelKeys[channel]
+	b.channelKeysMutex.RUnlock()
+	if key != "" {
+		p.client.Cmd.JoinKey(channel, key)
+	} else {
+		p.client.Cmd.Join(channel)
+	}
+}
+
+// queue queues msg to be sent by the puppet of its user or by the bot. Returns false
+// if the queue is full.
+func (b *Birc) queue(msg config.Message) bool {
+	if b.usePuppets(&msg) {
+		if p := b.getPuppet(msg.Username); p != nil {
+			if len(p.queue) >= b.MessageQueue {
+				return false
+			}
+			p.queue <- msg
+			return true
+		}
+	}
+	if len(b.Local) >= b.MessageQueue {
+		return false
+	}
+	b.Local <- msg
+	return true
+}
+
+// queueLocal queues msg to be sent by the bot, it's dropped if the queue is full.
+func (b *Birc) queueLocal(msg config.Message) {
+	select {
+	case b.Local <- msg:
+	default:
+		b.Log.Debugf("flooding, dropping message (queue at %d)", len(b.Local))
+	}
+}
+
+// reapPuppets disconnects puppets that haven't been used for PuppetIdleTimeout seconds.
+func (b *Birc) reapPuppets() {
+	timeout := time.Duration(b.GetInt("PuppetIdleTimeout")) * time.Second
+	if timeout == 0 {
+		timeout = defaultPuppetIdleTimeout * time.Second
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		b.puppets.Lock()
+		var idle []*puppet
+		for _, p := range b.puppets.puppets {
+			if time.Since(p.lastUsed) > timeout {
+				idle = append(idle, p)
+			}
+		}
+		b.puppets.Unlock()
+		for _, p := range idle {
+			b.Log.Debugf("disconnecting idle puppet %s for %s", p.client.GetNick(), p.username)
+			p.client.Quit("idle")
+		}
+	}
+}
+
+// quitPuppets disconnects all puppets.
+func (b *Birc) quitPuppets() {
+	b.puppets.Lock()
+	defer b.puppets.Unlock()
+	for _, p := range b.puppets.puppets {
+		p.client.Quit("")
+	}
+}
@@ -0,0 +1,25 @@
+package birc
+
+import (
+	"testing"
+
+	"github.com/lrstanley/girc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPuppetNick(t *testing.T) {
+	b := &Birc{i: girc.New(girc.Config{Server: "localhost", Nick: "bot", User: "bot"})}
+	testcases := map[string]string{
+		"wim":                   "wim",
+		"wim|discord":           "wim|discord",
+		"wim.bot (slack)":       "wim-bot-slack",
+		"1337 h4x0r":            "h4x0r",
+		"Ωmega":                 "mega",
+		"ωωω":                   "matterbridge",
+		"averyveryverylongnick": "averyveryveryl",
+	}
+	for username, nick := range testcases {
+		assert.Equal(t, nick, b.puppetNick(username), username)
+		assert.True(t, girc.IsValidNick(b.puppetNick(username)), username)
+	}
+}
@@ -0,0 +1,151 @@
+package birc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lrstanley/girc"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SASL mechanisms supported by SASLMechanism.
+const (
+	saslPlain       = "PLAIN"
+	saslExternal    = "EXTERNAL"
+	saslScramSHA256 = "SCRAM-SHA-256"
+)
+
+// getSASL returns the SASL mechanism configured with SASLMechanism.
+func (b *Birc) getSASL() (girc.SASLMech, error) {
+	switch mech := strings.ToUpper(b.GetString("SASLMechanism")); mech {
+	case "", saslPlain:
+		return &girc.SASLPlain{
+			User: b.GetString("NickServNick"),
+			Pass: b.GetString("NickServPassword"),
+		}, nil
+	case saslExternal:
+		if b.GetString("TLSClientCertificate") == "" {
+			return nil, errors.New("SASLMechanism EXTERNAL needs a TLSClientCertificate")
+		}
+		return &girc.SASLExternal{}, nil
+	case saslScramSHA256:
+		return &scramSHA256{
+			user: b.GetString("NickServNick"),
+			pass: b.GetString("NickServPassword"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported SASLMechanism %s", mech)
+	}
+}
+
+// scramSHA256 implements the SCRAM-SHA-256 SASL mechanism (RFC 7677), so the
+// password itself is never sent to the server.
+type scramSHA256 struct {
+	user string
+	pass string
+
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// Method identifies what type of SASL this implements.
+func (s *scramSHA256) Method() string {
+	return saslScramSHA256
+}
+
+// Encode returns the response to the server challenge in params.
+func (s *scramSHA256) Encode(params []string) string {
+	if len(params) != 1 {
+		return ""
+	}
+	// the server starts (again) with an empty challenge
+	if params[0] == "+" {
+		return s.clientFirst()
+	}
+	challenge, err := base64.StdEncoding.DecodeString(params[0])
+	if err != nil {
+		return ""
+	}
+	if s.serverSignature == nil {
+		return s.clientFinal(string(challenge))
+	}
+	// verify the server knows our password too
+	if !hmac.Equal([]byte(challenge), []byte("v="+base64.StdEncoding.EncodeToString(s.serverSignature))) {
+		return ""
+	}
+	return "+"
+}
+
+func (s *scramSHA256) clientFirst() string {
+	var err error
+	if s.nonce, err = scramNonce(); err != nil {
+		return ""
+	}
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s.user)
+	s.clientFirstBare = "n=" + name + ",r=" + s.nonce
+	s.serverSignature = nil
+	return base64.StdEncoding.EncodeToString([]byte("n,," + s.clientFirstBare))
+}
+
+func (s *scramSHA256) clientFinal(serverFirst string) string {
+	var (
+		nonce      string
+		salt       []byte
+		iterations int
+		err        error
+	)
+	for _, attr := range strings.Split(serverFirst, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt, err = base64.StdEncoding.DecodeString(attr[2:])
+		case 'i':
+			iterations, err = strconv.Atoi(attr[2:])
+		}
+		if err != nil {
+			return ""
+		}
+	}
+	if !strings.HasPrefix(nonce, s.nonce) || len(salt) == 0 || iterations <= 0 {
+		return ""
+	}
+
+	salted := pbkdf2.Key([]byte(s.pass), salt, iterations, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientFinalNoProof := "c=biws,r=" + nonce
+	authMessage := s.clientFirstBare + "," + serverFirst + "," + clientFinalNoProof
+
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	s.serverSignature = hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+	return base64.StdEncoding.EncodeToString([]byte(clientFinalNoProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+}
+
+// scramNonce returns a new random client nonce.
+var scramNonce = func() (string, error) {
+	buf := make([]byte, 18)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(buf), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
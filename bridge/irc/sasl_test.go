@@ -0,0 +1,31 @@
+package birc
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// test vector from RFC 7677
+func TestScramSHA256(t *testing.T) {
+	defer func(f func() (string, error)) { scramNonce = f }(scramNonce)
+	scramNonce = func() (string, error) { return "rOprNGfwEbeRWgbNEkqO", nil }
+	s := &scramSHA256{user: "user", pass: "pencil"}
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	assert.Equal(t, b64("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"), s.Encode([]string{"+"}))
+	assert.Equal(t,
+		b64("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="),
+		s.Encode([]string{b64("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")}))
+	assert.Equal(t, "+", s.Encode([]string{b64("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")}))
+
+	// wrong server signature
+	s.Encode([]string{"+"})
+	s.Encode([]string{b64("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")})
+	assert.Equal(t, "", s.Encode([]string{b64("v=AAAA")}))
+
+	// server nonce has to start with our nonce
+	s.Encode([]string{"+"})
+	assert.Equal(t, "", s.Encode([]string{b64("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")}))
+}
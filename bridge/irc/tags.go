@@ -0,0 +1,215 @@
+package birc
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/lrstanley/girc"
+)
+
+// IRCv3 message tags, see https://ircv3.net/specs/extensions/message-tags
+const (
+	tagMsgID      = "msgid"
+	tagReply      = "+draft/reply"
+	tagReplyFinal = "+reply"
+	tagReact      = "+draft/react"
+)
+
+// localIDPrefix marks the message IDs we return for messages relayed to IRC. The server
+// only tells us the real msgid when it echoes the message back (echo-message).
+const localIDPrefix = "matterbridge-"
+
+// maxPendingEchoes is the maximum number of sent lines we keep waiting for their echo.
+const maxPendingEchoes = 100
+
+type pendingEcho struct {
+	id      string
+	channel string
+	text    string
+}
+
+// msgIDMap maps the IDs we return for relayed messages to the msgid the server
+// gave them and back.
+type msgIDMap struct {
+	sync.Mutex
+
+	counter  uint64
+	toServer *lru.Cache
+	toLocal  *lru.Cache
+	pending  []pendingEcho
+}
+
+func newMsgIDMap() *msgIDMap {
+	toServer, _ := lru.New(5000)
+	toLocal, _ := lru.New(5000)
+	return &msgIDMap{toServer: toServer, toLocal: toLocal}
+}
+
+// newID returns a new local message ID.
+func (m *msgIDMap) newID() string {
+	m.Lock()
+	defer m.Unlock()
+	m.counter++
+	return localIDPrefix + strconv.FormatUint(m.counter, 10)
+}
+
+// sent records that text was sent to channel as (part of) the message with local ID id.
+func (m *msgIDMap) sent(id, channel, text string) {
+	m.Lock()
+	defer m.Unlock()
+	if len(m.pending) >= maxPendingEchoes {
+		m.pending = m.pending[1:]
+	}
+	m.pending = append(m.pending, pendingEcho{id: id, channel: strings.ToLower(channel), text: text})
+}
+
+// echoed maps the local ID of the line that was echoed to the msgid the server gave it.
+// Lines are echoed in the order we sent them, but girc may split long lines so we only
+// match on the start of the text. Lines sent before the matching one are forgotten.
+func (m *msgIDMap) echoed(channel, text, msgid string) {
+	m.Lock()
+	defer m.Unlock()
+	channel = strings.ToLower(channel)
+	for i, p := range m.pending {
+		if p.channel != channel || text == "" || !strings.HasPrefix(p.text, text) {
+			continue
+		}
+		m.pending = m.pending[i+1:]
+		// only the first line of a multi-line message gets an ID
+		if !m.toServer.Contains(p.id) {
+			m.toServer.Add(p.id, msgid)
+			m.toLocal.Add(msgid, p.id)
+		}
+		return
+	}
+}
+
+// serverID returns the msgid on the server of the message with ID id, or an empty
+// string if we don't know it.
+func (m *msgIDMap) serverID(id string) string {
+	if id == "" || id == config.ParentIDNotFound {
+		return ""
+	}
+	if !strings.HasPrefix(id, localIDPrefix) {
+		return id
+	}
+	if msgid, ok := m.toServer.Get(id); ok {
+		return msgid.(string)
+	}
+	return ""
+}
+
+// localID returns the ID we returned for the message with the given msgid, so the
+// gateway can find it, or msgid itself if it wasn't one of ours.
+func (m *msgIDMap) localID(msgid string) string {
+	if id, ok := m.toLocal.Get(msgid); ok {
+		return id.(string)
+	}
+	return msgid
+}
+
+// messageTagsEnabled returns true if we can send and receive client-only tags.
+func (b *Birc) messageTagsEnabled() bool {
+	return b.i.HasCapability("message-tags")
+}
+
+// trackIDs returns true if the server echoes our messages with their msgid,
+// so we can return message IDs for the messages we send.
+func (b *Birc) trackIDs() bool {
+	return b.i.HasCapability("echo-message") && b.messageTagsEnabled()
+}
+
+// setMessageTags sets the ID, ParentID and Timestamp of rmsg from the tags of event.
+func (b *Birc) setMessageTags(rmsg *config.Message, event *girc.Event) {
+	rmsg.Timestamp = event.Timestamp
+	if msgid, ok := event.Tags.Get(tagMsgID); ok {
+		rmsg.ID = msgid
+	}
+	if parent := replyTag(event); parent != "" {
+		rmsg.ParentID = b.msgIDs.localID(parent)
+	}
+}
+
+// replyTags returns the tags to send msg as a reply to msg.ParentID, if the server supports it.
+func (b *Birc) replyTags(msg *config.Message) girc.Tags {
+	if !b.messageTagsEnabled() {
+		return nil
+	}
+	parent := b.msgIDs.serverID(msg.ParentID)
+	if parent == "" {
+		return nil
+	}
+	tags := girc.Tags{}
+	if err := tags.Set(tagReply, parent); err != nil {
+		b.Log.Debugf("not replying to %s: %s", parent, err)
+		return nil
+	}
+	return tags
+}
+
+// sendReaction sends a reaction as TAGMSG, returns false if the server doesn't support
+// it or we don't know the message that was reacted to.
+func (b *Birc) sendReaction(msg *config.Message) bool {
+	tags := b.replyTags(msg)
+	if tags == nil {
+		return false
+	}
+	if err := tags.Set(tagReact, msg.Text); err != nil {
+		b.Log.Debugf("can't send reaction %s: %s", msg.Text, err)
+		return false
+	}
+	b.i.Send(&girc.Event{Command: girc.CAP_TAGMSG, Params: []string{msg.Channel}, Tags: tags})
+	return true
+}
+
+// handleTagMsg relays reactions sent as TAGMSG with a +draft/react tag.
+func (b *Birc) handleTagMsg(client *girc.Client, event girc.Event) {
+	if len(event.Params) == 0 || b.skipPrivMsg(event) {
+		return
+	}
+	reaction, ok := event.Tags.Get(tagReact)
+	if !ok || reaction == "" {
+		return
+	}
+	parent := replyTag(&event)
+	if parent == "" {
+		return
+	}
+	rmsg := config.Message{
+		Username:  event.Source.Name,
+		Channel:   strings.ToLower(event.Params[0]),
+		Account:   b.Account,
+		UserID:    event.Source.Ident + "@" + event.Source.Host,
+		Event:     config.EventReaction,
+		Text:      reaction,
+		ParentID:  b.msgIDs.localID(parent),
+		Timestamp: event.Timestamp,
+	}
+	b.Log.Debugf("<= Sending reaction from %s on %s to gateway", event.Params[0], b.Account)
+	b.Remote <- rmsg
+}
+
+// handleEcho records the msgid of the messages we sent when the server echoes them.
+func (b *Birc) handleEcho(client *girc.Client, event girc.Event) {
+	if event.Command != girc.PRIVMSG && event.Command != girc.NOTICE || len(event.Params) < 2 {
+		return
+	}
+	relayedNick, _ := event.Tags.Get("draft/relaymsg")
+	if !event.Echo && relayedNick != b.Nick && (event.Source == nil || !b.puppets.isPuppet(event.Source.Name)) {
+		return
+	}
+	if msgid, ok := event.Tags.Get(tagMsgID); ok {
+		b.msgIDs.echoed(event.Params[0], event.Last(), msgid)
+	}
+}
+
+func replyTag(event *girc.Event) string {
+	if parent, ok := event.Tags.Get(tagReply); ok {
+		return parent
+	}
+	parent, _ := event.Tags.Get(tagReplyFinal)
+	return parent
+}
@@ -0,0 +1,49 @@
+package birc
+
+import (
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/lrstanley/girc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgIDMap(t *testing.T) {
+	m := newMsgIDMap()
+	first := m.newID()
+	second := m.newID()
+	assert.NotEqual(t, first, second)
+
+	m.sent(first, "#test", "<wim> hello")
+	m.sent(first, "#test", "<wim> second line")
+	m.sent(second, "#Test", "<wim> a very long line that got split")
+
+	// unknown until the server echoes it
+	assert.Equal(t, "", m.serverID(first))
+
+	m.echoed("#test", "<wim> hello", "abc")
+	m.echoed("#test", "<wim> second line", "def")
+	m.echoed("#test", "<wim> a very long", "ghi")
+	m.echoed("#test", "line that got split", "jkl")
+
+	assert.Equal(t, "abc", m.serverID(first))
+	assert.Equal(t, "ghi", m.serverID(second))
+	assert.Equal(t, first, m.localID("abc"))
+	assert.Equal(t, "def", m.localID("def"))
+	assert.Empty(t, m.pending)
+
+	// IDs of messages sent by IRC users are the msgid itself
+	assert.Equal(t, "xyz", m.serverID("xyz"))
+	assert.Equal(t, "", m.serverID(config.ParentIDNotFound))
+}
+
+func TestReplyTag(t *testing.T) {
+	event := girc.ParseEvent("@msgid=abc;+draft/reply=def :wim!~wim@host PRIVMSG #test :hello")
+	assert.Equal(t, "def", replyTag(event))
+
+	event = girc.ParseEvent("@+reply=ghi :wim!~wim@host PRIVMSG #test :hello")
+	assert.Equal(t, "ghi", replyTag(event))
+
+	event = girc.ParseEvent(":wim!~wim@host PRIVMSG #test :hello")
+	assert.Equal(t, "", replyTag(event))
+}
@@ -0,0 +1,392 @@
+package bmatrix
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	lru "github.com/hashicorp/golang-lru"
+	matrix "github.com/matterbridge/gomatrix"
+)
+
+const defaultAppServiceUserPrefix = "_matterbridge_"
+
+// appService serves the application service API: the homeserver pushes the events of
+// our rooms to it (instead of us syncing them) and we send the messages of remote users
+// as virtual users in the namespace of the appservice.
+type appService struct {
+	sync.Mutex
+
+	server *http.Server
+	users  map[string]*virtualUser // by mxid
+	txns   *lru.Cache              // the transactions we already handled
+}
+
+// virtualUser is a matrix user relaying the messages of one remote user.
+type virtualUser struct {
+	sync.Mutex
+
+	client      *matrix.Client
+	registered  bool
+	displayName string
+	avatar      string // the URL of the remote avatar we uploaded
+	rooms       map[string]bool
+}
+
+func newAppService() *appService {
+	txns, _ := lru.New(1000)
+	return &appService{
+		users: make(map[string]*virtualUser),
+		txns:  txns,
+	}
+}
+
+// connectAppService connects in appservice mode, using the as_token of the registration
+// for the bot (the sender_localpart of the registration) and its virtual users.
+func (b *Bmatrix) connectAppService() error {
+	if b.GetString("MxID") == "" || b.GetString("AppServiceToken") == "" || b.GetString("AppServiceHSToken") == "" {
+		return errors.New("AppServiceListen needs MxID, AppServiceToken and AppServiceHSToken")
+	}
+	var err error
+	b.mc, err = matrix.NewClient(b.GetString("Server"), b.GetString("MxID"), b.GetString("AppServiceToken"))
+	if err != nil {
+		return err
+	}
+	b.UserID = b.GetString("MxID")
+	b.as = newAppService()
+	if b.GetBool("Encryption") {
+		b.Log.Warn("Encryption isn't supported with AppServiceListen, only unencrypted rooms are bridged")
+	}
+
+	// listen here, so we fail to connect if we can't listen
+	listener, err := net.Listen("tcp", b.GetString("AppServiceListen"))
+	if err != nil {
+		return err
+	}
+	b.as.server = &http.Server{Handler: b.appServiceHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := b.as.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			b.Log.Errorf("appservice stopped: %s", err)
+		}
+	}()
+	b.Log.Infof("Listening for appservice transactions on %s", listener.Addr())
+	return nil
+}
+
+// appServiceHandler returns the handler of the appservice API, with the legacy
+// (unprefixed) paths older homeservers use.
+func (b *Bmatrix) appServiceHandler() http.Handler {
+	mux := http.NewServeMux()
+	for _, prefix := range []string{"/_matrix/app/v1", ""} {
+		mux.HandleFunc(prefix+"/transactions/", b.handleTransaction)
+		mux.HandleFunc(prefix+"/users/", b.handleUserQuery)
+		mux.HandleFunc(prefix+"/rooms/", func(w http.ResponseWriter, r *http.Request) {
+			if b.appServiceAuthorized(w, r) {
+				appServiceError(w, http.StatusNotFound, "M_NOT_FOUND", "we don't have any rooms")
+			}
+		})
+	}
+	return mux
+}
+
+// appServiceAuthorized returns true if r is sent by the homeserver with the hs_token,
+// otherwise it replies with an error.
+func (b *Bmatrix) appServiceAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(b.GetString("AppServiceHSToken"))) != 1 {
+		appServiceError(w, http.StatusForbidden, "M_FORBIDDEN", "invalid hs_token")
+		return false
+	}
+	return true
+}
+
+func appServiceError(w http.ResponseWriter, status int, errcode, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(httpError{Errcode: errcode, Err: text}) //nolint:errcheck
+}
+
+func appServiceOK(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}")) //nolint:errcheck
+}
+
+// handleTransaction handles the events the homeserver pushes to us, like the syncer
+// does when we're not an appservice.
+func (b *Bmatrix) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	if !b.appServiceAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodPut {
+		appServiceError(w, http.StatusMethodNotAllowed, "M_UNRECOGNIZED", "use PUT")
+		return
+	}
+	txnID := path.Base(r.URL.Path)
+	// the homeserver retries transactions until we answer them
+	if b.as.txns.Contains(txnID) {
+		appServiceOK(w)
+		return
+	}
+	var txn struct {
+		Events []*matrix.Event `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		appServiceError(w, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+	for _, ev := range txn.Events {
+		switch ev.Type {
+		case "m.room.redaction", "m.room.message", "m.reaction":
+			b.handleEvent(ev)
+		case "m.room.member":
+			b.handleMemberChange(ev)
+		case "m.space.child":
+			b.handleSpaceChild(ev)
+		case "m.room.tombstone":
+			b.handleTombstone(ev)
+		}
+	}
+	b.as.txns.Add(txnID, struct{}{})
+	appServiceOK(w)
+}
+
+// handleUserQuery answers if a user in our namespace exists, registering it if needed.
+func (b *Bmatrix) handleUserQuery(w http.ResponseWriter, r *http.Request) {
+	if !b.appServiceAuthorized(w, r) {
+		return
+	}
+	mxid := path.Base(r.URL.Path)
+	if !b.isVirtualUser(mxid) {
+		appServiceError(w, http.StatusNotFound, "M_NOT_FOUND", "not one of our users")
+		return
+	}
+	u := b.as.user(b, mxid)
+	u.Lock()
+	defer u.Unlock()
+	if err := b.registerVirtualUser(u); err != nil {
+		b.Log.Errorf("registering %s failed: %s", mxid, err)
+		appServiceError(w, http.StatusNotFound, "M_NOT_FOUND", err.Error())
+		return
+	}
+	appServiceOK(w)
+}
+
+// user returns the virtual user with mxid.
+func (as *appService) user(b *Bmatrix, mxid string) *virtualUser {
+	as.Lock()
+	defer as.Unlock()
+	if u, ok := as.users[mxid]; ok {
+		return u
+	}
+	client, _ := matrix.NewClient(b.GetString("Server"), mxid, b.GetString("AppServiceToken"))
+	client.AppServiceUserID = mxid
+	u := &virtualUser{client: client, rooms: make(map[string]bool)}
+	as.users[mxid] = u
+	return u
+}
+
+// userPrefix returns the prefix of the localparts of our virtual users.
+func (b *Bmatrix) userPrefix() string {
+	if prefix := b.GetString("AppServiceUserPrefix"); prefix != "" {
+		return prefix
+	}
+	return defaultAppServiceUserPrefix
+}
+
+// serverName returns the server name of the homeserver, the one of the bot.
+func (b *Bmatrix) serverName() string {
+	return b.UserID[strings.Index(b.UserID, ":")+1:]
+}
+
+// isVirtualUser returns true if mxid is one of our virtual users.
+func (b *Bmatrix) isVirtualUser(mxid string) bool {
+	return b.as != nil && strings.HasPrefix(mxid, "@"+b.userPrefix()) && strings.HasSuffix(mxid, ":"+b.serverName())
+}
+
+// virtualUserID returns the mxid of the virtual user of the user with id on account.
+func (b *Bmatrix) virtualUserID(account, id string) string {
+	return "@" + b.userPrefix() + escapeLocalpart(account+"_"+id) + ":" + b.serverName()
+}
+
+// escapeLocalpart maps s to the characters allowed in the localpart of mxids, see
+// https://spec.matrix.org/v1.3/appendices/#mapping-from-other-character-sets
+func escapeLocalpart(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '-', c == '/':
+			sb.WriteByte(c)
+		case c >= 'A' && c <= 'Z':
+			sb.WriteByte('_')
+			sb.WriteByte(c + 'a' - 'A')
+		case c == '_':
+			sb.WriteString("__")
+		default:
+			fmt.Fprintf(&sb, "=%02x", c)
+		}
+	}
+	return sb.String()
+}
+
+// virtualUser returns the virtual user that sends msg to roomID, registering it, updating
+// its profile and joining it to roomID as needed. Returns nil if the bot sends msg.
+func (b *Bmatrix) virtualUser(msg *config.Message, roomID string) *virtualUser {
+	if b.as == nil || msg.Username == "" || roomID == "" {
+		return nil
+	}
+	// messages (and their edits) and reactions, not deletes: the bot deletes the messages
+	// of its virtual users as the users may not have the same id on every bridge
+	switch msg.Event {
+	case "", config.EventUserAction, config.EventReaction:
+	default:
+		return nil
+	}
+	id := msg.UserID
+	if id == "" {
+		id = msg.Username
+	}
+	u := b.as.user(b, b.virtualUserID(msg.Account, id))
+	u.Lock()
+	defer u.Unlock()
+	if err := b.registerVirtualUser(u); err != nil {
+		b.Log.Errorf("registering %s failed, sending as %s: %s", u.client.UserID, b.UserID, err)
+		return nil
+	}
+	b.updateVirtualUser(u, strings.TrimSpace(newMatrixUsername(msg.Username).plain), msg.Avatar)
+	if err := b.joinVirtualUser(u, roomID); err != nil {
+		b.Log.Errorf("joining %s to %s failed, sending as %s: %s", u.client.UserID, roomID, b.UserID, err)
+		return nil
+	}
+	return u
+}
+
+// registerVirtualUser registers u on the homeserver, the caller must hold the lock of u.
+func (b *Bmatrix) registerVirtualUser(u *virtualUser) error {
+	if u.registered {
+		return nil
+	}
+	req := struct {
+		Type     string `json:"type"`
+		Username string `json:"username"`
+	}{
+		Type:     "m.login.application_service",
+		Username: strings.TrimPrefix(u.client.UserID[:strings.Index(u.client.UserID, ":")], "@"),
+	}
+	err := b.retry(func() error {
+		return b.mc.MakeRequest("POST", b.mc.BuildURL("register"), req, nil)
+	})
+	if err != nil && handleError(err).Errcode != "M_USER_IN_USE" {
+		return err
+	}
+	u.registered = true
+	return nil
+}
+
+// updateVirtualUser sets the display name and avatar of u, the caller must hold the lock of u.
+func (b *Bmatrix) updateVirtualUser(u *virtualUser, displayName, avatar string) {
+	if displayName != "" && displayName != u.displayName {
+		err := b.retry(func() error {
+			return u.client.SetDisplayName(displayName)
+		})
+		if err != nil {
+			b.Log.Errorf("setting display name of %s failed: %s", u.client.UserID, err)
+		} else {
+			u.displayName = displayName
+		}
+	}
+	if avatar == "" || avatar == u.avatar {
+		return
+	}
+	data, err := helper.DownloadFile(avatar)
+	if err != nil {
+		b.Log.Errorf("downloading avatar %s failed: %s", avatar, err)
+		return
+	}
+	err = b.retry(func() error {
+		res, err := u.client.UploadToContentRepo(bytes.NewReader(*data), http.DetectContentType(*data), int64(len(*data)))
+		if err != nil {
+			return err
+		}
+		return u.client.SetAvatarURL(res.ContentURI)
+	})
+	if err != nil {
+		b.Log.Errorf("setting avatar of %s failed: %s", u.client.UserID, err)
+		return
+	}
+	u.avatar = avatar
+}
+
+// joinVirtualUser joins u to roomID, the bot invites it first in case the room is invite
+// only. The caller must hold the lock of u.
+func (b *Bmatrix) joinVirtualUser(u *virtualUser, roomID string) error {
+	if u.rooms[roomID] {
+		return nil
+	}
+	if _, err := b.mc.InviteUser(roomID, &matrix.ReqInviteUser{UserID: u.client.UserID}); err != nil {
+		// probably already in the room
+		b.Log.Debugf("inviting %s to %s failed: %s", u.client.UserID, roomID, err)
+	}
+	err := b.retry(func() error {
+		_, err := u.client.JoinRoom(roomID, "", nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	u.rooms[roomID] = true
+	return nil
+}
+
+var txnCounter uint64
+
+// eventSender sends message events as the bot or a virtual user. Virtual users send
+// them with the timestamp of the original message, when ts isn't zero. The events of
+// the bot are encrypted in encrypted rooms when e2ee is set.
+type eventSender struct {
+	mc   *matrix.Client
+	ts   time.Time
+	e2ee *encryption
+}
+
+// newTxnID returns a new transaction ID for the events we send.
+func newTxnID() string {
+	return "mb" + strconv.FormatInt(time.Now().UnixNano(), 10) + "." + strconv.FormatUint(atomic.AddUint64(&txnCounter, 1), 10)
+}
+
+func (s *eventSender) send(roomID string, content interface{}) (*matrix.RespSendEvent, error) {
+	return s.sendEvent(roomID, "m.room.message", content)
+}
+
+func (s *eventSender) sendEvent(roomID, eventType string, content interface{}) (*matrix.RespSendEvent, error) {
+	if s.e2ee != nil && s.e2ee.isEncrypted(roomID) {
+		encrypted, err := s.e2ee.encrypt(roomID, eventType, content)
+		if err != nil {
+			return nil, err
+		}
+		eventType, content = "m.room.encrypted", encrypted
+	}
+	if s.ts.IsZero() || s.mc.AppServiceUserID == "" {
+		return s.mc.SendMessageEvent(roomID, eventType, content)
+	}
+	urlPath := s.mc.BuildURLWithQuery([]string{"rooms", roomID, "send", eventType, newTxnID()},
+		map[string]string{"ts": strconv.FormatInt(s.ts.UnixNano()/int64(time.Millisecond), 10)})
+	var resp *matrix.RespSendEvent
+	err := s.mc.MakeRequest("PUT", urlPath, content, &resp)
+	return resp, err
+}
@@ -0,0 +1,162 @@
+package bmatrix
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// homeserver is a stand-in for a homeserver, recording the requests of the appservice.
+type homeserver struct {
+	sync.Mutex
+
+	requests []string
+}
+
+func (hs *homeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	hs.Lock()
+	hs.requests = append(hs.requests, r.Method+" "+r.URL.Path+" "+r.URL.RawQuery+" "+strings.TrimSpace(string(body)))
+	hs.Unlock()
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/displayname") && r.Method == http.MethodGet:
+		w.Write([]byte(`{"displayname":"Carol"}`)) //nolint:errcheck
+	case strings.Contains(r.URL.Path, "/join/"):
+		w.Write([]byte(`{"room_id":"!room:example.com"}`)) //nolint:errcheck
+	case strings.Contains(r.URL.Path, "/send/"):
+		w.Write([]byte(`{"event_id":"$sent"}`)) //nolint:errcheck
+	default:
+		w.Write([]byte(`{}`)) //nolint:errcheck
+	}
+}
+
+func (hs *homeserver) reset() []string {
+	hs.Lock()
+	defer hs.Unlock()
+	requests := hs.requests
+	hs.requests = nil
+	return requests
+}
+
+func newTestAppService(t *testing.T, server string) *Bmatrix {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	cfg := config.NewConfigFromString(logger, []byte(`
+[matrix.test]
+Server="`+server+`"
+MxID="@bot:example.com"
+AppServiceListen="127.0.0.1:0"
+AppServiceToken="as"
+AppServiceHSToken="hs"
+`))
+	b := New(&bridge.Config{
+		Bridge: &bridge.Bridge{Account: "matrix.test", Log: logrus.NewEntry(logger), Config: cfg, General: &config.Protocol{}},
+		Remote: make(chan config.Message, 10),
+	}).(*Bmatrix)
+	require.NoError(t, b.Connect())
+	b.RoomMap["!room:example.com"] = "#test"
+	return b
+}
+
+func TestEscapeLocalpart(t *testing.T) {
+	assert.Equal(t, "slack.test___u1", escapeLocalpart("slack.test_U1"))
+	assert.Equal(t, "irc=3aalice=20_bob", escapeLocalpart("irc:alice Bob"))
+}
+
+func TestAppServiceSend(t *testing.T) {
+	hs := &homeserver{}
+	server := httptest.NewServer(hs)
+	defer server.Close()
+	b := newTestAppService(t, server.URL)
+	defer b.Disconnect() //nolint:errcheck
+
+	msg := config.Message{
+		Text:      "hello",
+		Channel:   "#test",
+		Username:  "Alice",
+		UserID:    "U1",
+		Account:   "slack.test",
+		Timestamp: time.Unix(1600000000, 0),
+	}
+	id, err := b.Send(msg)
+	require.NoError(t, err)
+	assert.Equal(t, "$sent", id)
+
+	mxid := "@_matterbridge_slack.test___u1:example.com"
+	requests := hs.reset()
+	require.Len(t, requests, 5)
+	assert.Equal(t, `POST /_matrix/client/r0/register  {"type":"m.login.application_service","username":"_matterbridge_slack.test___u1"}`, requests[0])
+	assert.Equal(t, `PUT /_matrix/client/r0/profile/`+mxid+`/displayname user_id=%40_matterbridge_slack.test___u1%3Aexample.com {"displayname":"Alice"}`, requests[1])
+	assert.Equal(t, `POST /_matrix/client/r0/rooms/!room:example.com/invite  {"user_id":"`+mxid+`"}`, requests[2])
+	assert.True(t, strings.HasPrefix(requests[3], "POST /_matrix/client/r0/join/!room:example.com user_id="))
+	assert.Contains(t, requests[4], "PUT /_matrix/client/r0/rooms/!room:example.com/send/m.room.message/")
+	assert.Contains(t, requests[4], "ts=1600000000000&user_id=%40_matterbridge_slack.test___u1%3Aexample.com")
+	assert.Contains(t, requests[4], `"body":"hello"`)
+
+	// the virtual user is set up once
+	_, err = b.Send(msg)
+	require.NoError(t, err)
+	assert.Len(t, hs.reset(), 1)
+
+	// events are sent by the bot
+	msg.Event = config.EventJoinLeave
+	msg.Text = "bob joins"
+	_, err = b.Send(msg)
+	require.NoError(t, err)
+	requests = hs.reset()
+	require.Len(t, requests, 1)
+	assert.NotContains(t, requests[0], "user_id=")
+	assert.Contains(t, requests[0], `"body":"Alicebob joins"`)
+}
+
+func TestAppServiceTransaction(t *testing.T) {
+	hs := &homeserver{}
+	server := httptest.NewServer(hs)
+	defer server.Close()
+	b := newTestAppService(t, server.URL)
+	defer b.Disconnect() //nolint:errcheck
+	handler := b.appServiceHandler()
+
+	put := func(path, token string, events ...map[string]interface{}) int {
+		body, _ := json.Marshal(map[string]interface{}{"events": events})
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(string(body)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	event := func(sender, text string) map[string]interface{} {
+		return map[string]interface{}{
+			"type":             "m.room.message",
+			"sender":           sender,
+			"room_id":          "!room:example.com",
+			"event_id":         "$" + text,
+			"origin_server_ts": 1600000000000,
+			"content":          map[string]interface{}{"msgtype": "m.text", "body": text},
+		}
+	}
+
+	assert.Equal(t, http.StatusForbidden, put("/_matrix/app/v1/transactions/1", "wrong", event("@carol:example.com", "hi")))
+	assert.Equal(t, http.StatusOK, put("/_matrix/app/v1/transactions/1", "hs",
+		event("@_matterbridge_slack.test___u1:example.com", "echo"), event("@carol:example.com", "hi")))
+	// retried transactions are handled once
+	assert.Equal(t, http.StatusOK, put("/transactions/1", "hs", event("@carol:example.com", "hi")))
+
+	require.Len(t, b.Remote, 1)
+	msg := <-b.Remote
+	assert.Equal(t, "hi", msg.Text)
+	assert.Equal(t, "Carol", msg.Username)
+	assert.Equal(t, "#test", msg.Channel)
+	assert.Equal(t, time.Unix(1600000000, 0), msg.Timestamp)
+}
@@ -0,0 +1,1056 @@
+package bmatrix
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/matrix/olm"
+	lru "github.com/hashicorp/golang-lru"
+	matrix "github.com/matterbridge/gomatrix"
+)
+
+const (
+	olmAlgorithm    = "m.olm.v1.curve25519-aes-sha2"
+	megolmAlgorithm = "m.megolm.v1.aes-sha2"
+	// like the clients we rotate our room sessions after 100 messages or a week
+	megolmRotationMessages = 100
+	megolmRotationPeriod   = 7 * 24 * time.Hour
+	// maxPendingEvents is the number of events per session we keep until their key arrives
+	maxPendingEvents = 50
+)
+
+var errUnknownSession = errors.New("the key of the session hasn't been shared with us")
+
+// cryptoState is what we persist in the CryptoStore.
+type cryptoState struct {
+	DeviceID   string                           `json:"device_id"`
+	Account    *olm.Account                     `json:"account"`
+	Sessions   map[string][]*olm.Session        `json:"sessions"`    // by the curve25519 key of the other device
+	Inbound    map[string]*inboundGroupSession  `json:"inbound"`     // by inboundKey
+	Outbound   map[string]*outboundGroupSession `json:"outbound"`    // by room
+	MasterKeys map[string]string                `json:"master_keys"` // the cross-signing keys we trust, by user
+}
+
+// inboundGroupSession is a session others encrypt their messages in a room with.
+type inboundGroupSession struct {
+	Session *olm.InboundGroupSession `json:"session"`
+	UserID  string                   `json:"user_id"`
+	// Decrypted are the events we decrypted, by message index, so a message can't be
+	// replayed in another event.
+	Decrypted map[uint32]decryptedEvent `json:"decrypted,omitempty"`
+}
+
+// decryptedEvent identifies the event a message index of an inbound session was used in.
+type decryptedEvent struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"ts"`
+}
+
+// outboundGroupSession is the session we encrypt our messages in a room with.
+type outboundGroupSession struct {
+	Session    *olm.OutboundGroupSession `json:"session"`
+	Created    time.Time                 `json:"created"`
+	Messages   int                       `json:"messages"`
+	SharedWith map[string]bool           `json:"shared_with"` // by user and device ID
+}
+
+// deviceKeys are the keys of a device as published on the homeserver.
+type deviceKeys struct {
+	UserID     string                       `json:"user_id"`
+	DeviceID   string                       `json:"device_id"`
+	Algorithms []string                     `json:"algorithms"`
+	Keys       map[string]string            `json:"keys"`
+	Signatures map[string]map[string]string `json:"signatures,omitempty"`
+}
+
+// crossSigningKey is a master or self-signing key of a user.
+type crossSigningKey struct {
+	UserID     string                       `json:"user_id"`
+	Usage      []string                     `json:"usage"`
+	Keys       map[string]string            `json:"keys"`
+	Signatures map[string]map[string]string `json:"signatures,omitempty"`
+}
+
+// device is a device of a user in an encrypted room.
+type device struct {
+	userID      string
+	deviceID    string
+	curve25519  string
+	ed25519     string
+	crossSigned bool // signed by the self-signing key of its user
+}
+
+// megolmContent is the content of room messages encrypted with Megolm.
+type megolmContent struct {
+	Algorithm  string      `json:"algorithm"`
+	SenderKey  string      `json:"sender_key"`
+	Ciphertext string      `json:"ciphertext"`
+	SessionID  string      `json:"session_id"`
+	DeviceID   string      `json:"device_id"`
+	RelatesTo  interface{} `json:"m.relates_to,omitempty"`
+}
+
+// olmContent is the content of to-device messages encrypted with Olm.
+type olmContent struct {
+	Algorithm  string                `json:"algorithm"`
+	SenderKey  string                `json:"sender_key"`
+	Ciphertext map[string]olmMessage `json:"ciphertext"` // by the curve25519 key of the recipient
+}
+
+type olmMessage struct {
+	Type int    `json:"type"`
+	Body string `json:"body"`
+}
+
+// toDevicePayload is the decrypted payload of an Olm to-device message.
+type toDevicePayload struct {
+	Type          string            `json:"type"`
+	Sender        string            `json:"sender"`
+	Keys          map[string]string `json:"keys"`
+	Recipient     string            `json:"recipient"`
+	RecipientKeys map[string]string `json:"recipient_keys"`
+	Content       json.RawMessage   `json:"content"`
+}
+
+// roomKey is the content of the m.room_key to-device messages sharing a Megolm session.
+type roomKey struct {
+	Algorithm  string `json:"algorithm"`
+	RoomID     string `json:"room_id"`
+	SessionID  string `json:"session_id"`
+	SessionKey string `json:"session_key"`
+}
+
+// syncResponse is a /sync response with the parts needed for encryption gomatrix doesn't parse.
+type syncResponse struct {
+	matrix.RespSync
+	ToDevice struct {
+		Events []matrix.Event `json:"events"`
+	} `json:"to_device"`
+	DeviceLists struct {
+		Changed []string `json:"changed"`
+		Left    []string `json:"left"`
+	} `json:"device_lists"`
+	DeviceOneTimeKeysCount map[string]int `json:"device_one_time_keys_count"`
+}
+
+// encryption handles the end-to-end encryption of the rooms we're in. The keys and sessions
+// are persisted in the CryptoStore.
+type encryption struct {
+	sync.Mutex
+	// sendMutex sends one message at a time, so the session of a room is shared once. The
+	// Mutex isn't held during the requests to share it, which would stall the sync loop.
+	sendMutex sync.Mutex
+
+	b         *Bmatrix
+	file      string
+	state     cryptoState
+	encrypted map[string]bool               // the rooms with encryption enabled
+	devices   map[string]map[string]*device // the devices of users, by user and device ID
+	pending   *lru.Cache                    // the events waiting for their session key, by session ID
+}
+
+func newEncryption(b *Bmatrix) (*encryption, error) {
+	e := &encryption{
+		b:         b,
+		file:      b.GetString("CryptoStore"),
+		encrypted: make(map[string]bool),
+		devices:   make(map[string]map[string]*device),
+	}
+	e.pending, _ = lru.New(100)
+	if e.file == "" {
+		b.Log.Warn("CryptoStore isn't set, the encryption keys are lost on restart")
+		return e, nil
+	}
+	data, err := ioutil.ReadFile(e.file)
+	if os.IsNotExist(err) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &e.state); err != nil {
+		return nil, fmt.Errorf("parsing CryptoStore %s failed: %w", e.file, err)
+	}
+	return e, nil
+}
+
+// deviceID returns the device ID of the stored keys, so we log in as the same device.
+func (e *encryption) deviceID() string {
+	if e == nil {
+		return ""
+	}
+	return e.state.DeviceID
+}
+
+// setup publishes the keys of our device deviceID, creating new ones if needed.
+func (e *encryption) setup(deviceID string) error {
+	e.Lock()
+	defer e.Unlock()
+	newDevice := e.state.Account == nil || e.state.DeviceID != deviceID
+	if newDevice {
+		if e.state.Account != nil {
+			e.b.Log.Warnf("CryptoStore has the keys of device %s, creating new keys for device %s", e.state.DeviceID, deviceID)
+		}
+		account, err := olm.NewAccount()
+		if err != nil {
+			return err
+		}
+		e.state = cryptoState{DeviceID: deviceID, Account: account}
+	}
+	if e.state.Sessions == nil {
+		e.state.Sessions = make(map[string][]*olm.Session)
+	}
+	if e.state.Inbound == nil {
+		e.state.Inbound = make(map[string]*inboundGroupSession)
+	}
+	if e.state.Outbound == nil {
+		e.state.Outbound = make(map[string]*outboundGroupSession)
+	}
+	if e.state.MasterKeys == nil {
+		e.state.MasterKeys = make(map[string]string)
+	}
+
+	count, err := e.uploadKeys(newDevice)
+	if err != nil {
+		return fmt.Errorf("uploading the keys of device %s failed: %w", deviceID, err)
+	}
+	e.b.Log.Infof("Using device %s with key %s for encryption", deviceID, e.state.Account.Ed25519Key())
+	return e.replenishOneTimeKeys(count)
+}
+
+// uploadKeys uploads our device keys (if device is set) and the unpublished one-time keys and
+// returns the number of one-time keys the homeserver has. The caller must hold the lock.
+func (e *encryption) uploadKeys(device bool) (int, error) {
+	account := e.state.Account
+	req := make(map[string]interface{})
+	if device {
+		keys := &deviceKeys{
+			UserID:     e.b.UserID,
+			DeviceID:   e.state.DeviceID,
+			Algorithms: []string{olmAlgorithm, megolmAlgorithm},
+			Keys: map[string]string{
+				"curve25519:" + e.state.DeviceID: account.Curve25519Key(),
+				"ed25519:" + e.state.DeviceID:    account.Ed25519Key(),
+			},
+		}
+		signatures, err := e.sign(keys)
+		if err != nil {
+			return 0, err
+		}
+		keys.Signatures = signatures
+		req["device_keys"] = keys
+	}
+	oneTimeKeys := make(map[string]interface{})
+	for id, key := range account.UnpublishedOneTimeKeys() {
+		signatures, err := e.sign(map[string]string{"key": key})
+		if err != nil {
+			return 0, err
+		}
+		oneTimeKeys["signed_curve25519:"+id] = map[string]interface{}{"key": key, "signatures": signatures}
+	}
+	req["one_time_keys"] = oneTimeKeys
+
+	var resp struct {
+		OneTimeKeyCounts map[string]int `json:"one_time_key_counts"`
+	}
+	if err := e.b.mc.MakeRequest("POST", e.b.mc.BuildURL("keys", "upload"), req, &resp); err != nil {
+		return 0, err
+	}
+	account.MarkKeysAsPublished()
+	e.save()
+	return resp.OneTimeKeyCounts["signed_curve25519"], nil
+}
+
+// replenishOneTimeKeys makes sure the homeserver, which has count of our one-time keys, has
+// half of the keys we can keep. The caller must hold the lock.
+func (e *encryption) replenishOneTimeKeys(count int) error {
+	target := olm.MaxOneTimeKeys / 2
+	if count >= target {
+		return nil
+	}
+	if err := e.state.Account.GenerateOneTimeKeys(target - count); err != nil {
+		return err
+	}
+	_, err := e.uploadKeys(false)
+	return err
+}
+
+// sign returns the signatures of v by our device.
+func (e *encryption) sign(v interface{}) (map[string]map[string]string, error) {
+	data, err := canonicalJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]map[string]string{
+		e.b.UserID: {"ed25519:" + e.state.DeviceID: e.state.Account.Sign(data)},
+	}, nil
+}
+
+// canonicalJSON returns the canonical JSON of v without its signatures and unsigned
+// fields, which is what is signed in matrix.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+	delete(m, "signatures")
+	delete(m, "unsigned")
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(m); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// verifySignature checks the signature of v by the ed25519 key of userID with keyID.
+func verifySignature(v interface{}, signatures map[string]map[string]string, userID, keyID, key string) error {
+	signature, ok := signatures[userID]["ed25519:"+keyID]
+	if !ok {
+		return fmt.Errorf("not signed by %s of %s", keyID, userID)
+	}
+	data, err := canonicalJSON(v)
+	if err != nil {
+		return err
+	}
+	publicKey, err := olm.DecodeBase64(key)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid key %s", key)
+	}
+	sig, err := olm.DecodeBase64(signature)
+	if err != nil || !ed25519.Verify(publicKey, data, sig) {
+		return fmt.Errorf("invalid signature by %s of %s", keyID, userID)
+	}
+	return nil
+}
+
+// save writes the CryptoStore, the caller must hold the lock.
+func (e *encryption) save() {
+	if e.file == "" {
+		return
+	}
+	data, err := json.Marshal(e.state)
+	if err != nil {
+		e.b.Log.Errorf("encoding the CryptoStore failed: %s", err)
+		return
+	}
+	// write to a temporary file (only readable by us) first so we never leave a truncated file behind
+	tmp, err := ioutil.TempFile(filepath.Dir(e.file), filepath.Base(e.file)+".*")
+	if err != nil {
+		e.b.Log.Errorf("writing the CryptoStore failed: %s", err)
+		return
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		e.b.Log.Errorf("writing the CryptoStore failed: %s", err)
+		return
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), e.file); err != nil {
+		os.Remove(tmp.Name())
+		e.b.Log.Errorf("writing the CryptoStore failed: %s", err)
+	}
+}
+
+// isEncrypted returns true if encryption is enabled in roomID.
+func (e *encryption) isEncrypted(roomID string) bool {
+	e.Lock()
+	defer e.Unlock()
+	return e.encrypted[roomID]
+}
+
+// setEncrypted records that encryption is enabled in roomID.
+func (e *encryption) setEncrypted(roomID string) {
+	e.Lock()
+	defer e.Unlock()
+	e.encrypted[roomID] = true
+}
+
+// discardOutbound makes us use a new session in roomID, so members who left can't decrypt
+// the new messages.
+func (e *encryption) discardOutbound(roomID string) {
+	e.Lock()
+	defer e.Unlock()
+	if _, ok := e.state.Outbound[roomID]; ok {
+		delete(e.state.Outbound, roomID)
+		e.save()
+	}
+}
+
+// encrypt returns content of eventType encrypted for roomID, after sharing the key of
+// the session with the devices in the room.
+func (e *encryption) encrypt(roomID, eventType string, content interface{}) (interface{}, error) {
+	e.sendMutex.Lock()
+	defer e.sendMutex.Unlock()
+	out, err := e.outboundSession(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.shareSession(roomID, out); err != nil {
+		return nil, fmt.Errorf("sharing the room key failed: %w", err)
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	plaintext, err := json.Marshal(map[string]interface{}{"type": eventType, "content": content, "room_id": roomID})
+	if err != nil {
+		return nil, err
+	}
+	encrypted := &megolmContent{
+		Algorithm:  megolmAlgorithm,
+		SenderKey:  e.state.Account.Curve25519Key(),
+		Ciphertext: out.Session.Encrypt(plaintext),
+		SessionID:  out.Session.ID(),
+		DeviceID:   e.state.DeviceID,
+	}
+	out.Messages++
+	e.save()
+
+	// relations stay readable for the homeserver to aggregate edits, threads and reactions
+	var relation struct {
+		RelatesTo interface{} `json:"m.relates_to"`
+	}
+	if interface2Struct(content, &relation) == nil {
+		encrypted.RelatesTo = relation.RelatesTo
+	}
+	return encrypted, nil
+}
+
+// outboundSession returns the session we encrypt our messages in roomID with, a new one
+// when it's time to rotate it.
+func (e *encryption) outboundSession(roomID string) (*outboundGroupSession, error) {
+	e.Lock()
+	defer e.Unlock()
+	out := e.state.Outbound[roomID]
+	if out == nil || out.Messages >= megolmRotationMessages || time.Since(out.Created) > megolmRotationPeriod {
+		s, err := olm.NewOutboundGroupSession()
+		if err != nil {
+			return nil, err
+		}
+		out = &outboundGroupSession{Session: s, Created: time.Now(), SharedWith: make(map[string]bool)}
+		e.state.Outbound[roomID] = out
+	}
+	return out, nil
+}
+
+// shareSession sends the key of out to the devices in roomID that don't have it yet, only
+// verified devices unless EncryptionUnverified is set. The caller must hold sendMutex, but
+// not the lock.
+func (e *encryption) shareSession(roomID string, out *outboundGroupSession) error {
+	members, err := e.b.mc.JoinedMembers(roomID)
+	if err != nil {
+		return err
+	}
+	var users []string
+	for user := range members.Joined {
+		users = append(users, user)
+	}
+	if err := e.queryDevices(users); err != nil {
+		return err
+	}
+
+	targets := e.shareTargets(users, out)
+	if len(targets) == 0 {
+		return nil
+	}
+	if err := e.claimSessions(targets); err != nil {
+		return err
+	}
+	messages, err := e.roomKeyMessages(roomID, out, targets)
+	if err != nil || len(messages) == 0 {
+		return err
+	}
+	urlPath := e.b.mc.BuildURL("sendToDevice", "m.room.encrypted", newTxnID())
+	if err := e.b.mc.MakeRequest("PUT", urlPath, map[string]interface{}{"messages": messages}, nil); err != nil {
+		return err
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	for user, devices := range messages {
+		for id := range devices {
+			out.SharedWith[user+"|"+id] = true
+		}
+	}
+	e.save()
+	return nil
+}
+
+// shareTargets returns the devices of users the key of out should be shared with.
+func (e *encryption) shareTargets(users []string, out *outboundGroupSession) []*device {
+	e.Lock()
+	defer e.Unlock()
+	var targets []*device
+	for _, user := range users {
+		for _, d := range e.devices[user] {
+			if user == e.b.UserID && d.deviceID == e.state.DeviceID || out.SharedWith[d.userID+"|"+d.deviceID] {
+				continue
+			}
+			if !d.crossSigned && !e.b.GetBool("EncryptionUnverified") {
+				continue
+			}
+			targets = append(targets, d)
+		}
+	}
+	return targets
+}
+
+// roomKeyMessages returns the to-device messages sharing the key of out with the targets
+// we have a session with, by user and device ID.
+func (e *encryption) roomKeyMessages(roomID string, out *outboundGroupSession, targets []*device) (map[string]map[string]interface{}, error) {
+	e.Lock()
+	defer e.Unlock()
+	key := roomKey{Algorithm: megolmAlgorithm, RoomID: roomID, SessionID: out.Session.ID(), SessionKey: out.Session.SessionKey()}
+	messages := make(map[string]map[string]interface{})
+	for _, d := range targets {
+		sessions := e.state.Sessions[d.curve25519]
+		if len(sessions) == 0 {
+			continue
+		}
+		content, err := e.encryptOlm(sessions[len(sessions)-1], d, "m.room_key", key)
+		if err != nil {
+			return nil, err
+		}
+		if messages[d.userID] == nil {
+			messages[d.userID] = make(map[string]interface{})
+		}
+		messages[d.userID][d.deviceID] = content
+	}
+	// the Olm sessions advanced
+	e.save()
+	return messages, nil
+}
+
+// encryptOlm returns the to-device message of eventType with content encrypted for d with
+// s. The caller must hold the lock.
+func (e *encryption) encryptOlm(s *olm.Session, d *device, eventType string, content interface{}) (*olmContent, error) {
+	plaintext, err := json.Marshal(map[string]interface{}{
+		"type":           eventType,
+		"content":        content,
+		"sender":         e.b.UserID,
+		"sender_device":  e.state.DeviceID,
+		"keys":           map[string]string{"ed25519": e.state.Account.Ed25519Key()},
+		"recipient":      d.userID,
+		"recipient_keys": map[string]string{"ed25519": d.ed25519},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgType, body, err := s.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &olmContent{
+		Algorithm:  olmAlgorithm,
+		SenderKey:  e.state.Account.Curve25519Key(),
+		Ciphertext: map[string]olmMessage{d.curve25519: {Type: msgType, Body: body}},
+	}, nil
+}
+
+// queryDevices fetches the devices of the users we don't know yet. The caller must not
+// hold the lock.
+func (e *encryption) queryDevices(users []string) error {
+	e.Lock()
+	query := make(map[string][]string)
+	for _, user := range users {
+		if _, ok := e.devices[user]; !ok {
+			query[user] = []string{}
+		}
+	}
+	e.Unlock()
+	if len(query) == 0 {
+		return nil
+	}
+	var resp struct {
+		DeviceKeys      map[string]map[string]json.RawMessage `json:"device_keys"`
+		MasterKeys      map[string]json.RawMessage            `json:"master_keys"`
+		SelfSigningKeys map[string]json.RawMessage            `json:"self_signing_keys"`
+	}
+	req := map[string]interface{}{"device_keys": query, "timeout": 10000}
+	if err := e.b.mc.MakeRequest("POST", e.b.mc.BuildURL("keys", "query"), req, &resp); err != nil {
+		return err
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	for user := range query {
+		selfSigningKey := e.selfSigningKey(user, resp.MasterKeys[user], resp.SelfSigningKeys[user])
+		devices := make(map[string]*device)
+		for id, raw := range resp.DeviceKeys[user] {
+			d, err := parseDevice(user, id, raw, selfSigningKey)
+			if err != nil {
+				e.b.Log.Warnf("Ignoring device %s of %s: %s", id, user, err)
+				continue
+			}
+			devices[id] = d
+		}
+		e.devices[user] = devices
+	}
+	return nil
+}
+
+// selfSigningKey returns the self-signing key of user if it's signed by the master key we
+// trust, the first master key we've seen of the user. The caller must hold the lock.
+func (e *encryption) selfSigningKey(user string, masterRaw, selfSigningRaw json.RawMessage) string {
+	if masterRaw == nil || selfSigningRaw == nil {
+		return ""
+	}
+	var master, selfSigning crossSigningKey
+	if json.Unmarshal(masterRaw, &master) != nil || json.Unmarshal(selfSigningRaw, &selfSigning) != nil {
+		return ""
+	}
+	masterKey, selfSigningKey := firstKey(master.Keys), firstKey(selfSigning.Keys)
+	trusted, ok := e.state.MasterKeys[user]
+	switch {
+	case !ok:
+		e.state.MasterKeys[user] = masterKey
+		e.save()
+	case trusted != masterKey:
+		e.b.Log.Warnf("The master key of %s changed, not trusting its devices", user)
+		return ""
+	}
+	if err := verifySignature(selfSigningRaw, selfSigning.Signatures, user, masterKey, masterKey); err != nil {
+		e.b.Log.Warnf("Ignoring the self-signing key of %s: %s", user, err)
+		return ""
+	}
+	return selfSigningKey
+}
+
+// firstKey returns one of keys, cross-signing keys have a single key.
+func firstKey(keys map[string]string) string {
+	for _, key := range keys {
+		return key
+	}
+	return ""
+}
+
+// parseDevice returns the device with the keys raw, which must be signed by the device.
+func parseDevice(user, id string, raw json.RawMessage, selfSigningKey string) (*device, error) {
+	var keys deviceKeys
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		return nil, err
+	}
+	d := &device{
+		userID:     user,
+		deviceID:   id,
+		curve25519: keys.Keys["curve25519:"+id],
+		ed25519:    keys.Keys["ed25519:"+id],
+	}
+	if keys.UserID != user || keys.DeviceID != id || d.curve25519 == "" || d.ed25519 == "" {
+		return nil, errors.New("invalid device keys")
+	}
+	if err := verifySignature(raw, keys.Signatures, user, id, d.ed25519); err != nil {
+		return nil, err
+	}
+	d.crossSigned = selfSigningKey != "" && verifySignature(raw, keys.Signatures, user, selfSigningKey, selfSigningKey) == nil
+	return d, nil
+}
+
+// claimSessions sets up Olm sessions with the devices we don't have a session with yet,
+// by claiming one of their one-time keys. The caller must not hold the lock.
+func (e *encryption) claimSessions(devices []*device) error {
+	e.Lock()
+	claim := make(map[string]map[string]string)
+	byKey := make(map[string]*device)
+	for _, d := range devices {
+		if len(e.state.Sessions[d.curve25519]) > 0 {
+			continue
+		}
+		if claim[d.userID] == nil {
+			claim[d.userID] = make(map[string]string)
+		}
+		claim[d.userID][d.deviceID] = "signed_curve25519"
+		byKey[d.userID+"|"+d.deviceID] = d
+	}
+	e.Unlock()
+	if len(claim) == 0 {
+		return nil
+	}
+	var resp struct {
+		OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+	}
+	req := map[string]interface{}{"one_time_keys": claim, "timeout": 10000}
+	if err := e.b.mc.MakeRequest("POST", e.b.mc.BuildURL("keys", "claim"), req, &resp); err != nil {
+		return err
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	for user, devices := range resp.OneTimeKeys {
+		for id, keys := range devices {
+			d, ok := byKey[user+"|"+id]
+			if !ok {
+				continue
+			}
+			for _, raw := range keys {
+				var key struct {
+					Key        string                       `json:"key"`
+					Signatures map[string]map[string]string `json:"signatures"`
+				}
+				if err := json.Unmarshal(raw, &key); err != nil {
+					continue
+				}
+				if err := verifySignature(raw, key.Signatures, user, id, d.ed25519); err != nil {
+					e.b.Log.Warnf("Ignoring the one-time key of device %s of %s: %s", id, user, err)
+					continue
+				}
+				s, err := e.state.Account.NewOutboundSession(d.curve25519, key.Key)
+				if err != nil {
+					e.b.Log.Warnf("Setting up a session with device %s of %s failed: %s", id, user, err)
+					continue
+				}
+				e.state.Sessions[d.curve25519] = append(e.state.Sessions[d.curve25519], s)
+			}
+		}
+	}
+	return nil
+}
+
+// inboundKey returns the key of an inbound session in cryptoState.Inbound.
+func inboundKey(roomID, senderKey, sessionID string) string {
+	return roomID + "|" + senderKey + "|" + sessionID
+}
+
+// decryptEvent returns the decrypted event of the encrypted room event ev. Events of
+// sessions we don't have the key of yet are kept until handleToDevice receives it.
+func (e *encryption) decryptEvent(ev *matrix.Event) (*matrix.Event, error) {
+	var content megolmContent
+	if err := interface2Struct(ev.Content, &content); err != nil {
+		return nil, err
+	}
+	if content.Algorithm != megolmAlgorithm {
+		return nil, fmt.Errorf("unsupported algorithm %s", content.Algorithm)
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	s, ok := e.state.Inbound[inboundKey(ev.RoomID, content.SenderKey, content.SessionID)]
+	if !ok {
+		var pending []*matrix.Event
+		if v, ok := e.pending.Get(content.SessionID); ok {
+			pending = v.([]*matrix.Event)
+		}
+		if len(pending) < maxPendingEvents {
+			e.pending.Add(content.SessionID, append(pending, ev))
+		}
+		return nil, errUnknownSession
+	}
+	if s.UserID != ev.Sender {
+		return nil, fmt.Errorf("session of %s used by %s", s.UserID, ev.Sender)
+	}
+	plaintext, index, err := s.Session.Decrypt(content.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	used := decryptedEvent{ID: ev.ID, Timestamp: ev.Timestamp}
+	if first, ok := s.Decrypted[index]; ok && first != used {
+		return nil, fmt.Errorf("message %d of session %s was already used in %s", index, content.SessionID, first.ID)
+	} else if !ok {
+		if s.Decrypted == nil {
+			s.Decrypted = make(map[uint32]decryptedEvent)
+		}
+		s.Decrypted[index] = used
+		e.save()
+	}
+
+	var payload struct {
+		Type    string                 `json:"type"`
+		Content map[string]interface{} `json:"content"`
+		RoomID  string                 `json:"room_id"`
+	}
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, err
+	}
+	if payload.RoomID != ev.RoomID {
+		return nil, fmt.Errorf("event encrypted for room %s", payload.RoomID)
+	}
+	decrypted := *ev
+	decrypted.Type = payload.Type
+	decrypted.Content = payload.Content
+	if decrypted.Content == nil {
+		decrypted.Content = make(map[string]interface{})
+	}
+	if _, ok := decrypted.Content["m.relates_to"]; !ok && content.RelatesTo != nil {
+		decrypted.Content["m.relates_to"] = content.RelatesTo
+	}
+	return &decrypted, nil
+}
+
+// handleToDevice handles the (encrypted) to-device event ev and returns the pending events
+// we can decrypt now.
+func (e *encryption) handleToDevice(ev *matrix.Event) []*matrix.Event {
+	if ev.Type != "m.room.encrypted" {
+		return nil
+	}
+	var content olmContent
+	if err := interface2Struct(ev.Content, &content); err != nil || content.Algorithm != olmAlgorithm {
+		return nil
+	}
+	payload := e.decryptToDevice(ev, &content)
+	if payload == nil || payload.Type != "m.room_key" {
+		return nil
+	}
+	var key roomKey
+	if err := json.Unmarshal(payload.Content, &key); err != nil || key.Algorithm != megolmAlgorithm {
+		return nil
+	}
+	s, err := olm.NewInboundGroupSession(key.SessionKey)
+	if err != nil || s.ID() != key.SessionID {
+		e.b.Log.Warnf("Ignoring an invalid room key from %s", ev.Sender)
+		return nil
+	}
+	if err := e.queryDevices([]string{ev.Sender}); err != nil {
+		e.b.Log.Warnf("Ignoring the key of session %s from %s, fetching their devices failed: %s", key.SessionID, ev.Sender, err)
+		return nil
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	if err := e.checkSender(ev.Sender, content.SenderKey, payload.Keys["ed25519"]); err != nil {
+		e.b.Log.Warnf("Ignoring the key of session %s from %s: %s", key.SessionID, ev.Sender, err)
+		return nil
+	}
+	k := inboundKey(key.RoomID, content.SenderKey, key.SessionID)
+	if old, ok := e.state.Inbound[k]; ok && old.Session.FirstKnownIndex() <= s.FirstKnownIndex() {
+		return nil
+	}
+	e.b.Log.Debugf("Received the key of session %s in %s from %s", key.SessionID, key.RoomID, ev.Sender)
+	e.state.Inbound[k] = &inboundGroupSession{Session: s, UserID: ev.Sender}
+	e.save()
+
+	pending, ok := e.pending.Get(key.SessionID)
+	if !ok {
+		return nil
+	}
+	e.pending.Remove(key.SessionID)
+	return pending.([]*matrix.Event)
+}
+
+// decryptToDevice returns the decrypted payload of the to-device event ev with content,
+// or nil if it can't be decrypted or wasn't meant for us.
+func (e *encryption) decryptToDevice(ev *matrix.Event, content *olmContent) *toDevicePayload {
+	e.Lock()
+	defer e.Unlock()
+	msg, ok := content.Ciphertext[e.state.Account.Curve25519Key()]
+	if !ok {
+		return nil
+	}
+	plaintext, err := e.decryptOlm(content.SenderKey, msg)
+	if err != nil {
+		e.b.Log.Warnf("Decrypting a to-device message from %s failed: %s", ev.Sender, err)
+		return nil
+	}
+	var payload toDevicePayload
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil
+	}
+	if payload.Sender != ev.Sender || payload.Recipient != e.b.UserID || payload.RecipientKeys["ed25519"] != e.state.Account.Ed25519Key() {
+		e.b.Log.Warnf("Ignoring a to-device message from %s that wasn't meant for us", ev.Sender)
+		return nil
+	}
+	return &payload
+}
+
+// checkSender checks that the curve25519 and ed25519 key of a message from user belong
+// to one of their devices, which must be verified unless EncryptionUnverified is set, so
+// the homeserver can't pass off keys of its own as theirs. The caller must hold the lock.
+func (e *encryption) checkSender(user, curve25519, ed25519 string) error {
+	for _, d := range e.devices[user] {
+		if d.curve25519 != curve25519 {
+			continue
+		}
+		if d.ed25519 != ed25519 {
+			return fmt.Errorf("the keys don't match device %s", d.deviceID)
+		}
+		if !d.crossSigned && !e.b.GetBool("EncryptionUnverified") {
+			return fmt.Errorf("device %s isn't verified", d.deviceID)
+		}
+		return nil
+	}
+	return errors.New("unknown device")
+}
+
+// decryptOlm decrypts msg of the device with senderKey, setting up a new session for new
+// pre-key messages. The caller must hold the lock.
+func (e *encryption) decryptOlm(senderKey string, msg olmMessage) ([]byte, error) {
+	for _, s := range e.state.Sessions[senderKey] {
+		if msg.Type == olm.MessageTypePreKey && !s.MatchesInbound(msg.Body) {
+			continue
+		}
+		plaintext, err := s.Decrypt(msg.Type, msg.Body)
+		if err == nil {
+			e.save()
+			return plaintext, nil
+		}
+		if msg.Type == olm.MessageTypePreKey {
+			return nil, err
+		}
+	}
+	if msg.Type != olm.MessageTypePreKey {
+		return nil, errors.New("no session to decrypt the message")
+	}
+
+	s, err := e.state.Account.NewInboundSession(senderKey, msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := s.Decrypt(msg.Type, msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	e.state.Account.RemoveOneTimeKeys(s)
+	e.state.Sessions[senderKey] = append(e.state.Sessions[senderKey], s)
+	e.save()
+	return plaintext, nil
+}
+
+// handleSync handles the encryption parts of the sync resp and returns the pending events
+// we can decrypt now.
+func (e *encryption) handleSync(resp *syncResponse) []*matrix.Event {
+	// the devices are fetched again when needed, also by the to-device messages below
+	e.Lock()
+	for _, user := range append(resp.DeviceLists.Changed, resp.DeviceLists.Left...) {
+		delete(e.devices, user)
+	}
+	e.Unlock()
+
+	var events []*matrix.Event
+	for i := range resp.ToDevice.Events {
+		events = append(events, e.handleToDevice(&resp.ToDevice.Events[i])...)
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	if count, ok := resp.DeviceOneTimeKeysCount["signed_curve25519"]; ok {
+		if err := e.replenishOneTimeKeys(count); err != nil {
+			e.b.Log.Errorf("Uploading one-time keys failed: %s", err)
+		}
+	}
+	return events
+}
+
+// setupEncryption loads the CryptoStore, before we log in so we use the same device.
+func (b *Bmatrix) setupEncryption() error {
+	if !b.GetBool("Encryption") {
+		return nil
+	}
+	e, err := newEncryption(b)
+	if err != nil {
+		return err
+	}
+	b.e2ee = e
+	return nil
+}
+
+// startEncryption publishes the keys of our device deviceID, or of the device of our
+// access token if it's empty.
+func (b *Bmatrix) startEncryption(deviceID string) error {
+	if b.e2ee == nil {
+		return nil
+	}
+	if deviceID == "" {
+		var resp struct {
+			DeviceID string `json:"device_id"`
+		}
+		if err := b.mc.MakeRequest("GET", b.mc.BuildURL("account", "whoami"), nil, &resp); err != nil {
+			return err
+		}
+		if resp.DeviceID == "" {
+			return errors.New("the homeserver didn't return the device of Token, which is needed for encryption")
+		}
+		deviceID = resp.DeviceID
+	}
+	return b.e2ee.setup(deviceID)
+}
+
+// checkEncrypted records if encryption is enabled in roomID, for when we joined the room
+// before the current sync.
+func (b *Bmatrix) checkEncrypted(roomID string) {
+	if b.e2ee == nil {
+		return
+	}
+	var content struct {
+		Algorithm string `json:"algorithm"`
+	}
+	if err := b.mc.StateEvent(roomID, "m.room.encryption", "", &content); err == nil && content.Algorithm != "" {
+		b.e2ee.setEncrypted(roomID)
+	}
+}
+
+// handleEncrypted relays the encrypted room event ev.
+func (b *Bmatrix) handleEncrypted(ev *matrix.Event) {
+	if ev.Sender == b.UserID {
+		return
+	}
+	decrypted, err := b.e2ee.decryptEvent(ev)
+	if errors.Is(err, errUnknownSession) {
+		b.Log.Debugf("Waiting for the key to decrypt %s", ev.ID)
+		return
+	}
+	if err != nil {
+		b.Log.Errorf("Decrypting %s failed: %s", ev.ID, err)
+		return
+	}
+	switch decrypted.Type {
+	case "m.room.message", "m.reaction":
+		b.handleEvent(decrypted)
+	}
+}
+
+// syncEncrypted works like Client.Sync, but also handles the to-device messages and the
+// device list changes needed for encryption, which gomatrix doesn't parse.
+func (b *Bmatrix) syncEncrypted() error {
+	cli := b.mc
+	nextBatch := cli.Store.LoadNextBatch(cli.UserID)
+	filterID := cli.Store.LoadFilterID(cli.UserID)
+	if filterID == "" {
+		resFilter, err := cli.CreateFilter(cli.Syncer.GetFilterJSON(cli.UserID))
+		if err != nil {
+			return err
+		}
+		filterID = resFilter.FilterID
+		cli.Store.SaveFilterID(cli.UserID, filterID)
+	}
+
+	for {
+		query := map[string]string{"timeout": "30000", "filter": filterID}
+		if nextBatch != "" {
+			query["since"] = nextBatch
+		}
+		var resp syncResponse
+		if err := cli.MakeRequest("GET", cli.BuildURLWithQuery([]string{"sync"}, query), nil, &resp); err != nil {
+			duration, err2 := cli.Syncer.OnFailedSync(nil, err)
+			if err2 != nil {
+				return err2
+			}
+			time.Sleep(duration)
+			continue
+		}
+
+		cli.Store.SaveNextBatch(cli.UserID, resp.NextBatch)
+		// the keys are shared before they're used, so handle them before the room events
+		for _, ev := range b.e2ee.handleSync(&resp) {
+			b.handleEncrypted(ev)
+		}
+		if err := cli.Syncer.ProcessResponse(&resp.RespSync, nextBatch); err != nil {
+			return err
+		}
+		nextBatch = resp.NextBatch
+	}
+}
@@ -0,0 +1,242 @@
+package bmatrix
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/matrix/olm"
+	matrix "github.com/matterbridge/gomatrix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keyServer is a stand-in for a homeserver with an encrypted room the bot shares with
+// device PHONE of @carol:example.com, which is cross-signed unless unverified is set.
+type keyServer struct {
+	sync.Mutex
+
+	t           *testing.T
+	carol       *olm.Account
+	master      *olm.Account // the accounts of the cross-signing keys of carol
+	selfSigning *olm.Account
+	unverified  bool
+	toDevice    []json.RawMessage
+	sent        []json.RawMessage
+}
+
+// signed adds the signature of v by the signing key of account with keyID.
+func (ks *keyServer) signed(v map[string]interface{}, account *olm.Account, keyID string) map[string]interface{} {
+	data, err := canonicalJSON(v)
+	require.NoError(ks.t, err)
+	if v["signatures"] == nil {
+		v["signatures"] = map[string]map[string]string{"@carol:example.com": {}}
+	}
+	v["signatures"].(map[string]map[string]string)["@carol:example.com"]["ed25519:"+keyID] = account.Sign(data)
+	return v
+}
+
+func (ks *keyServer) crossSigningKey(account *olm.Account, usage string) map[string]interface{} {
+	return map[string]interface{}{
+		"user_id": "@carol:example.com",
+		"usage":   []string{usage},
+		"keys":    map[string]string{"ed25519:" + account.Ed25519Key(): account.Ed25519Key()},
+	}
+}
+
+func (ks *keyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	ks.Lock()
+	defer ks.Unlock()
+	var resp interface{} = map[string]interface{}{}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/account/whoami"):
+		resp = map[string]string{"user_id": "@bot:example.com", "device_id": "BOT"}
+	case strings.HasSuffix(r.URL.Path, "/keys/upload"):
+		resp = map[string]interface{}{"one_time_key_counts": map[string]int{"signed_curve25519": 50}}
+	case strings.HasSuffix(r.URL.Path, "/joined_members"):
+		resp = map[string]interface{}{"joined": map[string]interface{}{"@bot:example.com": struct{}{}, "@carol:example.com": struct{}{}}}
+	case strings.HasSuffix(r.URL.Path, "/keys/query"):
+		keys := ks.signed(map[string]interface{}{
+			"user_id":    "@carol:example.com",
+			"device_id":  "PHONE",
+			"algorithms": []string{olmAlgorithm, megolmAlgorithm},
+			"keys":       map[string]string{"curve25519:PHONE": ks.carol.Curve25519Key(), "ed25519:PHONE": ks.carol.Ed25519Key()},
+		}, ks.carol, "PHONE")
+		if !ks.unverified {
+			keys = ks.signed(keys, ks.selfSigning, ks.selfSigning.Ed25519Key())
+		}
+		resp = map[string]interface{}{
+			"device_keys":       map[string]interface{}{"@carol:example.com": map[string]interface{}{"PHONE": keys}},
+			"master_keys":       map[string]interface{}{"@carol:example.com": ks.crossSigningKey(ks.master, "master")},
+			"self_signing_keys": map[string]interface{}{"@carol:example.com": ks.signed(ks.crossSigningKey(ks.selfSigning, "self_signing"), ks.master, ks.master.Ed25519Key())},
+		}
+	case strings.HasSuffix(r.URL.Path, "/keys/claim"):
+		ks.carol.GenerateOneTimeKeys(1) //nolint:errcheck
+		var key map[string]interface{}
+		for id, k := range ks.carol.UnpublishedOneTimeKeys() {
+			key = map[string]interface{}{"signed_curve25519:" + id: ks.signed(map[string]interface{}{"key": k}, ks.carol, "PHONE")}
+		}
+		ks.carol.MarkKeysAsPublished()
+		resp = map[string]interface{}{"one_time_keys": map[string]interface{}{"@carol:example.com": map[string]interface{}{"PHONE": key}}}
+	case strings.Contains(r.URL.Path, "/sendToDevice/"):
+		ks.toDevice = append(ks.toDevice, body)
+	case strings.Contains(r.URL.Path, "/send/"):
+		assert.Contains(ks.t, r.URL.Path, "/send/m.room.encrypted/")
+		ks.sent = append(ks.sent, body)
+		resp = map[string]string{"event_id": "$sent"}
+	}
+	json.NewEncoder(w).Encode(resp) //nolint:errcheck
+}
+
+func TestEncryption(t *testing.T) {
+	var accounts [3]*olm.Account
+	for i := range accounts {
+		var err error
+		accounts[i], err = olm.NewAccount()
+		require.NoError(t, err)
+	}
+	carol := accounts[0]
+	ks := &keyServer{t: t, carol: carol, master: accounts[1], selfSigning: accounts[2]}
+	server := httptest.NewServer(ks)
+	defer server.Close()
+	store := filepath.Join(t.TempDir(), "crypto.json")
+	b := newTestMatrix(t, server.URL, `Encryption=true
+CryptoStore="`+store+`"`)
+	require.NoError(t, b.setupEncryption())
+	require.NoError(t, b.startEncryption(""))
+	assert.Equal(t, "BOT", b.e2ee.deviceID())
+	b.e2ee.setEncrypted("!room:example.com")
+
+	// our messages are encrypted with a session shared with carol
+	_, err := b.Send(config.Message{Text: "hello", Channel: "#test", Username: "alice: "})
+	require.NoError(t, err)
+	require.Len(t, ks.toDevice, 1)
+	require.Len(t, ks.sent, 1)
+
+	var toDevice struct {
+		Messages map[string]map[string]olmContent `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal(ks.toDevice[0], &toDevice))
+	msg := toDevice.Messages["@carol:example.com"]["PHONE"].Ciphertext[carol.Curve25519Key()]
+	session, err := carol.NewInboundSession(b.e2ee.state.Account.Curve25519Key(), msg.Body)
+	require.NoError(t, err)
+	plaintext, err := session.Decrypt(msg.Type, msg.Body)
+	require.NoError(t, err)
+	var payload struct {
+		Type    string  `json:"type"`
+		Content roomKey `json:"content"`
+	}
+	require.NoError(t, json.Unmarshal(plaintext, &payload))
+	assert.Equal(t, "m.room_key", payload.Type)
+	inbound, err := olm.NewInboundGroupSession(payload.Content.SessionKey)
+	require.NoError(t, err)
+
+	var content megolmContent
+	require.NoError(t, json.Unmarshal(ks.sent[0], &content))
+	assert.Equal(t, payload.Content.SessionID, content.SessionID)
+	plaintext, _, err = inbound.Decrypt(content.Ciphertext)
+	require.NoError(t, err)
+	assert.Contains(t, string(plaintext), `"body":"alice: hello"`)
+
+	// the session is shared once
+	_, err = b.Send(config.Message{Text: "again", Channel: "#test", Username: "alice: "})
+	require.NoError(t, err)
+	assert.Len(t, ks.toDevice, 1)
+
+	// messages of carol wait for their key
+	outbound, err := olm.NewOutboundGroupSession()
+	require.NoError(t, err)
+	sessionKey := outbound.SessionKey()
+	event, err := json.Marshal(map[string]interface{}{
+		"type":    "m.room.message",
+		"content": map[string]string{"msgtype": "m.text", "body": "hi"},
+		"room_id": "!room:example.com",
+	})
+	require.NoError(t, err)
+	b.handleEncrypted(&matrix.Event{
+		Type: "m.room.encrypted", Sender: "@carol:example.com", RoomID: "!room:example.com", ID: "$hi",
+		Content: map[string]interface{}{
+			"algorithm":  megolmAlgorithm,
+			"sender_key": carol.Curve25519Key(),
+			"ciphertext": outbound.Encrypt(event),
+			"session_id": outbound.ID(),
+			"device_id":  "PHONE",
+		},
+	})
+	assert.Empty(t, b.Remote)
+
+	// room keys are only accepted with the keys of a verified device of the sender
+	roomKeySync := func(sessionID, sessionKey string, keys map[string]string) *syncResponse {
+		key, err := json.Marshal(map[string]interface{}{
+			"type":           "m.room_key",
+			"content":        roomKey{Algorithm: megolmAlgorithm, RoomID: "!room:example.com", SessionID: sessionID, SessionKey: sessionKey},
+			"sender":         "@carol:example.com",
+			"keys":           keys,
+			"recipient":      "@bot:example.com",
+			"recipient_keys": map[string]string{"ed25519": b.e2ee.state.Account.Ed25519Key()},
+		})
+		require.NoError(t, err)
+		_, body, err := session.Encrypt(key)
+		require.NoError(t, err)
+		var resp syncResponse
+		resp.ToDevice.Events = []matrix.Event{{
+			Type:   "m.room.encrypted",
+			Sender: "@carol:example.com",
+			Content: map[string]interface{}{
+				"algorithm":  olmAlgorithm,
+				"sender_key": carol.Curve25519Key(),
+				"ciphertext": map[string]interface{}{b.e2ee.state.Account.Curve25519Key(): map[string]interface{}{"type": olm.MessageTypeNormal, "body": body}},
+			},
+		}}
+		return &resp
+	}
+	assert.Empty(t, b.e2ee.handleSync(roomKeySync(outbound.ID(), sessionKey, map[string]string{"ed25519": ks.master.Ed25519Key()})))
+	assert.Empty(t, b.e2ee.state.Inbound)
+	pending := b.e2ee.handleSync(roomKeySync(outbound.ID(), sessionKey, map[string]string{"ed25519": carol.Ed25519Key()}))
+	require.Len(t, pending, 1)
+	b.handleEncrypted(pending[0])
+	require.Len(t, b.Remote, 1)
+	rmsg := <-b.Remote
+	assert.Equal(t, "hi", rmsg.Text)
+	assert.Equal(t, "$hi", rmsg.ID)
+
+	// the message can be decrypted again in the same event, but not replayed in another one
+	_, err = b.e2ee.decryptEvent(pending[0])
+	require.NoError(t, err)
+	replayed := *pending[0]
+	replayed.ID = "$replayed"
+	_, err = b.e2ee.decryptEvent(&replayed)
+	assert.Error(t, err)
+
+	// and not anymore once the device isn't cross-signed
+	ks.Lock()
+	ks.unverified = true
+	ks.Unlock()
+	other, err := olm.NewOutboundGroupSession()
+	require.NoError(t, err)
+	resp := roomKeySync(other.ID(), other.SessionKey(), map[string]string{"ed25519": carol.Ed25519Key()})
+	resp.DeviceLists.Changed = []string{"@carol:example.com"}
+	assert.Empty(t, b.e2ee.handleSync(resp))
+	assert.Len(t, b.e2ee.state.Inbound, 1)
+
+	// and the keys of our new sessions aren't shared with it
+	b.e2ee.discardOutbound("!room:example.com")
+	_, err = b.Send(config.Message{Text: "secret", Channel: "#test", Username: "alice: "})
+	require.NoError(t, err)
+	assert.Len(t, ks.toDevice, 1)
+	assert.Len(t, ks.sent, 3)
+
+	// the keys are persisted
+	e, err := newEncryption(b)
+	require.NoError(t, err)
+	assert.Equal(t, "BOT", e.deviceID())
+	assert.Len(t, e.state.Inbound, 1)
+	assert.Equal(t, b.e2ee.state.Account.Ed25519Key(), e.state.Account.Ed25519Key())
+}
@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"html"
+	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
 	matrix "github.com/matterbridge/gomatrix"
 )
 
@@ -159,6 +163,40 @@ func (b *Bmatrix) containsAttachment(content map[string]interface{}) bool {
 	return true
 }
 
+// pillRE matches the user pills (mentions) in formatted bodies.
+var pillRE = regexp.MustCompile(`<a href="https://matrix\.to/#/((?:@|%40)[^"]+)">(.*?)</a>`)
+
+// getMentions returns the users mentioned with a pill in the formatted body of ev.
+func (b *Bmatrix) getMentions(ev *matrix.Event) []config.Mention {
+	formatted, ok := ev.Content["formatted_body"].(string)
+	if !ok {
+		return nil
+	}
+	var mentions []config.Mention
+	for _, match := range pillRE.FindAllStringSubmatch(formatted, -1) {
+		mxid, err := url.PathUnescape(match[1])
+		if err != nil {
+			continue
+		}
+		// the body contains the text of the pill
+		name := html.UnescapeString(htmlReplacementTag.ReplaceAllString(match[2], ""))
+		mentions = append(mentions, config.Mention{
+			Text:     name,
+			Username: name,
+			UserID:   mxid,
+			Account:  b.Account,
+		})
+	}
+	return mentions
+}
+
+// formatMentions replaces the mentions of matrix users in the formatted body with pills.
+func (b *Bmatrix) formatMentions(formattedBody string, mentions []config.Mention) string {
+	return helper.ReplaceMentions(formattedBody, b.Account, mentions, func(m config.Mention) string {
+		return `<a href="https://matrix.to/#/` + m.UserID + `">` + html.EscapeString(m.Username) + `</a>`
+	})
+}
+
 // getAvatarURL returns the avatar URL of the specified sender.
 func (b *Bmatrix) getAvatarURL(sender string) string {
 	urlPath := b.mc.BuildURL("profile", sender, "avatar_url")
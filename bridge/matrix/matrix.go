@@ -12,6 +12,7 @@ import (
 	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
 	"github.com/42wim/matterbridge/bridge/helper"
+	lru "github.com/hashicorp/golang-lru"
 	matrix "github.com/matterbridge/gomatrix"
 )
 
@@ -27,9 +28,15 @@ type NicknameCacheEntry struct {
 
 type Bmatrix struct {
 	mc          *matrix.Client
+	as          *appService
+	e2ee        *encryption
 	UserID      string
 	NicknameMap map[string]NicknameCacheEntry
 	RoomMap     map[string]string
+	threads     *lru.Cache // the thread roots of the messages in threads, by event ID
+	eventRooms  *lru.Cache // the rooms of the messages, by event ID
+	spaces      map[string]*space
+	invitable   map[string]struct{} // the channels waiting for an invite
 	rateMutex   sync.RWMutex
 	sync.RWMutex
 	*bridge.Config
@@ -80,16 +87,53 @@ type ReplyMessage struct {
 	matrix.TextMessage
 }
 
+// ThreadRelation puts a message in the thread of the root EventID. Clients without thread
+// support show it as a reply to InReplyTo when IsFallingBack is set.
+type ThreadRelation struct {
+	EventID       string                    `json:"event_id"`
+	Type          string                    `json:"rel_type"`
+	IsFallingBack bool                      `json:"is_falling_back"`
+	InReplyTo     *InReplyToRelationContent `json:"m.in_reply_to,omitempty"`
+}
+
+type ThreadMessage struct {
+	RelatedTo ThreadRelation `json:"m.relates_to"`
+	matrix.TextMessage
+}
+
+// ReactionRelation is the relation of a reaction (annotation) to the message it reacts to.
+type ReactionRelation struct {
+	EventID string `json:"event_id"`
+	Type    string `json:"rel_type"`
+	Key     string `json:"key"`
+}
+
+type ReactionMessage struct {
+	RelatedTo ReactionRelation `json:"m.relates_to"`
+}
+
 func New(cfg *bridge.Config) bridge.Bridger {
 	b := &Bmatrix{Config: cfg}
 	b.RoomMap = make(map[string]string)
 	b.NicknameMap = make(map[string]NicknameCacheEntry)
+	b.threads, _ = lru.New(5000)
+	b.eventRooms, _ = lru.New(5000)
+	b.spaces = make(map[string]*space)
+	b.invitable = make(map[string]struct{})
 	return b
 }
 
 func (b *Bmatrix) Connect() error {
 	var err error
 	b.Log.Infof("Connecting %s", b.GetString("Server"))
+	if b.GetString("AppServiceListen") != "" {
+		// the homeserver pushes the events to us, we don't sync
+		return b.connectAppService()
+	}
+	if err = b.setupEncryption(); err != nil {
+		return err
+	}
+	var deviceID string
 	if b.GetString("MxID") != "" && b.GetString("Token") != "" {
 		b.mc, err = matrix.NewClient(
 			b.GetString("Server"), b.GetString("MxID"), b.GetString("Token"),
@@ -109,49 +153,75 @@ func (b *Bmatrix) Connect() error {
 			User:       b.GetString("Login"),
 			Password:   b.GetString("Password"),
 			Identifier: matrix.NewUserIdentifier(b.GetString("Login")),
+			DeviceID:   b.e2ee.deviceID(),
 		})
 		if err != nil {
 			return err
 		}
 		b.mc.SetCredentials(resp.UserID, resp.AccessToken)
 		b.UserID = resp.UserID
+		deviceID = resp.DeviceID
 		b.Log.Info("Connection succeeded")
 	}
+	if err = b.startEncryption(deviceID); err != nil {
+		return err
+	}
 	go b.handlematrix()
 	return nil
 }
 
 func (b *Bmatrix) Disconnect() error {
+	if b.as != nil {
+		return b.as.server.Close()
+	}
 	return nil
 }
 
 func (b *Bmatrix) JoinChannel(channel config.ChannelInfo) error {
-	return b.retry(func() error {
+	var roomID string
+	err := b.retry(func() error {
 		resp, err := b.mc.JoinRoom(channel.Name, "", nil)
 		if err != nil {
 			return err
 		}
 
-		b.Lock()
-		b.RoomMap[resp.RoomID] = channel.Name
-		b.Unlock()
+		roomID = resp.RoomID
 
 		return nil
 	})
+	if err != nil {
+		// invite-only rooms are bridged once an allowed user invites us
+		if handleError(err).Errcode == "M_FORBIDDEN" && len(b.GetStringSlice("AcceptInvitesFrom")) > 0 {
+			b.Log.Infof("Can't join %s, waiting for an invite: %s", channel.Name, err)
+			b.awaitInvite(channel.Name)
+			return nil
+		}
+		return err
+	}
+
+	b.addRoom(roomID, channel.Name)
+
+	return nil
 }
 
 func (b *Bmatrix) Send(msg config.Message) (string, error) {
 	b.Log.Debugf("=> Receiving %#v", msg)
 
-	channel := b.getRoomID(msg.Channel)
+	channel := b.sendRoomID(&msg)
 	b.Log.Debugf("Channel %s maps to channel id %s", msg.Channel, channel)
 
 	username := newMatrixUsername(msg.Username)
+	s := &eventSender{mc: b.mc, e2ee: b.e2ee}
+	// virtual users (appservice mode) are shown with the name of the user
+	if u := b.virtualUser(&msg, channel); u != nil {
+		username = newMatrixUsername("")
+		s = &eventSender{mc: u.client, ts: msg.Timestamp}
+	}
 
 	body := username.plain + msg.Text
-	formattedBody := username.formatted + helper.ParseMarkdown(msg.Text)
+	formattedBody := username.formatted + b.formatMentions(helper.ParseMarkdown(msg.Text), msg.Mentions)
 
-	if b.GetBool("SpoofUsername") {
+	if b.GetBool("SpoofUsername") && s.mc == b.mc {
 		// https://spec.matrix.org/v1.3/client-server-api/#mroommember
 		type stateMember struct {
 			AvatarURL   string `json:"avatar_url,omitempty"`
@@ -169,7 +239,7 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		_, err := b.mc.SendStateEvent(channel, "m.room.member", b.UserID, m)
 		if err == nil {
 			body = msg.Text
-			formattedBody = helper.ParseMarkdown(msg.Text)
+			formattedBody = b.formatMentions(helper.ParseMarkdown(msg.Text), msg.Mentions)
 		}
 	}
 
@@ -190,7 +260,7 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		msgID := ""
 
 		err := b.retry(func() error {
-			resp, err := b.mc.SendMessageEvent(channel, "m.room.message", m)
+			resp, err := s.send(channel, m)
 			if err != nil {
 				return err
 			}
@@ -212,7 +282,7 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		msgID := ""
 
 		err := b.retry(func() error {
-			resp, err := b.mc.RedactEvent(channel, msg.ID, &matrix.ReqRedact{})
+			resp, err := s.mc.RedactEvent(channel, msg.ID, &matrix.ReqRedact{})
 			if err != nil {
 				return err
 			}
@@ -225,6 +295,31 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		return msgID, err
 	}
 
+	// React to a message
+	if msg.Event == config.EventReaction {
+		if !msg.ParentValid() {
+			return "", nil
+		}
+
+		var (
+			resp *matrix.RespSendEvent
+			err  error
+		)
+
+		err = b.retry(func() error {
+			resp, err = s.sendEvent(channel, "m.reaction", ReactionMessage{
+				RelatedTo: ReactionRelation{EventID: msg.ParentID, Type: "m.annotation", Key: msg.Text},
+			})
+
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return resp.EventID, nil
+	}
+
 	// Upload a file if it exists
 	if msg.Extra != nil {
 		for _, rmsg := range helper.HandleExtra(&msg, b.General) {
@@ -241,24 +336,25 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		}
 		// check if we have files to upload (from slack, telegram or mattermost)
 		if len(msg.Extra["file"]) > 0 {
-			return b.handleUploadFiles(&msg, channel)
+			return b.handleUploadFiles(&msg, channel, s)
 		}
 	}
 
 	// Edit message if we have an ID
 	if msg.ID != "" {
+		// clients without edit support show the fallback "* new text"
 		rmsg := EditedMessage{
 			TextMessage: matrix.TextMessage{
-				Body:          body,
+				Body:          "* " + body,
 				MsgType:       "m.text",
 				Format:        "org.matrix.custom.html",
-				FormattedBody: formattedBody,
+				FormattedBody: "* " + formattedBody,
 			},
 		}
 
 		rmsg.NewContent = SubTextMessage{
-			Body:          rmsg.TextMessage.Body,
-			FormattedBody: rmsg.TextMessage.FormattedBody,
+			Body:          body,
+			FormattedBody: formattedBody,
 			Format:        rmsg.TextMessage.Format,
 			MsgType:       "m.text",
 		}
@@ -276,7 +372,7 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		}
 
 		err := b.retry(func() error {
-			_, err := b.mc.SendMessageEvent(channel, "m.room.message", rmsg)
+			_, err := s.send(channel, rmsg)
 
 			return err
 		})
@@ -287,8 +383,8 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		return msg.ID, nil
 	}
 
-	// Use notices to send join/leave events
-	if msg.Event == config.EventJoinLeave {
+	// Use notices to send join/leave events and nick changes
+	if msg.Event == config.EventJoinLeave || msg.Event == config.EventNickChange {
 		m := matrix.TextMessage{
 			MsgType:       "m.notice",
 			Body:          body,
@@ -307,7 +403,7 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		)
 
 		err = b.retry(func() error {
-			resp, err = b.mc.SendMessageEvent(channel, "m.room.message", m)
+			resp, err = s.send(channel, m)
 
 			return err
 		})
@@ -319,33 +415,48 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 	}
 
 	if msg.ParentValid() {
-		m := ReplyMessage{
-			TextMessage: matrix.TextMessage{
-				MsgType:       "m.text",
-				Body:          body,
-				FormattedBody: formattedBody,
-				Format:        "org.matrix.custom.html",
-			},
+		text := matrix.TextMessage{
+			MsgType:       "m.text",
+			Body:          body,
+			FormattedBody: formattedBody,
+			Format:        "org.matrix.custom.html",
 		}
 
 		if b.GetBool("HTMLDisable") {
-			m.TextMessage.Format = ""
-			m.TextMessage.FormattedBody = ""
+			text.Format = ""
+			text.FormattedBody = ""
 		}
 
-		m.RelatedTo = InReplyToRelation{
-			InReplyTo: InReplyToRelationContent{
-				EventID: msg.ParentID,
+		var m interface{} = ReplyMessage{
+			TextMessage: text,
+			RelatedTo: InReplyToRelation{
+				InReplyTo: InReplyToRelationContent{
+					EventID: msg.ParentID,
+				},
 			},
 		}
 
+		// replies to messages in a thread stay in the thread
+		root, inThread := b.threadRoot(msg.ParentID)
+		if inThread || b.GetBool("UseThreads") {
+			m = ThreadMessage{
+				TextMessage: text,
+				RelatedTo: ThreadRelation{
+					EventID:       root,
+					Type:          "m.thread",
+					IsFallingBack: true,
+					InReplyTo:     &InReplyToRelationContent{EventID: msg.ParentID},
+				},
+			}
+		}
+
 		var (
 			resp *matrix.RespSendEvent
 			err  error
 		)
 
 		err = b.retry(func() error {
-			resp, err = b.mc.SendMessageEvent(channel, "m.room.message", m)
+			resp, err = s.send(channel, m)
 
 			return err
 		})
@@ -353,6 +464,10 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 			return "", err
 		}
 
+		if inThread || b.GetBool("UseThreads") {
+			b.threads.Add(resp.EventID, root)
+		}
+
 		return resp.EventID, err
 	}
 
@@ -363,7 +478,7 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		)
 
 		err = b.retry(func() error {
-			resp, err = b.mc.SendText(channel, body)
+			resp, err = s.send(channel, matrix.TextMessage{MsgType: "m.text", Body: body})
 
 			return err
 		})
@@ -381,7 +496,12 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 	)
 
 	err = b.retry(func() error {
-		resp, err = b.mc.SendFormattedText(channel, body, formattedBody)
+		resp, err = s.send(channel, matrix.TextMessage{
+			MsgType:       "m.text",
+			Body:          body,
+			FormattedBody: formattedBody,
+			Format:        "org.matrix.custom.html",
+		})
 
 		return err
 	})
@@ -396,13 +516,26 @@ func (b *Bmatrix) handlematrix() {
 	syncer := b.mc.Syncer.(*matrix.DefaultSyncer)
 	syncer.OnEventType("m.room.redaction", b.handleEvent)
 	syncer.OnEventType("m.room.message", b.handleEvent)
+	syncer.OnEventType("m.reaction", b.handleEvent)
 	syncer.OnEventType("m.room.member", b.handleMemberChange)
+	syncer.OnEventType("m.space.child", b.handleSpaceChild)
+	syncer.OnEventType("m.room.tombstone", b.handleTombstone)
+	if b.e2ee != nil {
+		syncer.OnEventType("m.room.encrypted", b.handleEncrypted)
+		syncer.OnEventType("m.room.encryption", func(ev *matrix.Event) { b.e2ee.setEncrypted(ev.RoomID) })
+	}
 	go func() {
 		for {
 			if b == nil {
 				return
 			}
-			if err := b.mc.Sync(); err != nil {
+			var err error
+			if b.e2ee != nil {
+				err = b.syncEncrypted()
+			} else {
+				err = b.mc.Sync()
+			}
+			if err != nil {
 				b.Log.Println("Sync() returned ", err)
 			}
 		}
@@ -451,38 +584,135 @@ func (b *Bmatrix) handleReply(ev *matrix.Event, rmsg config.Message) bool {
 		return false
 	}
 
-	body := rmsg.Text
+	rmsg.Text = b.stripReplyFallback(rmsg.Text)
+	rmsg.ParentID = relation.InReplyTo.EventID
+	b.Remote <- rmsg
 
-	if !b.GetBool("keepquotedreply") {
-		for strings.HasPrefix(body, "> ") {
-			lineIdx := strings.IndexRune(body, '\n')
-			if lineIdx == -1 {
-				body = ""
-			} else {
-				body = body[(lineIdx + 1):]
-			}
-		}
+	return true
+}
+
+// handleThread relays messages in a thread with the thread root as parent, also when
+// they're a reply to another message in the thread.
+func (b *Bmatrix) handleThread(ev *matrix.Event, rmsg config.Message) bool {
+	relationInterface, present := ev.Content["m.relates_to"]
+	if !present {
+		return false
 	}
 
-	rmsg.Text = body
-	rmsg.ParentID = relation.InReplyTo.EventID
+	var relation ThreadRelation
+	if err := interface2Struct(relationInterface, &relation); err != nil || relation.Type != "m.thread" {
+		return false
+	}
+
+	b.threads.Add(ev.ID, relation.EventID)
+	// only real replies (not the fallback for clients without threads) quote the message
+	if !relation.IsFallingBack && relation.InReplyTo != nil {
+		rmsg.Text = b.stripReplyFallback(rmsg.Text)
+	}
+	rmsg.ParentID = relation.EventID
 	b.Remote <- rmsg
 
 	return true
 }
 
+// handleReaction relays the reaction ev, the redaction of a reaction is relayed as
+// the delete of the reaction.
+func (b *Bmatrix) handleReaction(ev *matrix.Event, rmsg config.Message) {
+	var relation ReactionRelation
+	if err := interface2Struct(ev.Content["m.relates_to"], &relation); err != nil {
+		b.Log.Warnf("Couldn't parse 'm.relates_to' object with value %#v", ev.Content["m.relates_to"])
+		return
+	}
+	if relation.Type != "m.annotation" || relation.Key == "" {
+		return
+	}
+
+	rmsg.Event = config.EventReaction
+	rmsg.Text = relation.Key
+	rmsg.ParentID = relation.EventID
+	b.Log.Debugf("<= Sending reaction from %s on %s to gateway", ev.Sender, b.Account)
+	b.Remote <- rmsg
+}
+
+// stripReplyFallback removes the quote of the message replied to from body, unless
+// KeepQuotedReply is set.
+func (b *Bmatrix) stripReplyFallback(body string) string {
+	if b.GetBool("keepquotedreply") {
+		return body
+	}
+	for strings.HasPrefix(body, "> ") {
+		lineIdx := strings.IndexRune(body, '\n')
+		if lineIdx == -1 {
+			body = ""
+		} else {
+			body = body[(lineIdx + 1):]
+		}
+	}
+	return body
+}
+
+// threadRoot returns the root of the thread of the message with eventID, or eventID and
+// false if it isn't in a thread we know.
+func (b *Bmatrix) threadRoot(eventID string) (string, bool) {
+	if root, ok := b.threads.Get(eventID); ok {
+		return root.(string), true
+	}
+	return eventID, false
+}
+
 func (b *Bmatrix) handleMemberChange(ev *matrix.Event) {
 	// Update the displayname on join messages, according to https://matrix.org/docs/spec/client_server/r0.6.1#events-on-change-of-profile-information
 	if ev.Content["membership"] == "join" {
 		if dn, ok := ev.Content["displayname"].(string); ok {
+			b.handleDisplayNameChange(ev, dn)
 			b.cacheDisplayName(ev.Sender, dn)
 		}
 	}
+	if ev.Content["membership"] == "invite" {
+		b.handleInvite(ev)
+	}
+	// members who left mustn't be able to decrypt new messages
+	if b.e2ee != nil && (ev.Content["membership"] == "leave" || ev.Content["membership"] == "ban") {
+		b.e2ee.discardOutbound(ev.RoomID)
+	}
+}
+
+// handleDisplayNameChange relays the change of the display name of the user of the
+// (membership) event ev to dn, if it's a change of a user who already joined.
+func (b *Bmatrix) handleDisplayNameChange(ev *matrix.Event, dn string) {
+	prev := ev.PrevContent
+	if prev == nil {
+		prev, _ = ev.Unsigned["prev_content"].(map[string]interface{})
+	}
+	old, ok := prev["displayname"].(string)
+	if !ok || prev["membership"] != "join" || old == dn || ev.Sender == b.UserID || b.isVirtualUser(ev.Sender) || b.GetBool("UseUserName") {
+		return
+	}
+	b.RLock()
+	channel, ok := b.RoomMap[ev.RoomID]
+	b.RUnlock()
+	if !ok {
+		return
+	}
+	rmsg := config.Message{
+		Username:  "system",
+		Text:      old + " is now known as " + dn,
+		Channel:   channel,
+		Account:   b.Account,
+		UserID:    ev.Sender,
+		Event:     config.EventNickChange,
+		Timestamp: time.Unix(0, ev.Timestamp*int64(time.Millisecond)),
+		Extra:     map[string][]interface{}{config.EventNickChange: {config.NickChangeInfo{Old: old, New: dn}}},
+	}
+	b.Log.Debugf("<= Sending message from %s on %s to gateway", ev.Sender, b.Account)
+	b.Remote <- rmsg
 }
 
 func (b *Bmatrix) handleEvent(ev *matrix.Event) {
 	b.Log.Debugf("== Receiving event: %#v", ev)
-	if ev.Sender != b.UserID {
+	// replies to messages in spaces go to the room of the message
+	b.eventRooms.Add(ev.ID, ev.RoomID)
+	if ev.Sender != b.UserID && !b.isVirtualUser(ev.Sender) {
 		b.RLock()
 		channel, ok := b.RoomMap[ev.RoomID]
 		b.RUnlock()
@@ -493,12 +723,13 @@ func (b *Bmatrix) handleEvent(ev *matrix.Event) {
 
 		// Create our message
 		rmsg := config.Message{
-			Username: b.getDisplayName(ev.Sender),
-			Channel:  channel,
-			Account:  b.Account,
-			UserID:   ev.Sender,
-			ID:       ev.ID,
-			Avatar:   b.getAvatarURL(ev.Sender),
+			Username:  b.getDisplayName(ev.Sender),
+			Channel:   channel,
+			Account:   b.Account,
+			UserID:    ev.Sender,
+			ID:        ev.ID,
+			Avatar:    b.getAvatarURL(ev.Sender),
+			Timestamp: time.Unix(0, ev.Timestamp*int64(time.Millisecond)),
 		}
 
 		// Remove homeserver suffix if configured
@@ -516,6 +747,11 @@ func (b *Bmatrix) handleEvent(ev *matrix.Event) {
 			return
 		}
 
+		if ev.Type == "m.reaction" {
+			b.handleReaction(ev, rmsg)
+			return
+		}
+
 		// Text must be a string
 		if rmsg.Text, ok = ev.Content["body"].(string); !ok {
 			b.Log.Errorf("Content[body] is not a string: %T\n%#v",
@@ -523,6 +759,8 @@ func (b *Bmatrix) handleEvent(ev *matrix.Event) {
 			return
 		}
 
+		rmsg.Mentions = b.getMentions(ev)
+
 		// Do we have a /me action
 		if ev.Content["msgtype"].(string) == "m.emote" {
 			rmsg.Event = config.EventUserAction
@@ -533,6 +771,11 @@ func (b *Bmatrix) handleEvent(ev *matrix.Event) {
 			return
 		}
 
+		// Is it in a thread?
+		if b.handleThread(ev, rmsg) {
+			return
+		}
+
 		// Is it a reply?
 		if b.handleReply(ev, rmsg) {
 			return
@@ -616,27 +859,53 @@ func (b *Bmatrix) handleDownloadFile(rmsg *config.Message, content map[string]in
 }
 
 // handleUploadFiles handles native upload of files.
-func (b *Bmatrix) handleUploadFiles(msg *config.Message, channel string) (string, error) {
+func (b *Bmatrix) handleUploadFiles(msg *config.Message, channel string, s *eventSender) (string, error) {
+	var (
+		failed    []string
+		commented bool
+		err       error
+	)
 	for _, f := range msg.Extra["file"] {
 		if fi, ok := f.(config.FileInfo); ok {
-			b.handleUploadFile(msg, channel, &fi)
+			sent, uploadErr := b.handleUploadFile(msg, channel, &fi, s)
+			commented = commented || sent
+			if uploadErr != nil {
+				failed = append(failed, fi.Name)
+				err = uploadErr
+			}
 		}
 	}
+	if len(failed) > 0 {
+		return "", &helper.UploadError{Text: commented, Files: failed, Err: err}
+	}
 	return "", nil
 }
 
-// handleUploadFile handles native upload of a file.
-func (b *Bmatrix) handleUploadFile(msg *config.Message, channel string, fi *config.FileInfo) {
+// handleUploadFile handles native upload of a file. Returns whether the comment of the
+// file was sent and the error if the file couldn't be uploaded.
+func (b *Bmatrix) handleUploadFile(msg *config.Message, channel string, fi *config.FileInfo, s *eventSender) (bool, error) {
 	username := newMatrixUsername(msg.Username)
+	if s.mc != b.mc {
+		username = newMatrixUsername("")
+	}
 	content := bytes.NewReader(*fi.Data)
 	sp := strings.Split(fi.Name, ".")
 	mtype := mime.TypeByExtension("." + sp[len(sp)-1])
 	// image and video uploads send no username, we have to do this ourself here #715
-	err := b.retry(func() error {
-		_, err := b.mc.SendFormattedText(channel, username.plain+fi.Comment, username.formatted+fi.Comment)
+	var err error
+	if username.plain+fi.Comment != "" {
+		err = b.retry(func() error {
+			_, err := s.send(channel, matrix.TextMessage{
+				MsgType:       "m.text",
+				Body:          username.plain + fi.Comment,
+				FormattedBody: username.formatted + fi.Comment,
+				Format:        "org.matrix.custom.html",
+			})
 
-		return err
-	})
+			return err
+		})
+	}
+	commented := username.plain+fi.Comment != "" && err == nil
 	if err != nil {
 		b.Log.Errorf("file comment failed: %#v", err)
 	}
@@ -646,21 +915,21 @@ func (b *Bmatrix) handleUploadFile(msg *config.Message, channel string, fi *conf
 	var res *matrix.RespMediaUpload
 
 	err = b.retry(func() error {
-		res, err = b.mc.UploadToContentRepo(content, mtype, int64(len(*fi.Data)))
+		res, err = s.mc.UploadToContentRepo(content, mtype, int64(len(*fi.Data)))
 
 		return err
 	})
 
 	if err != nil {
 		b.Log.Errorf("file upload failed: %#v", err)
-		return
+		return commented, err
 	}
 
 	switch {
 	case strings.Contains(mtype, "video"):
 		b.Log.Debugf("sendVideo %s", res.ContentURI)
 		err = b.retry(func() error {
-			_, err = b.mc.SendVideo(channel, fi.Name, res.ContentURI)
+			_, err = s.send(channel, matrix.VideoMessage{MsgType: "m.video", Body: fi.Name, URL: res.ContentURI})
 
 			return err
 		})
@@ -670,7 +939,7 @@ func (b *Bmatrix) handleUploadFile(msg *config.Message, channel string, fi *conf
 	case strings.Contains(mtype, "image"):
 		b.Log.Debugf("sendImage %s", res.ContentURI)
 		err = b.retry(func() error {
-			_, err = b.mc.SendImage(channel, fi.Name, res.ContentURI)
+			_, err = s.send(channel, matrix.ImageMessage{MsgType: "m.image", Body: fi.Name, URL: res.ContentURI})
 
 			return err
 		})
@@ -680,7 +949,7 @@ func (b *Bmatrix) handleUploadFile(msg *config.Message, channel string, fi *conf
 	case strings.Contains(mtype, "audio"):
 		b.Log.Debugf("sendAudio %s", res.ContentURI)
 		err = b.retry(func() error {
-			_, err = b.mc.SendMessageEvent(channel, "m.room.message", matrix.AudioMessage{
+			_, err = s.send(channel, matrix.AudioMessage{
 				MsgType: "m.audio",
 				Body:    fi.Name,
 				URL:     res.ContentURI,
@@ -698,7 +967,7 @@ func (b *Bmatrix) handleUploadFile(msg *config.Message, channel string, fi *conf
 	default:
 		b.Log.Debugf("sendFile %s", res.ContentURI)
 		err = b.retry(func() error {
-			_, err = b.mc.SendMessageEvent(channel, "m.room.message", matrix.FileMessage{
+			_, err = s.send(channel, matrix.FileMessage{
 				MsgType: "m.file",
 				Body:    fi.Name,
 				URL:     res.ContentURI,
@@ -715,4 +984,5 @@ func (b *Bmatrix) handleUploadFile(msg *config.Message, channel string, fi *conf
 		}
 	}
 	b.Log.Debugf("result: %#v", res)
+	return commented, nil
 }
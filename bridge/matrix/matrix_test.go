@@ -1,9 +1,16 @@
 package bmatrix
 
 import (
+	"io/ioutil"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	matrix "github.com/matterbridge/gomatrix"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPlainUsername(t *testing.T) {
@@ -26,3 +33,113 @@ func TestFancyUsername(t *testing.T) {
 	assert.Equal(t, "&lt;MyUser&gt;", uut.formatted)
 	assert.Equal(t, "<MyUser>", uut.plain)
 }
+
+func TestMentions(t *testing.T) {
+	b := &Bmatrix{Config: &bridge.Config{Bridge: &bridge.Bridge{Account: "matrix.test"}}}
+	ev := &matrix.Event{Content: map[string]interface{}{
+		"body":           "Alice &: ping",
+		"formatted_body": `<a href="https://matrix.to/#/%40alice%3Aexample.com">Alice &amp;</a>: ping`,
+	}}
+	mentions := b.getMentions(ev)
+	assert.Equal(t, []config.Mention{
+		{Text: "Alice &", Username: "Alice &", UserID: "@alice:example.com", Account: "matrix.test"},
+	}, mentions)
+
+	mentions[0].Text = "@alice"
+	assert.Equal(t, `<a href="https://matrix.to/#/@alice:example.com">Alice &amp;</a>: pong`,
+		b.formatMentions("@alice: pong", mentions))
+}
+
+func newTestMatrix(t *testing.T, server, extra string) *Bmatrix {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	cfg := config.NewConfigFromString(logger, []byte(`
+[matrix.test]
+Server="`+server+`"
+`+extra))
+	b := New(&bridge.Config{
+		Bridge: &bridge.Bridge{Account: "matrix.test", Log: logrus.NewEntry(logger), Config: cfg, General: &config.Protocol{}},
+		Remote: make(chan config.Message, 10),
+	}).(*Bmatrix)
+	var err error
+	b.mc, err = matrix.NewClient(server, "@bot:example.com", "token")
+	require.NoError(t, err)
+	b.UserID = "@bot:example.com"
+	b.RoomMap["!room:example.com"] = "#test"
+	return b
+}
+
+func TestReceiveThreadAndReaction(t *testing.T) {
+	hs := &homeserver{}
+	server := httptest.NewServer(hs)
+	defer server.Close()
+	b := newTestMatrix(t, server.URL, "")
+
+	b.handleEvent(&matrix.Event{
+		Type: "m.room.message", Sender: "@carol:example.com", RoomID: "!room:example.com", ID: "$reply",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "in thread",
+			"m.relates_to": map[string]interface{}{
+				"rel_type":        "m.thread",
+				"event_id":        "$root",
+				"is_falling_back": true,
+				"m.in_reply_to":   map[string]interface{}{"event_id": "$previous"},
+			},
+		},
+	})
+	msg := <-b.Remote
+	assert.Equal(t, "in thread", msg.Text)
+	assert.Equal(t, "$root", msg.ParentID)
+	root, ok := b.threadRoot("$reply")
+	assert.True(t, ok)
+	assert.Equal(t, "$root", root)
+
+	b.handleEvent(&matrix.Event{
+		Type: "m.reaction", Sender: "@carol:example.com", RoomID: "!room:example.com", ID: "$reaction",
+		Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": "$root", "key": "👍"},
+		},
+	})
+	msg = <-b.Remote
+	assert.Equal(t, config.EventReaction, msg.Event)
+	assert.Equal(t, "👍", msg.Text)
+	assert.Equal(t, "$root", msg.ParentID)
+	assert.Equal(t, "$reaction", msg.ID)
+}
+
+func TestSendThreadAndReaction(t *testing.T) {
+	hs := &homeserver{}
+	server := httptest.NewServer(hs)
+	defer server.Close()
+	b := newTestMatrix(t, server.URL, "")
+
+	// a reply to a message in a thread stays in the thread
+	b.threads.Add("$reply", "$root")
+	_, err := b.Send(config.Message{Text: "hi", Channel: "#test", Username: "alice: ", ParentID: "$reply"})
+	require.NoError(t, err)
+	requests := hs.reset()
+	require.Len(t, requests, 1)
+	assert.Contains(t, requests[0], `"rel_type":"m.thread"`)
+	assert.Contains(t, requests[0], `"event_id":"$root"`)
+	assert.Contains(t, requests[0], `"m.in_reply_to":{"event_id":"$reply"}`)
+	root, ok := b.threadRoot("$sent")
+	assert.True(t, ok)
+	assert.Equal(t, "$root", root)
+
+	// other replies are sent as replies
+	_, err = b.Send(config.Message{Text: "hi", Channel: "#test", Username: "alice: ", ParentID: "$other"})
+	require.NoError(t, err)
+	requests = hs.reset()
+	require.Len(t, requests, 1)
+	assert.NotContains(t, requests[0], "m.thread")
+	assert.Contains(t, requests[0], `"m.in_reply_to":{"event_id":"$other"}`)
+
+	id, err := b.Send(config.Message{Text: "👍", Channel: "#test", Event: config.EventReaction, ParentID: "$other"})
+	require.NoError(t, err)
+	assert.Equal(t, "$sent", id)
+	requests = hs.reset()
+	require.Len(t, requests, 1)
+	assert.Contains(t, requests[0], "PUT /_matrix/client/r0/rooms/!room:example.com/send/m.reaction/")
+	assert.Contains(t, requests[0], `{"m.relates_to":{"event_id":"$other","rel_type":"m.annotation","key":"👍"}}`)
+}
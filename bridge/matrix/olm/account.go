@@ -0,0 +1,206 @@
+package olm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// MaxOneTimeKeys is the number of one-time keys an account keeps, the oldest keys are
+// dropped when more are generated.
+const MaxOneTimeKeys = 100
+
+// Account holds the identity keys and the one-time keys of a device.
+type Account struct {
+	IdentityKey Curve25519KeyPair  `json:"identity_key"`
+	SigningKey  ed25519.PrivateKey `json:"signing_key"`
+	OneTimeKeys []OneTimeKey       `json:"one_time_keys"`
+	NextKeyID   uint32             `json:"next_key_id"`
+}
+
+// OneTimeKey is a key others can claim once to set up an Olm session with us.
+type OneTimeKey struct {
+	ID        uint32            `json:"id"`
+	Key       Curve25519KeyPair `json:"key"`
+	Published bool              `json:"published"`
+}
+
+// NewAccount returns an account with new identity keys.
+func NewAccount() (*Account, error) {
+	identityKey, err := newCurve25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{IdentityKey: identityKey, SigningKey: signingKey}, nil
+}
+
+// Curve25519Key returns the identity key others encrypt to.
+func (a *Account) Curve25519Key() string {
+	return EncodeBase64(a.IdentityKey.Public)
+}
+
+// Ed25519Key returns the key our signatures are verified with.
+func (a *Account) Ed25519Key() string {
+	return EncodeBase64(a.SigningKey.Public().(ed25519.PublicKey))
+}
+
+// Sign returns the signature of message.
+func (a *Account) Sign(message []byte) string {
+	return EncodeBase64(ed25519.Sign(a.SigningKey, message))
+}
+
+// GenerateOneTimeKeys adds n new one-time keys.
+func (a *Account) GenerateOneTimeKeys(n int) error {
+	for i := 0; i < n; i++ {
+		key, err := newCurve25519KeyPair()
+		if err != nil {
+			return err
+		}
+		a.NextKeyID++
+		a.OneTimeKeys = append(a.OneTimeKeys, OneTimeKey{ID: a.NextKeyID, Key: key})
+	}
+	if len(a.OneTimeKeys) > MaxOneTimeKeys {
+		a.OneTimeKeys = a.OneTimeKeys[len(a.OneTimeKeys)-MaxOneTimeKeys:]
+	}
+	return nil
+}
+
+// UnpublishedOneTimeKeys returns the public one-time keys that weren't published yet, by key ID.
+func (a *Account) UnpublishedOneTimeKeys() map[string]string {
+	keys := make(map[string]string)
+	for _, k := range a.OneTimeKeys {
+		if !k.Published {
+			keys[EncodeBase64(binary.BigEndian.AppendUint32(nil, k.ID))] = EncodeBase64(k.Key.Public)
+		}
+	}
+	return keys
+}
+
+// MarkKeysAsPublished marks all one-time keys as published.
+func (a *Account) MarkKeysAsPublished() {
+	for i := range a.OneTimeKeys {
+		a.OneTimeKeys[i].Published = true
+	}
+}
+
+// RemoveOneTimeKeys removes the one-time key used by the inbound session s.
+func (a *Account) RemoveOneTimeKeys(s *Session) {
+	keys := a.OneTimeKeys[:0]
+	for _, k := range a.OneTimeKeys {
+		if !bytes.Equal(k.Key.Public, s.BobOneTimeKey) {
+			keys = append(keys, k)
+		}
+	}
+	a.OneTimeKeys = keys
+}
+
+// NewOutboundSession returns a session to send messages to the device with identity key
+// theirIdentityKey, using its one-time key theirOneTimeKey.
+func (a *Account) NewOutboundSession(theirIdentityKey, theirOneTimeKey string) (*Session, error) {
+	identityKey, err := decodeKey(theirIdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	oneTimeKey, err := decodeKey(theirOneTimeKey)
+	if err != nil {
+		return nil, err
+	}
+	baseKey, err := newCurve25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	ratchetKey, err := newCurve25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := tripleDH(
+		[2][]byte{a.IdentityKey.Private, oneTimeKey},
+		[2][]byte{baseKey.Private, identityKey},
+		[2][]byte{baseKey.Private, oneTimeKey},
+	)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, chainKey := deriveRootKey(secret)
+	return &Session{
+		AliceIdentityKey: a.IdentityKey.Public,
+		AliceBaseKey:     baseKey.Public,
+		BobOneTimeKey:    oneTimeKey,
+		RootKey:          rootKey,
+		SenderChain:      &Chain{RatchetKey: ratchetKey, ChainKey: chainKey},
+	}, nil
+}
+
+// NewInboundSession returns the session set up by the pre-key message body. The message
+// is decrypted with Session.Decrypt, after which the one-time key it used should be
+// removed with RemoveOneTimeKeys. theirIdentityKey is checked when not empty.
+func (a *Account) NewInboundSession(theirIdentityKey, body string) (*Session, error) {
+	raw, err := DecodeBase64(body)
+	if err != nil {
+		return nil, err
+	}
+	pre, err := decodePreKeyMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	if theirIdentityKey != "" {
+		identityKey, err := decodeKey(theirIdentityKey)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(identityKey, pre.identityKey) {
+			return nil, errors.New("olm: message from another identity key")
+		}
+	}
+	msg, err := decodeMessage(pre.message)
+	if err != nil {
+		return nil, err
+	}
+
+	var oneTimeKey *OneTimeKey
+	for i := range a.OneTimeKeys {
+		if bytes.Equal(a.OneTimeKeys[i].Key.Public, pre.oneTimeKey) {
+			oneTimeKey = &a.OneTimeKeys[i]
+		}
+	}
+	if oneTimeKey == nil {
+		return nil, errors.New("olm: unknown one-time key")
+	}
+
+	secret, err := tripleDH(
+		[2][]byte{oneTimeKey.Key.Private, pre.identityKey},
+		[2][]byte{a.IdentityKey.Private, pre.baseKey},
+		[2][]byte{oneTimeKey.Key.Private, pre.baseKey},
+	)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, chainKey := deriveRootKey(secret)
+	return &Session{
+		AliceIdentityKey: pre.identityKey,
+		AliceBaseKey:     pre.baseKey,
+		BobOneTimeKey:    pre.oneTimeKey,
+		RootKey:          rootKey,
+		ReceiverChains:   []Chain{{RatchetKey: Curve25519KeyPair{Public: msg.ratchetKey}, ChainKey: chainKey}},
+	}, nil
+}
+
+// tripleDH returns the concatenated shared secrets of the (private, public) key pairs.
+func tripleDH(pairs ...[2][]byte) ([]byte, error) {
+	var secret []byte
+	for _, pair := range pairs {
+		s, err := sharedSecret(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, s...)
+	}
+	return secret, nil
+}
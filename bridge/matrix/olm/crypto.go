@@ -0,0 +1,153 @@
+// Package olm is a pure Go implementation of the Olm and Megolm ratchets used for
+// end-to-end encryption in Matrix.
+//
+// The package provides the following functionality:
+//
+// - Accounts with identity keys and one-time keys
+// - Olm sessions to exchange encrypted messages with a single device
+// - Megolm (group) sessions to encrypt and decrypt room messages
+//
+// It follows the specifications at https://gitlab.matrix.org/matrix-org/olm/-/tree/master/docs,
+// the tests check it against known answers computed from them. It hasn't been checked
+// against messages of libolm or vodozemac. All types can be persisted as JSON, but not in
+// the pickle format of libolm.
+package olm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	keyLength   = 32
+	macLength   = 8
+	infoKeys    = "OLM_KEYS"
+	infoRoot    = "OLM_ROOT"
+	infoRatchet = "OLM_RATCHET"
+	infoMegolm  = "MEGOLM_KEYS"
+)
+
+var (
+	ErrBadMAC       = errors.New("olm: bad message MAC")
+	ErrBadSignature = errors.New("olm: bad signature")
+	ErrBadMessage   = errors.New("olm: invalid message")
+)
+
+// EncodeBase64 encodes b like Matrix does: the standard alphabet without padding.
+func EncodeBase64(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+// DecodeBase64 decodes s, with or without padding.
+func DecodeBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// decodeKey decodes the base64 encoded curve25519 or ed25519 public key s.
+func decodeKey(s string) ([]byte, error) {
+	key, err := DecodeBase64(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keyLength {
+		return nil, fmt.Errorf("olm: invalid key length %d", len(key))
+	}
+	return key, nil
+}
+
+// Curve25519KeyPair is a curve25519 key, Private is empty for the keys of other devices.
+type Curve25519KeyPair struct {
+	Private []byte `json:"private,omitempty"`
+	Public  []byte `json:"public"`
+}
+
+func newCurve25519KeyPair() (Curve25519KeyPair, error) {
+	private := make([]byte, keyLength)
+	if _, err := rand.Read(private); err != nil {
+		return Curve25519KeyPair{}, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return Curve25519KeyPair{}, err
+	}
+	return Curve25519KeyPair{Private: private, Public: public}, nil
+}
+
+// sharedSecret returns the Diffie-Hellman secret of our private and their public key.
+func sharedSecret(private, public []byte) ([]byte, error) {
+	return curve25519.X25519(private, public)
+}
+
+func hkdfSHA256(secret, salt []byte, info string, length int) []byte {
+	out := make([]byte, length)
+	// hkdf only fails when reading more than 255 blocks
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), out) //nolint:errcheck
+	return out
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// cipherKeys are the keys a message is encrypted (AES-256-CBC) and authenticated
+// (HMAC-SHA-256) with.
+type cipherKeys struct {
+	aesKey []byte
+	macKey []byte
+	iv     []byte
+}
+
+// deriveCipherKeys derives the keys of a message from its message key.
+func deriveCipherKeys(key []byte, info string) cipherKeys {
+	k := hkdfSHA256(key, nil, info, 80)
+	return cipherKeys{aesKey: k[:32], macKey: k[32:64], iv: k[64:]}
+}
+
+func (k cipherKeys) encrypt(plaintext []byte) []byte {
+	block, _ := aes.NewCipher(k.aesKey)
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	data := append(append([]byte(nil), plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, k.iv).CryptBlocks(data, data)
+	return data
+}
+
+func (k cipherKeys) decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrBadMessage
+	}
+	block, _ := aes.NewCipher(k.aesKey)
+	data := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, k.iv).CryptBlocks(data, ciphertext)
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, ErrBadMessage
+	}
+	return data[:len(data)-padding], nil
+}
+
+// mac returns the truncated MAC of data.
+func (k cipherKeys) mac(data []byte) []byte {
+	return hmacSHA256(k.macKey, data)[:macLength]
+}
+
+// verify checks the MAC at the end of message.
+func (k cipherKeys) verify(message []byte) error {
+	if len(message) < macLength || !hmac.Equal(k.mac(message[:len(message)-macLength]), message[len(message)-macLength:]) {
+		return ErrBadMAC
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package olm
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	megolmParts      = 4
+	megolmPartLength = 32
+	signatureLength  = 64
+	// sessionKeyVersion is the version of the exported session keys we support.
+	sessionKeyVersion = 2
+	sessionKeyLength  = 1 + 4 + megolmParts*megolmPartLength + keyLength + signatureLength
+)
+
+// megolmRatchet is the hash ratchet of a group session, Data are the 4 parts R(0)..R(3)
+// of the ratchet at index Counter.
+type megolmRatchet struct {
+	Data    []byte `json:"data"`
+	Counter uint32 `json:"counter"`
+}
+
+func (r *megolmRatchet) copy() megolmRatchet {
+	return megolmRatchet{Data: append([]byte(nil), r.Data...), Counter: r.Counter}
+}
+
+// rehash sets part to to the hash of part from.
+func (r *megolmRatchet) rehash(from, to int) {
+	h := hmacSHA256(r.Data[from*megolmPartLength:(from+1)*megolmPartLength], []byte{byte(to)})
+	copy(r.Data[to*megolmPartLength:], h)
+}
+
+// advance advances the ratchet by one.
+func (r *megolmRatchet) advance() {
+	r.Counter++
+	// the parts to rehash depend on the bytes of the counter that changed
+	h := 0
+	for mask := uint32(0x00FFFFFF); h < megolmParts; h++ {
+		if r.Counter&mask == 0 {
+			break
+		}
+		mask >>= 8
+	}
+	for i := megolmParts - 1; i >= h; i-- {
+		r.rehash(h, i)
+	}
+}
+
+// advanceTo advances the ratchet to index.
+func (r *megolmRatchet) advanceTo(index uint32) {
+	for j := 0; j < megolmParts; j++ {
+		shift := uint((megolmParts - j - 1) * 8)
+		mask := ^uint32(0) << shift
+		steps := ((index >> shift) - (r.Counter >> shift)) & 0xff
+		if steps == 0 {
+			if index >= r.Counter {
+				continue
+			}
+			steps = 0x100
+		}
+		// only the last step of R(j) needs to update R(j+1)..R(3)
+		for ; steps > 1; steps-- {
+			r.rehash(j, j)
+		}
+		for k := megolmParts - 1; k >= j; k-- {
+			r.rehash(j, k)
+		}
+		r.Counter = index & mask
+	}
+}
+
+func (r *megolmRatchet) cipherKeys() cipherKeys {
+	return deriveCipherKeys(r.Data, infoMegolm)
+}
+
+// OutboundGroupSession is a Megolm session we encrypt room messages with.
+type OutboundGroupSession struct {
+	Ratchet    megolmRatchet      `json:"ratchet"`
+	SigningKey ed25519.PrivateKey `json:"signing_key"`
+}
+
+// NewOutboundGroupSession returns a new group session.
+func NewOutboundGroupSession() (*OutboundGroupSession, error) {
+	data := make([]byte, megolmParts*megolmPartLength)
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboundGroupSession{Ratchet: megolmRatchet{Data: data}, SigningKey: signingKey}, nil
+}
+
+// ID returns the session ID, the public signing key.
+func (s *OutboundGroupSession) ID() string {
+	return EncodeBase64(s.SigningKey.Public().(ed25519.PublicKey))
+}
+
+// MessageIndex returns the index of the next message.
+func (s *OutboundGroupSession) MessageIndex() uint32 {
+	return s.Ratchet.Counter
+}
+
+// SessionKey returns the key others need to decrypt the messages from the current index on.
+func (s *OutboundGroupSession) SessionKey() string {
+	b := []byte{sessionKeyVersion}
+	b = binary.BigEndian.AppendUint32(b, s.Ratchet.Counter)
+	b = append(b, s.Ratchet.Data...)
+	b = append(b, s.SigningKey.Public().(ed25519.PublicKey)...)
+	b = append(b, ed25519.Sign(s.SigningKey, b)...)
+	return EncodeBase64(b)
+}
+
+// Encrypt encrypts plaintext and returns the base64 encoded message.
+func (s *OutboundGroupSession) Encrypt(plaintext []byte) string {
+	keys := s.Ratchet.cipherKeys()
+	msg := encodeGroupMessage(s.Ratchet.Counter, keys.encrypt(plaintext))
+	msg = append(msg, keys.mac(msg)...)
+	msg = append(msg, ed25519.Sign(s.SigningKey, msg)...)
+	s.Ratchet.advance()
+	return EncodeBase64(msg)
+}
+
+// InboundGroupSession is a Megolm session of another device we decrypt room messages with.
+type InboundGroupSession struct {
+	InitialRatchet megolmRatchet     `json:"initial_ratchet"`
+	LatestRatchet  megolmRatchet     `json:"latest_ratchet"`
+	SigningKey     ed25519.PublicKey `json:"signing_key"`
+}
+
+// NewInboundGroupSession returns the group session of sessionKey, as shared by its sender.
+func NewInboundGroupSession(sessionKey string) (*InboundGroupSession, error) {
+	raw, err := DecodeBase64(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != sessionKeyLength || raw[0] != sessionKeyVersion {
+		return nil, errors.New("olm: invalid session key")
+	}
+	signed := raw[:len(raw)-signatureLength]
+	signingKey := ed25519.PublicKey(signed[len(signed)-keyLength:])
+	if !ed25519.Verify(signingKey, signed, raw[len(signed):]) {
+		return nil, ErrBadSignature
+	}
+	ratchet := megolmRatchet{Data: append([]byte(nil), raw[5:5+megolmParts*megolmPartLength]...), Counter: binary.BigEndian.Uint32(raw[1:5])}
+	return &InboundGroupSession{
+		InitialRatchet: ratchet,
+		LatestRatchet:  ratchet.copy(),
+		SigningKey:     append(ed25519.PublicKey(nil), signingKey...),
+	}, nil
+}
+
+// ID returns the session ID, the public signing key.
+func (s *InboundGroupSession) ID() string {
+	return EncodeBase64(s.SigningKey)
+}
+
+// FirstKnownIndex returns the index of the first message we can decrypt.
+func (s *InboundGroupSession) FirstKnownIndex() uint32 {
+	return s.InitialRatchet.Counter
+}
+
+// Decrypt decrypts the base64 encoded message body and returns the plaintext and the
+// index of the message.
+func (s *InboundGroupSession) Decrypt(body string) ([]byte, uint32, error) {
+	raw, err := DecodeBase64(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, ciphertext, err := decodeGroupMessage(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	signed := raw[:len(raw)-signatureLength]
+	if !ed25519.Verify(s.SigningKey, signed, raw[len(signed):]) {
+		return nil, 0, ErrBadSignature
+	}
+	if index < s.InitialRatchet.Counter {
+		return nil, 0, errors.New("olm: unknown message index")
+	}
+
+	// messages before the latest one are decrypted from the initial ratchet
+	ratchet := &s.LatestRatchet
+	if index < s.LatestRatchet.Counter {
+		initial := s.InitialRatchet.copy()
+		ratchet = &initial
+	}
+	ratchet.advanceTo(index)
+	keys := ratchet.cipherKeys()
+	if err := keys.verify(signed); err != nil {
+		return nil, 0, err
+	}
+	plaintext, err := keys.decrypt(ciphertext)
+	if err != nil {
+		return nil, 0, err
+	}
+	return plaintext, index, nil
+}
@@ -0,0 +1,159 @@
+package olm
+
+import (
+	"encoding/binary"
+)
+
+// messageVersion is the version of the message formats we support.
+const messageVersion = 3
+
+// The tags of the (protobuf-like) fields of the messages.
+const (
+	tagRatchetKey = 0x0A
+	tagChainIndex = 0x10
+	tagCiphertext = 0x22
+
+	tagOneTimeKey  = 0x0A
+	tagBaseKey     = 0x12
+	tagIdentityKey = 0x1A
+	tagMessage     = 0x22
+
+	tagGroupIndex      = 0x08
+	tagGroupCiphertext = 0x12
+)
+
+func appendBytesField(b []byte, tag byte, value []byte) []byte {
+	b = append(b, tag)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendIntField(b []byte, tag byte, value uint32) []byte {
+	b = append(b, tag)
+	return binary.AppendUvarint(b, uint64(value))
+}
+
+// fields are the decoded fields of a message.
+type fields struct {
+	bytes map[byte][]byte
+	ints  map[byte]uint64
+}
+
+// decodeFields decodes the fields of the message b (without version), skipping unknown ones.
+func decodeFields(b []byte) (fields, error) {
+	f := fields{bytes: make(map[byte][]byte), ints: make(map[byte]uint64)}
+	for len(b) > 0 {
+		tag := b[0]
+		b = b[1:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return f, ErrBadMessage
+			}
+			f.ints[tag] = v
+			b = b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return f, ErrBadMessage
+			}
+			f.bytes[tag] = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return f, ErrBadMessage
+		}
+	}
+	return f, nil
+}
+
+// message is a normal Olm message.
+type message struct {
+	ratchetKey []byte
+	chainIndex uint32
+	ciphertext []byte
+}
+
+// encode returns the message without MAC.
+func (m *message) encode() []byte {
+	b := []byte{messageVersion}
+	b = appendBytesField(b, tagRatchetKey, m.ratchetKey)
+	b = appendIntField(b, tagChainIndex, m.chainIndex)
+	return appendBytesField(b, tagCiphertext, m.ciphertext)
+}
+
+// decodeMessage decodes the message b, which ends with its MAC.
+func decodeMessage(b []byte) (*message, error) {
+	if len(b) < 1+macLength || b[0] != messageVersion {
+		return nil, ErrBadMessage
+	}
+	f, err := decodeFields(b[1 : len(b)-macLength])
+	if err != nil {
+		return nil, err
+	}
+	index, ok := f.ints[tagChainIndex]
+	if !ok || len(f.bytes[tagRatchetKey]) != keyLength || len(f.bytes[tagCiphertext]) == 0 {
+		return nil, ErrBadMessage
+	}
+	return &message{ratchetKey: f.bytes[tagRatchetKey], chainIndex: uint32(index), ciphertext: f.bytes[tagCiphertext]}, nil
+}
+
+// preKeyMessage is the message sent until the other device replied, it has the keys to
+// set up the session.
+type preKeyMessage struct {
+	oneTimeKey  []byte
+	baseKey     []byte
+	identityKey []byte
+	message     []byte
+}
+
+func (m *preKeyMessage) encode() []byte {
+	b := []byte{messageVersion}
+	b = appendBytesField(b, tagOneTimeKey, m.oneTimeKey)
+	b = appendBytesField(b, tagBaseKey, m.baseKey)
+	b = appendBytesField(b, tagIdentityKey, m.identityKey)
+	return appendBytesField(b, tagMessage, m.message)
+}
+
+func decodePreKeyMessage(b []byte) (*preKeyMessage, error) {
+	if len(b) < 1 || b[0] != messageVersion {
+		return nil, ErrBadMessage
+	}
+	f, err := decodeFields(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	m := &preKeyMessage{
+		oneTimeKey:  f.bytes[tagOneTimeKey],
+		baseKey:     f.bytes[tagBaseKey],
+		identityKey: f.bytes[tagIdentityKey],
+		message:     f.bytes[tagMessage],
+	}
+	if len(m.oneTimeKey) != keyLength || len(m.baseKey) != keyLength || len(m.identityKey) != keyLength || len(m.message) == 0 {
+		return nil, ErrBadMessage
+	}
+	return m, nil
+}
+
+// encodeGroupMessage returns the Megolm message without MAC and signature.
+func encodeGroupMessage(index uint32, ciphertext []byte) []byte {
+	b := []byte{messageVersion}
+	b = appendIntField(b, tagGroupIndex, index)
+	return appendBytesField(b, tagGroupCiphertext, ciphertext)
+}
+
+// decodeGroupMessage decodes the Megolm message b, which ends with its MAC and signature.
+func decodeGroupMessage(b []byte) (uint32, []byte, error) {
+	if len(b) < 1+macLength+signatureLength || b[0] != messageVersion {
+		return 0, nil, ErrBadMessage
+	}
+	f, err := decodeFields(b[1 : len(b)-macLength-signatureLength])
+	if err != nil {
+		return 0, nil, err
+	}
+	index, ok := f.ints[tagGroupIndex]
+	if !ok || len(f.bytes[tagGroupCiphertext]) == 0 {
+		return 0, nil, ErrBadMessage
+	}
+	return uint32(index), f.bytes[tagGroupCiphertext], nil
+}
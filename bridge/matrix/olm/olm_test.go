@@ -0,0 +1,265 @@
+package olm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSessions(t *testing.T) (*Session, *Session) {
+	alice, err := NewAccount()
+	require.NoError(t, err)
+	bob, err := NewAccount()
+	require.NoError(t, err)
+	require.NoError(t, bob.GenerateOneTimeKeys(2))
+	var oneTimeKey string
+	for _, key := range bob.UnpublishedOneTimeKeys() {
+		oneTimeKey = key
+	}
+	bob.MarkKeysAsPublished()
+	assert.Empty(t, bob.UnpublishedOneTimeKeys())
+
+	out, err := alice.NewOutboundSession(bob.Curve25519Key(), oneTimeKey)
+	require.NoError(t, err)
+	msgType, body, err := out.Encrypt([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, MessageTypePreKey, msgType)
+
+	_, err = bob.NewInboundSession(bob.Curve25519Key(), body)
+	assert.Error(t, err, "the message is from alice")
+	in, err := bob.NewInboundSession(alice.Curve25519Key(), body)
+	require.NoError(t, err)
+	assert.True(t, in.MatchesInbound(body))
+	plaintext, err := in.Decrypt(msgType, body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(plaintext))
+	assert.Equal(t, out.ID(), in.ID())
+
+	bob.RemoveOneTimeKeys(in)
+	assert.Len(t, bob.OneTimeKeys, 1)
+	_, err = bob.NewInboundSession("", body)
+	assert.Error(t, err, "the one-time key is used")
+	return out, in
+}
+
+func TestSession(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	// alice sends pre-key messages until bob replies
+	msgType, body, err := alice.Encrypt([]byte("second"))
+	require.NoError(t, err)
+	assert.Equal(t, MessageTypePreKey, msgType)
+	_, err = bob.Decrypt(MessageTypeNormal, body)
+	assert.Error(t, err)
+	plaintext, err := bob.Decrypt(msgType, body)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(plaintext))
+
+	msgType, body, err = bob.Encrypt([]byte("reply"))
+	require.NoError(t, err)
+	assert.Equal(t, MessageTypeNormal, msgType)
+	plaintext, err = alice.Decrypt(msgType, body)
+	require.NoError(t, err)
+	assert.Equal(t, "reply", string(plaintext))
+
+	// messages arriving out of order
+	var bodies []string
+	for _, text := range []string{"one", "two", "three"} {
+		msgType, body, err = alice.Encrypt([]byte(text))
+		require.NoError(t, err)
+		assert.Equal(t, MessageTypeNormal, msgType)
+		bodies = append(bodies, body)
+	}
+	for _, i := range []int{2, 0, 1} {
+		plaintext, err = bob.Decrypt(MessageTypeNormal, bodies[i])
+		require.NoError(t, err)
+		assert.Equal(t, []string{"one", "two", "three"}[i], string(plaintext))
+	}
+	_, err = bob.Decrypt(MessageTypeNormal, bodies[1])
+	assert.Error(t, err, "message keys are used once")
+
+	// tampered messages are rejected without changing the session
+	msgType, body, err = bob.Encrypt([]byte("last"))
+	require.NoError(t, err)
+	raw, err := DecodeBase64(body)
+	require.NoError(t, err)
+	raw[len(raw)-10] ^= 1
+	_, err = alice.Decrypt(msgType, EncodeBase64(raw))
+	assert.Equal(t, ErrBadMAC, err)
+
+	// sessions survive being persisted
+	data, err := json.Marshal(alice)
+	require.NoError(t, err)
+	var restored Session
+	require.NoError(t, json.Unmarshal(data, &restored))
+	plaintext, err = restored.Decrypt(msgType, body)
+	require.NoError(t, err)
+	assert.Equal(t, "last", string(plaintext))
+}
+
+func TestMegolmRatchet(t *testing.T) {
+	s, err := NewOutboundGroupSession()
+	require.NoError(t, err)
+	start := s.Ratchet.copy()
+
+	for _, index := range []uint32{1, 255, 256, 0x10000 + 3} {
+		stepped := start.copy()
+		for stepped.Counter < index {
+			stepped.advance()
+		}
+		jumped := start.copy()
+		jumped.advanceTo(index)
+		assert.Equal(t, stepped, jumped, "index %d", index)
+	}
+}
+
+func TestGroupSession(t *testing.T) {
+	out, err := NewOutboundGroupSession()
+	require.NoError(t, err)
+	first := out.Encrypt([]byte("before the key was shared"))
+
+	in, err := NewInboundGroupSession(out.SessionKey())
+	require.NoError(t, err)
+	assert.Equal(t, out.ID(), in.ID())
+	assert.Equal(t, uint32(1), in.FirstKnownIndex())
+	_, _, err = in.Decrypt(first)
+	assert.Error(t, err)
+
+	var bodies []string
+	for _, text := range []string{"one", "two", "three"} {
+		bodies = append(bodies, out.Encrypt([]byte(text)))
+	}
+	for _, i := range []int{2, 0, 1, 0} {
+		plaintext, index, err := in.Decrypt(bodies[i])
+		require.NoError(t, err)
+		assert.Equal(t, []string{"one", "two", "three"}[i], string(plaintext))
+		assert.Equal(t, uint32(i+1), index)
+	}
+
+	raw, err := DecodeBase64(bodies[0])
+	require.NoError(t, err)
+	raw[5] ^= 1
+	_, _, err = in.Decrypt(EncodeBase64(raw))
+	assert.Equal(t, ErrBadSignature, err)
+
+	key, err := DecodeBase64(out.SessionKey())
+	require.NoError(t, err)
+	key[10] ^= 1
+	_, err = NewInboundGroupSession(EncodeBase64(key))
+	assert.Equal(t, ErrBadSignature, err)
+}
+
+func fromHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+// testKey returns the curve25519 key pair with the private key of 32 times c.
+func testKey(t *testing.T, c byte) Curve25519KeyPair {
+	private := bytes.Repeat([]byte{c}, keyLength)
+	public, err := sharedSecret(private, basepoint)
+	require.NoError(t, err)
+	return Curve25519KeyPair{Private: private, Public: public}
+}
+
+var basepoint = append([]byte{9}, make([]byte, keyLength-1)...)
+
+// TestPrimitives checks the primitives with the test vectors of RFC 7748 and RFC 5869.
+func TestPrimitives(t *testing.T) {
+	alice := fromHex(t, "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	public, err := sharedSecret(alice, basepoint)
+	require.NoError(t, err)
+	assert.Equal(t, "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a", hex.EncodeToString(public))
+	secret, err := sharedSecret(alice, fromHex(t, "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"))
+	require.NoError(t, err)
+	assert.Equal(t, "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742", hex.EncodeToString(secret))
+
+	okm := hkdfSHA256(bytes.Repeat([]byte{0x0b}, 22), fromHex(t, "000102030405060708090a0b0c"), string(fromHex(t, "f0f1f2f3f4f5f6f7f8f9")), 42)
+	assert.Equal(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865", hex.EncodeToString(okm))
+}
+
+// The known answers of TestOlmVectors and TestMegolmVectors were computed with a separate
+// implementation of the specifications, whose primitives pass the RFC 7748, RFC 8032,
+// FIPS-197 and RFC 5869 test vectors.
+
+func TestOlmVectors(t *testing.T) {
+	const (
+		sessionID = "8i02nn1Wkd1p+ExLP+LYyS4acPLBipSl5DkmqoL/NR8"
+		preKey    = "AwogUKYUCbHd0DJemxa3AOcZ6XcsBwALG9d4bpB8ZT0gSV0SIM6NOtHMtjPse3DBeBSlx27NApaFBQ00R0W6BYcOWH1ZGiCk4JKStlHCeLl3LFafX6m7E9kGtGq2jJ353CtECfiiCSI/AwogXf7dO2vUf2+ijuFdlp1bsOpTd01Ii9r53xxuASSz7yIQACIQcKZDZuLKq4iQ+BguE4BWY1i0ifWK7Rwe"
+	)
+	aliceIdentity, aliceBase, aliceRatchet := testKey(t, 1), testKey(t, 2), testKey(t, 3)
+	bobIdentity, bobOneTime := testKey(t, 4), testKey(t, 5)
+
+	// alice sets up the session like NewOutboundSession, with fixed keys
+	secret, err := tripleDH(
+		[2][]byte{aliceIdentity.Private, bobOneTime.Public},
+		[2][]byte{aliceBase.Private, bobIdentity.Public},
+		[2][]byte{aliceBase.Private, bobOneTime.Public},
+	)
+	require.NoError(t, err)
+	rootKey, chainKey := deriveRootKey(secret)
+	alice := &Session{
+		AliceIdentityKey: aliceIdentity.Public,
+		AliceBaseKey:     aliceBase.Public,
+		BobOneTimeKey:    bobOneTime.Public,
+		RootKey:          rootKey,
+		SenderChain:      &Chain{RatchetKey: aliceRatchet, ChainKey: chainKey},
+	}
+	assert.Equal(t, sessionID, alice.ID())
+	msgType, body, err := alice.Encrypt([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, MessageTypePreKey, msgType)
+	assert.Equal(t, preKey, body)
+
+	bob := &Account{IdentityKey: bobIdentity, OneTimeKeys: []OneTimeKey{{Key: bobOneTime}}}
+	in, err := bob.NewInboundSession(EncodeBase64(aliceIdentity.Public), preKey)
+	require.NoError(t, err)
+	assert.Equal(t, sessionID, in.ID())
+	plaintext, err := in.Decrypt(MessageTypePreKey, preKey)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(plaintext))
+}
+
+func TestMegolmVectors(t *testing.T) {
+	const (
+		sessionID  = "iodf/x6zhFFXes1a/uQFRWVo3XyJ4JCGOgVXvHr0nxc"
+		sessionKey = "AgAAAAAAAQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyAhIiMkJSYnKCkqKywtLi8wMTIzNDU2Nzg5Ojs8PT4/QEFCQ0RFRkdISUpLTE1OT1BRUlNUVVZXWFlaW1xdXl9gYWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXp7fH1+f4qHX/8es4RRV3rNWv7kBUVlaN18ieCQhjoFV7x69J8Xyu1ARAk7LDOiVwpY5mqF5M18cpQtVqEXTGHinUe6WlqTHXfV3TyAyLFJP5f6CtP9yUSsoUystmT77IAPtwqkBA"
+		first      = "AwgAEhAJyc3ljuF+LVkBm1A6iWwV39xqKXa092qPZPu7BUWiA/8HgduwV6eQ+1hS0eK7UlV+eUsof6eb2Fr0GzxWogsoTEv0ByAGyy4AZ55Q0K7SSMQuLF1JJFIF"
+		later      = "AwiDhAQSEBIXAxeEQXNESi4ryWaru4hULG/EQF0+mmyEq5/dYmn/O0+OC8rvJckEYlDTpPqPOCEXO3H6C4igo8KMMTBvgByVtZPZ4oMq+EuNzDOxzborAlH++ZimOAA"
+		ratchet    = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f797f21ad97515c3ed5cb1f8e6ec28cd83627aa8dc4ced0717120abbb03397159201a0fb884f73490cd5f073da95216d73e02b9d2fb0fc19bae3266158693b80e60e847fb896937043a0f7095c52a9def2c3bf9fb23442bfb6be3cc253aee55d3"
+	)
+	data := make([]byte, megolmParts*megolmPartLength)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	out := &OutboundGroupSession{
+		Ratchet:    megolmRatchet{Data: data},
+		SigningKey: ed25519.NewKeyFromSeed(bytes.Repeat([]byte{6}, ed25519.SeedSize)),
+	}
+	assert.Equal(t, sessionID, out.ID())
+	assert.Equal(t, sessionKey, out.SessionKey())
+	assert.Equal(t, first, out.Encrypt([]byte("hello")))
+
+	advanced := megolmRatchet{Data: append([]byte(nil), data...)}
+	advanced.advanceTo(0x010203)
+	assert.Equal(t, ratchet, hex.EncodeToString(advanced.Data))
+
+	in, err := NewInboundGroupSession(sessionKey)
+	require.NoError(t, err)
+	for _, m := range []struct {
+		body  string
+		text  string
+		index uint32
+	}{{later, "later", 0x010203}, {first, "hello", 0}} {
+		plaintext, index, err := in.Decrypt(m.body)
+		require.NoError(t, err)
+		assert.Equal(t, m.text, string(plaintext))
+		assert.Equal(t, m.index, index)
+	}
+}
@@ -0,0 +1,248 @@
+package olm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// The types of Olm messages.
+const (
+	MessageTypePreKey = 0
+	MessageTypeNormal = 1
+)
+
+const (
+	// maxReceiverChains is the number of ratchet keys of the other device we keep.
+	maxReceiverChains = 5
+	// maxSkippedKeys is the number of keys of skipped messages we keep for when they arrive.
+	maxSkippedKeys = 40
+	// maxMessageGap is the number of messages we skip at most to decrypt a message.
+	maxMessageGap = 2000
+)
+
+// Session is an Olm session with another device. Alice is the device that set it up,
+// Bob the device whose one-time key was used.
+type Session struct {
+	AliceIdentityKey []byte       `json:"alice_identity_key"`
+	AliceBaseKey     []byte       `json:"alice_base_key"`
+	BobOneTimeKey    []byte       `json:"bob_one_time_key"`
+	ReceivedMessage  bool         `json:"received_message"`
+	RootKey          []byte       `json:"root_key"`
+	SenderChain      *Chain       `json:"sender_chain,omitempty"`
+	ReceiverChains   []Chain      `json:"receiver_chains"`
+	SkippedKeys      []SkippedKey `json:"skipped_keys"`
+}
+
+// Chain is a chain of message keys of the double ratchet.
+type Chain struct {
+	RatchetKey Curve25519KeyPair `json:"ratchet_key"`
+	ChainKey   []byte            `json:"chain_key"`
+	Index      uint32            `json:"index"`
+}
+
+// SkippedKey is the key of a message we skipped over.
+type SkippedKey struct {
+	RatchetKey []byte `json:"ratchet_key"`
+	Index      uint32 `json:"index"`
+	MessageKey []byte `json:"message_key"`
+}
+
+// deriveRootKey returns the root and chain key of a new session with secret.
+func deriveRootKey(secret []byte) ([]byte, []byte) {
+	k := hkdfSHA256(secret, nil, infoRoot, 64)
+	return k[:32], k[32:]
+}
+
+// advanceRootKey returns the next root and chain key after a ratchet step.
+func advanceRootKey(rootKey, ourKey, theirKey []byte) ([]byte, []byte, error) {
+	secret, err := sharedSecret(ourKey, theirKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	k := hkdfSHA256(secret, rootKey, infoRatchet, 64)
+	return k[:32], k[32:], nil
+}
+
+func (c *Chain) messageKey() []byte {
+	return hmacSHA256(c.ChainKey, []byte{1})
+}
+
+func (c *Chain) advance() {
+	c.ChainKey = hmacSHA256(c.ChainKey, []byte{2})
+	c.Index++
+}
+
+// ID returns the ID of the session, the same on both devices.
+func (s *Session) ID() string {
+	h := sha256.New()
+	h.Write(s.AliceIdentityKey)
+	h.Write(s.AliceBaseKey)
+	h.Write(s.BobOneTimeKey)
+	return EncodeBase64(h.Sum(nil))
+}
+
+// MatchesInbound returns true if the pre-key message body was sent to set up s.
+func (s *Session) MatchesInbound(body string) bool {
+	raw, err := DecodeBase64(body)
+	if err != nil {
+		return false
+	}
+	pre, err := decodePreKeyMessage(raw)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(pre.identityKey, s.AliceIdentityKey) &&
+		bytes.Equal(pre.baseKey, s.AliceBaseKey) &&
+		bytes.Equal(pre.oneTimeKey, s.BobOneTimeKey)
+}
+
+// Encrypt encrypts plaintext and returns the type and (base64 encoded) body of the message.
+// Messages are pre-key messages until we received a message of the other device.
+func (s *Session) Encrypt(plaintext []byte) (int, string, error) {
+	if s.SenderChain == nil {
+		// a ratchet step after we received a message with a new ratchet key
+		ratchetKey, err := newCurve25519KeyPair()
+		if err != nil {
+			return 0, "", err
+		}
+		rootKey, chainKey, err := advanceRootKey(s.RootKey, ratchetKey.Private, s.ReceiverChains[0].RatchetKey.Public)
+		if err != nil {
+			return 0, "", err
+		}
+		s.RootKey = rootKey
+		s.SenderChain = &Chain{RatchetKey: ratchetKey, ChainKey: chainKey}
+	}
+
+	c := s.SenderChain
+	keys := deriveCipherKeys(c.messageKey(), infoKeys)
+	msg := (&message{ratchetKey: c.RatchetKey.Public, chainIndex: c.Index, ciphertext: keys.encrypt(plaintext)}).encode()
+	msg = append(msg, keys.mac(msg)...)
+	c.advance()
+
+	if s.ReceivedMessage {
+		return MessageTypeNormal, EncodeBase64(msg), nil
+	}
+	pre := &preKeyMessage{oneTimeKey: s.BobOneTimeKey, baseKey: s.AliceBaseKey, identityKey: s.AliceIdentityKey, message: msg}
+	return MessageTypePreKey, EncodeBase64(pre.encode()), nil
+}
+
+// Decrypt decrypts the message body of msgType. The session isn't changed when the message
+// can't be decrypted.
+func (s *Session) Decrypt(msgType int, body string) ([]byte, error) {
+	raw, err := DecodeBase64(body)
+	if err != nil {
+		return nil, err
+	}
+	if msgType == MessageTypePreKey {
+		pre, err := decodePreKeyMessage(raw)
+		if err != nil {
+			return nil, err
+		}
+		raw = pre.message
+	}
+	msg, err := decodeMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := s.decrypt(msg, raw)
+	if err != nil {
+		return nil, err
+	}
+	s.ReceivedMessage = true
+	return plaintext, nil
+}
+
+func (s *Session) decrypt(msg *message, raw []byte) ([]byte, error) {
+	var c *Chain
+	for i := range s.ReceiverChains {
+		if bytes.Equal(s.ReceiverChains[i].RatchetKey.Public, msg.ratchetKey) {
+			c = &s.ReceiverChains[i]
+			break
+		}
+	}
+
+	if c == nil {
+		// the other device did a ratchet step
+		if s.SenderChain == nil {
+			return nil, errors.New("olm: message with unknown ratchet key")
+		}
+		rootKey, chainKey, err := advanceRootKey(s.RootKey, s.SenderChain.RatchetKey.Private, msg.ratchetKey)
+		if err != nil {
+			return nil, err
+		}
+		next := Chain{RatchetKey: Curve25519KeyPair{Public: msg.ratchetKey}, ChainKey: chainKey}
+		plaintext, skipped, err := decryptWithChain(&next, msg, raw)
+		if err != nil {
+			return nil, err
+		}
+		s.ReceiverChains = append([]Chain{next}, s.ReceiverChains...)
+		if len(s.ReceiverChains) > maxReceiverChains {
+			s.ReceiverChains = s.ReceiverChains[:maxReceiverChains]
+		}
+		s.RootKey = rootKey
+		s.SenderChain = nil
+		s.addSkippedKeys(skipped)
+		return plaintext, nil
+	}
+
+	if msg.chainIndex < c.Index {
+		// a message we skipped over before
+		for i, k := range s.SkippedKeys {
+			if k.Index != msg.chainIndex || !bytes.Equal(k.RatchetKey, msg.ratchetKey) {
+				continue
+			}
+			keys := deriveCipherKeys(k.MessageKey, infoKeys)
+			if err := keys.verify(raw); err != nil {
+				return nil, err
+			}
+			plaintext, err := keys.decrypt(msg.ciphertext)
+			if err != nil {
+				return nil, err
+			}
+			s.SkippedKeys = append(s.SkippedKeys[:i], s.SkippedKeys[i+1:]...)
+			return plaintext, nil
+		}
+		return nil, errors.New("olm: message key already used")
+	}
+
+	next := *c
+	plaintext, skipped, err := decryptWithChain(&next, msg, raw)
+	if err != nil {
+		return nil, err
+	}
+	*c = next
+	s.addSkippedKeys(skipped)
+	return plaintext, nil
+}
+
+func (s *Session) addSkippedKeys(keys []SkippedKey) {
+	s.SkippedKeys = append(s.SkippedKeys, keys...)
+	if len(s.SkippedKeys) > maxSkippedKeys {
+		s.SkippedKeys = s.SkippedKeys[len(s.SkippedKeys)-maxSkippedKeys:]
+	}
+}
+
+// decryptWithChain advances c to the message msg and decrypts it, returning the keys of
+// the messages skipped over.
+func decryptWithChain(c *Chain, msg *message, raw []byte) ([]byte, []SkippedKey, error) {
+	if msg.chainIndex-c.Index > maxMessageGap {
+		return nil, nil, errors.New("olm: too many skipped messages")
+	}
+	var skipped []SkippedKey
+	for c.Index < msg.chainIndex {
+		skipped = append(skipped, SkippedKey{RatchetKey: c.RatchetKey.Public, Index: c.Index, MessageKey: c.messageKey()})
+		c.advance()
+	}
+	keys := deriveCipherKeys(c.messageKey(), infoKeys)
+	if err := keys.verify(raw); err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := keys.decrypt(msg.ciphertext)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.advance()
+	return plaintext, skipped, nil
+}
@@ -0,0 +1,375 @@
+package bmatrix
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	matrix "github.com/matterbridge/gomatrix"
+)
+
+// maxUpgrades limits the room upgrades we follow when joining a room.
+const maxUpgrades = 5
+
+// space is a space bridged as channel name: the messages of its (joined) child rooms are
+// relayed as messages of the channel.
+type space struct {
+	name     string
+	children []spaceChild
+}
+
+type spaceChild struct {
+	roomID string
+	order  string
+}
+
+// spaceChildContent is the content of m.space.child events, children without via were
+// removed from the space.
+type spaceChildContent struct {
+	Via   []string `json:"via"`
+	Order string   `json:"order"`
+}
+
+// addChild adds the child c, keeping the children in the order of the space.
+func (sp *space) addChild(c spaceChild) {
+	sp.removeChild(c.roomID)
+	i := sort.Search(len(sp.children), func(i int) bool {
+		return childBefore(c, sp.children[i])
+	})
+	sp.children = append(sp.children, spaceChild{})
+	copy(sp.children[i+1:], sp.children[i:])
+	sp.children[i] = c
+}
+
+func (sp *space) removeChild(roomID string) bool {
+	for i, c := range sp.children {
+		if c.roomID == roomID {
+			sp.children = append(sp.children[:i], sp.children[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// childBefore returns true if a is ordered before b, children with an order come first.
+func childBefore(a, b spaceChild) bool {
+	if (a.order == "") != (b.order == "") {
+		return a.order != ""
+	}
+	if a.order != b.order {
+		return a.order < b.order
+	}
+	return a.roomID < b.roomID
+}
+
+// serverName returns the server part of the user, room or alias id.
+func serverName(id string) string {
+	if i := strings.IndexByte(id, ':'); i != -1 {
+		return id[i+1:]
+	}
+	return ""
+}
+
+// addRoom bridges the joined room roomID as channel name: the rooms it was upgraded to are
+// followed and the child rooms of spaces are joined.
+func (b *Bmatrix) addRoom(roomID, name string) {
+	for i := 0; i < maxUpgrades; i++ {
+		replacement := b.replacementRoom(roomID)
+		if replacement == "" {
+			break
+		}
+		resp, err := b.mc.JoinRoom(replacement, serverName(roomID), nil)
+		if err != nil {
+			b.Log.Errorf("%s was upgraded to %s but joining it failed: %s", roomID, replacement, err)
+			break
+		}
+		b.Log.Infof("%s was upgraded to %s, bridging %s there", roomID, resp.RoomID, name)
+		roomID = resp.RoomID
+	}
+
+	if b.isSpace(roomID) {
+		b.joinSpace(roomID, name)
+		return
+	}
+
+	b.Lock()
+	b.RoomMap[roomID] = name
+	b.Unlock()
+	b.checkEncrypted(roomID)
+}
+
+// replacementRoom returns the room roomID was upgraded to, if any.
+func (b *Bmatrix) replacementRoom(roomID string) string {
+	var tombstone struct {
+		ReplacementRoom string `json:"replacement_room"`
+	}
+	if err := b.mc.StateEvent(roomID, "m.room.tombstone", "", &tombstone); err != nil {
+		return ""
+	}
+	return tombstone.ReplacementRoom
+}
+
+func (b *Bmatrix) isSpace(roomID string) bool {
+	var create struct {
+		Type string `json:"type"`
+	}
+	return b.mc.StateEvent(roomID, "m.room.create", "", &create) == nil && create.Type == "m.space"
+}
+
+// joinSpace bridges the child rooms of the space roomID as channel name.
+func (b *Bmatrix) joinSpace(roomID, name string) {
+	b.Lock()
+	if _, ok := b.spaces[roomID]; ok {
+		b.Unlock()
+		return
+	}
+	sp := &space{name: name}
+	b.spaces[roomID] = sp
+	b.Unlock()
+
+	var state []matrix.Event
+	if err := b.mc.MakeRequest("GET", b.mc.BuildURL("rooms", roomID, "state"), nil, &state); err != nil {
+		b.Log.Errorf("Getting the rooms of space %s failed: %s", roomID, err)
+		return
+	}
+	for i := range state {
+		if state[i].Type == "m.space.child" {
+			state[i].RoomID = roomID
+			b.handleSpaceChild(&state[i])
+		}
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+	b.Log.Infof("Bridging %d rooms of space %s as %s", len(sp.children), roomID, name)
+}
+
+// handleSpaceChild joins or stops bridging the child room of the (space) event ev.
+func (b *Bmatrix) handleSpaceChild(ev *matrix.Event) {
+	b.RLock()
+	sp, ok := b.spaces[ev.RoomID]
+	b.RUnlock()
+	if !ok || ev.StateKey == nil || *ev.StateKey == "" {
+		return
+	}
+	roomID := *ev.StateKey
+
+	var content spaceChildContent
+	if err := interface2Struct(ev.Content, &content); err != nil || len(content.Via) == 0 {
+		b.Lock()
+		if sp.removeChild(roomID) && b.RoomMap[roomID] == sp.name {
+			delete(b.RoomMap, roomID)
+			b.Log.Infof("%s was removed from space %s, not bridging it anymore", roomID, ev.RoomID)
+		}
+		b.Unlock()
+		return
+	}
+
+	b.RLock()
+	channel, bridged := b.RoomMap[roomID]
+	b.RUnlock()
+	// rooms which are configured as channels themselves keep their channel
+	if bridged && channel != sp.name {
+		return
+	}
+
+	resp, err := b.mc.JoinRoom(roomID, content.Via[0], nil)
+	if err != nil {
+		b.Log.Errorf("Joining %s of space %s failed: %s", roomID, ev.RoomID, err)
+		return
+	}
+	if b.isSpace(resp.RoomID) {
+		b.joinSpace(resp.RoomID, sp.name)
+		return
+	}
+
+	b.Lock()
+	sp.addChild(spaceChild{roomID: resp.RoomID, order: content.Order})
+	b.RoomMap[resp.RoomID] = sp.name
+	b.Unlock()
+	b.checkEncrypted(resp.RoomID)
+}
+
+// handleTombstone moves the bridging of the room of (tombstone) event ev to the room it was
+// upgraded to.
+func (b *Bmatrix) handleTombstone(ev *matrix.Event) {
+	replacement, _ := ev.Content["replacement_room"].(string)
+	if replacement == "" {
+		return
+	}
+
+	b.RLock()
+	name, bridged := b.RoomMap[ev.RoomID]
+	sp, isSpace := b.spaces[ev.RoomID]
+	b.RUnlock()
+	if !bridged && !isSpace {
+		return
+	}
+
+	resp, err := b.mc.JoinRoom(replacement, serverName(ev.Sender), nil)
+	if err != nil {
+		b.Log.Errorf("%s was upgraded to %s but joining it failed: %s", ev.RoomID, replacement, err)
+		return
+	}
+	b.Log.Infof("%s was upgraded to %s", ev.RoomID, resp.RoomID)
+
+	if isSpace {
+		b.Lock()
+		delete(b.spaces, ev.RoomID)
+		b.Unlock()
+		b.joinSpace(resp.RoomID, sp.name)
+		return
+	}
+
+	b.Lock()
+	delete(b.RoomMap, ev.RoomID)
+	b.RoomMap[resp.RoomID] = name
+	for _, parent := range b.spaces {
+		for i := range parent.children {
+			if parent.children[i].roomID == ev.RoomID {
+				parent.children[i].roomID = resp.RoomID
+			}
+		}
+	}
+	b.Unlock()
+	b.checkEncrypted(resp.RoomID)
+}
+
+// spaceByName returns the space bridged as channel name, preferring spaces with rooms over
+// the (nested) spaces without rooms. The caller must hold the lock.
+func (b *Bmatrix) spaceByName(name string) *space {
+	var found *space
+	for _, sp := range b.spaces {
+		if sp.name == name && (found == nil || len(found.children) == 0) {
+			found = sp
+		}
+	}
+	return found
+}
+
+// sendRoomID returns the room to send msg to. Messages to a space go to the room of the
+// message they reply to or change, or else to the first room of the space.
+func (b *Bmatrix) sendRoomID(msg *config.Message) string {
+	b.RLock()
+	sp := b.spaceByName(msg.Channel)
+	b.RUnlock()
+	if sp == nil {
+		return b.getRoomID(msg.Channel)
+	}
+
+	for _, id := range []string{msg.ParentID, msg.ID} {
+		if roomID, ok := b.eventRooms.Get(id); ok && id != "" {
+			return roomID.(string)
+		}
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+	if len(sp.children) == 0 {
+		return ""
+	}
+	return sp.children[0].roomID
+}
+
+// acceptInvite returns true if the invites of sender are accepted, AcceptInvitesFrom
+// contains user ids or the servers (":example.com") of the users.
+func (b *Bmatrix) acceptInvite(sender string) bool {
+	for _, allowed := range b.GetStringSlice("AcceptInvitesFrom") {
+		if allowed == sender || strings.HasPrefix(allowed, ":") && allowed[1:] == serverName(sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitInvite records channel name to be bridged once we're invited to it.
+func (b *Bmatrix) awaitInvite(name string) {
+	b.Lock()
+	b.invitable[name] = struct{}{}
+	b.Unlock()
+}
+
+// handleInvite joins the room of the (membership) event ev when we're invited by an
+// allowed user, and bridges it if it's a room we're waiting for.
+func (b *Bmatrix) handleInvite(ev *matrix.Event) {
+	if ev.StateKey == nil || *ev.StateKey != b.UserID {
+		return
+	}
+	if !b.acceptInvite(ev.Sender) {
+		b.Log.Infof("Ignoring the invite of %s to %s", ev.Sender, ev.RoomID)
+		return
+	}
+
+	resp, err := b.mc.JoinRoom(ev.RoomID, serverName(ev.Sender), nil)
+	if err != nil {
+		b.Log.Errorf("Joining %s after the invite of %s failed: %s", ev.RoomID, ev.Sender, err)
+		return
+	}
+
+	if b.joinInvitedChild(resp.RoomID) {
+		return
+	}
+	name, ok := b.invitedChannel(resp.RoomID)
+	if !ok {
+		b.Log.Infof("Joined %s after the invite of %s, add it to a gateway to bridge it", resp.RoomID, ev.Sender)
+		return
+	}
+	b.Log.Infof("Joined %s after the invite of %s, bridging it as %s", resp.RoomID, ev.Sender, name)
+	b.addRoom(resp.RoomID, name)
+}
+
+// joinInvitedChild bridges the joined room roomID if it's a child of a bridged space, for
+// children we could only join after an invite.
+func (b *Bmatrix) joinInvitedChild(roomID string) bool {
+	b.RLock()
+	spaceIDs := make([]string, 0, len(b.spaces))
+	for spaceID := range b.spaces {
+		spaceIDs = append(spaceIDs, spaceID)
+	}
+	b.RUnlock()
+
+	for _, spaceID := range spaceIDs {
+		var content spaceChildContent
+		if b.mc.StateEvent(spaceID, "m.space.child", roomID, &content) != nil || len(content.Via) == 0 {
+			continue
+		}
+		b.handleSpaceChild(&matrix.Event{
+			Type:     "m.space.child",
+			RoomID:   spaceID,
+			StateKey: &roomID,
+			Content:  map[string]interface{}{"via": content.Via, "order": content.Order},
+		})
+		return true
+	}
+	return false
+}
+
+// invitedChannel returns the channel waiting for an invite to the room roomID.
+func (b *Bmatrix) invitedChannel(roomID string) (string, bool) {
+	b.RLock()
+	invitable := make([]string, 0, len(b.invitable))
+	for name := range b.invitable {
+		invitable = append(invitable, name)
+	}
+	b.RUnlock()
+
+	for _, name := range invitable {
+		id := name
+		if strings.HasPrefix(name, "#") {
+			var resp struct {
+				RoomID string `json:"room_id"`
+			}
+			if err := b.mc.MakeRequest("GET", b.mc.BuildURL("directory", "room", name), nil, &resp); err != nil {
+				continue
+			}
+			id = resp.RoomID
+		}
+		if id == roomID {
+			b.Lock()
+			delete(b.invitable, name)
+			b.Unlock()
+			return name, true
+		}
+	}
+	return "", false
+}
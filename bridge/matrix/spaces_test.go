@@ -0,0 +1,167 @@
+package bmatrix
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	matrix "github.com/matterbridge/gomatrix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// spaceServer is a stand-in for a homeserver with the space #space:example.com, the room
+// #old:example.com which was upgraded and the invite-only room !locked:example.com.
+type spaceServer struct {
+	sync.Mutex
+
+	invited bool
+	sent    []string
+}
+
+func (ss *spaceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ss.Lock()
+	defer ss.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/_matrix/client/r0/")
+	switch {
+	case strings.HasPrefix(p, "join/"):
+		room := strings.TrimPrefix(p, "join/")
+		switch room {
+		case "#space:example.com":
+			room = "!space:example.com"
+		case "#old:example.com":
+			room = "!old:example.com"
+		case "!locked:example.com":
+			if !ss.invited {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"not invited"}`)) //nolint:errcheck
+				return
+			}
+		}
+		w.Write([]byte(`{"room_id":"` + room + `"}`)) //nolint:errcheck
+	case strings.Contains(p, "/send/"):
+		ss.sent = append(ss.sent, strings.Split(p, "/")[1])
+		w.Write([]byte(`{"event_id":"$sent"}`)) //nolint:errcheck
+	case p == "rooms/!space:example.com/state/m.room.create":
+		w.Write([]byte(`{"type":"m.space"}`)) //nolint:errcheck
+	case p == "rooms/!space:example.com/state":
+		w.Write([]byte(`[
+			{"type":"m.room.create","state_key":"","content":{"type":"m.space"}},
+			{"type":"m.space.child","state_key":"!b:example.com","content":{"via":["example.com"],"order":"b"}},
+			{"type":"m.space.child","state_key":"!a:example.com","content":{"via":["example.com"],"order":"a"}},
+			{"type":"m.space.child","state_key":"!gone:example.com","content":{}}
+		]`)) //nolint:errcheck
+	case p == "rooms/!old:example.com/state/m.room.tombstone":
+		w.Write([]byte(`{"replacement_room":"!new:example.com"}`)) //nolint:errcheck
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`)) //nolint:errcheck
+	}
+}
+
+func (ss *spaceServer) lastSent() string {
+	ss.Lock()
+	defer ss.Unlock()
+	if len(ss.sent) == 0 {
+		return ""
+	}
+	return ss.sent[len(ss.sent)-1]
+}
+
+func TestSpaces(t *testing.T) {
+	ss := &spaceServer{}
+	server := httptest.NewServer(ss)
+	defer server.Close()
+	b := newTestMatrix(t, server.URL, `AcceptInvitesFrom=["@admin:example.com"]`)
+
+	// the rooms of a space are bridged as one channel
+	require.NoError(t, b.JoinChannel(config.ChannelInfo{Name: "#space:example.com"}))
+	assert.Equal(t, "#space:example.com", b.RoomMap["!a:example.com"])
+	assert.Equal(t, "#space:example.com", b.RoomMap["!b:example.com"])
+	assert.NotContains(t, b.RoomMap, "!gone:example.com")
+	assert.NotContains(t, b.RoomMap, "!space:example.com")
+
+	_, err := b.Send(config.Message{Text: "hello", Channel: "#space:example.com", Username: "alice: "})
+	require.NoError(t, err)
+	assert.Equal(t, "!a:example.com", ss.lastSent(), "messages go to the first room")
+
+	b.handleEvent(&matrix.Event{
+		Type: "m.room.message", Sender: "@carol:example.com", RoomID: "!b:example.com", ID: "$question",
+		Content: map[string]interface{}{"msgtype": "m.text", "body": "question"},
+	})
+	require.Len(t, b.Remote, 1)
+	rmsg := <-b.Remote
+	assert.Equal(t, "#space:example.com", rmsg.Channel)
+	_, err = b.Send(config.Message{Text: "answer", Channel: "#space:example.com", Username: "alice: ", ParentID: "$question"})
+	require.NoError(t, err)
+	assert.Equal(t, "!b:example.com", ss.lastSent(), "replies go to the room of the message")
+
+	// children added to and removed from the space
+	stateKey := "!c:example.com"
+	b.handleSpaceChild(&matrix.Event{
+		Type: "m.space.child", RoomID: "!space:example.com", StateKey: &stateKey,
+		Content: map[string]interface{}{"via": []string{"example.com"}},
+	})
+	assert.Equal(t, "#space:example.com", b.RoomMap["!c:example.com"])
+	stateKey = "!a:example.com"
+	b.handleSpaceChild(&matrix.Event{
+		Type: "m.space.child", RoomID: "!space:example.com", StateKey: &stateKey,
+		Content: map[string]interface{}{},
+	})
+	assert.NotContains(t, b.RoomMap, "!a:example.com")
+	_, err = b.Send(config.Message{Text: "hello", Channel: "#space:example.com", Username: "alice: "})
+	require.NoError(t, err)
+	assert.Equal(t, "!b:example.com", ss.lastSent())
+}
+
+func TestRoomUpgrades(t *testing.T) {
+	ss := &spaceServer{}
+	server := httptest.NewServer(ss)
+	defer server.Close()
+	b := newTestMatrix(t, server.URL, "")
+
+	// rooms upgraded before we joined
+	require.NoError(t, b.JoinChannel(config.ChannelInfo{Name: "#old:example.com"}))
+	assert.Equal(t, "#old:example.com", b.RoomMap["!new:example.com"])
+	assert.NotContains(t, b.RoomMap, "!old:example.com")
+
+	// rooms upgraded while bridged
+	b.handleTombstone(&matrix.Event{
+		Type: "m.room.tombstone", Sender: "@admin:example.com", RoomID: "!room:example.com",
+		Content: map[string]interface{}{"replacement_room": "!upgraded:example.com"},
+	})
+	assert.Equal(t, "#test", b.RoomMap["!upgraded:example.com"])
+	assert.NotContains(t, b.RoomMap, "!room:example.com")
+}
+
+func TestInvites(t *testing.T) {
+	ss := &spaceServer{}
+	server := httptest.NewServer(ss)
+	defer server.Close()
+	b := newTestMatrix(t, server.URL, `AcceptInvitesFrom=["@admin:example.com", ":trusted.org"]`)
+
+	assert.True(t, b.acceptInvite("@admin:example.com"))
+	assert.True(t, b.acceptInvite("@anyone:trusted.org"))
+	assert.False(t, b.acceptInvite("@mallory:example.com"))
+	assert.False(t, b.acceptInvite("@mallory:untrusted.org"))
+
+	// invite-only rooms wait for an invite
+	require.NoError(t, b.JoinChannel(config.ChannelInfo{Name: "!locked:example.com"}))
+	assert.NotContains(t, b.RoomMap, "!locked:example.com")
+
+	ss.invited = true
+	invite := func(sender string) {
+		stateKey := b.UserID
+		b.handleMemberChange(&matrix.Event{
+			Type: "m.room.member", Sender: sender, RoomID: "!locked:example.com", StateKey: &stateKey,
+			Content: map[string]interface{}{"membership": "invite"},
+		})
+	}
+	invite("@mallory:example.com")
+	assert.NotContains(t, b.RoomMap, "!locked:example.com")
+	invite("@admin:example.com")
+	assert.Equal(t, "!locked:example.com", b.RoomMap["!locked:example.com"])
+}
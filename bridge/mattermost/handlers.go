@@ -1,6 +1,8 @@
 package bmattermost
 
 import (
+	"time"
+
 	"github.com/42wim/matterbridge/bridge/config"
 	"github.com/42wim/matterbridge/bridge/helper"
 	"github.com/matterbridge/matterclient"
@@ -114,13 +116,17 @@ func (b *Bmattermost) handleMatterClient(messages chan *config.Message) {
 		b.Log.Debugf("== Receiving event %#v", message)
 
 		rmsg := &config.Message{
-			Username: message.Username,
-			UserID:   message.UserID,
-			Channel:  channelName,
-			Text:     message.Text,
-			ID:       message.Post.Id,
-			ParentID: message.Post.RootId, // ParentID is obsolete with mattermost
-			Extra:    make(map[string][]interface{}),
+			Username:  message.Username,
+			UserID:    message.UserID,
+			Channel:   channelName,
+			Text:      message.Text,
+			ID:        message.Post.Id,
+			ParentID:  message.Post.RootId, // ParentID is obsolete with mattermost
+			Extra:     make(map[string][]interface{}),
+			Timestamp: time.Unix(0, message.Post.CreateAt*int64(time.Millisecond)),
+		}
+		if message.Post.EditAt != 0 {
+			rmsg.Timestamp = time.Unix(0, message.Post.EditAt*int64(time.Millisecond))
 		}
 
 		// handle mattermost post properties (override username and attachments)
@@ -169,22 +175,27 @@ func (b *Bmattermost) handleMatterHook(messages chan *config.Message) {
 }
 
 func (b *Bmattermost) handleUploadFile(msg *config.Message) (string, error) {
-	var err error
-	var res, id string
+	var res string
 	channelID := b.getChannelID(msg.Channel)
-	for _, f := range msg.Extra["file"] {
+	for i, f := range msg.Extra["file"] {
 		fi := f.(config.FileInfo)
-		id, err = b.mc.UploadFile(*fi.Data, channelID, fi.Name)
+		id, err := b.mc.UploadFile(*fi.Data, channelID, fi.Name)
 		if err != nil {
-			return "", err
+			return res, &helper.UploadError{ID: res, Text: i > 0, Files: helper.FileNames(msg.Extra["file"][i:]), Err: err}
 		}
 		msg.Text = fi.Comment
 		if b.GetBool("PrefixMessagesWithNick") {
 			msg.Text = "[ " + msg.Username + " | " + "<@" + msg.UserID + ">" + " ]: " + msg.Text
 		}
-		res, err = b.mc.PostMessageWithFiles(channelID, msg.Text, msg.ParentID, []string{id})
+		postID, err := b.mc.PostMessageWithFiles(channelID, msg.Text, msg.ParentID, []string{id})
+		if err != nil {
+			return res, &helper.UploadError{ID: res, Text: i > 0, Files: helper.FileNames(msg.Extra["file"][i:]), Err: err}
+		}
+		if res == "" {
+			res = postID
+		}
 	}
-	return res, err
+	return res, nil
 }
 
 //nolint:forcetypeassert
@@ -10,6 +10,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"html"
 	"mime"
 	"os"
 	"regexp"
@@ -19,6 +20,7 @@ import (
 
 	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
 	"github.com/davecgh/go-spew/spew"
 
 	"github.com/mattn/godown"
@@ -272,6 +274,24 @@ func (b *Bmsteams) Send(msg config.Message) (string, error) {
 	mentionPattern := regexp.MustCompile(`(?:^|\s)@([^@\s]+)`)
 	mentionCounter := 0
 
+	// mentions of teams users
+	htmlText = helper.ReplaceMentions(htmlText, b.Account, msg.Mentions, func(m config.Mention) string {
+		mentionCounter++
+		mentionCounterPointer := mentionCounter
+		userID, displayName := m.UserID, m.Username
+		chatMessageMentionsArr = append(chatMessageMentionsArr, msgraph.ChatMessageMention{
+			ID:          &mentionCounterPointer,
+			MentionText: &displayName,
+			Mentioned: &msgraph.IdentitySet{
+				User: &msgraph.Identity{
+					ID:          &userID,
+					DisplayName: &displayName,
+				},
+			},
+		})
+		return fmt.Sprintf("<at id=\"%v\">%s</at>", mentionCounter, html.EscapeString(displayName))
+	})
+
 	htmlText = mentionPattern.ReplaceAllStringFunc(htmlText, func(matchingMention string) string {
 		mentionCounter++
 		//TODO: entscheiden ob channel/all oder user-mention erzeugt werden muss
@@ -668,6 +688,7 @@ func (b *Bmsteams) poll(channelName string) error {
 									UserID:   *reply.From.User.ID,
 									ID:       *reply.ID,
 									ParentID: *msg.ID,
+									Mentions: b.getMentions(&reply),
 									Extra:    make(map[string][]interface{}),
 								}
 								b.handleAttachments(&changedReplyObject, reply)
@@ -705,6 +726,7 @@ func (b *Bmsteams) poll(channelName string) error {
 								UserID:   *reply.From.User.ID,
 								ID:       *reply.ID,
 								ParentID: *msg.ID,
+								Mentions: b.getMentions(&reply),
 								Extra:    make(map[string][]interface{}),
 							}
 							b.handleAttachments(&newReplyObject, reply)
@@ -759,6 +781,7 @@ func (b *Bmsteams) poll(channelName string) error {
 					Avatar:   "",
 					UserID:   *msg.From.User.ID,
 					ID:       *msg.ID,
+					Mentions: b.getMentions(&msg),
 					Extra:    make(map[string][]interface{}),
 				}
 				b.handleAttachments(&rmsg, msg)
@@ -798,6 +821,29 @@ func (b *Bmsteams) setBotID() error {
 	return nil
 }
 
+// getMentions returns the users mentioned in msg, with the text converMentionsAndRemoveHTML
+// replaces their mention with.
+func (b *Bmsteams) getMentions(msg *msgraph.ChatMessage) []config.Mention {
+	var mentions []config.Mention
+	for _, mention := range msg.Mentions {
+		if mention.MentionText == nil || mention.Mentioned == nil || mention.Mentioned.User == nil ||
+			mention.Mentioned.User.ID == nil {
+			continue
+		}
+		username := *mention.MentionText
+		if mention.Mentioned.User.DisplayName != nil {
+			username = *mention.Mentioned.User.DisplayName
+		}
+		mentions = append(mentions, config.Mention{
+			Text:     "@" + *mention.MentionText,
+			Username: username,
+			UserID:   *mention.Mentioned.User.ID,
+			Account:  b.Account,
+		})
+	}
+	return mentions
+}
+
 func (b *Bmsteams) converMentionsAndRemoveHTML(msg *msgraph.ChatMessage) string {
 	// convert mentions in msg.Body.Content
 
@@ -819,6 +865,9 @@ func (b *Bmsteams) converMentionsAndRemoveHTML(msg *msgraph.ChatMessage) string
 				if mention.Mentioned.Conversation != nil {
 					return "@" + "channel"
 				}
+				if mention.Mentioned.User != nil && mention.MentionText != nil {
+					return "@" + *mention.MentionText
+				}
 			} else {
 				b.Log.Debugf("=> Mention additionalData is empty ")
 			}
@@ -0,0 +1,322 @@
+package bslack
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/slack-go/slack"
+)
+
+// attachmentColors are the hex colors of the named attachment colors.
+var attachmentColors = map[string]string{
+	"good":    "#2eb886",
+	"warning": "#daa038",
+	"danger":  "#a30200",
+}
+
+// richTextContainer is a rich text list, quote or preformatted block, which our version of
+// slack-go doesn't parse.
+type richTextContainer struct {
+	Type     slack.RichTextElementType `json:"type"`
+	Style    string                    `json:"style"` // bullet or ordered (lists)
+	Indent   int                       `json:"indent"`
+	Elements json.RawMessage           `json:"elements"`
+}
+
+// handleBlocks replaces the text of messages with Block Kit blocks (from apps and integrations)
+// by the rendered blocks, their text is only the fallback for notifications. The rich text
+// blocks of messages written by users have the same content as the text.
+func (b *Bslack) handleBlocks(ev *slack.MessageEvent, rmsg *config.Message) {
+	blocks, suffix := ev.Blocks.BlockSet, ""
+	if ev.SubMessage != nil {
+		blocks, suffix = ev.SubMessage.Blocks.BlockSet, b.GetString(editSuffixConfig)
+	}
+	richTextOnly := true
+	for _, block := range blocks {
+		if block.BlockType() != slack.MBTRichText {
+			richTextOnly = false
+		}
+	}
+	if len(blocks) == 0 || richTextOnly && strings.TrimSpace(rmsg.Text) != "" {
+		return
+	}
+
+	text := b.renderBlocks(blocks)
+	if text == "" {
+		return
+	}
+	rmsg.Text = text + suffix
+	if embed := b.blocksEmbed(blocks); embed.Text != "" || embed.ImageURL != "" {
+		rmsg.Extra[config.ExtraEmbed] = append(rmsg.Extra[config.ExtraEmbed], embed)
+	}
+}
+
+// renderBlocks renders blocks as Slack formatted text, the way Slack shows them.
+func (b *Bslack) renderBlocks(blocks []slack.Block) string {
+	var parts []string
+	for _, block := range blocks {
+		if text := b.renderBlock(block); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func (b *Bslack) renderBlock(block slack.Block) string {
+	switch bl := block.(type) {
+	case *slack.HeaderBlock:
+		if bl.Text != nil && bl.Text.Text != "" {
+			return "*" + bl.Text.Text + "*"
+		}
+	case *slack.SectionBlock:
+		var lines []string
+		if bl.Text != nil && bl.Text.Text != "" {
+			lines = append(lines, bl.Text.Text)
+		}
+		for _, field := range bl.Fields {
+			lines = append(lines, field.Text)
+		}
+		return strings.Join(lines, "\n")
+	case *slack.ContextBlock:
+		var texts []string
+		for _, element := range bl.ContextElements.Elements {
+			if text, ok := element.(*slack.TextBlockObject); ok && text.Text != "" {
+				texts = append(texts, text.Text)
+			}
+		}
+		return strings.Join(texts, " ")
+	case *slack.ImageBlock:
+		if bl.Title != nil && bl.Title.Text != "" {
+			return "<" + bl.ImageURL + "|" + bl.Title.Text + ">"
+		}
+		return bl.ImageURL
+	case *slack.DividerBlock:
+		return "---"
+	case *slack.RichTextBlock:
+		return b.renderRichText(bl)
+	}
+	return ""
+}
+
+func (b *Bslack) renderRichText(block *slack.RichTextBlock) string {
+	var sb strings.Builder
+	for _, element := range block.Elements {
+		switch e := element.(type) {
+		case *slack.RichTextSection:
+			sb.WriteString(b.renderRichTextSection(e.Elements))
+		case *slack.RichTextUnknown:
+			// lists, quotes and code blocks start on their own line
+			if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "\n") {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(b.renderRichTextContainer(e.Raw))
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+func (b *Bslack) renderRichTextContainer(raw string) string {
+	var container richTextContainer
+	if err := json.Unmarshal([]byte(raw), &container); err != nil {
+		return ""
+	}
+	switch container.Type {
+	case slack.RTEList:
+		var sections []slack.RichTextSection
+		if err := json.Unmarshal(container.Elements, &sections); err != nil {
+			return ""
+		}
+		var sb strings.Builder
+		for i := range sections {
+			bullet := "• "
+			if container.Style == "ordered" {
+				bullet = strconv.Itoa(i+1) + ". "
+			}
+			sb.WriteString(strings.Repeat("    ", container.Indent) + bullet + b.renderRichTextSection(sections[i].Elements) + "\n")
+		}
+		return sb.String()
+	case slack.RTEQuote, slack.RTEPreformatted:
+		// their elements are the elements of a section
+		var section slack.RichTextSection
+		if err := json.Unmarshal([]byte(`{"elements":`+string(container.Elements)+`}`), &section); err != nil {
+			return ""
+		}
+		text := strings.TrimRight(b.renderRichTextSection(section.Elements), "\n")
+		if container.Type == slack.RTEPreformatted {
+			return "```\n" + text + "\n```\n"
+		}
+		return "> " + strings.ReplaceAll(text, "\n", "\n> ") + "\n"
+	}
+	return ""
+}
+
+func (b *Bslack) renderRichTextSection(elements []slack.RichTextSectionElement) string {
+	var sb strings.Builder
+	for _, element := range elements {
+		switch e := element.(type) {
+		case *slack.RichTextSectionTextElement:
+			sb.WriteString(styleRichText(e.Text, e.Style))
+		case *slack.RichTextSectionLinkElement:
+			if e.Text != "" {
+				sb.WriteString("<" + e.URL + "|" + styleRichText(e.Text, e.Style) + ">")
+			} else {
+				sb.WriteString(e.URL)
+			}
+		case *slack.RichTextSectionUserElement:
+			sb.WriteString("<@" + e.UserID + ">")
+		case *slack.RichTextSectionChannelElement:
+			name := e.ChannelID
+			if b.channels != nil {
+				if channel, err := b.channels.getChannelByID(e.ChannelID); err == nil {
+					name = channel.Name
+				}
+			}
+			sb.WriteString("<#" + e.ChannelID + "|" + name + ">")
+		case *slack.RichTextSectionUserGroupElement:
+			sb.WriteString("<!subteam^" + e.UsergroupID + ">")
+		case *slack.RichTextSectionBroadcastElement:
+			sb.WriteString("<!" + e.Range + ">")
+		case *slack.RichTextSectionEmojiElement:
+			sb.WriteString(":" + e.Name + ":")
+		case *slack.RichTextSectionDateElement:
+			sb.WriteString(e.Timestamp.Time().UTC().Format("2006-01-02 15:04 MST"))
+		case *slack.RichTextSectionColorElement:
+			sb.WriteString(e.Value)
+		}
+	}
+	return sb.String()
+}
+
+// styleRichText formats text with the Slack formatting of style.
+func styleRichText(text string, style *slack.RichTextSectionTextStyle) string {
+	if style == nil || strings.TrimSpace(text) == "" {
+		return text
+	}
+	if style.Code {
+		text = "`" + text + "`"
+	}
+	if style.Strike {
+		text = "~" + text + "~"
+	}
+	if style.Italic {
+		text = "_" + text + "_"
+	}
+	if style.Bold {
+		text = "*" + text + "*"
+	}
+	return text
+}
+
+// blocksEmbed returns the embed of blocks: the first header is the title.
+func (b *Bslack) blocksEmbed(blocks []slack.Block) config.EmbedInfo {
+	var embed config.EmbedInfo
+	var parts []string
+	for _, block := range blocks {
+		switch bl := block.(type) {
+		case *slack.HeaderBlock:
+			if embed.Title == "" && bl.Text != nil {
+				embed.Title = bl.Text.Text
+				continue
+			}
+		case *slack.ImageBlock:
+			if embed.ImageURL == "" {
+				embed.ImageURL = bl.ImageURL
+				continue
+			}
+		}
+		if text := b.renderBlock(block); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	embed.Text = strings.Join(parts, "\n")
+	return embed
+}
+
+// renderAttachment renders the (legacy) attachment as Slack formatted text, the way Slack
+// shows it.
+func (b *Bslack) renderAttachment(attach *slack.Attachment) string {
+	var lines []string
+	add := func(line string) {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	add(attach.Pretext)
+	if attach.AuthorName != "" {
+		add("*" + attach.AuthorName + "*")
+	}
+	switch {
+	case attach.Title != "" && attach.TitleLink != "":
+		add("*<" + attach.TitleLink + "|" + attach.Title + ">*")
+	case attach.Title != "":
+		add("*" + attach.Title + "*")
+	}
+	add(attach.Text)
+	for _, field := range attach.Fields {
+		if field.Title != "" {
+			add("*" + field.Title + "*: " + field.Value)
+		} else {
+			add(field.Value)
+		}
+	}
+	add(b.renderBlocks(attach.Blocks.BlockSet))
+	add(attach.ImageURL)
+	add(attach.Footer)
+	if len(lines) == 0 {
+		return attach.Fallback
+	}
+	return strings.Join(lines, "\n")
+}
+
+func attachmentEmbed(attach *slack.Attachment) config.EmbedInfo {
+	embed := config.EmbedInfo{
+		Title:    attach.Title,
+		URL:      attach.TitleLink,
+		Author:   attach.AuthorName,
+		Text:     strings.TrimSpace(attach.Pretext + "\n" + attach.Text),
+		Color:    attach.Color,
+		ImageURL: attach.ImageURL,
+		Footer:   attach.Footer,
+	}
+	if color, ok := attachmentColors[embed.Color]; ok {
+		embed.Color = color
+	} else if embed.Color != "" && !strings.HasPrefix(embed.Color, "#") {
+		embed.Color = "#" + embed.Color
+	}
+	if embed.Text == "" && embed.Title == "" {
+		embed.Text = attach.Fallback
+	}
+	for _, field := range attach.Fields {
+		embed.Fields = append(embed.Fields, config.EmbedField{Name: field.Title, Value: field.Value, Short: field.Short})
+	}
+	return embed
+}
+
+// convertEmbeds converts the Slack formatting of the embeds of rmsg for the gateway.
+func (b *Bslack) convertEmbeds(rmsg *config.Message) {
+	for i, e := range rmsg.Extra[config.ExtraEmbed] {
+		embed, ok := e.(config.EmbedInfo)
+		if !ok {
+			continue
+		}
+		embed.Title = b.convertText(embed.Title)
+		embed.Author = b.convertText(embed.Author)
+		embed.Text = b.convertText(embed.Text)
+		embed.Footer = b.convertText(embed.Footer)
+		for j := range embed.Fields {
+			embed.Fields[j].Name = b.convertText(embed.Fields[j].Name)
+			embed.Fields[j].Value = b.convertText(embed.Fields[j].Value)
+		}
+		rmsg.Extra[config.ExtraEmbed][i] = embed
+	}
+	for i, t := range rmsg.Extra[config.ExtraEmbedText] {
+		if text, ok := t.(string); ok {
+			rmsg.Extra[config.ExtraEmbedText][i] = b.convertText(text)
+		}
+	}
+	if len(rmsg.Extra[config.ExtraEmbed]) > 0 {
+		rmsg.Extra[config.ExtraEmbedSource] = []interface{}{rmsg.Text}
+	}
+}
@@ -0,0 +1,89 @@
+package bslack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const alertEvent = `{
+	"type": "message", "subtype": "bot_message", "bot_id": "B1", "text": "Alert firing", "channel": "C1", "ts": "1.2",
+	"blocks": [
+		{"type": "header", "text": {"type": "plain_text", "text": "Disk almost full"}},
+		{"type": "section", "text": {"type": "mrkdwn", "text": "Host <https://grafana.example.com/d/1|db1> is at 95%"},
+			"fields": [{"type": "mrkdwn", "text": "*Severity:*\ncritical"}, {"type": "mrkdwn", "text": "*Team:*\n<!subteam^S1|ops>"}]},
+		{"type": "divider"},
+		{"type": "image", "image_url": "https://grafana.example.com/render/1.png", "alt_text": "graph"},
+		{"type": "context", "elements": [{"type": "image", "image_url": "https://example.com/icon.png", "alt_text": "icon"}, {"type": "mrkdwn", "text": "Grafana"}]},
+		{"type": "rich_text", "elements": [
+			{"type": "rich_text_section", "elements": [
+				{"type": "text", "text": "Runbook "}, {"type": "link", "url": "https://wiki.example.com/disk", "text": "here"},
+				{"type": "text", "text": ", ping "}, {"type": "user", "user_id": "U1"}, {"type": "text", "text": " "},
+				{"type": "text", "text": "now", "style": {"bold": true}}, {"type": "emoji", "name": "fire"}]},
+			{"type": "rich_text_list", "style": "ordered", "elements": [
+				{"type": "rich_text_section", "elements": [{"type": "text", "text": "clean logs"}]},
+				{"type": "rich_text_section", "elements": [{"type": "text", "text": "df -h", "style": {"code": true}}]}]},
+			{"type": "rich_text_quote", "elements": [{"type": "text", "text": "quoted\nlines"}]},
+			{"type": "rich_text_preformatted", "elements": [{"type": "text", "text": "$ du -sh /var"}]}
+		]}
+	],
+	"attachments": [{
+		"color": "danger", "title": "CI build #42", "title_link": "https://ci.example.com/42", "text": "Tests failed",
+		"fields": [{"title": "Branch", "value": "main", "short": true}], "footer": "CI"
+	}]
+}`
+
+func TestRenderBlocks(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	b := newBridge(&bridge.Config{Bridge: &bridge.Bridge{Log: logrus.NewEntry(logger), Config: config.NewConfigFromString(logger, nil)}})
+
+	var ev slack.MessageEvent
+	require.NoError(t, json.Unmarshal([]byte(alertEvent), &ev))
+	rmsg := &config.Message{Text: ev.Text, Extra: make(map[string][]interface{})}
+	b.handleAttachments(&ev, rmsg)
+
+	assert.Equal(t, "*Disk almost full*\n"+
+		"Host <https://grafana.example.com/d/1|db1> is at 95%\n*Severity:*\ncritical\n*Team:*\n<!subteam^S1|ops>\n"+
+		"---\n"+
+		"https://grafana.example.com/render/1.png\n"+
+		"Grafana\n"+
+		"Runbook <https://wiki.example.com/disk|here>, ping <@U1> *now*:fire:\n"+
+		"1. clean logs\n2. `df -h`\n"+
+		"> quoted\n> lines\n"+
+		"```\n$ du -sh /var\n```\n"+
+		"*<https://ci.example.com/42|CI build #42>*\nTests failed\n*Branch*: main\nCI", rmsg.Text)
+
+	require.Len(t, rmsg.Extra[config.ExtraEmbed], 2)
+	blocks := rmsg.Extra[config.ExtraEmbed][0].(config.EmbedInfo)
+	assert.Equal(t, "Disk almost full", blocks.Title)
+	assert.Equal(t, "https://grafana.example.com/render/1.png", blocks.ImageURL)
+	assert.NotContains(t, blocks.Text, "Disk almost full")
+	assert.Equal(t, config.EmbedInfo{
+		Title:  "CI build #42",
+		URL:    "https://ci.example.com/42",
+		Text:   "Tests failed",
+		Color:  "#a30200",
+		Footer: "CI",
+		Fields: []config.EmbedField{{Name: "Branch", Value: "main", Short: true}},
+	}, rmsg.Extra[config.ExtraEmbed][1])
+	// the text of the message is the fallback of the blocks
+	assert.Equal(t, []interface{}{""}, rmsg.Extra[config.ExtraEmbedText])
+
+	// the rich text of messages from users is the same as their text
+	ev = slack.MessageEvent{}
+	require.NoError(t, json.Unmarshal([]byte(`{"type": "message", "user": "U1", "text": "hi *there*", "blocks": [
+		{"type": "rich_text", "elements": [{"type": "rich_text_section", "elements": [{"type": "text", "text": "hi "}, {"type": "text", "text": "there", "style": {"bold": true}}]}]}
+	]}`), &ev))
+	rmsg = &config.Message{Text: ev.Text, Extra: make(map[string][]interface{})}
+	b.handleBlocks(&ev, rmsg)
+	assert.Equal(t, "hi *there*", rmsg.Text)
+	assert.Empty(t, rmsg.Extra[config.ExtraEmbed])
+}
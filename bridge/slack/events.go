@@ -0,0 +1,217 @@
+package bslack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/socketmode"
+)
+
+// maxEventsRequestSize is the size of the Events API requests we accept at most.
+const maxEventsRequestSize = 1 << 20
+
+// connectEvents sets up receiving events with Socket Mode or the Events API, for Slack apps
+// that can't use RTM.
+func (b *Bslack) connectEvents() error {
+	resp, err := b.sc.AuthTest()
+	if err != nil {
+		return err
+	}
+	// RTM sends us this in the connected event
+	b.si = &slack.Info{
+		User: &slack.UserDetails{ID: resp.UserID, Name: resp.User},
+		Team: &slack.Team{ID: resp.TeamID, Name: resp.Team},
+	}
+	b.channels.populateChannels(true)
+	b.users.populateUsers(true)
+
+	b.eventsAPI = make(chan json.RawMessage, 100)
+	// cancelled by Disconnect, which stops the goroutines receiving and handling the events
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	if b.GetString(appTokenConfig) != "" {
+		b.Log.Info("Receiving events using Socket Mode")
+		b.sm = socketmode.New(b.sc, socketmode.OptionDebug(b.GetBool("Debug")))
+		go b.runSocketMode(b.ctx)
+		go b.handleSocketMode(b.ctx)
+		return nil
+	}
+
+	if b.GetString(signingSecretConfig) == "" {
+		return errors.New("SigningSecret needs to be configured to receive events with the Events API")
+	}
+	ln, err := net.Listen("tcp", b.GetString(eventsBindAddressConfig))
+	if err != nil {
+		return err
+	}
+	b.Log.Infof("Receiving events using the Events API on %s", ln.Addr())
+	b.eventsServer = &http.Server{Handler: http.HandlerFunc(b.handleEventsRequest), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := b.eventsServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			b.Log.Errorf("Events API receiver failed: %s", err)
+		}
+	}()
+	return nil
+}
+
+// runSocketMode keeps the Socket Mode connection up until we disconnect.
+func (b *Bslack) runSocketMode(ctx context.Context) {
+	for {
+		err := b.sm.RunContext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		b.Log.Errorf("Socket Mode connection failed, reconnecting: %s", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// handleSocketMode acknowledges the Events API events received with Socket Mode and
+// queues them, until ctx is cancelled.
+func (b *Bslack) handleSocketMode(ctx context.Context) {
+	defer close(b.eventsAPI)
+	for {
+		var evt socketmode.Event
+		select {
+		case <-ctx.Done():
+			return
+		case evt = <-b.sm.Events:
+		}
+		switch evt.Type {
+		case socketmode.EventTypeEventsAPI:
+			b.sm.Ack(*evt.Request)
+			select {
+			case b.eventsAPI <- evt.Request.Payload:
+			case <-ctx.Done():
+				return
+			}
+		case socketmode.EventTypeConnected:
+			b.Log.Info("Connected to Slack using Socket Mode")
+		case socketmode.EventTypeInvalidAuth:
+			b.Log.Fatalf("Invalid AppToken %#v", evt.Data)
+		case socketmode.EventTypeConnectionError, socketmode.EventTypeIncomingError:
+			b.Log.Errorf("Connection failed %#v", evt.Data)
+		case socketmode.EventTypeConnecting, socketmode.EventTypeHello, socketmode.EventTypeDisconnect:
+			continue
+		default:
+			b.Log.Debugf("Unhandled incoming Socket Mode event: %s", evt.Type)
+		}
+	}
+}
+
+// handleEventsRequest verifies the signature of the Events API request and queues its event.
+func (b *Bslack) handleEventsRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEventsRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	sv, err := slack.NewSecretsVerifier(r.Header, b.GetString(signingSecretConfig))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sv.Write(body) //nolint:errcheck
+	if err = sv.Ensure(); err != nil {
+		b.Log.Warnf("Rejecting Events API request with invalid signature from %s", r.RemoteAddr)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var outer struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+	}
+	if err = json.Unmarshal(body, &outer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if outer.Type == "url_verification" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(outer.Challenge)) //nolint:errcheck
+		return
+	}
+	// we answer right away, so retries are for events we already received
+	if r.Header.Get("X-Slack-Retry-Num") != "" {
+		return
+	}
+	select {
+	case b.eventsAPI <- body:
+	case <-b.ctx.Done():
+		http.Error(w, "disconnected", http.StatusServiceUnavailable)
+	}
+}
+
+// handleEventsAPI handles the queued Events API events like the RTM events, until we
+// disconnect. It closes messages when it returns.
+func (b *Bslack) handleEventsAPI(messages chan *config.Message) {
+	defer close(messages)
+	for {
+		var payload json.RawMessage
+		select {
+		case <-b.ctx.Done():
+			return
+		case p, ok := <-b.eventsAPI:
+			if !ok {
+				return
+			}
+			payload = p
+		}
+		var outer struct {
+			Type  string          `json:"type"`
+			Event json.RawMessage `json:"event"`
+		}
+		if err := json.Unmarshal(payload, &outer); err != nil {
+			b.Log.Errorf("Could not parse Events API event: %s", err)
+			continue
+		}
+		if outer.Type != "event_callback" {
+			b.Log.Debugf("Unhandled Events API event: %s", outer.Type)
+			continue
+		}
+		ev, err := decodeEventsAPIEvent(outer.Event)
+		if err != nil {
+			b.Log.Errorf("Could not parse Events API event: %s", err)
+			continue
+		}
+		if ev == nil {
+			b.Log.Debugf("Unhandled incoming event: %s", outer.Event)
+			continue
+		}
+		b.Log.Debugf("== Receiving event %#v", ev)
+		b.handleSlackEvent(messages, ev)
+	}
+}
+
+// decodeEventsAPIEvent decodes the inner event of an Events API event to the RTM event of
+// the same type, they have the same format. Events we don't handle return nil.
+func decodeEventsAPIEvent(raw json.RawMessage) (interface{}, error) {
+	var inner struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &inner); err != nil {
+		return nil, err
+	}
+	var ev interface{}
+	switch inner.Type {
+	case "message":
+		ev = &slack.MessageEvent{}
+	case "file_deleted":
+		ev = &slack.FileDeletedEvent{}
+	case sUserTyping:
+		ev = &slack.UserTypingEvent{}
+	case sMemberJoined:
+		ev = &slack.MemberJoinedChannelEvent{}
+	case "user_change":
+		ev = &slack.UserChangeEvent{}
+	default:
+		return nil, nil
+	}
+	return ev, json.Unmarshal(raw, ev)
+}
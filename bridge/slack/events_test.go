@@ -0,0 +1,124 @@
+package bslack
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/socketmode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func eventsRequest(secret, body string) *http.Request {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":" + body))
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("X-Slack-Request-Timestamp", ts)
+	r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestEventsRequest(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	cfg := config.NewConfigFromString(logger, []byte(`
+[slack.test]
+SigningSecret="secret"
+`))
+	b := newBridge(&bridge.Config{Bridge: &bridge.Bridge{Account: "slack.test", Log: logrus.NewEntry(logger), Config: cfg}})
+	b.eventsAPI = make(chan json.RawMessage, 10)
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	defer b.cancel()
+
+	w := httptest.NewRecorder()
+	b.handleEventsRequest(w, eventsRequest("wrong", `{"type":"event_callback"}`))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, b.eventsAPI)
+
+	w = httptest.NewRecorder()
+	b.handleEventsRequest(w, eventsRequest("secret", `{"type":"url_verification","challenge":"abc"}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "abc", w.Body.String())
+
+	body := `{"type":"event_callback","event":{"type":"message","channel":"C1","user":"U1","text":"hi","ts":"1.2"}}`
+	w = httptest.NewRecorder()
+	b.handleEventsRequest(w, eventsRequest("secret", body))
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, b.eventsAPI, 1)
+	assert.JSONEq(t, body, string(<-b.eventsAPI))
+
+	r := eventsRequest("secret", body)
+	r.Header.Set("X-Slack-Retry-Num", "1")
+	b.handleEventsRequest(httptest.NewRecorder(), r)
+	assert.Empty(t, b.eventsAPI, "retries are ignored")
+
+	w = httptest.NewRecorder()
+	b.handleEventsRequest(w, eventsRequest("secret", `{"type":"event_callback","text":"`+strings.Repeat("x", maxEventsRequestSize)+`"}`))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Empty(t, b.eventsAPI)
+}
+
+func TestSocketModeDisconnect(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	b := newBridge(&bridge.Config{Bridge: &bridge.Bridge{Account: "slack.test", Log: logrus.NewEntry(logger), Config: config.NewConfigFromString(logger, nil)}})
+	b.eventsAPI = make(chan json.RawMessage, 10)
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.sm = socketmode.New(slack.New("token"))
+
+	messages := make(chan *config.Message)
+	go b.handleSocketMode(b.ctx)
+	go b.handleEventsAPI(messages)
+	require.NoError(t, b.Disconnect())
+
+	// both goroutines stop, closing their channels
+	select {
+	case _, ok := <-messages:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleEventsAPI didn't stop")
+	}
+	select {
+	case _, ok := <-b.eventsAPI:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleSocketMode didn't stop")
+	}
+}
+
+func TestDecodeEventsAPIEvent(t *testing.T) {
+	ev, err := decodeEventsAPIEvent(json.RawMessage(`{
+		"type": "message", "subtype": "message_changed", "channel": "C1",
+		"message": {"type": "message", "user": "U1", "text": "edited", "ts": "1.2", "edited": {"user": "U1", "ts": "1.3"}}
+	}`))
+	require.NoError(t, err)
+	msg, ok := ev.(*slack.MessageEvent)
+	require.True(t, ok)
+	assert.Equal(t, sMessageChanged, msg.SubType)
+	assert.Equal(t, "C1", msg.Channel)
+	require.NotNil(t, msg.SubMessage)
+	assert.Equal(t, "edited", msg.SubMessage.Text)
+
+	ev, err = decodeEventsAPIEvent(json.RawMessage(`{"type": "file_deleted", "file_id": "F1"}`))
+	require.NoError(t, err)
+	assert.Equal(t, &slack.FileDeletedEvent{Type: "file_deleted", FileID: "F1"}, ev)
+
+	ev, err = decodeEventsAPIEvent(json.RawMessage(`{"type": "app_mention"}`))
+	require.NoError(t, err)
+	assert.Nil(t, ev)
+}
@@ -3,7 +3,6 @@ package bslack
 import (
 	"errors"
 	"fmt"
-	"html"
 	"regexp"
 	"strings"
 	"time"
@@ -18,10 +17,14 @@ var ErrEventIgnored = errors.New("this event message should ignored")
 
 func (b *Bslack) handleSlack() {
 	messages := make(chan *config.Message)
-	if b.GetString(incomingWebhookConfig) != "" && b.GetString(tokenConfig) == "" {
+	switch {
+	case b.GetString(incomingWebhookConfig) != "" && b.GetString(tokenConfig) == "":
 		b.Log.Debugf("Choosing webhooks based receiving")
 		go b.handleMatterHook(messages)
-	} else {
+	case b.eventsAPI != nil:
+		b.Log.Debugf("Choosing Events API based receiving")
+		go b.handleEventsAPI(messages)
+	default:
 		b.Log.Debugf("Choosing token based receiving")
 		go b.handleSlackClient(messages)
 	}
@@ -33,12 +36,9 @@ func (b *Bslack) handleSlack() {
 			message.Event != config.EventFileDelete {
 			b.Log.Debugf("<= Sending message from %s on %s to gateway", message.Username, b.Account)
 			// cleanup the message
-			message.Text = b.replaceMention(message.Text)
-			message.Text = b.replaceVariable(message.Text)
-			message.Text = b.replaceChannel(message.Text)
-			message.Text = b.replaceURL(message.Text)
-			message.Text = b.replaceb0rkedMarkDown(message.Text)
-			message.Text = html.UnescapeString(message.Text)
+			message.Mentions = b.getMentions(message.Text)
+			message.Text = b.convertText(message.Text)
+			b.convertEmbeds(message)
 
 			// Add the avatar
 			message.Avatar = b.users.getAvatar(message.UserID)
@@ -54,45 +54,12 @@ func (b *Bslack) handleSlackClient(messages chan *config.Message) {
 		if msg.Type != sUserTyping && msg.Type != sHello && msg.Type != sLatencyReport {
 			b.Log.Debugf("== Receiving event %#v", msg.Data)
 		}
+		if b.handleSlackEvent(messages, msg.Data) {
+			continue
+		}
 		switch ev := msg.Data.(type) {
-		case *slack.UserTypingEvent:
-			if !b.GetBool("ShowUserTyping") {
-				continue
-			}
-			rmsg, err := b.handleTypingEvent(ev)
-			if err == ErrEventIgnored {
-				continue
-			} else if err != nil {
-				b.Log.Errorf("%#v", err)
-				continue
-			}
-
-			messages <- rmsg
-		case *slack.MessageEvent:
-			if b.skipMessageEvent(ev) {
-				b.Log.Debugf("Skipped message: %#v", ev)
-				continue
-			}
-			rmsg, err := b.handleMessageEvent(ev)
-			if err != nil {
-				b.Log.Errorf("%#v", err)
-				continue
-			}
-			messages <- rmsg
-		case *slack.FileDeletedEvent:
-			rmsg, err := b.handleFileDeletedEvent(ev)
-			if err != nil {
-				b.Log.Printf("%#v", err)
-				continue
-			}
-			messages <- rmsg
 		case *slack.OutgoingErrorEvent:
 			b.Log.Debugf("%#v", ev.Error())
-		case *slack.ChannelJoinedEvent:
-			// When we join a channel we update the full list of users as
-			// well as the information for the channel that we joined as this
-			// should now tell that we are a member of it.
-			b.channels.registerChannel(ev.Channel)
 		case *slack.ConnectedEvent:
 			b.si = ev.Info
 			b.channels.populateChannels(true)
@@ -101,18 +68,68 @@ func (b *Bslack) handleSlackClient(messages chan *config.Message) {
 			b.Log.Fatalf("Invalid Token %#v", ev)
 		case *slack.ConnectionErrorEvent:
 			b.Log.Errorf("Connection failed %#v %#v", ev.Error(), ev.ErrorObj)
-		case *slack.MemberJoinedChannelEvent:
-			b.users.populateUser(ev.User)
 		case *slack.HelloEvent, *slack.LatencyReport, *slack.ConnectingEvent:
 			continue
-		case *slack.UserChangeEvent:
-			b.users.invalidateUser(ev.User.ID)
 		default:
 			b.Log.Debugf("Unhandled incoming event: %T", ev)
 		}
 	}
 }
 
+// handleSlackEvent handles the events we receive with RTM, Socket Mode and the Events API.
+// It returns false for events it doesn't handle.
+func (b *Bslack) handleSlackEvent(messages chan *config.Message, data interface{}) bool {
+	switch ev := data.(type) {
+	case *slack.UserTypingEvent:
+		if !b.GetBool("ShowUserTyping") {
+			return true
+		}
+		rmsg, err := b.handleTypingEvent(ev)
+		if err == ErrEventIgnored {
+			return true
+		} else if err != nil {
+			b.Log.Errorf("%#v", err)
+			return true
+		}
+
+		messages <- rmsg
+	case *slack.MessageEvent:
+		if b.skipMessageEvent(ev) {
+			b.Log.Debugf("Skipped message: %#v", ev)
+			return true
+		}
+		rmsg, err := b.handleMessageEvent(ev)
+		if err != nil {
+			b.Log.Errorf("%#v", err)
+			return true
+		}
+		messages <- rmsg
+	case *slack.FileDeletedEvent:
+		rmsg, err := b.handleFileDeletedEvent(ev)
+		if err != nil {
+			b.Log.Printf("%#v", err)
+			return true
+		}
+		messages <- rmsg
+	case *slack.ChannelJoinedEvent:
+		// When we join a channel we update the full list of users as
+		// well as the information for the channel that we joined as this
+		// should now tell that we are a member of it.
+		b.channels.registerChannel(ev.Channel)
+	case *slack.MemberJoinedChannelEvent:
+		// apps without RTM only get this event when they're added to a channel
+		if b.si != nil && ev.User == b.si.User.ID {
+			b.channels.populateChannels(false)
+		}
+		b.users.populateUser(ev.User)
+	case *slack.UserChangeEvent:
+		b.users.invalidateUser(ev.User.ID)
+	default:
+		return false
+	}
+	return true
+}
+
 func (b *Bslack) handleMatterHook(messages chan *config.Message) {
 	for {
 		message := b.mh.Receive()
@@ -169,7 +186,7 @@ func (b *Bslack) skipMessageEvent(ev *slack.MessageEvent) bool {
 
 	// Skip any messages that we made ourselves or from 'slackbot' (see #527).
 	if ev.Username == sSlackBotUser ||
-		(b.rtm != nil && ev.Username == b.si.User.Name) || hasOurCallbackID {
+		(b.si != nil && ev.Username == b.si.User.Name) || hasOurCallbackID {
 		return true
 	}
 
@@ -284,13 +301,6 @@ func (b *Bslack) handleStatusEvent(ev *slack.MessageEvent, rmsg *config.Message)
 	return false
 }
 
-func getMessageTitle(attach *slack.Attachment) string {
-	if attach.TitleLink != "" {
-		return fmt.Sprintf("[%s](%s)\n", attach.Title, attach.TitleLink)
-	}
-	return attach.Title
-}
-
 func (b *Bslack) handleAttachments(ev *slack.MessageEvent, rmsg *config.Message) {
 	// File comments are set by the system (because there is no username given).
 	if ev.SubType == sFileComment {
@@ -311,21 +321,29 @@ func (b *Bslack) handleAttachments(ev *slack.MessageEvent, rmsg *config.Message)
 	// Den String wieder zusammensetzen
 	rmsg.Text = strings.Join(lines, "") + "\n"
 
-	// See if we have some text in the attachments.
-	if rmsg.Text == "" || rmsg.Text != "" {
-		for i, attach := range ev.Attachments {
-			if attach.Text != "" {
-				if attach.Title != "" {
-					rmsg.Text = getMessageTitle(&ev.Attachments[i])
-				}
-				rmsg.Text += attach.Text
-				if attach.Footer != "" {
-					rmsg.Text += "\n\n" + attach.Footer
-				}
-			} else {
-				rmsg.Text = attach.Fallback
-			}
+	// Render the blocks and attachments of messages from bots and integrations.
+	plain := rmsg.Text
+	b.handleBlocks(ev, rmsg)
+	if len(rmsg.Extra[config.ExtraEmbed]) > 0 {
+		// the embed of the blocks has all of the text
+		plain = ""
+	}
+	for i := range ev.Attachments {
+		text := b.renderAttachment(&ev.Attachments[i])
+		if text != "" && text == strings.TrimSpace(plain) {
+			plain = ""
 		}
+		switch {
+		case text == "" || text == strings.TrimSpace(rmsg.Text):
+		case strings.TrimSpace(rmsg.Text) == "":
+			rmsg.Text = text
+		default:
+			rmsg.Text = strings.TrimRight(rmsg.Text, "\n") + "\n" + text
+		}
+		rmsg.Extra[config.ExtraEmbed] = append(rmsg.Extra[config.ExtraEmbed], attachmentEmbed(&ev.Attachments[i]))
+	}
+	if len(rmsg.Extra[config.ExtraEmbed]) > 0 {
+		rmsg.Extra[config.ExtraEmbedText] = []interface{}{strings.TrimSpace(plain)}
 	}
 
 	// Save the attachments, so that we can send them to other slack (compatible) bridges.
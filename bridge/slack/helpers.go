@@ -2,7 +2,9 @@ package bslack
 
 import (
 	"fmt"
+	"html"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,13 +23,14 @@ func (b *Bslack) populateReceivedMessage(ev *slack.MessageEvent) (*config.Messag
 	}
 
 	rmsg := &config.Message{
-		Text:     ev.Text,
-		Channel:  channel.Name,
-		Account:  b.Account,
-		ID:       ev.Timestamp,
-		Extra:    make(map[string][]interface{}),
-		ParentID: ev.ThreadTimestamp,
-		Protocol: b.Protocol,
+		Text:      ev.Text,
+		Channel:   channel.Name,
+		Account:   b.Account,
+		ID:        ev.Timestamp,
+		Extra:     make(map[string][]interface{}),
+		ParentID:  ev.ThreadTimestamp,
+		Protocol:  b.Protocol,
+		Timestamp: parseSlackTimestamp(ev.Timestamp),
 	}
 	if b.useChannelID {
 		rmsg.Channel = "ID:" + channel.ID
@@ -101,7 +104,7 @@ func (b *Bslack) populateMessageWithBotInfo(ev *slack.MessageEvent, rmsg *config
 	var err error
 	var bot *slack.Bot
 	for {
-		bot, err = b.rtm.GetBotInfo(ev.BotID)
+		bot, err = b.sc.GetBotInfo(ev.BotID)
 		if err == nil {
 			break
 		}
@@ -147,6 +150,16 @@ func (b *Bslack) extractTopicOrPurpose(text string) (string, string) {
 	return "unknown", ""
 }
 
+// convertText converts the Slack formatting (mentions, links, markdown) of text for the gateway.
+func (b *Bslack) convertText(text string) string {
+	text = b.replaceMention(text)
+	text = b.replaceVariable(text)
+	text = b.replaceChannel(text)
+	text = b.replaceURL(text)
+	text = b.replaceb0rkedMarkDown(text)
+	return html.UnescapeString(text)
+}
+
 // @see https://api.slack.com/docs/message-formatting#linking_to_channels_and_users
 func (b *Bslack) replaceMention(text string) string {
 	replaceFunc := func(match string) string {
@@ -159,6 +172,25 @@ func (b *Bslack) replaceMention(text string) string {
 	return mentionRE.ReplaceAllStringFunc(text, replaceFunc)
 }
 
+// getMentions returns the users mentioned in text, with the text replaceMention replaces
+// their mention with.
+func (b *Bslack) getMentions(text string) []config.Mention {
+	var mentions []config.Mention
+	for _, match := range mentionRE.FindAllStringSubmatch(text, -1) {
+		username := b.users.getUsername(match[1])
+		if username == "" {
+			continue
+		}
+		mentions = append(mentions, config.Mention{
+			Text:     "@" + username,
+			Username: username,
+			UserID:   match[1],
+			Account:  b.Account,
+		})
+	}
+	return mentions
+}
+
 // @see https://api.slack.com/docs/message-formatting#linking_to_channels_and_users
 func (b *Bslack) replaceChannel(text string) string {
 	for _, r := range channelRE.FindAllStringSubmatch(text, -1) {
@@ -253,3 +285,18 @@ func handleRateLimit(log *logrus.Entry, err error) error {
 	time.Sleep(rateLimit.RetryAfter)
 	return nil
 }
+
+// parseSlackTimestamp converts a slack message timestamp ("1355517523.000005")
+// to a time.Time. Returns the zero time if ts can't be parsed.
+func parseSlackTimestamp(ts string) time.Time {
+	parts := strings.SplitN(ts, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	var usec int64
+	if len(parts) == 2 {
+		usec, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+	return time.Unix(sec, usec*int64(time.Microsecond))
+}
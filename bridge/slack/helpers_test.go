@@ -3,6 +3,7 @@ package bslack
 import (
 	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/42wim/matterbridge/bridge"
 	"github.com/sirupsen/logrus"
@@ -34,3 +35,9 @@ func TestExtractTopicOrPurpose(t *testing.T) {
 		assert.Equalf(t, tc.wantOutput, gotOutput, "This testcase failed: %s", name)
 	}
 }
+
+func TestParseSlackTimestamp(t *testing.T) {
+	assert.Equal(t, time.Unix(1355517523, 5000), parseSlackTimestamp("1355517523.000005"))
+	assert.Equal(t, time.Unix(1355517523, 0), parseSlackTimestamp("1355517523"))
+	assert.True(t, parseSlackTimestamp("").IsZero())
+}
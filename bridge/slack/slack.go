@@ -2,8 +2,11 @@ package bslack
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"regexp"
 	"strings"
 	"sync"
@@ -16,6 +19,7 @@ import (
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/rs/xid"
 	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/socketmode"
 )
 
 type Bslack struct {
@@ -27,6 +31,13 @@ type Bslack struct {
 	rtm *slack.RTM
 	si  *slack.Info
 
+	// Socket Mode and the Events API, instead of RTM
+	sm           *socketmode.Client
+	ctx          context.Context // of the Socket Mode or Events API connection
+	cancel       context.CancelFunc
+	eventsServer *http.Server
+	eventsAPI    chan json.RawMessage
+
 	cache        *lru.Cache
 	uuid         string
 	useChannelID bool
@@ -57,16 +68,19 @@ const (
 	sSlackBotUser        = "slackbot"
 	cfileDownloadChannel = "file_download_channel"
 
-	tokenConfig           = "Token"
-	incomingWebhookConfig = "WebhookBindAddress"
-	outgoingWebhookConfig = "WebhookURL"
-	skipTLSConfig         = "SkipTLSVerify"
-	useNickPrefixConfig   = "PrefixMessagesWithNick"
-	editDisableConfig     = "EditDisable"
-	editSuffixConfig      = "EditSuffix"
-	iconURLConfig         = "iconurl"
-	noSendJoinConfig      = "nosendjoinpart"
-	messageLength         = 3000
+	tokenConfig             = "Token"
+	appTokenConfig          = "AppToken"
+	eventsBindAddressConfig = "EventsBindAddress"
+	signingSecretConfig     = "SigningSecret"
+	incomingWebhookConfig   = "WebhookBindAddress"
+	outgoingWebhookConfig   = "WebhookURL"
+	skipTLSConfig           = "SkipTLSVerify"
+	useNickPrefixConfig     = "PrefixMessagesWithNick"
+	editDisableConfig       = "EditDisable"
+	editSuffixConfig        = "EditSuffix"
+	iconURLConfig           = "iconurl"
+	noSendJoinConfig        = "nosendjoinpart"
+	messageLength           = 3000
 )
 
 func New(cfg *bridge.Config) bridge.Bridger {
@@ -107,17 +121,27 @@ func (b *Bslack) Connect() error {
 		return errors.New("no connection method found: WebhookBindAddress, WebhookURL or Token need to be configured")
 	}
 
-	// If we have a token we use the Slack websocket-based RTM for both sending and receiving.
+	// If we have a token we send with the Web API and receive with Socket Mode, the Events API
+	// or (for classic apps) the Slack websocket-based RTM.
 	if token := b.GetString(tokenConfig); token != "" {
 		b.Log.Info("Connecting using token")
 
-		b.sc = slack.New(token, slack.OptionDebug(b.GetBool("Debug")))
+		b.sc = slack.New(token,
+			slack.OptionDebug(b.GetBool("Debug")),
+			slack.OptionAppLevelToken(b.GetString(appTokenConfig)),
+		)
 
 		b.channels = newChannelManager(b.Log, b.sc)
 		b.users = newUserManager(b.Log, b.sc)
 
-		b.rtm = b.sc.NewRTM()
-		go b.rtm.ManageConnection()
+		if b.GetString(appTokenConfig) != "" || b.GetString(eventsBindAddressConfig) != "" {
+			if err := b.connectEvents(); err != nil {
+				return err
+			}
+		} else {
+			b.rtm = b.sc.NewRTM()
+			go b.rtm.ManageConnection()
+		}
 		go b.handleSlack()
 		return nil
 	}
@@ -144,7 +168,16 @@ func (b *Bslack) Connect() error {
 }
 
 func (b *Bslack) Disconnect() error {
-	return b.rtm.Disconnect()
+	switch {
+	case b.rtm != nil:
+		return b.rtm.Disconnect()
+	case b.sm != nil:
+		b.cancel()
+	case b.eventsServer != nil:
+		b.cancel()
+		return b.eventsServer.Close()
+	}
+	return nil
 }
 
 // JoinChannel only acts as a verification method that checks whether Matterbridge's
@@ -193,8 +226,9 @@ func (b *Bslack) Reload(cfg *bridge.Config) (string, error) {
 }
 
 func insertTags(input string) string {
-	re := regexp.MustCompile(`(@[A-Za-z0-9]{1,21})`)
-	output := re.ReplaceAllString(input, "<$1>")
+	// skip mentions that already are tags
+	re := regexp.MustCompile(`(^|[^<])(@[A-Za-z0-9]{1,21})`)
+	output := re.ReplaceAllString(input, "$1<$2>")
 	return output
 }
 
@@ -203,6 +237,12 @@ func (b *Bslack) Send(msg config.Message) (string, error) {
 	if msg.Event != config.EventUserTyping {
 		b.Log.Debugf("=> Receiving %#v", msg)
 	}
+	if msg.Event == config.EventDirectMessage {
+		return b.sendDirectMessage(&msg)
+	}
+	msg.Text = helper.ReplaceMentions(msg.Text, b.Account, msg.Mentions, func(m config.Mention) string {
+		return "<@" + m.UserID + ">"
+	})
 	formatierterText := insertTags(msg.Text)
 	msg.Text = helper.ClipMessage(formatierterText, messageLength, b.GetString("MessageClipped"))
 	msg.Text = b.replaceCodeFence(formatierterText)
@@ -216,7 +256,20 @@ func (b *Bslack) Send(msg config.Message) (string, error) {
 	if b.GetString(outgoingWebhookConfig) != "" && b.GetString(tokenConfig) == "" {
 		return "", b.sendWebhook(msg)
 	}
-	return b.sendRTM(msg)
+	return b.sendWebAPI(msg)
+}
+
+// sendDirectMessage sends msg to the user with its UserID in a direct message.
+func (b *Bslack) sendDirectMessage(msg *config.Message) (string, error) {
+	if b.sc == nil {
+		return "", errors.New("direct messages need a token")
+	}
+	channel, _, _, err := b.sc.OpenConversation(&slack.OpenConversationParameters{Users: []string{msg.UserID}})
+	if err != nil {
+		return "", err
+	}
+	_, ts, err := b.sc.PostMessage(channel.ID, slack.MsgOptionText(msg.Text, false))
+	return ts, err
 }
 
 // sendWebhook uses the configured WebhookURL to send the message
@@ -285,7 +338,7 @@ func (b *Bslack) sendWebhook(msg config.Message) error {
 	return nil
 }
 
-func (b *Bslack) sendRTM(msg config.Message) (string, error) {
+func (b *Bslack) sendWebAPI(msg config.Message) (string, error) {
 	// Handle channelmember messages.
 	if handled := b.handleGetChannelMembers(&msg); handled {
 		return "", nil
@@ -296,7 +349,8 @@ func (b *Bslack) sendRTM(msg config.Message) (string, error) {
 		return "", fmt.Errorf("could not send message: %v", err)
 	}
 	if msg.Event == config.EventUserTyping {
-		if b.GetBool("ShowUserTyping") {
+		// only RTM can send typing notifications
+		if b.GetBool("ShowUserTyping") && b.rtm != nil {
 			b.rtm.SendMessage(b.rtm.NewTypingMessage(channelInfo.ID))
 		}
 		return "", nil
@@ -355,9 +409,9 @@ func (b *Bslack) updateTopicOrPurpose(msg *config.Message, channelInfo *slack.Ch
 	incomingChangeType, text := b.extractTopicOrPurpose(msg.Text)
 	switch incomingChangeType {
 	case "topic":
-		updateFunc = b.rtm.SetTopicOfConversation
+		updateFunc = b.sc.SetTopicOfConversation
 	case "purpose":
-		updateFunc = b.rtm.SetPurposeOfConversation
+		updateFunc = b.sc.SetPurposeOfConversation
 	default:
 		b.Log.Errorf("Unhandled type received from extractTopicOrPurpose: %s", incomingChangeType)
 		return nil
@@ -403,7 +457,7 @@ func (b *Bslack) deleteMessage(msg *config.Message, channelInfo *slack.Channel)
 	}
 
 	for {
-		_, _, err := b.rtm.DeleteMessage(channelInfo.ID, msg.ID)
+		_, _, err := b.sc.DeleteMessage(channelInfo.ID, msg.ID)
 		if err == nil {
 			return true, nil
 		}
@@ -421,7 +475,7 @@ func (b *Bslack) editMessage(msg *config.Message, channelInfo *slack.Channel) (b
 	}
 	messageOptions := b.prepareMessageOptions(msg)
 	for {
-		_, _, _, err := b.rtm.UpdateMessage(channelInfo.ID, msg.ID, messageOptions...)
+		_, _, _, err := b.sc.UpdateMessage(channelInfo.ID, msg.ID, messageOptions...)
 		if err == nil {
 			return true, nil
 		}
@@ -440,7 +494,7 @@ func (b *Bslack) postMessage(msg *config.Message, channelInfo *slack.Channel) (s
 	}
 	messageOptions := b.prepareMessageOptions(msg)
 	for {
-		_, id, err := b.rtm.PostMessage(channelInfo.ID, messageOptions...)
+		_, id, err := b.sc.PostMessage(channelInfo.ID, messageOptions...)
 		if err == nil {
 			return id, nil
 		}
@@ -455,7 +509,7 @@ func (b *Bslack) postMessage(msg *config.Message, channelInfo *slack.Channel) (s
 // uploadFile handles native upload of files
 func (b *Bslack) uploadFile(msg *config.Message, channelID string) (string, error) {
 	var messageID string
-	for _, f := range msg.Extra["file"] {
+	for i, f := range msg.Extra["file"] {
 		fi, ok := f.(config.FileInfo)
 		if !ok {
 			b.Log.Errorf("Received a file with unexpected content: %#v", f)
@@ -483,7 +537,7 @@ func (b *Bslack) uploadFile(msg *config.Message, channelID string) (string, erro
 		})
 		if err != nil {
 			b.Log.Errorf("uploadfile %#v", err)
-			return "", err
+			return messageID, &helper.UploadError{ID: messageID, Text: i > 0, Files: helper.FileNames(msg.Extra["file"][i:]), Err: err}
 		}
 		if res.ID != "" {
 			b.Log.Debugf("Adding file ID %s to cache with timestamp %s", res.ID, ts.String())
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf16"
 
 	"github.com/42wim/matterbridge/bridge/config"
@@ -218,6 +219,10 @@ func (b *Btelegram) handleRecv(updates <-chan tgbotapi.Update) {
 
 		// set the ID's from the channel or group message
 		rmsg.ID = strconv.Itoa(message.MessageID)
+		rmsg.Timestamp = message.Time()
+		if message.EditDate != 0 {
+			rmsg.Timestamp = time.Unix(int64(message.EditDate), 0)
+		}
 		rmsg.Channel = strconv.FormatInt(message.Chat.ID, 10)
 		if message.IsTopicMessage {
 			rmsg.Channel += "/" + strconv.Itoa(message.MessageThreadID)
@@ -230,6 +235,9 @@ func (b *Btelegram) handleRecv(updates <-chan tgbotapi.Update) {
 			rmsg.ParentID = strconv.Itoa(message.ReplyToMessage.MessageID)
 		}
 
+		// handle mentions
+		b.handleMentions(&rmsg, message)
+
 		// handle entities (adding URLs)
 		b.handleEntities(&rmsg, message)
 
@@ -285,6 +293,7 @@ func (b *Btelegram) handleUserJoin(update tgbotapi.Update) {
 			Protocol: b.Protocol,
 			Event:    config.EventJoinLeave,
 			Text:     "joined chat",
+			Extra:    map[string][]interface{}{config.EventJoinLeave: {config.JoinLeaveInfo{Nick: user.FirstName, Action: config.JoinLeaveJoin}}},
 		}
 		b.Remote <- rmsg
 	}
@@ -302,6 +311,7 @@ func (b *Btelegram) handleUserLeave(update tgbotapi.Update) {
 		Protocol: b.Protocol,
 		Event:    config.EventJoinLeave,
 		Text:     "left chat",
+		Extra:    map[string][]interface{}{config.EventJoinLeave: {config.JoinLeaveInfo{Nick: user.FirstName, Action: config.JoinLeaveLeave}}},
 	}
 
 	b.Remote <- rmsg
@@ -547,7 +557,7 @@ func (b *Btelegram) handleUploadFile(msg *config.Message, chatid int64, threadid
 			voc.ReplyToMessageID = parentID
 			res, err := b.c.Send(voc)
 			if err != nil {
-				return "", err
+				return "", &helper.UploadError{Err: err}
 			}
 			return strconv.Itoa(res.MessageID), nil
 		default:
@@ -581,6 +591,33 @@ func (b *Btelegram) handleQuote(message, quoteNick, quoteMessage string) string
 	return format
 }
 
+// handleMentions adds the users mentioned in the message to rmsg.Mentions.
+// Users without username are mentioned with a text_mention, for @username mentions
+// we don't know the user ID.
+func (b *Btelegram) handleMentions(rmsg *config.Message, message *tgbotapi.Message) {
+	asRunes := utf16.Encode([]rune(message.Text))
+	for _, e := range message.Entities {
+		if e.Offset+e.Length > len(asRunes) {
+			continue
+		}
+		text := string(utf16.Decode(asRunes[e.Offset : e.Offset+e.Length]))
+		switch {
+		case e.Type == "text_mention" && e.User != nil:
+			rmsg.Mentions = append(rmsg.Mentions, config.Mention{
+				Text:     text,
+				Username: text,
+				UserID:   strconv.FormatInt(e.User.ID, 10),
+				Account:  b.Account,
+			})
+		case e.Type == "mention":
+			rmsg.Mentions = append(rmsg.Mentions, config.Mention{
+				Text:     text,
+				Username: strings.TrimPrefix(text, "@"),
+			})
+		}
+	}
+}
+
 // handleEntities handles messageEntities
 func (b *Btelegram) handleEntities(rmsg *config.Message, message *tgbotapi.Message) {
 	if message.Entities == nil {
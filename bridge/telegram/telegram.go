@@ -24,6 +24,10 @@ type Btelegram struct {
 	c *tgbotapi.BotAPI
 	*bridge.Config
 	avatarMap map[string]string // keep cache of userid and avatar sha
+
+	updates       chan tgbotapi.Update // updates received with the webhook
+	webhookPath   string
+	webhookSecret string
 }
 
 func New(cfg *bridge.Config) bridge.Bridger {
@@ -48,15 +52,33 @@ func (b *Btelegram) Connect() error {
 		b.Log.Debugf("%#v", err)
 		return err
 	}
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	updates := b.c.GetUpdatesChan(u)
+	var updates tgbotapi.UpdatesChannel
+	if b.GetString("WebhookBindAddress") != "" {
+		updates, err = b.connectWebhook()
+		if err != nil {
+			return err
+		}
+	} else {
+		// Telegram doesn't send updates with getUpdates while a webhook is set
+		if info, err := b.c.GetWebhookInfo(); err == nil && info.IsSet() {
+			b.Log.Infof("Removing webhook %s to receive updates with long polling", info.URL)
+			if _, err := b.c.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+				return err
+			}
+		}
+		u := tgbotapi.NewUpdate(0)
+		u.Timeout = 60
+		updates = b.c.GetUpdatesChan(u)
+	}
 	b.Log.Info("Connection succeeded")
 	go b.handleRecv(updates)
 	return nil
 }
 
 func (b *Btelegram) Disconnect() error {
+	if b.updates != nil {
+		b.unlistenWebhook()
+	}
 	return nil
 }
 
@@ -86,6 +108,19 @@ func TGGetParseMode(b *Btelegram, username string, text string) (textout string,
 	return textout, parsemode
 }
 
+// replaceMentions replaces the (HTML escaped) mentions of telegram users in text with
+// links that mention them.
+func (b *Btelegram) replaceMentions(text string, mentions []config.Mention) string {
+	escaped := make([]config.Mention, 0, len(mentions))
+	for _, m := range mentions {
+		m.Text = html.EscapeString(m.Text)
+		escaped = append(escaped, m)
+	}
+	return helper.ReplaceMentions(text, b.Account, escaped, func(m config.Mention) string {
+		return `<a href="tg://user?id=` + m.UserID + `">` + html.EscapeString(m.Username) + `</a>`
+	})
+}
+
 func (b *Btelegram) getIds(channel string) (int64, int, error) {
 	var chatid int64
 	topicid := 0
@@ -120,6 +155,18 @@ func (b *Btelegram) getIds(channel string) (int64, int, error) {
 func (b *Btelegram) Send(msg config.Message) (string, error) {
 	b.Log.Debugf("=> Receiving %#v", msg)
 
+	// the private chat with a user has their ID, it only exists if they started the bot
+	if msg.Event == config.EventDirectMessage {
+		userID, err := strconv.ParseInt(msg.UserID, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		if b.GetString("MessageFormat") == HTMLFormat {
+			msg.Text = makeHTML(html.EscapeString(msg.Text))
+		}
+		return b.sendMessage(userID, 0, "", msg.Text, 0)
+	}
+
 	chatid, topicid, err := b.getIds(msg.Channel)
 	if err != nil {
 		return "", err
@@ -131,7 +178,7 @@ func (b *Btelegram) Send(msg config.Message) (string, error) {
 	}
 
 	if b.GetString("MessageFormat") == HTMLFormat {
-		msg.Text = makeHTML(html.EscapeString(msg.Text))
+		msg.Text = b.replaceMentions(makeHTML(html.EscapeString(msg.Text)), msg.Mentions)
 	}
 
 	// Delete message
@@ -219,7 +266,7 @@ func (b *Btelegram) sendMediaFiles(msg *config.Message, chatid int64, threadid i
 	}
 	messages, err := b.c.SendMediaGroup(mg)
 	if err != nil {
-		return "", err
+		return "", &helper.UploadError{Err: err}
 	}
 	// return first message id
 	return strconv.Itoa(messages[0].MessageID), nil
@@ -0,0 +1,171 @@
+package btelegram
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+)
+
+// secretTokenHeader is the header Telegram sends the secret token of the webhook in.
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token" //nolint:gosec
+
+// A webhookListener receives the updates of the bots with the same WebhookBindAddress,
+// each bot gets the requests for the path of its WebhookURL.
+type webhookListener struct {
+	ln      net.Listener
+	server  *http.Server
+	tlsCert string
+	tlsKey  string
+
+	mutex sync.RWMutex
+	bots  map[string]*Btelegram // by path
+}
+
+var (
+	webhookListenersMutex sync.Mutex
+	webhookListeners      = make(map[string]*webhookListener) // by bind address
+)
+
+// connectWebhook receives the updates of the bot on WebhookBindAddress and registers
+// WebhookURL with Telegram.
+func (b *Btelegram) connectWebhook() (tgbotapi.UpdatesChannel, error) {
+	u, err := url.Parse(b.GetString("WebhookURL"))
+	if err != nil || u.Scheme != "https" {
+		return nil, fmt.Errorf("WebhookURL %q needs to be a https URL", b.GetString("WebhookURL"))
+	}
+	b.webhookPath = u.Path
+	if b.webhookPath == "" {
+		b.webhookPath = "/"
+	}
+	b.webhookSecret = b.GetString("WebhookSecret")
+	if b.webhookSecret == "" {
+		secret := make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			return nil, err
+		}
+		b.webhookSecret = hex.EncodeToString(secret)
+	}
+	b.updates = make(chan tgbotapi.Update, b.c.Buffer)
+
+	if err = b.listenWebhook(); err != nil {
+		return nil, err
+	}
+	wh, _ := tgbotapi.NewWebhook(u.String())
+	wh.SecretToken = b.webhookSecret
+	if _, err = b.c.Request(wh); err != nil {
+		b.unlistenWebhook()
+		return nil, err
+	}
+	b.Log.Infof("Receiving updates on %s%s for webhook %s", b.GetString("WebhookBindAddress"), b.webhookPath, u.Redacted())
+	return b.updates, nil
+}
+
+// listenWebhook adds the bot to the listener of WebhookBindAddress, which is started
+// when it's the first bot on the address.
+func (b *Btelegram) listenWebhook() error {
+	addr := b.GetString("WebhookBindAddress")
+	tlsCert, tlsKey := b.GetString("WebhookTLSCert"), b.GetString("WebhookTLSKey")
+
+	webhookListenersMutex.Lock()
+	defer webhookListenersMutex.Unlock()
+
+	l, ok := webhookListeners[addr]
+	if !ok {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		l = &webhookListener{ln: ln, tlsCert: tlsCert, tlsKey: tlsKey, bots: make(map[string]*Btelegram)}
+		l.server = &http.Server{Handler: l, ReadHeaderTimeout: 10 * time.Second}
+		go l.serve(b)
+		webhookListeners[addr] = l
+	}
+	if l.tlsCert != tlsCert || l.tlsKey != tlsKey {
+		return fmt.Errorf("%s is already used by a webhook with other WebhookTLSCert/WebhookTLSKey", addr)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if other, ok := l.bots[b.webhookPath]; ok {
+		return fmt.Errorf("%s%s is already used by the webhook of %s, use another path in WebhookURL", addr, b.webhookPath, other.Account)
+	}
+	l.bots[b.webhookPath] = b
+	return nil
+}
+
+// unlistenWebhook removes the bot from the listener of WebhookBindAddress, which stops
+// when it was the last bot on the address.
+func (b *Btelegram) unlistenWebhook() {
+	addr := b.GetString("WebhookBindAddress")
+
+	webhookListenersMutex.Lock()
+	defer webhookListenersMutex.Unlock()
+
+	l, ok := webhookListeners[addr]
+	if !ok {
+		return
+	}
+	l.mutex.Lock()
+	if l.bots[b.webhookPath] == b {
+		delete(l.bots, b.webhookPath)
+	}
+	empty := len(l.bots) == 0
+	l.mutex.Unlock()
+	if empty {
+		l.server.Close() //nolint:errcheck
+		delete(webhookListeners, addr)
+	}
+}
+
+// serve serves the webhooks until the listener is closed, b is the bot that started it.
+func (l *webhookListener) serve(b *Btelegram) {
+	var err error
+	if l.tlsCert != "" {
+		err = l.server.ServeTLS(l.ln, l.tlsCert, l.tlsKey)
+	} else {
+		err = l.server.Serve(l.ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		b.Log.Errorf("Webhook listener on %s failed: %s", l.ln.Addr(), err)
+	}
+}
+
+func (l *webhookListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mutex.RLock()
+	b, ok := l.bots[r.URL.Path]
+	l.mutex.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	b.handleWebhookRequest(w, r)
+}
+
+// handleWebhookRequest verifies the secret token of the webhook request and queues its update.
+func (b *Btelegram) handleWebhookRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(secretTokenHeader)), []byte(b.webhookSecret)) != 1 {
+		b.Log.Warnf("Rejecting webhook request with invalid secret token from %s", r.RemoteAddr)
+		http.Error(w, "invalid secret token", http.StatusUnauthorized)
+		return
+	}
+	var update tgbotapi.Update
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b.updates <- update
+}
@@ -0,0 +1,72 @@
+package btelegram
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTelegram(account, path, secret string, cfg config.Config, logger *logrus.Logger) *Btelegram {
+	b := New(&bridge.Config{
+		Bridge: &bridge.Bridge{Account: account, Log: logrus.NewEntry(logger), Config: cfg, General: &config.Protocol{}},
+	}).(*Btelegram)
+	b.webhookPath = path
+	b.webhookSecret = secret
+	b.updates = make(chan tgbotapi.Update, 1)
+	return b
+}
+
+func TestWebhookListener(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	cfg := config.NewConfigFromString(logger, []byte(`
+[telegram.one]
+WebhookBindAddress="127.0.0.1:0"
+[telegram.two]
+WebhookBindAddress="127.0.0.1:0"
+`))
+	one := newTestTelegram("telegram.one", "/one", "secret1", cfg, logger)
+	two := newTestTelegram("telegram.two", "/two", "secret2", cfg, logger)
+
+	// the bots share a listener
+	require.NoError(t, one.listenWebhook())
+	require.NoError(t, two.listenWebhook())
+	l := webhookListeners["127.0.0.1:0"]
+	require.NotNil(t, l)
+	assert.Len(t, l.bots, 2)
+	again := newTestTelegram("telegram.one", "/one", "secret1", cfg, logger)
+	assert.Error(t, again.listenWebhook(), "paths can't be shared")
+
+	post := func(path, secret string) int {
+		req, err := http.NewRequest(http.MethodPost, "http://"+l.ln.Addr().String()+path, strings.NewReader(`{"update_id":42}`))
+		require.NoError(t, err)
+		req.Header.Set(secretTokenHeader, secret)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, post("/two", "secret2"))
+	require.Len(t, two.updates, 1)
+	assert.Equal(t, 42, (<-two.updates).UpdateID)
+	assert.Empty(t, one.updates)
+
+	assert.Equal(t, http.StatusUnauthorized, post("/one", "secret2"))
+	assert.Equal(t, http.StatusUnauthorized, post("/one", ""))
+	assert.Equal(t, http.StatusNotFound, post("/three", "secret1"))
+	assert.Empty(t, one.updates)
+
+	// the listener stops with the last bot
+	one.unlistenWebhook()
+	assert.Equal(t, http.StatusNotFound, post("/one", "secret1"))
+	two.unlistenWebhook()
+	assert.NotContains(t, webhookListeners, "127.0.0.1:0")
+}
@@ -23,6 +23,8 @@ func (b *Bwhatsapp) eventHandler(evt interface{}) {
 		b.handleMessage(e)
 	case *events.GroupInfo:
 		b.handleGroupInfo(e)
+	case *events.PushName:
+		b.handlePushName(e)
 	}
 }
 
@@ -52,6 +54,7 @@ func (b *Bwhatsapp) handleUserJoin(event *events.GroupInfo) {
 			Protocol: b.Protocol,
 			Event:    config.EventJoinLeave,
 			Text:     "joined chat",
+			Extra:    map[string][]interface{}{config.EventJoinLeave: {config.JoinLeaveInfo{Nick: senderName, Action: config.JoinLeaveJoin}}},
 		}
 
 		b.Remote <- rmsg
@@ -69,6 +72,7 @@ func (b *Bwhatsapp) handleUserLeave(event *events.GroupInfo) {
 			Protocol: b.Protocol,
 			Event:    config.EventJoinLeave,
 			Text:     "left chat",
+			Extra:    map[string][]interface{}{config.EventJoinLeave: {config.JoinLeaveInfo{Nick: senderName, Action: config.JoinLeaveLeave}}},
 		}
 
 		b.Remote <- rmsg
@@ -97,6 +101,37 @@ func (b *Bwhatsapp) handleTopicChange(event *events.GroupInfo) {
 	b.Remote <- rmsg
 }
 
+// handlePushName relays the change of the push name of a user, if it's the name we show.
+func (b *Bwhatsapp) handlePushName(event *events.PushName) {
+	b.Log.Debugf("Receiving event %#v", event)
+
+	if event.Message == nil || event.OldPushName == "" || event.OldPushName == event.NewPushName {
+		return
+	}
+	contact, exists := b.contacts[event.JID]
+	if exists {
+		contact.PushName = event.NewPushName
+		b.contacts[event.JID] = contact
+	}
+	// the name in the contacts of the user wins over the push name
+	if exists && (contact.FullName != "" || contact.FirstName != "") {
+		return
+	}
+
+	rmsg := config.Message{
+		UserID:   event.JID.String(),
+		Username: "system",
+		Channel:  event.Message.Chat.String(),
+		Account:  b.Account,
+		Protocol: b.Protocol,
+		Event:    config.EventNickChange,
+		Text:     event.OldPushName + " is now known as " + event.NewPushName,
+		Extra:    map[string][]interface{}{config.EventNickChange: {config.NickChangeInfo{Old: event.OldPushName, New: event.NewPushName}}},
+	}
+
+	b.Remote <- rmsg
+}
+
 func (b *Bwhatsapp) handleMessage(message *events.Message) {
 	msg := message.Message
 	switch {
@@ -172,15 +207,16 @@ func (b *Bwhatsapp) handleTextMessage(messageInfo types.MessageInfo, msg *proto.
 	}
 
 	rmsg := config.Message{
-		UserID:   senderJID.String(),
-		Username: senderName,
-		Text:     text,
-		Channel:  channel.String(),
-		Account:  b.Account,
-		Protocol: b.Protocol,
-		Extra:    make(map[string][]interface{}),
-		ID:       getMessageIdFormat(senderJID, messageInfo.ID),
-		ParentID: parentID,
+		UserID:    senderJID.String(),
+		Username:  senderName,
+		Text:      text,
+		Channel:   channel.String(),
+		Account:   b.Account,
+		Protocol:  b.Protocol,
+		Extra:     make(map[string][]interface{}),
+		ID:        getMessageIdFormat(senderJID, messageInfo.ID),
+		ParentID:  parentID,
+		Timestamp: messageInfo.Timestamp,
 	}
 
 	if avatarURL, exists := b.userAvatars[senderJID.String()]; exists {
@@ -206,14 +242,15 @@ func (b *Bwhatsapp) handleImageMessage(msg *events.Message) {
 	}
 
 	rmsg := config.Message{
-		UserID:   senderJID.String(),
-		Username: senderName,
-		Channel:  msg.Info.Chat.String(),
-		Account:  b.Account,
-		Protocol: b.Protocol,
-		Extra:    make(map[string][]interface{}),
-		ID:       getMessageIdFormat(senderJID, msg.Info.ID),
-		ParentID: getParentIdFromCtx(ci),
+		UserID:    senderJID.String(),
+		Username:  senderName,
+		Channel:   msg.Info.Chat.String(),
+		Account:   b.Account,
+		Protocol:  b.Protocol,
+		Extra:     make(map[string][]interface{}),
+		ID:        getMessageIdFormat(senderJID, msg.Info.ID),
+		ParentID:  getParentIdFromCtx(ci),
+		Timestamp: msg.Info.Timestamp,
 	}
 
 	if avatarURL, exists := b.userAvatars[senderJID.String()]; exists {
@@ -270,14 +307,15 @@ func (b *Bwhatsapp) handleVideoMessage(msg *events.Message) {
 	}
 
 	rmsg := config.Message{
-		UserID:   senderJID.String(),
-		Username: senderName,
-		Channel:  msg.Info.Chat.String(),
-		Account:  b.Account,
-		Protocol: b.Protocol,
-		Extra:    make(map[string][]interface{}),
-		ID:       getMessageIdFormat(senderJID, msg.Info.ID),
-		ParentID: getParentIdFromCtx(ci),
+		UserID:    senderJID.String(),
+		Username:  senderName,
+		Channel:   msg.Info.Chat.String(),
+		Account:   b.Account,
+		Protocol:  b.Protocol,
+		Extra:     make(map[string][]interface{}),
+		ID:        getMessageIdFormat(senderJID, msg.Info.ID),
+		ParentID:  getParentIdFromCtx(ci),
+		Timestamp: msg.Info.Timestamp,
 	}
 
 	if avatarURL, exists := b.userAvatars[senderJID.String()]; exists {
@@ -336,14 +374,15 @@ func (b *Bwhatsapp) handleAudioMessage(msg *events.Message) {
 		senderJID = types.NewJID(ci.GetParticipant(), types.DefaultUserServer)
 	}
 	rmsg := config.Message{
-		UserID:   senderJID.String(),
-		Username: senderName,
-		Channel:  msg.Info.Chat.String(),
-		Account:  b.Account,
-		Protocol: b.Protocol,
-		Extra:    make(map[string][]interface{}),
-		ID:       getMessageIdFormat(senderJID, msg.Info.ID),
-		ParentID: getParentIdFromCtx(ci),
+		UserID:    senderJID.String(),
+		Username:  senderName,
+		Channel:   msg.Info.Chat.String(),
+		Account:   b.Account,
+		Protocol:  b.Protocol,
+		Extra:     make(map[string][]interface{}),
+		ID:        getMessageIdFormat(senderJID, msg.Info.ID),
+		ParentID:  getParentIdFromCtx(ci),
+		Timestamp: msg.Info.Timestamp,
 	}
 
 	if avatarURL, exists := b.userAvatars[senderJID.String()]; exists {
@@ -394,14 +433,15 @@ func (b *Bwhatsapp) handleDocumentMessage(msg *events.Message) {
 	}
 
 	rmsg := config.Message{
-		UserID:   senderJID.String(),
-		Username: senderName,
-		Channel:  msg.Info.Chat.String(),
-		Account:  b.Account,
-		Protocol: b.Protocol,
-		Extra:    make(map[string][]interface{}),
-		ID:       getMessageIdFormat(senderJID, msg.Info.ID),
-		ParentID: getParentIdFromCtx(ci),
+		UserID:    senderJID.String(),
+		Username:  senderName,
+		Channel:   msg.Info.Chat.String(),
+		Account:   b.Account,
+		Protocol:  b.Protocol,
+		Extra:     make(map[string][]interface{}),
+		ID:        getMessageIdFormat(senderJID, msg.Info.ID),
+		ParentID:  getParentIdFromCtx(ci),
+		Timestamp: msg.Info.Timestamp,
 	}
 
 	if avatarURL, exists := b.userAvatars[senderJID.String()]; exists {
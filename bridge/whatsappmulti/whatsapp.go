@@ -407,7 +407,7 @@ func (b *Bwhatsapp) Send(msg config.Message) (string, error) {
 		b.Log.Debugf("Extra file is %#v", filetype)
 
 		// TODO: add different types
-		// TODO: add webp conversion
+		// webp images can be converted by the gateway, see MediaImageFormats
 		switch filetype {
 		case "image/jpeg", "image/png", "image/gif":
 			return b.PostImageMessage(msg, filetype)
@@ -0,0 +1,190 @@
+package gateway
+
+import (
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+)
+
+// AttachmentMode values, configured per account.
+const (
+	// AttachmentModeNative uploads files natively to the destination (default).
+	AttachmentModeNative = "native"
+	// AttachmentModeLink sends links to the files on the mediaserver instead.
+	AttachmentModeLink = "link"
+	// AttachmentModeBoth uploads files natively and also sends the links.
+	AttachmentModeBoth = "both"
+	// AttachmentModePreview uploads a downscaled preview of images and sends links to the originals.
+	AttachmentModePreview = "inline-preview"
+)
+
+const defaultAttachmentPreviewSize = 512
+
+// attachmentMode returns the AttachmentMode configured for dest.
+func (gw *Gateway) attachmentMode(dest *bridge.Bridge) string {
+	switch mode := strings.ToLower(dest.GetString("AttachmentMode")); mode {
+	case AttachmentModeLink, AttachmentModeBoth, AttachmentModePreview:
+		return mode
+	case "", AttachmentModeNative:
+	default:
+		gw.logger.Warnf("Unknown AttachmentMode %s for %s, using %s", mode, dest.Account, AttachmentModeNative)
+	}
+	return AttachmentModeNative
+}
+
+// handleAttachmentMode applies the AttachmentMode of dest to the files of msg.
+// Files that are only linked are removed from msg and their links added to the text.
+// Files that are uploaded and linked (modes both and inline-preview) stay on msg and
+// the returned message, which has to be sent after msg, contains their links.
+// Files larger than AttachmentMaxSize of dest are always linked.
+// Files not stored on the mediaserver can't be linked and are always uploaded.
+func (gw *Gateway) handleAttachmentMode(msg *config.Message, dest *bridge.Bridge) *config.Message {
+	if msg.Extra == nil || len(msg.Extra["file"]) == 0 || msg.Event == config.EventAvatarDownload {
+		return nil
+	}
+
+	mode := gw.attachmentMode(dest)
+	maxSize := dest.GetInt("AttachmentMaxSize")
+	var (
+		native     []interface{}
+		linked     []config.FileInfo
+		alsoLinked []config.FileInfo
+	)
+	for _, f := range msg.Extra["file"] {
+		fi, ok := f.(config.FileInfo)
+		if !ok || !linkable(&fi) {
+			native = append(native, f)
+			continue
+		}
+		switch {
+		case fi.Data == nil || mode == AttachmentModeLink:
+			linked = append(linked, fi)
+		case maxSize > 0 && len(*fi.Data) > maxSize:
+			gw.logger.Debugf("%s is larger than AttachmentMaxSize %d of %s, sending link", fi.Name, maxSize, dest.Account)
+			linked = append(linked, fi)
+		case mode == AttachmentModePreview:
+			preview, ok := gw.attachmentPreview(fi, dest)
+			if !ok {
+				linked = append(linked, fi)
+				continue
+			}
+			native = append(native, preview)
+			alsoLinked = append(alsoLinked, fi)
+		case mode == AttachmentModeBoth:
+			native = append(native, fi)
+			alsoLinked = append(alsoLinked, fi)
+		default:
+			native = append(native, fi)
+		}
+	}
+	if len(linked) == 0 && len(alsoLinked) == 0 {
+		return nil
+	}
+
+	extra := make(map[string][]interface{}, len(msg.Extra))
+	for k, v := range msg.Extra {
+		extra[k] = v
+	}
+	extra["file"] = native
+
+	if len(native) == 0 {
+		msg.Text = attachmentLinks(msg.Text, linked, true)
+		delete(extra, "file")
+		msg.Extra = extra
+		return nil
+	}
+	msg.Extra = extra
+
+	lmsg := *msg
+	lmsg.ID = ""
+	lmsg.Extra = nil
+	lmsg.Text = attachmentLinks(attachmentLinks("", alsoLinked, false), linked, true)
+	return &lmsg
+}
+
+// attachmentPreview returns fi with its data replaced by a downscaled version
+// of the image, returns false if fi isn't an image.
+func (gw *Gateway) attachmentPreview(fi config.FileInfo, dest *bridge.Bridge) (config.FileInfo, bool) {
+	format := helper.DetectImageFormat(*fi.Data)
+	if format == "" || format == helper.ImageFormatHEIC {
+		return fi, false
+	}
+	size := dest.GetInt("AttachmentPreviewSize")
+	if size == 0 {
+		size = defaultAttachmentPreviewSize
+	}
+	if !helper.CanEncodeImage(format) {
+		format = helper.ImageFormatPNG
+	}
+	data := make([]byte, len(*fi.Data))
+	copy(data, *fi.Data)
+	if err := helper.ConvertImage(&data, format, size); err != nil {
+		gw.logger.Errorf("creating preview of %s failed: %s", fi.Name, err)
+		return fi, false
+	}
+	fi.Name = replaceExt(fi.Name, helper.ImageExtension(format))
+	fi.Data = &data
+	fi.Size = int64(len(data))
+	return fi, true
+}
+
+// attachmentFallback returns the message with links to the files of msg that failed to
+// upload to a destination, as described by uploadErr. Files without a mediaserver URL
+// can't be linked and are dropped, as are the files that were uploaded. The text is left
+// out if it was delivered already. Returns false if there is nothing to link.
+func attachmentFallback(msg config.Message, uploadErr *helper.UploadError) (config.Message, bool) {
+	if msg.Extra == nil {
+		return msg, false
+	}
+	failed := make(map[string]bool, len(uploadErr.Files))
+	for _, name := range uploadErr.Files {
+		failed[name] = true
+	}
+	var linked []config.FileInfo
+	for _, f := range msg.Extra["file"] {
+		fi, ok := f.(config.FileInfo)
+		if ok && linkable(&fi) && (len(failed) == 0 || failed[fi.Name]) {
+			linked = append(linked, fi)
+		}
+	}
+	if len(linked) == 0 {
+		return msg, false
+	}
+	extra := make(map[string][]interface{}, len(msg.Extra))
+	for k, v := range msg.Extra {
+		extra[k] = v
+	}
+	delete(extra, "file")
+	msg.Extra = extra
+	if uploadErr.Text {
+		msg.Text = attachmentLinks("", linked, false)
+	} else {
+		msg.Text = attachmentLinks(msg.Text, linked, true)
+	}
+	return msg, true
+}
+
+// linkable returns true if we have a public URL for fi: it has been stored on
+// the mediaserver or the source bridge only gave us a URL.
+func linkable(fi *config.FileInfo) bool {
+	return fi.URL != "" && (fi.SHA != "" || fi.Data == nil)
+}
+
+// attachmentLinks appends a line with the URL of every file to text, prefixed
+// with the file comment when withComment is set and it isn't the text itself.
+func attachmentLinks(text string, files []config.FileInfo, withComment bool) string {
+	lines := []string{}
+	if text != "" {
+		lines = append(lines, text)
+	}
+	for _, fi := range files {
+		if withComment && fi.Comment != "" && fi.Comment != text {
+			lines = append(lines, fi.Comment+": "+fi.URL)
+			continue
+		}
+		lines = append(lines, fi.URL)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,254 @@
+package gateway
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+)
+
+const (
+	// whoPeriod is how long users are listed by the who command after their last message.
+	whoPeriod = 24 * time.Hour
+	// whoMaxUsers is the maximum number of users listed by the who command.
+	whoMaxUsers = 25
+)
+
+// activeUser is a user who sent a message in a channel of the gateway, for the who command.
+type activeUser struct {
+	name    string
+	account string
+	seen    time.Time
+}
+
+// commandInfo returns the CommandInfo the bridge added to msg, if any.
+func commandInfo(msg *config.Message) (config.CommandInfo, bool) {
+	for _, v := range msg.Extra[config.EventCommand] {
+		if info, ok := v.(config.CommandInfo); ok && info.Name != "" {
+			return info, true
+		}
+	}
+	return config.CommandInfo{}, false
+}
+
+// handleEventCommand runs the command in the EventCommand msg for the gateways of the
+// channel it was given in and sends the replies back to the bridge. Returns true if msg
+// was a command.
+func (r *Router) handleEventCommand(msg *config.Message) bool {
+	if msg.Event != config.EventCommand {
+		return false
+	}
+	info, ok := commandInfo(msg)
+	if !ok {
+		return true
+	}
+	var replies []string
+	for _, gw := range r.Gateways {
+		if _, ok := gw.Channels[getChannelID(msg)]; ok {
+			replies = append(replies, gw.handleCommand(msg, info))
+		}
+	}
+	reply := strings.Join(replies, "\n\n")
+	if reply == "" {
+		reply = "This channel isn't bridged."
+	}
+
+	br := r.getBridge(msg.Account)
+	if br == nil {
+		return true
+	}
+	if _, err := br.Send(config.Message{
+		Text:    reply,
+		Channel: msg.Channel,
+		Account: msg.Account,
+		Event:   config.EventCommand,
+		Extra:   map[string][]interface{}{config.EventCommand: {info}},
+	}); err != nil {
+		r.logger.Errorf("replying to command %s on %s failed: %s", info.Name, msg.Account, err)
+	}
+	return true
+}
+
+// handleCommand runs the command info given by the user of msg and returns the reply.
+// The mute and unmute commands take the name of the user and optionally their account.
+func (gw *Gateway) handleCommand(msg *config.Message, info config.CommandInfo) string {
+	switch info.Name {
+	case config.CommandStatus:
+		return gw.status()
+	case config.CommandWho:
+		return gw.who()
+	case config.CommandMute, config.CommandUnmute:
+	default:
+		return fmt.Sprintf("Unknown command %s.", info.Name)
+	}
+
+	var name, account string
+	if len(info.Args) > 0 {
+		name = info.Args[0]
+	}
+	if len(info.Args) > 1 {
+		account = info.Args[1]
+	}
+	if name == "" {
+		return "Which user?"
+	}
+	key, user, reply := gw.muteKey(name, account)
+	if key == "" {
+		return reply
+	}
+	if info.Name == config.CommandUnmute {
+		if !gw.setMuted(key, user, false) {
+			return fmt.Sprintf("%s isn't muted in %s.", user, gw.Name)
+		}
+		gw.logger.Infof("%s on %s unmuted %s in gateway %s", msg.Username, msg.Account, user, gw.Name)
+		return fmt.Sprintf("Unmuted %s in %s.", user, gw.Name)
+	}
+	gw.logger.Infof("%s on %s muted %s in gateway %s", msg.Username, msg.Account, user, gw.Name)
+	gw.setMuted(key, user, true)
+	return fmt.Sprintf("Muted %s in %s, their messages aren't relayed until they're unmuted or matterbridge restarts.", user, gw.Name)
+}
+
+// muteKey returns the key the user with name (on account, if it's not empty) is muted by
+// and how the user is shown: the name of their identity, or their account and user ID, so
+// they can't get around a mute by changing their name. If the user isn't known, key is
+// empty and reply tells why.
+func (gw *Gateway) muteKey(name, account string) (key, user, reply string) {
+	if id := gw.Router.identities.findByName(name); id != nil && account == "" {
+		return "identity " + strings.ToLower(id.Name), id.Name, ""
+	}
+	var accounts []string
+	for acc := range gw.Bridges {
+		if account == "" || acc == account {
+			if userID, ok := gw.users.Peek(acc + " " + strings.ToLower(name)); ok {
+				key = acc + " " + userID.(string)
+				accounts = append(accounts, acc)
+			}
+		}
+	}
+	switch {
+	case len(accounts) == 1:
+		return key, name + " on " + accounts[0], ""
+	case len(accounts) > 1:
+		sort.Strings(accounts)
+		return "", "", fmt.Sprintf("%s is on %s, which account?", name, strings.Join(accounts, " and "))
+	case account != "":
+		return "", "", fmt.Sprintf("%s didn't send messages on %s recently.", name, account)
+	default:
+		return "", "", fmt.Sprintf("%s didn't send messages in %s recently.", name, gw.Name)
+	}
+}
+
+// status returns the channels of the gateway and whether their bridges joined them.
+func (gw *Gateway) status() string {
+	ids := make([]string, 0, len(gw.Channels))
+	for id := range gw.Channels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	lines := []string{fmt.Sprintf("Gateway %s:", gw.Name)}
+	for _, id := range ids {
+		channel := gw.Channels[id]
+		state := "not joined"
+		if br, ok := gw.Bridges[channel.Account]; ok && br.Joined[id] {
+			state = "joined"
+		}
+		lines = append(lines, fmt.Sprintf("- %s on %s (%s, %s)", channel.Name, channel.Account, channel.Direction, state))
+	}
+	if muted := gw.mutedUsers(); len(muted) > 0 {
+		lines = append(lines, "Muted: "+strings.Join(muted, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// rememberActive remembers the user of msg for the who command.
+func (gw *Gateway) rememberActive(msg *config.Message) {
+	if msg.Event != "" && msg.Event != config.EventUserAction {
+		return
+	}
+	name := gw.identityName(msg)
+	if name == "" {
+		name = msg.Username
+	}
+	if name == "" {
+		return
+	}
+	gw.active.Add(msg.Account+" "+strings.ToLower(name), activeUser{name: name, account: msg.Account, seen: time.Now()})
+}
+
+// who returns the users who sent messages in the channels of the gateway recently, the
+// most recent first.
+func (gw *Gateway) who() string {
+	var users []activeUser
+	for _, key := range gw.active.Keys() {
+		if v, ok := gw.active.Peek(key); ok && time.Since(v.(activeUser).seen) < whoPeriod {
+			users = append(users, v.(activeUser))
+		}
+	}
+	if len(users) == 0 {
+		return fmt.Sprintf("Nobody was active in %s recently.", gw.Name)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].seen.After(users[j].seen) })
+
+	lines := []string{fmt.Sprintf("Active in %s:", gw.Name)}
+	for i, u := range users {
+		if i == whoMaxUsers {
+			lines = append(lines, fmt.Sprintf("... and %d more", len(users)-i))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("- %s on %s, %s", u.name, u.account, ago(time.Since(u.seen))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func ago(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", d/time.Minute)
+	default:
+		return fmt.Sprintf("%dh ago", d/time.Hour)
+	}
+}
+
+// setMuted mutes or unmutes the user with key (shown as user) and returns false if
+// nothing changed. Mutes are only kept in memory.
+func (gw *Gateway) setMuted(key, user string, muted bool) bool {
+	gw.mutedMu.Lock()
+	defer gw.mutedMu.Unlock()
+	if _, ok := gw.muted[key]; ok == muted {
+		return false
+	}
+	if muted {
+		gw.muted[key] = user
+	} else {
+		delete(gw.muted, key)
+	}
+	return true
+}
+
+// isMuted returns true if the user who sent msg is muted, by their user ID or by the
+// identity with name.
+func (gw *Gateway) isMuted(msg *config.Message, name string) bool {
+	gw.mutedMu.Lock()
+	defer gw.mutedMu.Unlock()
+	if _, ok := gw.muted[msg.Account+" "+msg.UserID]; ok && msg.UserID != "" {
+		return true
+	}
+	_, ok := gw.muted["identity "+strings.ToLower(name)]
+	return ok && name != ""
+}
+
+func (gw *Gateway) mutedUsers() []string {
+	gw.mutedMu.Lock()
+	defer gw.mutedMu.Unlock()
+	users := make([]string, 0, len(gw.muted))
+	for _, user := range gw.muted {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
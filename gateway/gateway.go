@@ -1,15 +1,18 @@
 package gateway
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
 	"github.com/42wim/matterbridge/internal"
 	"github.com/d5/tengo/v2"
 	"github.com/d5/tengo/v2/stdlib"
@@ -30,7 +33,15 @@ type Gateway struct {
 	Name           string
 	Messages       *lru.Cache
 
-	logger *logrus.Entry
+	users      *lru.Cache
+	active     *lru.Cache
+	muted      map[string]string // muted users, by account and user ID or identity
+	mutedMu    sync.Mutex
+	stale      map[string]*staleBacklog
+	staleMu    sync.Mutex
+	joinPart   map[string]*joinPartBuffer
+	joinPartMu sync.Mutex
+	logger     *logrus.Entry
 }
 
 type BrMsgID struct {
@@ -47,6 +58,8 @@ func New(rootLogger *logrus.Logger, cfg *config.Gateway, r *Router) *Gateway {
 	logger := rootLogger.WithFields(logrus.Fields{"prefix": "gateway"})
 
 	cache, _ := lru.New(5000)
+	users, _ := lru.New(5000)
+	active, _ := lru.New(1000)
 	gw := &Gateway{
 		Channels: make(map[string]*config.ChannelInfo),
 		Message:  r.Message,
@@ -54,6 +67,11 @@ func New(rootLogger *logrus.Logger, cfg *config.Gateway, r *Router) *Gateway {
 		Bridges:  make(map[string]*bridge.Bridge),
 		Config:   r.Config,
 		Messages: cache,
+		users:    users,
+		active:   active,
+		muted:    make(map[string]string),
+		stale:    make(map[string]*staleBacklog),
+		joinPart: make(map[string]*joinPartBuffer),
 		logger:   logger,
 	}
 	if err := gw.AddConfig(cfg); err != nil {
@@ -217,8 +235,8 @@ func (gw *Gateway) getDestChannel(msg *config.Message, dest bridge.Bridge) []con
 		return channels
 	}
 
-	// discord join/leave is for the whole bridge, isn't a per channel join/leave
-	if msg.Event == config.EventJoinLeave && getProtocol(msg) == "discord" && msg.Channel == "" {
+	// discord join/leave and nick changes without channel are for the whole bridge
+	if msg.Channel == "" && (msg.Event == config.EventNickChange || msg.Event == config.EventJoinLeave && getProtocol(msg) == "discord") {
 		for _, channel := range gw.Channels {
 			if channel.Account == dest.Account && strings.Contains(channel.Direction, "out") &&
 				gw.validGatewayDest(msg) {
@@ -306,6 +324,20 @@ func (gw *Gateway) ignoreMessage(msg *config.Message) bool {
 	if gw.ignoreTextEmpty(msg) || gw.ignoreText(msg.Username, igNicks) || gw.ignoreText(msg.Text, igMessages) || gw.ignoreFilesComment(msg.Extra, igMessages) {
 		return true
 	}
+	name := gw.identityName(msg)
+	// ignore all users of an identity by its name
+	if name != "" && gw.ignoreText(name, igNicks) {
+		return true
+	}
+	// users muted with a command of the bridge
+	if gw.isMuted(msg, name) {
+		gw.logger.Debugf("ignoring message of muted user %s", msg.Username)
+		return true
+	}
+	// users of an identity are relayed under its name, so their nick changes don't show
+	if name != "" && msg.Event == config.EventNickChange {
+		return true
+	}
 
 	return false
 }
@@ -503,9 +535,33 @@ func (gw *Gateway) SendMessage(
 		return "", nil
 	}
 
+	if gw.isStale(rmsg) {
+		gw.handleStale(&msg, dest, channel)
+		return "", nil
+	}
+	// relay the summary of messages we didn't send first
+	gw.flushStale(dest, channel.ID)
+
+	if msg.Event == config.EventJoinLeave {
+		gw.handleJoinLeave(rmsg, &msg, dest)
+		if gw.bufferJoinPart(rmsg, &msg, dest, channel) {
+			gw.logger.Debugf("=> Buffering join/part from %s (%s) to %s (%s)", msg.Account, rmsg.Channel, dest.Account, channel.Name)
+			return "", nil
+		}
+	} else {
+		gw.flushJoinPart(dest, channel.ID)
+	}
+
 	if debugSendMessage != "" {
 		gw.logger.Debug(debugSendMessage)
 	}
+
+	gw.handleMentions(&msg, dest)
+	gw.handleNickChange(rmsg, &msg, dest)
+	gw.handleDelayNotice(&msg, dest)
+	gw.handleTranscode(&msg, dest)
+	linkMsg := gw.handleAttachmentMode(&msg, dest)
+
 	// if we are using mattermost plugin account, send messages to MattermostPlugin channel
 	// that can be picked up by the mattermost matterbridge plugin
 	if dest.Account == "mattermost.plugin" {
@@ -518,8 +574,30 @@ func (gw *Gateway) SendMessage(
 
 	// wichtig
 	mID, err := dest.Send(msg)
-	if err != nil {
+	var uploadErr *helper.UploadError
+	switch {
+	case errors.As(err, &uploadErr):
+		// fall back to links to the mediaserver if the native upload failed
+		fallback, ok := attachmentFallback(msg, uploadErr)
+		if !ok {
+			return uploadErr.ID, err
+		}
+		gw.logger.Warnf("Sending files to %s failed: %s, sending links instead", dest.Account, err)
+		fallbackID, err := dest.Send(fallback)
+		if err != nil {
+			return uploadErr.ID, err
+		}
+		// the message is known by the ID of the part that was delivered first
+		mID = uploadErr.ID
+		if mID == "" {
+			mID = fallbackID
+		}
+	case err != nil:
 		return mID, err
+	case linkMsg != nil:
+		if _, err := dest.Send(*linkMsg); err != nil {
+			gw.logger.Errorf("Sending file links to %s failed: %s", dest.Account, err)
+		}
 	}
 
 	// append the message ID (mID) from this bridge (dest) to our brMsgIDs slice
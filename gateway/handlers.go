@@ -2,7 +2,7 @@ package gateway
 
 import (
 	"bytes"
-	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -17,6 +17,10 @@ import (
 	"github.com/42wim/matterbridge/gateway/bridgemap"
 )
 
+// eventFlush is the event of the messages requestFlush sends to the router, bridges
+// never send it.
+const eventFlush = "gateway_flush"
+
 // handleEventFailure handles failures and reconnects bridges.
 func (r *Router) handleEventFailure(msg *config.Message) {
 	if msg.Event != config.EventFailure {
@@ -32,6 +36,26 @@ func (r *Router) handleEventFailure(msg *config.Message) {
 	}
 }
 
+// handleEventFlush runs the flush the timer of a gateway requested with requestFlush.
+func (r *Router) handleEventFlush(msg *config.Message) bool {
+	if msg.Event != eventFlush {
+		return false
+	}
+	for _, v := range msg.Extra[eventFlush] {
+		if flush, ok := v.(func()); ok {
+			flush()
+		}
+	}
+	return true
+}
+
+// requestFlush has the router run flush, which sends messages the gateway held back.
+// Timers use this instead of sending themselves, so bridges are only sent to from the
+// router goroutine and the held back messages stay in order with the others.
+func (gw *Gateway) requestFlush(flush func()) {
+	gw.Router.Message <- config.Message{Event: eventFlush, Extra: map[string][]interface{}{eventFlush: {flush}}}
+}
+
 // handleEventGetChannelMembers handles channel members
 func (r *Router) handleEventGetChannelMembers(msg *config.Message) {
 	if msg.Event != config.EventGetChannelMembers {
@@ -68,13 +92,10 @@ func (r *Router) handleEventRejoinChannels(msg *config.Message) {
 
 // handleFiles uploads or places all files on the given msg to the MediaServer and
 // adds the new URL of the file on the MediaServer onto the given msg.
+// Files are stored under the SHA-256 of their content, identical files are only stored once.
 func (gw *Gateway) handleFiles(msg *config.Message) {
-	reg := regexp.MustCompile("[^a-zA-Z0-9]+")
-
 	// If we don't have a attachfield or we don't have a mediaserver configured return
-	if msg.Extra == nil ||
-		(gw.BridgeValues().General.MediaServerUpload == "" &&
-			gw.BridgeValues().General.MediaDownloadPath == "") {
+	if msg.Extra == nil || !gw.mediaServerEnabled() {
 		return
 	}
 
@@ -85,49 +106,68 @@ func (gw *Gateway) handleFiles(msg *config.Message) {
 
 	for i, f := range msg.Extra["file"] {
 		fi := f.(config.FileInfo)
-		ext := filepath.Ext(fi.Name)
-		fi.Name = fi.Name[0 : len(fi.Name)-len(ext)]
-		fi.Name = reg.ReplaceAllString(fi.Name, "_")
-		fi.Name += ext
+		durl, sha256sum, err := gw.storeFile(fi)
+		if err != nil {
+			gw.logger.Error(err)
+			continue
+		}
+
+		// We uploaded/placed the file successfully. Add the SHA and URL.
+		extra := msg.Extra["file"][i].(config.FileInfo)
+		extra.URL = durl
+		extra.SHA = sha256sum
+		msg.Extra["file"][i] = extra
+	}
+}
+
+func (gw *Gateway) mediaServerEnabled() bool {
+	return gw.BridgeValues().General.MediaServerUpload != "" || gw.BridgeValues().General.MediaDownloadPath != ""
+}
+
+// storeFile uploads or places the file fi on the MediaServer, unless it's already stored,
+// and returns its download URL and SHA-256.
+func (gw *Gateway) storeFile(fi config.FileInfo) (string, string, error) {
+	reg := regexp.MustCompile("[^a-zA-Z0-9]+")
+	ext := filepath.Ext(fi.Name)
+	fi.Name = fi.Name[0 : len(fi.Name)-len(ext)]
+	fi.Name = reg.ReplaceAllString(fi.Name, "_")
+	fi.Name += ext
 
-		sha1sum := fmt.Sprintf("%x", sha1.Sum(*fi.Data))[:8] //nolint:gosec
+	sha256sum := fmt.Sprintf("%x", sha256.Sum256(*fi.Data))
 
+	name, stored := gw.Router.media.lookup(sha256sum, fi.Name, fi.Avatar)
+	if stored {
+		gw.logger.Debugf("mediaserver already has %s as %s/%s", fi.Name, sha256sum, name)
+	} else {
 		if gw.BridgeValues().General.MediaServerUpload != "" {
 			// Use MediaServerUpload. Upload using a PUT HTTP request and basicauth.
-			if err := gw.handleFilesUpload(&fi); err != nil {
-				gw.logger.Error(err)
-				continue
+			if err := gw.handleFilesUpload(&fi, sha256sum); err != nil {
+				return "", "", err
 			}
 		} else {
 			// Use MediaServerPath. Place the file on the current filesystem.
-			if err := gw.handleFilesLocal(&fi); err != nil {
-				gw.logger.Error(err)
-				continue
+			if err := gw.handleFilesLocal(&fi, sha256sum); err != nil {
+				return "", "", err
 			}
 		}
+		gw.Router.media.add(sha256sum, name, int64(len(*fi.Data)))
+	}
 
-		// Download URL.
-		durl := gw.BridgeValues().General.MediaServerDownload + "/" + sha1sum + "/" + fi.Name
-
-		gw.logger.Debugf("mediaserver download URL = %s", durl)
+	// Download URL.
+	durl := gw.BridgeValues().General.MediaServerDownload + "/" + sha256sum + "/" + name
 
-		// We uploaded/placed the file successfully. Add the SHA and URL.
-		extra := msg.Extra["file"][i].(config.FileInfo)
-		extra.URL = durl
-		extra.SHA = sha1sum
-		msg.Extra["file"][i] = extra
-	}
+	gw.logger.Debugf("mediaserver download URL = %s", durl)
+	return durl, sha256sum, nil
 }
 
 // handleFilesUpload uses MediaServerUpload configuration to upload the file.
 // Returns error on failure.
-func (gw *Gateway) handleFilesUpload(fi *config.FileInfo) error {
+func (gw *Gateway) handleFilesUpload(fi *config.FileInfo, sha256sum string) error {
 	client := &http.Client{
 		Timeout: time.Second * 5,
 	}
 	// Use MediaServerUpload. Upload using a PUT HTTP request and basicauth.
-	sha1sum := fmt.Sprintf("%x", sha1.Sum(*fi.Data))[:8] //nolint:gosec
-	url := gw.BridgeValues().General.MediaServerUpload + "/" + sha1sum + "/" + fi.Name
+	url := gw.BridgeValues().General.MediaServerUpload + "/" + sha256sum + "/" + fi.Name
 
 	req, err := http.NewRequest("PUT", url, bytes.NewReader(*fi.Data))
 	if err != nil {
@@ -137,24 +177,45 @@ func (gw *Gateway) handleFilesUpload(fi *config.FileInfo) error {
 	gw.logger.Debugf("mediaserver upload url: %s", url)
 
 	req.Header.Set("Content-Type", "binary/octet-stream")
-	_, err = client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("mediaserver upload failed, could not Do request: %#v", err)
 	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("mediaserver upload failed: %s", resp.Status)
+	}
 	return nil
 }
 
 // handleFilesLocal use MediaServerPath configuration, places the file on the current filesystem.
+// If the same content is already stored under another name it is hard linked instead of copied.
 // Returns error on failure.
-func (gw *Gateway) handleFilesLocal(fi *config.FileInfo) error {
-	sha1sum := fmt.Sprintf("%x", sha1.Sum(*fi.Data))[:8] //nolint:gosec
-	dir := gw.BridgeValues().General.MediaDownloadPath + "/" + sha1sum
+func (gw *Gateway) handleFilesLocal(fi *config.FileInfo, sha256sum string) error {
+	dir := gw.BridgeValues().General.MediaDownloadPath + "/" + sha256sum
 	err := os.Mkdir(dir, os.ModePerm)
 	if err != nil && !os.IsExist(err) {
 		return fmt.Errorf("mediaserver path failed, could not mkdir: %s %#v", err, err)
 	}
 
 	path := dir + "/" + fi.Name
+	if _, err = os.Stat(path); err == nil {
+		gw.logger.Debugf("mediaserver path already has file: %s", path)
+		return nil
+	}
+
+	if entries, err := ioutil.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			if !entry.Mode().IsRegular() {
+				continue
+			}
+			if err = os.Link(dir+"/"+entry.Name(), path); err == nil {
+				gw.logger.Debugf("mediaserver path linking file: %s to %s", path, entry.Name())
+				return nil
+			}
+		}
+	}
+
 	gw.logger.Debugf("mediaserver path placing file: %s", path)
 
 	err = ioutil.WriteFile(path, *fi.Data, os.ModePerm)
@@ -164,6 +225,25 @@ func (gw *Gateway) handleFilesLocal(fi *config.FileInfo) error {
 	return nil
 }
 
+// handleFilesRecord links the files of msg stored on the mediaserver to the
+// message and the IDs of the messages it was relayed as.
+func (gw *Gateway) handleFilesRecord(msg *config.Message, msgIDs []*BrMsgID) {
+	if msg.Extra == nil || msg.ID == "" {
+		return
+	}
+	var relayed []string
+	for _, id := range msgIDs {
+		relayed = append(relayed, id.ID)
+	}
+	for _, f := range msg.Extra["file"] {
+		fi, ok := f.(config.FileInfo)
+		if !ok || fi.SHA == "" {
+			continue
+		}
+		gw.Router.media.link(fi.SHA, gw.Name, msg.Protocol+" "+msg.ID, relayed)
+	}
+}
+
 // ignoreEvent returns true if we need to ignore this event for the specified destination bridge.
 func (gw *Gateway) ignoreEvent(event string, dest *bridge.Bridge) bool {
 	switch event {
@@ -177,6 +257,11 @@ func (gw *Gateway) ignoreEvent(event string, dest *bridge.Bridge) bool {
 		if !dest.GetBool("ShowJoinPart") {
 			return true
 		}
+	case config.EventNickChange:
+		// only relay nick changes when configured or to rename puppets
+		if !dest.GetBool("ShowNickChange") && !dest.GetBool("Puppets") {
+			return true
+		}
 	case config.EventTopicChange:
 		// only relay topic change when used in some way on other side
 		if !dest.GetBool("ShowTopicChange") && !dest.GetBool("SyncTopic") {
@@ -199,6 +284,13 @@ func (gw *Gateway) handleMessage(rmsg *config.Message, dest *bridge.Bridge) []*B
 		}
 	}
 
+	// Reactions would be relayed as a message with just the emoji otherwise.
+	if rmsg.Event == config.EventReaction {
+		if _, ok := bridgemap.ReactionSupport[dest.Protocol]; !ok {
+			return nil
+		}
+	}
+
 	// if we have an attached file, or other info
 	if rmsg.Extra != nil && len(rmsg.Extra[config.EventFileFailureSize]) != 0 && rmsg.Text == "" {
 		return brMsgIDs
@@ -208,15 +300,16 @@ func (gw *Gateway) handleMessage(rmsg *config.Message, dest *bridge.Bridge) []*B
 		return brMsgIDs
 	}
 
-	// broadcast to every out channel (irc QUIT)
-	if rmsg.Channel == "" && rmsg.Event != config.EventJoinLeave {
+	// broadcast to every out channel (discord join/leave, nick changes)
+	if rmsg.Channel == "" && rmsg.Event != config.EventJoinLeave && rmsg.Event != config.EventNickChange {
 		gw.logger.Debug("empty channel")
 		return brMsgIDs
 	}
 
 	// Get the ID of the parent message in thread
 	var canonicalParentMsgID string
-	if rmsg.ParentID != "" && dest.GetBool("PreserveThreading") {
+	// reactions are useless without the message they're a reaction to
+	if rmsg.ParentID != "" && (dest.GetBool("PreserveThreading") || rmsg.Event == config.EventReaction) {
 		canonicalParentMsgID = gw.FindCanonicalMsgID(rmsg.Protocol, rmsg.ParentID)
 	}
 
@@ -236,6 +329,88 @@ func (gw *Gateway) handleMessage(rmsg *config.Message, dest *bridge.Bridge) []*B
 	return brMsgIDs
 }
 
+// nickChangeInfo returns the NickChangeInfo the bridge added to msg, if any.
+func nickChangeInfo(msg *config.Message) (config.NickChangeInfo, bool) {
+	for _, v := range msg.Extra[config.EventNickChange] {
+		if info, ok := v.(config.NickChangeInfo); ok && info.Old != "" && info.New != "" {
+			return info, true
+		}
+	}
+	return config.NickChangeInfo{}, false
+}
+
+// handleNickChange adds how the old and new nick of the nick change rmsg appear on dest
+// to msg, so dest can rename the puppet of the user.
+func (gw *Gateway) handleNickChange(rmsg, msg *config.Message, dest *bridge.Bridge) {
+	if msg.Event != config.EventNickChange {
+		return
+	}
+	info, ok := nickChangeInfo(rmsg)
+	if !ok {
+		return
+	}
+	user := *rmsg
+	user.Username = info.Old
+	info.RemoteOld = gw.modifyUsername(&user, dest)
+	user.Username = info.New
+	info.RemoteNew = gw.modifyUsername(&user, dest)
+	msg.Extra = map[string][]interface{}{config.EventNickChange: {info}}
+}
+
+// handleJoinLeave adds how the users who joined or left in rmsg appear on dest to msg,
+// so dest can have their puppets join or part.
+func (gw *Gateway) handleJoinLeave(rmsg, msg *config.Message, dest *bridge.Bridge) {
+	if msg.Event != config.EventJoinLeave {
+		return
+	}
+	info, ok := joinPartInfo(rmsg)
+	if !ok {
+		return
+	}
+	user := *rmsg
+	user.Username = info.Nick
+	info.Remote = gw.modifyUsername(&user, dest)
+	msg.Extra = map[string][]interface{}{config.EventJoinLeave: {info}}
+}
+
+// handleDelayNotice annotates messages that are relayed more than DelayNoticeAfter
+// seconds after they were sent on the source bridge, using DelayNoticeFormat. Only the
+// Matrix appservice can send messages with their original time, IRC servers set the
+// server-time themselves and Slack can't post messages in the past.
+func (gw *Gateway) handleDelayNotice(msg *config.Message, dest *bridge.Bridge) {
+	after := dest.GetInt("DelayNoticeAfter")
+	if after <= 0 || msg.Timestamp.IsZero() || msg.Text == "" || msg.ID != "" {
+		return
+	}
+	if msg.Event != "" && msg.Event != config.EventUserAction {
+		return
+	}
+	delay := time.Since(msg.Timestamp)
+	if delay < time.Duration(after)*time.Second {
+		return
+	}
+	format := dest.GetString("DelayNoticeFormat")
+	if format == "" {
+		format = "{MESSAGE} (sent {DELAY} ago)"
+	}
+	format = strings.ReplaceAll(format, "{DELAY}", formatDelay(delay))
+	format = strings.ReplaceAll(format, "{TIME}", msg.Timestamp.Format("2006-01-02 15:04 MST"))
+	msg.Text = strings.ReplaceAll(format, "{MESSAGE}", msg.Text)
+}
+
+// formatDelay returns a short human readable representation of d, eg 12m.
+func formatDelay(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
 func (gw *Gateway) handleExtractNicks(msg *config.Message) {
 	var err error
 	br := gw.Bridges[msg.Account]
@@ -1,8 +1,22 @@
 package gateway
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
 	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 
 	"testing"
@@ -73,3 +87,651 @@ func TestExtractNick(t *testing.T) {
 	}
 
 }
+
+func TestHandleFilesDeduplication(t *testing.T) {
+	dir := t.TempDir()
+	r := maketestRouter([]byte(fmt.Sprintf(`
+[general]
+MediaDownloadPath=%q
+MediaServerDownload="https://example.com/media"
+MediaIndexFile=%q
+`, dir, filepath.Join(dir, "index.json")) + string(testconfig)))
+	gw := r.Gateways["bridge1"]
+
+	data := []byte("the same content")
+	sha := fmt.Sprintf("%x", sha256.Sum256(data))
+	newMsg := func(id, name string) *config.Message {
+		return &config.Message{
+			ID:       id,
+			Protocol: "irc",
+			Extra: map[string][]interface{}{
+				"file": {config.FileInfo{Name: name, Data: &data}},
+			},
+		}
+	}
+
+	msg1 := newMsg("1", "first.txt")
+	gw.handleFiles(msg1)
+	gw.handleFilesRecord(msg1, []*BrMsgID{{ID: "slack 123"}})
+	msg2 := newMsg("2", "second.txt")
+	gw.handleFiles(msg2)
+
+	fi1 := msg1.Extra["file"][0].(config.FileInfo)
+	fi2 := msg2.Extra["file"][0].(config.FileInfo)
+	assert.Equal(t, sha, fi1.SHA)
+	assert.Equal(t, "https://example.com/media/"+sha+"/first.txt", fi1.URL)
+	// identical content is reused under the name it was stored with first
+	assert.Equal(t, fi1.URL, fi2.URL)
+
+	entries, err := ioutil.ReadDir(filepath.Join(dir, sha))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	rec, ok := r.media.get(sha)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"first.txt"}, rec.Names)
+	assert.Equal(t, []MediaMessage{{Gateway: "bridge1", ID: "irc 1", Relayed: []string{"slack 123"}}}, rec.Messages)
+
+	// the index survives a restart
+	_, err = os.Stat(filepath.Join(dir, "index.json"))
+	assert.NoError(t, err)
+	rec, ok = newMediaStore(gw.logger, filepath.Join(dir, "index.json")).get(sha)
+	assert.True(t, ok)
+	assert.Equal(t, int64(len(data)), rec.Size)
+}
+
+func TestMediaStoreIndex(t *testing.T) {
+	logger := logrus.NewEntry(logrus.New())
+	logger.Logger.SetOutput(ioutil.Discard)
+	file := filepath.Join(t.TempDir(), "index.json")
+	lines := func() int {
+		data, err := ioutil.ReadFile(file)
+		assert.NoError(t, err)
+		return strings.Count(string(data), "\n")
+	}
+
+	m := newMediaStore(logger, file)
+	m.add("abc", "a.txt", 3)
+	m.add("abc", "a.txt", 3)
+	m.add("abc", "b.txt", 3)
+	for i := 0; i < 5; i++ {
+		m.link("abc", "bridge1", "irc 1", []string{fmt.Sprintf("slack %d", i)})
+	}
+	m.link("def", "bridge1", "irc 2", nil)
+	assert.Equal(t, 7, lines(), "changes are appended")
+
+	// the index is replayed and compacted when it's reopened
+	m = newMediaStore(logger, file)
+	rec, ok := m.get("abc")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, rec.Names)
+	assert.Equal(t, int64(3), rec.Size)
+	assert.Equal(t, []MediaMessage{{Gateway: "bridge1", ID: "irc 1", Relayed: []string{"slack 4"}}}, rec.Messages)
+	assert.Equal(t, 3, lines())
+
+	// only the last links of a file are kept
+	m.add("def", "d.txt", 1)
+	for i := 0; i < mediaMaxMessages+5; i++ {
+		m.link("def", "bridge1", fmt.Sprintf("irc %d", 100+i), nil)
+	}
+	rec, _ = m.get("def")
+	assert.Len(t, rec.Messages, mediaMaxMessages)
+	assert.Equal(t, "irc 105", rec.Messages[0].ID)
+	m = newMediaStore(logger, file)
+	rec, _ = m.get("def")
+	assert.Len(t, rec.Messages, mediaMaxMessages)
+
+	// a line cut off by a crash is skipped
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0o600)
+	assert.NoError(t, err)
+	f.WriteString(`{"sha256":"ghi","na`) //nolint:errcheck
+	f.Close()
+	m = newMediaStore(logger, file)
+	m.add("ghi", "c.txt", 1)
+	m = newMediaStore(logger, file)
+	_, ok = m.get("abc")
+	assert.True(t, ok)
+	_, ok = m.get("ghi")
+	assert.True(t, ok)
+}
+
+func TestHandleTranscode(t *testing.T) {
+	dir := t.TempDir()
+	r := maketestRouter([]byte(fmt.Sprintf(`
+[general]
+MediaDownloadPath=%q
+MediaServerDownload="https://example.com/media"
+[irc.freenode]
+server=""
+[discord.test]
+server=""
+MediaImageFormats=["jpg"]
+[slack.test]
+server=""
+MediaImageFormats=["png", "jpeg"]
+
+[[gateway]]
+    name = "bridge1"
+    enable=true
+
+    [[gateway.inout]]
+    account = "irc.freenode"
+    channel = "#wimtesting"
+
+    [[gateway.inout]]
+    account = "discord.test"
+    channel = "general"
+
+    [[gateway.inout]]
+    account = "slack.test"
+    channel = "general"
+`, dir)))
+	gw := r.Gateways["bridge1"]
+
+	var buf bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	assert.NoError(t, png.Encode(&buf, img))
+	data := buf.Bytes()
+	msg := &config.Message{Extra: map[string][]interface{}{"file": {config.FileInfo{Name: "graph.png", Data: &data}}}}
+	gw.handleFiles(msg)
+	original := msg.Extra["file"][0].(config.FileInfo)
+
+	// accepted formats are relayed as they are
+	relayed := *msg
+	gw.handleTranscode(&relayed, gw.Bridges["slack.test"])
+	assert.Equal(t, original, relayed.Extra["file"][0])
+
+	relayed = *msg
+	gw.handleTranscode(&relayed, gw.Bridges["discord.test"])
+	fi := relayed.Extra["file"][0].(config.FileInfo)
+	assert.Equal(t, "graph.jpg", fi.Name)
+	assert.Equal(t, helper.ImageFormatJPEG, helper.DetectImageFormat(*fi.Data))
+	assert.Equal(t, int64(len(*fi.Data)), fi.Size)
+	// the transcoded file is stored too
+	sha := fmt.Sprintf("%x", sha256.Sum256(*fi.Data))
+	assert.Equal(t, sha, fi.SHA)
+	assert.Equal(t, "https://example.com/media/"+sha+"/graph.jpg", fi.URL)
+	_, err := os.Stat(filepath.Join(dir, sha, "graph.jpg"))
+	assert.NoError(t, err)
+
+	// the message relayed to other destinations isn't touched
+	assert.Equal(t, original, msg.Extra["file"][0])
+	assert.Equal(t, helper.ImageFormatPNG, helper.DetectImageFormat(*original.Data))
+}
+
+func TestHandleAttachmentMode(t *testing.T) {
+	r := maketestRouter([]byte(`
+[irc.freenode]
+server=""
+AttachmentMode="link"
+[discord.test]
+server=""
+AttachmentMaxSize=10
+[slack.test]
+server=""
+AttachmentMode="both"
+
+[[gateway]]
+    name = "bridge1"
+    enable=true
+
+    [[gateway.inout]]
+    account = "irc.freenode"
+    channel = "#wimtesting"
+
+    [[gateway.inout]]
+    account = "discord.test"
+    channel = "general"
+
+    [[gateway.inout]]
+    account="slack.test"
+    channel="testing"
+`))
+	gw := r.Gateways["bridge1"]
+
+	small := []byte("small")
+	large := []byte("this is a large file")
+	newMsg := func() *config.Message {
+		return &config.Message{
+			Text: "look",
+			Extra: map[string][]interface{}{
+				"file": {
+					config.FileInfo{Name: "small.txt", Data: &small, URL: "https://example.com/1/small.txt", SHA: "1"},
+					config.FileInfo{Name: "large.txt", Data: &large, URL: "https://example.com/2/large.txt", SHA: "2", Comment: "big"},
+					config.FileInfo{Name: "local.txt", Data: &small},
+				},
+			},
+		}
+	}
+
+	// link mode: only the file without a mediaserver URL is uploaded
+	msg := newMsg()
+	lmsg := gw.handleAttachmentMode(msg, gw.Bridges["irc.freenode"])
+	assert.Len(t, msg.Extra["file"], 1)
+	assert.Equal(t, "https://example.com/1/small.txt\nbig: https://example.com/2/large.txt", lmsg.Text)
+
+	// without files left to upload the links are added to the message
+	msg = newMsg()
+	msg.Extra["file"] = msg.Extra["file"][:2]
+	assert.Nil(t, gw.handleAttachmentMode(msg, gw.Bridges["irc.freenode"]))
+	assert.Equal(t, "look\nhttps://example.com/1/small.txt\nbig: https://example.com/2/large.txt", msg.Text)
+	assert.Empty(t, msg.Extra["file"])
+
+	// native mode with a size limit
+	msg = newMsg()
+	lmsg = gw.handleAttachmentMode(msg, gw.Bridges["discord.test"])
+	assert.Len(t, msg.Extra["file"], 2)
+	assert.Equal(t, "big: https://example.com/2/large.txt", lmsg.Text)
+
+	// both mode
+	msg = newMsg()
+	lmsg = gw.handleAttachmentMode(msg, gw.Bridges["slack.test"])
+	assert.Len(t, msg.Extra["file"], 3)
+	assert.Equal(t, "https://example.com/1/small.txt\nhttps://example.com/2/large.txt", lmsg.Text)
+
+	// upload failure fallback
+	fallback, ok := attachmentFallback(*newMsg(), &helper.UploadError{})
+	assert.True(t, ok)
+	assert.Empty(t, fallback.Extra["file"])
+	assert.Equal(t, "look\nhttps://example.com/1/small.txt\nbig: https://example.com/2/large.txt", fallback.Text)
+
+	// only the files that failed are linked, without the text that was delivered
+	fallback, ok = attachmentFallback(*newMsg(), &helper.UploadError{Text: true, Files: []string{"large.txt", "local.txt"}})
+	assert.True(t, ok)
+	assert.Equal(t, "https://example.com/2/large.txt", fallback.Text)
+	_, ok = attachmentFallback(*newMsg(), &helper.UploadError{Files: []string{"local.txt"}})
+	assert.False(t, ok)
+}
+
+func TestHandleDelayNotice(t *testing.T) {
+	r := maketestRouter([]byte(`
+[irc.freenode]
+server=""
+DelayNoticeAfter=60
+[discord.test]
+server=""
+
+[[gateway]]
+    name = "bridge1"
+    enable=true
+
+    [[gateway.inout]]
+    account = "irc.freenode"
+    channel = "#wimtesting"
+
+    [[gateway.inout]]
+    account = "discord.test"
+    channel = "general"
+`))
+	gw := r.Gateways["bridge1"]
+
+	msg := &config.Message{Text: "hello", Timestamp: time.Now().Add(-12 * time.Minute)}
+	gw.handleDelayNotice(msg, gw.Bridges["irc.freenode"])
+	assert.Equal(t, "hello (sent 12m ago)", msg.Text)
+
+	msg = &config.Message{Text: "hello", Timestamp: time.Now().Add(-12 * time.Minute)}
+	gw.handleDelayNotice(msg, gw.Bridges["discord.test"])
+	assert.Equal(t, "hello", msg.Text)
+
+	msg = &config.Message{Text: "hello", Timestamp: time.Now().Add(-10 * time.Second)}
+	gw.handleDelayNotice(msg, gw.Bridges["irc.freenode"])
+	assert.Equal(t, "hello", msg.Text)
+
+	assert.Equal(t, "3h", formatDelay(3*time.Hour+5*time.Minute))
+	assert.Equal(t, "2d", formatDelay(50*time.Hour))
+}
+
+func TestHandleStale(t *testing.T) {
+	r := maketestRouter([]byte(`
+[irc.freenode]
+server=""
+[discord.test]
+server=""
+
+[[gateway]]
+    name = "bridge1"
+    enable=true
+    MaxMessageAge=60
+    StalePolicy="digest"
+    StaleDigestSize=2
+
+    [[gateway.inout]]
+    account = "irc.freenode"
+    channel = "#wimtesting"
+
+    [[gateway.inout]]
+    account = "discord.test"
+    channel = "general"
+`))
+	gw := r.Gateways["bridge1"]
+	assert.Equal(t, StalePolicyDigest, gw.stalePolicy())
+
+	old := time.Now().Add(-time.Hour)
+	assert.True(t, gw.isStale(&config.Message{Text: "old", Timestamp: old}))
+	assert.False(t, gw.isStale(&config.Message{Text: "new", Timestamp: time.Now()}))
+	assert.False(t, gw.isStale(&config.Message{Event: config.EventJoinLeave, Timestamp: old}))
+
+	dest := gw.Bridges["discord.test"]
+	channel := &config.ChannelInfo{Name: "general", ID: "generaldiscord.test"}
+	for _, text := range []string{"one", "two", "three"} {
+		gw.handleStale(&config.Message{Username: "<wim> ", Text: text, Timestamp: old}, dest, channel)
+	}
+	b := gw.stale["discord.test"+channel.ID]
+	b.timer.Stop()
+	assert.Equal(t, 3, b.count)
+	assert.Equal(t, []string{"<wim> one", "<wim> two", "<wim> three"}, b.lines)
+
+	lines := strings.Split(staleDigest(b, gw.MyConfig.StaleDigestSize), "\n")
+	assert.Len(t, lines, 4)
+	assert.Equal(t, "... and 1 more", lines[3])
+	assert.True(t, strings.HasPrefix(staleSummary(b), "3 messages not relayed during outage"))
+
+	// timers have the router flush
+	flushed := false
+	go gw.requestFlush(func() { flushed = true })
+	msg := <-r.Message
+	assert.True(t, r.handleEventFlush(&msg))
+	assert.True(t, flushed)
+	assert.False(t, r.handleEventFlush(&config.Message{Text: "hello"}))
+}
+
+func TestHandleMentions(t *testing.T) {
+	r := maketestRouter([]byte(`
+[irc.freenode]
+server=""
+[discord.test]
+server=""
+[slack.test]
+server=""
+
+[[gateway]]
+    name = "bridge1"
+    enable=true
+
+    [[gateway.inout]]
+    account = "irc.freenode"
+    channel = "#wimtesting"
+
+    [[gateway.inout]]
+    account = "discord.test"
+    channel = "general"
+
+    [[gateway.inout]]
+    account = "slack.test"
+    channel = "general"
+
+[[identity]]
+    name = "caroline"
+    users = [ "slack.test:U2", "discord.test:99" ]
+`))
+	gw := r.Gateways["bridge1"]
+	gw.rememberUser(&config.Message{Username: "Alice", UserID: "1234", Account: "discord.test"})
+	gw.rememberUser(&config.Message{Username: "bob", UserID: "U1", Account: "slack.test", Event: config.EventJoinLeave})
+
+	mentions := []config.Mention{
+		{Text: "alice", Username: "alice"},
+		{Text: "bob", Username: "bob"},
+		{Text: "@carol", Username: "carol", UserID: "U2", Account: "slack.test"},
+	}
+	msg := &config.Message{Text: "alice: bob and @carol", Mentions: mentions}
+	gw.handleMentions(msg, gw.Bridges["discord.test"])
+	assert.Equal(t, []config.Mention{
+		{Text: "alice", Username: "alice", UserID: "1234", Account: "discord.test"},
+		{Text: "bob", Username: "bob"},
+		{Text: "@carol", Username: "carol", UserID: "99", Account: "discord.test"},
+	}, msg.Mentions)
+
+	msg = &config.Message{Text: "alice: bob and @carol", Mentions: mentions}
+	gw.handleMentions(msg, gw.Bridges["slack.test"])
+	assert.Equal(t, mentions[2], msg.Mentions[2])
+	assert.Equal(t, config.Mention{Text: "alice", Username: "alice"}, mentions[0])
+}
+
+func TestIdentityLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbridge-identities")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := dir + "/identities.json"
+	logger := logrus.New().WithField("prefix", "test")
+	s := newIdentityStore(logger, nil, file)
+
+	isAccount := func(account string) bool { return account == "irc.test" || account == "slack.test" }
+	sendAll := func(account, userID, text string) []identityReply {
+		replies, ok := s.handleCommand(&config.Message{Text: text, Account: account, Channel: "#test", UserID: userID, Username: userID}, isAccount)
+		assert.True(t, ok)
+		return replies
+	}
+	send := func(account, userID, text string) string {
+		replies := sendAll(account, userID, text)
+		assert.Len(t, replies, 1)
+		assert.Equal(t, identityReply{account: account, channel: "#test", userID: userID, username: userID, text: replies[0].text}, replies[0])
+		return replies[0].text
+	}
+	code := func(reply string) string {
+		return regexp.MustCompile(`!link (\d+)`).FindStringSubmatch(reply)[1]
+	}
+
+	_, ok := s.handleCommand(&config.Message{Text: "!linked", Account: "irc.test", UserID: "alice"}, isAccount)
+	assert.False(t, ok)
+	assert.Equal(t, "Unknown or expired code.", send("irc.test", "alice", "!link 12345"))
+	assert.Equal(t, "Unknown account matrix.test.", send("irc.test", "alice", "!link matrix.test alice"))
+
+	// the first code only works for the account the user named
+	reply := send("irc.test", "alice", "!link slack.test U1")
+	first := code(reply)
+	assert.Equal(t, "Send \"!link "+first+"\" from U1 on slack.test within 10 minutes.", reply)
+	assert.Equal(t, "Unknown or expired code.", send("irc.test", "alice", "!link "+first))
+	assert.Equal(t, "Unknown or expired code.", send("slack.test", "U2", "!link "+first))
+
+	// the confirmation goes to the first user and names the account
+	replies := sendAll("slack.test", "U1", "!link "+first)
+	assert.Len(t, replies, 2)
+	assert.Equal(t, "Confirm with the code sent to alice on irc.test.", replies[0].text)
+	assert.Equal(t, "irc.test", replies[1].account)
+	assert.Equal(t, "alice", replies[1].userID)
+	assert.Contains(t, replies[1].text, "to link U1 (U1) on slack.test to your account.")
+	second := code(replies[1].text)
+	assert.Equal(t, "Only the user who sent the first code can confirm.", send("irc.test", "mallory", "!link "+second))
+	assert.Nil(t, s.find("slack.test", "U1"))
+	assert.Equal(t, "Linked U1 on slack.test.", send("irc.test", "alice", "!link "+second))
+
+	// linked identities are persisted
+	s = newIdentityStore(logger, []config.Identity{{Name: "bob", Users: []string{"discord.test:2"}}}, file)
+	id := s.find("slack.test", "U1")
+	assert.Equal(t, &config.Identity{Name: "alice", Users: []string{"irc.test:alice", "slack.test:U1"}}, id)
+	userID, ok := userOn(s.findByName("Bob"), "discord.test")
+	assert.True(t, ok)
+	assert.Equal(t, "2", userID)
+
+	assert.Equal(t, "Unlinked slack.test.", send("slack.test", "U1", "!unlink"))
+	assert.Nil(t, s.find("irc.test", "alice"))
+	assert.Equal(t, "You don't have linked accounts.", send("slack.test", "U1", "!unlink"))
+}
+
+func TestSummarizeJoinPart(t *testing.T) {
+	event := func(nick, action string) config.Message {
+		return config.Message{
+			Username: "[irc] <system> ",
+			Text:     nick + " " + action + "s",
+			Event:    config.EventJoinLeave,
+			Extra:    map[string][]interface{}{config.EventJoinLeave: {config.JoinLeaveInfo{Nick: nick, Action: action}}},
+		}
+	}
+	texts := func(msgs []config.Message) []string {
+		var texts []string
+		for _, msg := range msgs {
+			texts = append(texts, msg.Text)
+		}
+		return texts
+	}
+
+	// rejoin cycles are dropped, a single join is relayed as is
+	msgs := summarizeJoinPart([]config.Message{
+		event("alice", config.JoinLeaveLeave),
+		event("bob", config.JoinLeaveJoin),
+		event("Alice", config.JoinLeaveJoin),
+	}, "system")
+	assert.Equal(t, []string{"bob joins"}, texts(msgs))
+	assert.Equal(t, "[irc] <system> ", msgs[0].Username)
+
+	var split []config.Message
+	for i := 0; i < 12; i++ {
+		split = append(split, event(fmt.Sprintf("user%d", i), config.JoinLeaveNetsplit))
+	}
+	split = append(split, event("carol", config.JoinLeaveJoin), event("dave", config.JoinLeaveJoin),
+		config.Message{Text: "eve joined", Event: config.EventJoinLeave})
+	msgs = summarizeJoinPart(split, "system")
+	assert.Equal(t, []string{"eve joined", "12 users left due to netsplit", "2 users joined (carol, dave)"}, texts(msgs))
+	assert.Equal(t, "system", msgs[1].Username)
+	assert.Len(t, msgs[1].Extra[config.EventJoinLeave], 12)
+	assert.Equal(t, []interface{}{
+		config.JoinLeaveInfo{Nick: "carol", Action: config.JoinLeaveJoin},
+		config.JoinLeaveInfo{Nick: "dave", Action: config.JoinLeaveJoin},
+	}, msgs[2].Extra[config.EventJoinLeave])
+}
+
+func TestHandleNickChange(t *testing.T) {
+	r := maketestRouter([]byte(`
+[irc.freenode]
+server=""
+Puppets=true
+RemoteNickFormat="{NICK}[{PROTOCOL}]"
+[discord.test]
+server=""
+[slack.test]
+server=""
+ShowNickChange=true
+
+[[gateway]]
+    name = "bridge1"
+    enable=true
+
+    [[gateway.inout]]
+    account = "irc.freenode"
+    channel = "#wimtesting"
+
+    [[gateway.inout]]
+    account = "discord.test"
+    channel = "general"
+
+    [[gateway.inout]]
+    account = "slack.test"
+    channel = "general"
+
+[[identity]]
+    name = "caroline"
+    users = [ "discord.test:99" ]
+`))
+	gw := r.Gateways["bridge1"]
+	info := config.NickChangeInfo{Old: "alice", New: "alice_away"}
+	rmsg := &config.Message{
+		Username: "system",
+		UserID:   "1234",
+		Account:  "discord.test",
+		Protocol: "discord",
+		Gateway:  "bridge1",
+		Event:    config.EventNickChange,
+		Text:     "alice is now known as alice_away",
+		Extra:    map[string][]interface{}{config.EventNickChange: {info}},
+	}
+	assert.False(t, gw.ignoreEvent(rmsg.Event, gw.Bridges["irc.freenode"]))
+	assert.False(t, gw.ignoreEvent(rmsg.Event, gw.Bridges["slack.test"]))
+	assert.True(t, gw.ignoreEvent(rmsg.Event, gw.Bridges["discord.test"]))
+	assert.Len(t, gw.getDestChannel(rmsg, *gw.Bridges["irc.freenode"]), 1)
+
+	msg := *rmsg
+	gw.handleNickChange(rmsg, &msg, gw.Bridges["irc.freenode"])
+	assert.Equal(t, []interface{}{config.NickChangeInfo{
+		Old: "alice", New: "alice_away", RemoteOld: "alice[discord]", RemoteNew: "alice_away[discord]",
+	}}, msg.Extra[config.EventNickChange])
+	assert.Equal(t, []interface{}{info}, rmsg.Extra[config.EventNickChange])
+
+	gw.rememberUser(rmsg)
+	userID, ok := gw.users.Get("discord.test alice_away")
+	assert.True(t, ok)
+	assert.Equal(t, "1234", userID)
+
+	// users of an identity keep its name
+	rmsg.UserID = "99"
+	assert.True(t, gw.ignoreMessage(rmsg))
+
+	// puppets follow the joins and leaves of their user
+	join := &config.Message{
+		Username: "system",
+		Account:  "discord.test",
+		Protocol: "discord",
+		Event:    config.EventJoinLeave,
+		Text:     "bob joins",
+		Extra:    map[string][]interface{}{config.EventJoinLeave: {config.JoinLeaveInfo{Nick: "bob", Action: config.JoinLeaveJoin}}},
+	}
+	msg = *join
+	gw.handleJoinLeave(join, &msg, gw.Bridges["irc.freenode"])
+	assert.Equal(t, []interface{}{config.JoinLeaveInfo{Nick: "bob", Action: config.JoinLeaveJoin, Remote: "bob[discord]"}},
+		msg.Extra[config.EventJoinLeave])
+}
+
+func TestHandleCommand(t *testing.T) {
+	r := maketestRouter([]byte(`
+[irc.freenode]
+server=""
+[discord.test]
+server=""
+
+[[gateway]]
+    name = "bridge1"
+    enable=true
+
+    [[gateway.inout]]
+    account = "irc.freenode"
+    channel = "#wimtesting"
+
+    [[gateway.inout]]
+    account = "discord.test"
+    channel = "general"
+
+[[identity]]
+    name = "caroline"
+    users = [ "irc.freenode:carol" ]
+`))
+	gw := r.Gateways["bridge1"]
+	gw.Bridges["discord.test"].Joined["generaldiscord.test"] = true
+	admin := &config.Message{Username: "admin", Account: "discord.test", Channel: "general", Event: config.EventCommand}
+	command := func(name string, args ...string) string {
+		return gw.handleCommand(admin, config.CommandInfo{Name: name, Args: args})
+	}
+
+	assert.Equal(t, "Nobody was active in bridge1 recently.", command(config.CommandWho))
+	gw.rememberActive(&config.Message{Username: "Alice", Account: "discord.test"})
+	gw.rememberActive(&config.Message{Username: "carol", UserID: "carol", Account: "irc.freenode"})
+	gw.rememberActive(&config.Message{Username: "system", Account: "irc.freenode", Event: config.EventJoinLeave})
+	assert.Equal(t, "Active in bridge1:\n- caroline on irc.freenode, just now\n- Alice on discord.test, just now", command(config.CommandWho))
+
+	// muted users aren't relayed, by their user ID or identity, not by their name
+	alice := &config.Message{Username: "Alice", UserID: "1", Text: "hi", Account: "discord.test", Channel: "general"}
+	gw.rememberUser(alice)
+	gw.rememberUser(&config.Message{Username: "alice", UserID: "alice", Account: "irc.freenode"})
+	assert.False(t, gw.ignoreMessage(alice))
+	assert.Equal(t, "alice is on discord.test and irc.freenode, which account?", command(config.CommandMute, "alice"))
+	assert.Equal(t, "bob didn't send messages in bridge1 recently.", command(config.CommandMute, "bob"))
+	assert.Equal(t, "bob didn't send messages on irc.freenode recently.", command(config.CommandMute, "bob", "irc.freenode"))
+	assert.Equal(t, "Muted alice on discord.test in bridge1, their messages aren't relayed until they're unmuted or matterbridge restarts.",
+		command(config.CommandMute, "alice", "discord.test"))
+	assert.Equal(t, "Muted caroline in bridge1, their messages aren't relayed until they're unmuted or matterbridge restarts.",
+		command(config.CommandMute, "caroline"))
+	assert.True(t, gw.ignoreMessage(alice))
+	renamed := *alice
+	renamed.Username = "notalice"
+	assert.True(t, gw.ignoreMessage(&renamed))
+	assert.False(t, gw.ignoreMessage(&config.Message{Username: "alice", UserID: "alice", Text: "hi", Account: "irc.freenode", Channel: "#wimtesting"}))
+	assert.True(t, gw.ignoreMessage(&config.Message{Username: "carol", UserID: "carol", Text: "hi", Account: "irc.freenode", Channel: "#wimtesting"}))
+
+	assert.Equal(t, "Gateway bridge1:\n"+
+		"- #wimtesting on irc.freenode (inout, not joined)\n"+
+		"- general on discord.test (inout, joined)\n"+
+		"Muted: alice on discord.test, caroline", command(config.CommandStatus))
+
+	assert.Equal(t, "Unmuted alice on discord.test in bridge1.", command(config.CommandUnmute, "alice", "discord.test"))
+	assert.Equal(t, "alice on discord.test isn't muted in bridge1.", command(config.CommandUnmute, "alice", "discord.test"))
+	assert.False(t, gw.ignoreMessage(alice))
+	assert.Equal(t, "Which user?", command(config.CommandMute))
+}
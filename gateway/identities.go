@@ -0,0 +1,416 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	linkCommand   = "!link"
+	unlinkCommand = "!unlink"
+	// linkCodeExpiry is how long the codes of the !link command are valid.
+	linkCodeExpiry = 10 * time.Minute
+)
+
+// directMessageProtocols are the protocols of the bridges that can send EventDirectMessage
+// messages, the replies to !link are sent privately on them.
+var directMessageProtocols = map[string]bool{
+	"discord":  true,
+	"irc":      true,
+	"slack":    true,
+	"telegram": true,
+}
+
+// pendingLink is a user who sent !link (or !link <code>) and whose code hasn't been used yet.
+type pendingLink struct {
+	user     string // account:userid
+	userID   string
+	username string
+	account  string
+	channel  string // where the user sent the command
+	// the other account of the user, the first code is only accepted from it
+	linkAccount  string
+	linkUsername string
+	from         *pendingLink // the user who sent the first !link, set for the second code
+	expires      time.Time
+}
+
+// identityReply is a reply to a !link or !unlink command for the user with userID on
+// account, sent privately if the bridge supports it and in channel otherwise.
+type identityReply struct {
+	account  string
+	channel  string
+	userID   string
+	username string
+	parentID string
+	text     string
+}
+
+// replyTo returns the reply text to the command in msg.
+func replyTo(msg *config.Message, text string) []identityReply {
+	return []identityReply{{
+		account:  msg.Account,
+		channel:  msg.Channel,
+		userID:   msg.UserID,
+		username: msg.Username,
+		parentID: msg.ParentID,
+		text:     text,
+	}}
+}
+
+// identityStore keeps the identities configured with [[identity]] and the ones users
+// linked with the !link command. If an identity file is configured the linked
+// identities are persisted there.
+type identityStore struct {
+	sync.Mutex
+
+	configured []*config.Identity
+	linked     []*config.Identity
+	pending    map[string]*pendingLink
+	file       string
+	logger     *logrus.Entry
+}
+
+func newIdentityStore(logger *logrus.Entry, configured []config.Identity, file string) *identityStore {
+	s := &identityStore{
+		pending: make(map[string]*pendingLink),
+		file:    file,
+		logger:  logger,
+	}
+	for i := range configured {
+		s.configured = append(s.configured, &configured[i])
+	}
+	if file == "" {
+		return s
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("reading identities %s failed: %s", file, err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(data, &s.linked); err != nil {
+		logger.Errorf("parsing identities %s failed: %s", file, err)
+	}
+	return s
+}
+
+// identityUser returns how users are specified in identities.
+func identityUser(account, userID string) string {
+	return account + ":" + userID
+}
+
+// find returns (a copy of) the identity of the user with userID on account.
+func (s *identityStore) find(account, userID string) *config.Identity {
+	if userID == "" {
+		return nil
+	}
+	user := identityUser(account, userID)
+	return s.lookup(func(id *config.Identity) bool {
+		for _, u := range id.Users {
+			if u == user {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// findByName returns (a copy of) the identity with name.
+func (s *identityStore) findByName(name string) *config.Identity {
+	if name == "" {
+		return nil
+	}
+	return s.lookup(func(id *config.Identity) bool {
+		return strings.EqualFold(id.Name, name)
+	})
+}
+
+// lookup returns a copy of the first identity match returns true for, configured
+// identities first.
+func (s *identityStore) lookup(match func(*config.Identity) bool) *config.Identity {
+	s.Lock()
+	defer s.Unlock()
+	for _, identities := range [][]*config.Identity{s.configured, s.linked} {
+		for _, id := range identities {
+			if match(id) {
+				found := *id
+				found.Users = append([]string(nil), id.Users...)
+				return &found
+			}
+		}
+	}
+	return nil
+}
+
+// userOn returns the userid of the user of id on account.
+func userOn(id *config.Identity, account string) (string, bool) {
+	for _, u := range id.Users {
+		if strings.HasPrefix(u, account+":") {
+			return strings.TrimPrefix(u, account+":"), true
+		}
+	}
+	return "", false
+}
+
+// handleCommand handles the !link and !unlink commands in msg and returns the replies,
+// or false if msg isn't a command. isAccount returns true for the accounts of the bridges.
+//
+// Linking takes three steps:
+//  1. "!link <account> <username>" names the other account of the user, who gets a code
+//  2. "!link <code>" from that account, the first user gets a second code
+//  3. "!link <second code>" from the first account confirms the link
+func (s *identityStore) handleCommand(msg *config.Message, isAccount func(string) bool) ([]identityReply, bool) {
+	if s.file == "" || msg.Event != "" || msg.UserID == "" {
+		return nil, false
+	}
+	fields := strings.Fields(msg.Text)
+	if len(fields) == 0 {
+		return nil, false
+	}
+	user := identityUser(msg.Account, msg.UserID)
+	switch {
+	case fields[0] == unlinkCommand && len(fields) == 1:
+		if !s.unlink(user) {
+			return replyTo(msg, "You don't have linked accounts."), true
+		}
+		return replyTo(msg, fmt.Sprintf("Unlinked %s.", msg.Account)), true
+	case fields[0] != linkCommand:
+		return nil, false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.expirePending()
+	p := &pendingLink{
+		user:     user,
+		userID:   msg.UserID,
+		username: msg.Username,
+		account:  msg.Account,
+		channel:  msg.Channel,
+		expires:  time.Now().Add(linkCodeExpiry),
+	}
+	switch len(fields) {
+	case 1:
+		return replyTo(msg, fmt.Sprintf("Send \"%s <account> <username>\" with the account and username of your other account.", linkCommand)), true
+	case 2:
+		return s.useCode(msg, p, fields[1]), true
+	}
+
+	p.linkAccount, p.linkUsername = fields[1], strings.Join(fields[2:], " ")
+	if !isAccount(p.linkAccount) {
+		return replyTo(msg, fmt.Sprintf("Unknown account %s.", p.linkAccount)), true
+	}
+	code := s.addPending(p)
+	return replyTo(msg, fmt.Sprintf("Send \"%s %s\" from %s on %s within 10 minutes.", linkCommand, code, p.linkUsername, p.linkAccount)), true
+}
+
+// useCode handles the "!link <code>" of the user p in msg, the caller must hold the lock.
+func (s *identityStore) useCode(msg *config.Message, p *pendingLink, code string) []identityReply {
+	from, ok := s.pending[code]
+	if !ok {
+		return replyTo(msg, "Unknown or expired code.")
+	}
+	if from.from == nil {
+		// second step: only the account the first user named can use the code
+		if from.user == p.user || from.linkAccount != p.account || !strings.EqualFold(from.linkUsername, p.username) {
+			return replyTo(msg, "Unknown or expired code.")
+		}
+		delete(s.pending, code)
+		p.from = from
+		confirm := s.addPending(p)
+		return append(replyTo(msg, fmt.Sprintf("Confirm with the code sent to %s on %s.", from.username, from.account)),
+			identityReply{
+				account:  from.account,
+				channel:  from.channel,
+				userID:   from.userID,
+				username: from.username,
+				text: fmt.Sprintf("Send \"%s %s\" to link %s (%s) on %s to your account.",
+					linkCommand, confirm, p.username, p.userID, p.account),
+			})
+	}
+	// third step: only the user who started can confirm
+	if from.from.user != p.user {
+		return replyTo(msg, "Only the user who sent the first code can confirm.")
+	}
+	delete(s.pending, code)
+	s.link(from.from.username, from.from.user, from.user)
+	return replyTo(msg, fmt.Sprintf("Linked %s on %s.", from.username, from.account))
+}
+
+// addPending adds p with a new code and returns the code, the caller must hold the lock.
+func (s *identityStore) addPending(p *pendingLink) string {
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+		if err != nil {
+			n = big.NewInt(time.Now().UnixNano() % 1000000)
+		}
+		code := fmt.Sprintf("%06d", n)
+		if _, ok := s.pending[code]; !ok {
+			s.pending[code] = p
+			return code
+		}
+	}
+}
+
+// expirePending removes the expired codes, the caller must hold the lock.
+func (s *identityStore) expirePending() {
+	for code, p := range s.pending {
+		if time.Now().After(p.expires) {
+			delete(s.pending, code)
+		}
+	}
+}
+
+// link links user to the identity of first, creating one named name if needed.
+// The caller must hold the lock.
+func (s *identityStore) link(name, first, user string) {
+	s.removeUser(user)
+	for _, id := range s.linked {
+		for _, u := range id.Users {
+			if u == first {
+				id.Users = append(id.Users, user)
+				s.save()
+				return
+			}
+		}
+	}
+	s.linked = append(s.linked, &config.Identity{Name: name, Users: []string{first, user}})
+	s.save()
+}
+
+// unlink removes user from the linked identities and returns false if it wasn't linked.
+func (s *identityStore) unlink(user string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if !s.removeUser(user) {
+		return false
+	}
+	s.save()
+	return true
+}
+
+// removeUser removes user from the linked identities, the caller must hold the lock.
+func (s *identityStore) removeUser(user string) bool {
+	removed := false
+	linked := s.linked[:0]
+	for _, id := range s.linked {
+		users := id.Users[:0]
+		for _, u := range id.Users {
+			if u == user {
+				removed = true
+				continue
+			}
+			users = append(users, u)
+		}
+		id.Users = users
+		// an identity of one user doesn't link anything
+		if len(id.Users) > 1 {
+			linked = append(linked, id)
+		}
+	}
+	s.linked = linked
+	return removed
+}
+
+// save writes the linked identities to the identity file, the caller must hold the lock.
+func (s *identityStore) save() {
+	data, err := json.MarshalIndent(s.linked, "", "  ")
+	if err != nil {
+		s.logger.Errorf("encoding identities failed: %s", err)
+		return
+	}
+	// write to a temporary file first so we never leave a truncated file behind
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), filepath.Base(s.file)+".*")
+	if err != nil {
+		s.logger.Errorf("writing identities failed: %s", err)
+		return
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		s.logger.Errorf("writing identities failed: %s", err)
+		return
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), s.file); err != nil {
+		os.Remove(tmp.Name())
+		s.logger.Errorf("writing identities failed: %s", err)
+	}
+}
+
+// handleIdentityCommand handles the !link and !unlink commands and sends the replies.
+// Returns true if msg was a command that shouldn't be relayed.
+func (r *Router) handleIdentityCommand(msg *config.Message) bool {
+	replies, ok := r.identities.handleCommand(msg, func(account string) bool {
+		return r.getBridge(account) != nil
+	})
+	if !ok {
+		return false
+	}
+	for _, reply := range replies {
+		r.sendIdentityReply(reply)
+	}
+	return true
+}
+
+// sendIdentityReply sends reply to its user privately if the bridge supports it, so
+// nobody else sees the codes, and in the channel the user sent the command in otherwise.
+func (r *Router) sendIdentityReply(reply identityReply) {
+	br := r.getBridge(reply.account)
+	if br == nil {
+		return
+	}
+	if directMessageProtocols[br.Protocol] {
+		_, err := br.Send(config.Message{
+			Text:     reply.text,
+			Channel:  reply.channel,
+			Account:  reply.account,
+			Username: reply.username,
+			UserID:   reply.userID,
+			Event:    config.EventDirectMessage,
+		})
+		if err == nil {
+			return
+		}
+		r.logger.Warnf("replying privately to %s on %s failed: %s, replying in %s", reply.username, reply.account, err, reply.channel)
+	}
+	msg := config.Message{Text: reply.text, Channel: reply.channel, Account: reply.account, ParentID: reply.parentID}
+	if _, err := br.Send(msg); err != nil {
+		r.logger.Errorf("replying to %s on %s failed: %s", linkCommand, reply.account, err)
+	}
+}
+
+// applyIdentity relays msg with the name and avatar of the identity of its user.
+func (gw *Gateway) applyIdentity(msg *config.Message) {
+	id := gw.Router.identities.find(msg.Account, msg.UserID)
+	if id == nil {
+		return
+	}
+	if id.Name != "" {
+		msg.Username = id.Name
+	}
+	if id.Avatar != "" {
+		msg.Avatar = id.Avatar
+	}
+}
+
+// identityName returns the name of the identity of the user who sent msg.
+func (gw *Gateway) identityName(msg *config.Message) string {
+	if id := gw.Router.identities.find(msg.Account, msg.UserID); id != nil {
+		return id.Name
+	}
+	return ""
+}
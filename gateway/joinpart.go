@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+)
+
+// joinPartMaxNicks is the maximum number of nicks listed in a join/part summary.
+const joinPartMaxNicks = 5
+
+// joinPartBuffer holds the joins/parts relayed to a destination channel during the
+// JoinPartWindow.
+type joinPartBuffer struct {
+	msgs []config.Message
+	// username is how the "system" user appears on the destination, used for summaries
+	username string
+}
+
+// bufferJoinPart buffers the join/part msg (relayed from rmsg) for channel of dest if
+// JoinPartWindow is configured and returns true if it did.
+func (gw *Gateway) bufferJoinPart(rmsg, msg *config.Message, dest *bridge.Bridge, channel *config.ChannelInfo) bool {
+	window := dest.GetInt("JoinPartWindow")
+	if window <= 0 {
+		return false
+	}
+
+	gw.joinPartMu.Lock()
+	defer gw.joinPartMu.Unlock()
+	key := dest.Account + channel.ID
+	b, ok := gw.joinPart[key]
+	if !ok {
+		system := *rmsg
+		system.Username = "system"
+		b = &joinPartBuffer{username: gw.modifyUsername(&system, dest)}
+		time.AfterFunc(time.Duration(window)*time.Second, func() {
+			gw.requestFlush(func() {
+				if gw.pendingJoinPart(key) == b {
+					gw.flushJoinPart(dest, channel.ID)
+				}
+			})
+		})
+		gw.joinPart[key] = b
+	}
+	b.msgs = append(b.msgs, *msg)
+	return true
+}
+
+// pendingJoinPart returns the joins/parts buffered for the destination channel with key, if any.
+func (gw *Gateway) pendingJoinPart(key string) *joinPartBuffer {
+	gw.joinPartMu.Lock()
+	defer gw.joinPartMu.Unlock()
+	return gw.joinPart[key]
+}
+
+// flushJoinPart sends the joins/parts buffered for channel of dest, collapsed into
+// summaries where possible. It's called when the JoinPartWindow ends and before relaying
+// another message, so the joins/parts aren't sent after messages that followed them.
+func (gw *Gateway) flushJoinPart(dest *bridge.Bridge, channel string) {
+	gw.joinPartMu.Lock()
+	key := dest.Account + channel
+	b, ok := gw.joinPart[key]
+	delete(gw.joinPart, key)
+	gw.joinPartMu.Unlock()
+	if !ok {
+		return
+	}
+
+	for _, msg := range summarizeJoinPart(b.msgs, b.username) {
+		if _, err := dest.Send(msg); err != nil {
+			gw.logger.Errorf("Sending joins/parts to %s failed: %s", dest.Account, err)
+		}
+	}
+}
+
+// joinPartInfo returns the JoinLeaveInfo the bridge added to msg, if any.
+func joinPartInfo(msg *config.Message) (config.JoinLeaveInfo, bool) {
+	for _, v := range msg.Extra[config.EventJoinLeave] {
+		if info, ok := v.(config.JoinLeaveInfo); ok && info.Nick != "" {
+			return info, true
+		}
+	}
+	return config.JoinLeaveInfo{}, false
+}
+
+// joinPartUser is what a user did during the JoinPartWindow.
+type joinPartUser struct {
+	nick    string
+	info    config.JoinLeaveInfo // of the last join or leave
+	balance int                  // joins minus leaves
+	join    config.Message
+	leave   config.Message
+	action  string // the action of leave
+}
+
+// summarizeJoinPart collapses msgs into the messages to send: users who left and joined
+// again (or the other way round) are dropped and the others are summarised per action,
+// sent as username. Messages without JoinLeaveInfo are sent as is.
+func summarizeJoinPart(msgs []config.Message, username string) []config.Message {
+	var (
+		out    []config.Message
+		users  []*joinPartUser
+		byNick = make(map[string]*joinPartUser)
+	)
+	for _, msg := range msgs {
+		info, ok := joinPartInfo(&msg)
+		if !ok {
+			out = append(out, msg)
+			continue
+		}
+		u, ok := byNick[strings.ToLower(info.Nick)]
+		if !ok {
+			u = &joinPartUser{nick: info.Nick}
+			byNick[strings.ToLower(info.Nick)] = u
+			users = append(users, u)
+		}
+		u.info = info
+		if info.Action == config.JoinLeaveJoin {
+			u.balance++
+			u.join = msg
+		} else {
+			u.balance--
+			u.leave = msg
+			u.action = info.Action
+		}
+	}
+
+	var (
+		actions []string
+		nicks   = make(map[string][]string)
+		infos   = make(map[string][]interface{})
+		last    = make(map[string]config.Message)
+	)
+	for _, u := range users {
+		action, msg := u.action, u.leave
+		switch {
+		case u.balance == 0:
+			continue
+		case u.balance > 0:
+			action, msg = config.JoinLeaveJoin, u.join
+		}
+		if _, ok := nicks[action]; !ok {
+			actions = append(actions, action)
+		}
+		nicks[action] = append(nicks[action], u.nick)
+		info := u.info
+		info.Action = action
+		infos[action] = append(infos[action], info)
+		last[action] = msg
+	}
+	for _, action := range actions {
+		msg := last[action]
+		if len(nicks[action]) > 1 {
+			msg.Username = username
+			msg.ID = ""
+			msg.UserID = ""
+			msg.Avatar = ""
+			// keep who joined or left, for the puppets of the destination
+			msg.Extra = map[string][]interface{}{config.EventJoinLeave: infos[action]}
+			msg.Timestamp = time.Now()
+			msg.Text = joinPartSummary(action, nicks[action])
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// joinPartSummary returns eg "12 users left due to netsplit" or "3 users joined (alice, bob, carol)".
+func joinPartSummary(action string, nicks []string) string {
+	var text string
+	switch action {
+	case config.JoinLeaveJoin:
+		text = fmt.Sprintf("%d users joined", len(nicks))
+	case config.JoinLeaveNetsplit:
+		return fmt.Sprintf("%d users left due to netsplit", len(nicks))
+	default:
+		text = fmt.Sprintf("%d users left", len(nicks))
+	}
+	if len(nicks) > joinPartMaxNicks {
+		return text
+	}
+	return text + " (" + strings.Join(nicks, ", ") + ")"
+}
@@ -0,0 +1,258 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mediaMaxMessages is the number of messages a file is linked to at most, older links are
+// dropped (and compacted away) when it's relayed with more messages.
+const mediaMaxMessages = 20
+
+// MediaRecord describes a file stored on the mediaserver, identified by the
+// SHA-256 of its content, and the (last mediaMaxMessages) messages it was relayed with.
+type MediaRecord struct {
+	SHA      string         `json:"sha256"`
+	Names    []string       `json:"names"`
+	Size     int64          `json:"size"`
+	Created  time.Time      `json:"created"`
+	Messages []MediaMessage `json:"messages,omitempty"`
+}
+
+// MediaMessage links a stored file to a message (as "protocol ID") and the
+// IDs of the messages it was relayed as.
+type MediaMessage struct {
+	Gateway string   `json:"gateway"`
+	ID      string   `json:"id"`
+	Relayed []string `json:"relayed,omitempty"`
+}
+
+// mediaEntry is a line of the index file, it records that a file was stored under a name
+// (Name, Size and Created) or that it was relayed with a message (Message).
+type mediaEntry struct {
+	SHA     string        `json:"sha256"`
+	Name    string        `json:"name,omitempty"`
+	Size    int64         `json:"size,omitempty"`
+	Created *time.Time    `json:"created,omitempty"`
+	Message *MediaMessage `json:"message,omitempty"`
+}
+
+// mediaStore keeps track of the files stored on the mediaserver so identical
+// files are only stored once, across all gateways. If an index file is
+// configured the changes are appended to it, one JSON entry per line, so
+// recording a file doesn't depend on the size of the index.
+type mediaStore struct {
+	sync.Mutex
+
+	records   map[string]*MediaRecord
+	indexFile string
+	index     *os.File
+	logger    *logrus.Entry
+}
+
+func newMediaStore(logger *logrus.Entry, indexFile string) *mediaStore {
+	m := &mediaStore{
+		records:   make(map[string]*MediaRecord),
+		indexFile: indexFile,
+		logger:    logger,
+	}
+	if indexFile == "" {
+		return m
+	}
+	entries, invalid, err := m.load()
+	if err != nil {
+		logger.Errorf("reading media index %s failed: %s", indexFile, err)
+	}
+	// entries that were replaced (eg the relayed IDs of edited messages) are dropped, and
+	// so is a line cut off by a crash, new entries would be appended to it
+	if invalid > 0 || entries > 2*m.entries() {
+		m.compact()
+	}
+	m.index, err = os.OpenFile(indexFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		logger.Errorf("opening media index %s failed: %s", indexFile, err)
+	}
+	return m
+}
+
+// load reads the index file and returns the number of valid and invalid entries it has.
+func (m *mediaStore) load() (int, int, error) {
+	f, err := os.Open(m.indexFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	entries, invalid := 0, 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry mediaEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// the last line is cut off if we didn't finish writing it
+			m.logger.Warnf("skipping invalid entry %d of media index %s: %s", entries+invalid+1, m.indexFile, err)
+			invalid++
+			continue
+		}
+		m.apply(&entry)
+		entries++
+	}
+	return entries, invalid, scanner.Err()
+}
+
+// entries returns the number of entries needed to describe the records.
+func (m *mediaStore) entries() int {
+	n := 0
+	for _, rec := range m.records {
+		n += len(rec.Names) + len(rec.Messages)
+	}
+	return n
+}
+
+// compact rewrites the index file with the entries of the current records.
+func (m *mediaStore) compact() {
+	shas := make([]string, 0, len(m.records))
+	for sha := range m.records {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+
+	// write to a temporary file first so we never leave a truncated index behind
+	tmp, err := ioutil.TempFile(filepath.Dir(m.indexFile), filepath.Base(m.indexFile)+".*")
+	if err != nil {
+		m.logger.Errorf("compacting media index failed: %s", err)
+		return
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, sha := range shas {
+		rec := m.records[sha]
+		created := rec.Created
+		for _, name := range rec.Names {
+			enc.Encode(&mediaEntry{SHA: sha, Name: name, Size: rec.Size, Created: &created}) //nolint:errcheck
+		}
+		for i := range rec.Messages {
+			enc.Encode(&mediaEntry{SHA: sha, Message: &rec.Messages[i]}) //nolint:errcheck
+		}
+	}
+	if err = w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		m.logger.Errorf("compacting media index failed: %s", err)
+		return
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), m.indexFile); err != nil {
+		os.Remove(tmp.Name())
+		m.logger.Errorf("compacting media index failed: %s", err)
+	}
+}
+
+// apply applies the change of entry to the records and returns false if nothing changed.
+func (m *mediaStore) apply(entry *mediaEntry) bool {
+	rec, ok := m.records[entry.SHA]
+	if entry.Message != nil {
+		if !ok {
+			return false
+		}
+		for i := range rec.Messages {
+			if rec.Messages[i].Gateway == entry.Message.Gateway && rec.Messages[i].ID == entry.Message.ID {
+				rec.Messages[i].Relayed = entry.Message.Relayed
+				return true
+			}
+		}
+		rec.Messages = append(rec.Messages, *entry.Message)
+		if len(rec.Messages) > mediaMaxMessages {
+			rec.Messages = append([]MediaMessage(nil), rec.Messages[len(rec.Messages)-mediaMaxMessages:]...)
+		}
+		return true
+	}
+
+	if !ok {
+		rec = &MediaRecord{SHA: entry.SHA, Size: entry.Size}
+		if entry.Created != nil {
+			rec.Created = *entry.Created
+		}
+		m.records[entry.SHA] = rec
+	}
+	for _, n := range rec.Names {
+		if n == entry.Name {
+			return false
+		}
+	}
+	rec.Names = append(rec.Names, entry.Name)
+	return true
+}
+
+// get returns the record of the file with the given SHA-256.
+func (m *mediaStore) get(sha string) (MediaRecord, bool) {
+	m.Lock()
+	defer m.Unlock()
+	rec, ok := m.records[sha]
+	if !ok {
+		return MediaRecord{}, false
+	}
+	return *rec, true
+}
+
+// lookup returns the name under which the file with sha should be linked and
+// true if it doesn't need to be stored again. A file already stored under
+// another name is reused, unless keepName is set (avatars are looked up by name).
+func (m *mediaStore) lookup(sha, name string, keepName bool) (string, bool) {
+	m.Lock()
+	defer m.Unlock()
+	rec, ok := m.records[sha]
+	if !ok {
+		return name, false
+	}
+	for _, n := range rec.Names {
+		if n == name {
+			return name, true
+		}
+	}
+	if !keepName && len(rec.Names) > 0 {
+		return rec.Names[0], true
+	}
+	return name, false
+}
+
+// add records that the file with sha has been stored as name.
+func (m *mediaStore) add(sha, name string, size int64) {
+	created := time.Now()
+	m.record(&mediaEntry{SHA: sha, Name: name, Size: size, Created: &created})
+}
+
+// link records that the file with sha was part of the message with ID on
+// gateway, relayed as the messages with IDs relayed.
+func (m *mediaStore) link(sha, gateway, ID string, relayed []string) {
+	m.record(&mediaEntry{SHA: sha, Message: &MediaMessage{Gateway: gateway, ID: ID, Relayed: relayed}})
+}
+
+// record applies entry and appends it to the index file.
+func (m *mediaStore) record(entry *mediaEntry) {
+	m.Lock()
+	defer m.Unlock()
+	if !m.apply(entry) || m.index == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		m.logger.Errorf("encoding media index entry failed: %s", err)
+		return
+	}
+	// a single write, so a crash can only cut off the last line
+	if _, err := m.index.Write(append(data, '\n')); err != nil {
+		m.logger.Errorf("writing media index failed: %s", err)
+	}
+}
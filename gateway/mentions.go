@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+)
+
+// rememberUser remembers the user who sent msg, so mentions of their name on other
+// bridges can be resolved to them.
+func (gw *Gateway) rememberUser(msg *config.Message) {
+	username := msg.Username
+	switch msg.Event {
+	case "", config.EventUserAction:
+	case config.EventNickChange:
+		username = ""
+		if info, ok := nickChangeInfo(msg); ok {
+			username = info.New
+		}
+	default:
+		return
+	}
+	if msg.UserID == "" || username == "" {
+		return
+	}
+	gw.users.Add(msg.Account+" "+strings.ToLower(username), msg.UserID)
+}
+
+// handleMentions resolves the mentions in msg for dest. Mentions of users of dest keep
+// their user ID, other mentions get the ID of the user of dest with the same identity or
+// name if we know one, so dest can turn them into native mentions.
+// The mentions are copied, the message relayed to other destinations isn't touched.
+func (gw *Gateway) handleMentions(msg *config.Message, dest *bridge.Bridge) {
+	if len(msg.Mentions) == 0 {
+		return
+	}
+	mentions := make([]config.Mention, 0, len(msg.Mentions))
+	for _, m := range msg.Mentions {
+		if m.Account != dest.Account {
+			m.Account, m.UserID = "", gw.resolveMention(m, dest)
+			if m.UserID != "" {
+				m.Account = dest.Account
+			}
+		}
+		mentions = append(mentions, m)
+	}
+	msg.Mentions = mentions
+}
+
+// resolveMention returns the user ID on dest of the user mentioned with m: the user of dest
+// linked to the mentioned user or to the identity with its name, or the user of dest we've
+// seen with the same name.
+func (gw *Gateway) resolveMention(m config.Mention, dest *bridge.Bridge) string {
+	id := gw.Router.identities.find(m.Account, m.UserID)
+	if id == nil {
+		id = gw.Router.identities.findByName(m.Username)
+	}
+	if id != nil {
+		if userID, ok := userOn(id, dest.Account); ok {
+			return userID
+		}
+	}
+	if userID, ok := gw.users.Get(dest.Account + " " + strings.ToLower(m.Username)); ok {
+		return userID.(string)
+	}
+	return ""
+}
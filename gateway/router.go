@@ -20,7 +20,9 @@ type Router struct {
 	Message          chan config.Message
 	MattermostPlugin chan config.Message
 
-	logger *logrus.Entry
+	media      *mediaStore
+	identities *identityStore
+	logger     *logrus.Entry
 }
 
 // NewRouter initializes a new Matterbridge router for the specified configuration and
@@ -34,6 +36,8 @@ func NewRouter(rootLogger *logrus.Logger, cfg config.Config, bridgeMap map[strin
 		Message:          make(chan config.Message),
 		MattermostPlugin: make(chan config.Message),
 		Gateways:         make(map[string]*Gateway),
+		media:            newMediaStore(logger, cfg.BridgeValues().General.MediaIndexFile),
+		identities:       newIdentityStore(logger, cfg.BridgeValues().Identity, cfg.BridgeValues().General.IdentityFile),
 		logger:           logger,
 	}
 	sgw := samechannel.New(cfg)
@@ -130,6 +134,9 @@ func (r *Router) getBridge(account string) *bridge.Bridge {
 func (r *Router) handleReceive() {
 	for msg := range r.Message {
 		msg := msg // scopelint
+		if r.handleEventFlush(&msg) {
+			continue
+		}
 		r.handleEventGetChannelMembers(&msg)
 		r.handleEventFailure(&msg)
 		r.handleEventRejoinChannels(&msg)
@@ -137,6 +144,10 @@ func (r *Router) handleReceive() {
 		// Set message protocol based on the account it came from
 		msg.Protocol = r.getBridge(msg.Account).Protocol
 
+		if r.handleIdentityCommand(&msg) || r.handleEventCommand(&msg) {
+			continue
+		}
+
 		filesHandled := false
 		for _, gw := range r.Gateways {
 			// record all the message ID's of the different bridges
@@ -144,7 +155,13 @@ func (r *Router) handleReceive() {
 			if gw.ignoreMessage(&msg) {
 				continue
 			}
-			msg.Timestamp = time.Now()
+			// keep the original timestamp if the bridge gave us one
+			if msg.Timestamp.IsZero() {
+				msg.Timestamp = time.Now()
+			}
+			gw.rememberUser(&msg)
+			gw.rememberActive(&msg)
+			gw.applyIdentity(&msg)
 			gw.modifyMessage(&msg)
 			if !filesHandled {
 				gw.handleFiles(&msg)
@@ -166,6 +183,7 @@ func (r *Router) handleReceive() {
 					gw.Messages.Add(msg.Protocol+" "+msg.ID, msgIDs)
 				}
 			}
+			gw.handleFilesRecord(&msg, msgIDs)
 		}
 	}
 }
@@ -0,0 +1,163 @@
+package gateway
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+)
+
+// StalePolicy values, configured per gateway.
+const (
+	// StalePolicyDrop drops messages older than MaxMessageAge (default).
+	StalePolicyDrop = "drop"
+	// StalePolicySummary drops them and sends a notice with the number of dropped messages.
+	StalePolicySummary = "summary"
+	// StalePolicyDigest collects them and sends them as one message.
+	StalePolicyDigest = "digest"
+)
+
+const (
+	defaultStaleDigestSize = 20
+	// staleFlushDelay is how long we wait for more stale messages before sending
+	// the summary or digest, if no fresh message comes in first.
+	staleFlushDelay = 10 * time.Second
+)
+
+// staleBacklog holds the stale messages of a destination channel that haven't
+// been summarised yet.
+type staleBacklog struct {
+	msg   config.Message
+	count int
+	first time.Time
+	last  time.Time
+	lines []string
+	timer *time.Timer
+}
+
+// stalePolicy returns the StalePolicy of the gateway.
+func (gw *Gateway) stalePolicy() string {
+	switch policy := strings.ToLower(gw.MyConfig.StalePolicy); policy {
+	case StalePolicySummary, StalePolicyDigest:
+		return policy
+	case "", StalePolicyDrop:
+	default:
+		gw.logger.Warnf("Unknown StalePolicy %s for gateway %s, using %s", policy, gw.Name, StalePolicyDrop)
+	}
+	return StalePolicyDrop
+}
+
+// isStale returns true if msg is older than the MaxMessageAge of the gateway.
+// Only messages are checked, events (joins, deletes, ...) are always relayed.
+func (gw *Gateway) isStale(msg *config.Message) bool {
+	if gw.MyConfig == nil || gw.MyConfig.MaxMessageAge <= 0 || msg.Timestamp.IsZero() {
+		return false
+	}
+	if msg.Event != "" && msg.Event != config.EventUserAction {
+		return false
+	}
+	return time.Since(msg.Timestamp) > time.Duration(gw.MyConfig.MaxMessageAge)*time.Second
+}
+
+// handleStale applies the StalePolicy to a message that wasn't relayed to
+// channel of dest because it's older than MaxMessageAge.
+func (gw *Gateway) handleStale(msg *config.Message, dest *bridge.Bridge, channel *config.ChannelInfo) {
+	policy := gw.stalePolicy()
+	gw.logger.Debugf("=> Not relaying stale message (%s old) from %s to %s (%s), policy %s",
+		time.Since(msg.Timestamp).Round(time.Second), msg.Account, dest.Account, channel.Name, policy)
+	if policy == StalePolicyDrop {
+		return
+	}
+
+	gw.staleMu.Lock()
+	defer gw.staleMu.Unlock()
+	key := dest.Account + channel.ID
+	b, ok := gw.stale[key]
+	if !ok {
+		b = &staleBacklog{
+			msg: config.Message{
+				Channel:  channel.Name,
+				Account:  msg.Account,
+				Protocol: msg.Protocol,
+				Gateway:  gw.Name,
+			},
+			first: msg.Timestamp,
+		}
+		b.timer = time.AfterFunc(staleFlushDelay, func() {
+			gw.requestFlush(func() {
+				if gw.pendingStale(key) == b {
+					gw.flushStale(dest, channel.ID)
+				}
+			})
+		})
+		gw.stale[key] = b
+	} else {
+		b.timer.Reset(staleFlushDelay)
+	}
+	b.count++
+	b.last = msg.Timestamp
+	if policy == StalePolicyDigest {
+		b.lines = append(b.lines, msg.Username+msg.Text)
+	}
+}
+
+// pendingStale returns the stale messages of the destination channel with key, if any.
+func (gw *Gateway) pendingStale(key string) *staleBacklog {
+	gw.staleMu.Lock()
+	defer gw.staleMu.Unlock()
+	return gw.stale[key]
+}
+
+// flushStale sends the summary or digest of the stale messages for channel of dest, if any.
+// It's called before relaying a fresh message and when no stale messages came in for a while.
+func (gw *Gateway) flushStale(dest *bridge.Bridge, channel string) {
+	gw.staleMu.Lock()
+	key := dest.Account + channel
+	b, ok := gw.stale[key]
+	if ok {
+		b.timer.Stop()
+		delete(gw.stale, key)
+	}
+	gw.staleMu.Unlock()
+	if !ok {
+		return
+	}
+
+	msg := b.msg
+	msg.Timestamp = time.Now()
+	msg.Text = staleSummary(b)
+	if len(b.lines) > 0 {
+		msg.Text = staleDigest(b, gw.MyConfig.StaleDigestSize)
+	}
+	if _, err := dest.Send(msg); err != nil {
+		gw.logger.Errorf("Sending stale messages summary to %s failed: %s", dest.Account, err)
+	}
+}
+
+// staleSummary returns eg "47 messages not relayed during outage (10:04 - 10:32 UTC)".
+func staleSummary(b *staleBacklog) string {
+	noun := "messages"
+	if b.count == 1 {
+		noun = "message"
+	}
+	return fmt.Sprintf("%d %s not relayed during outage (%s - %s)",
+		b.count, noun, b.first.Format("15:04"), b.last.Format("15:04 MST"))
+}
+
+// staleDigest returns the summary followed by at most size of the stale messages.
+func staleDigest(b *staleBacklog, size int) string {
+	if size <= 0 {
+		size = defaultStaleDigestSize
+	}
+	lines := []string{fmt.Sprintf("%d messages sent during outage (%s - %s):",
+		b.count, b.first.Format("15:04"), b.last.Format("15:04 MST"))}
+	if len(b.lines) > size {
+		lines = append(lines, b.lines[:size]...)
+		lines = append(lines, fmt.Sprintf("... and %d more", len(b.lines)-size))
+	} else {
+		lines = append(lines, b.lines...)
+	}
+	return strings.Join(lines, "\n")
+}
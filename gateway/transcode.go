@@ -0,0 +1,190 @@
+package gateway
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+)
+
+// transcodeEnabled returns true if any of the media transcoding settings is configured for dest.
+func transcodeEnabled(dest *bridge.Bridge) bool {
+	return len(dest.GetStringSlice("MediaImageFormats")) > 0 ||
+		len(dest.GetStringSlice("MediaAudioFormats")) > 0 ||
+		dest.GetInt("MediaMaxImageSize") > 0 ||
+		dest.GetBool("MediaStripMetadata") ||
+		dest.GetString("MediaStickerFormat") != ""
+}
+
+// handleTranscode converts the files attached to msg into formats the destination
+// bridge accepts, as configured with its MediaImageFormats, MediaAudioFormats,
+// MediaMaxImageSize, MediaStickerFormat and MediaStripMetadata settings.
+// The files are copied, the message relayed to other destinations isn't touched.
+func (gw *Gateway) handleTranscode(msg *config.Message, dest *bridge.Bridge) {
+	if msg.Extra == nil || len(msg.Extra["file"]) == 0 || !transcodeEnabled(dest) {
+		return
+	}
+
+	extra := make(map[string][]interface{}, len(msg.Extra))
+	for k, v := range msg.Extra {
+		extra[k] = v
+	}
+	files := make([]interface{}, 0, len(msg.Extra["file"]))
+	for _, f := range msg.Extra["file"] {
+		fi, ok := f.(config.FileInfo)
+		if !ok || fi.Data == nil || fi.Avatar {
+			files = append(files, f)
+			continue
+		}
+		files = append(files, gw.transcodeFile(fi, dest))
+	}
+	extra["file"] = files
+	msg.Extra = extra
+}
+
+// transcodeFile returns fi with its data converted for dest. On failure the
+// original file is returned, so the destination can still try to use it.
+func (gw *Gateway) transcodeFile(fi config.FileInfo, dest *bridge.Bridge) config.FileInfo {
+	data := make([]byte, len(*fi.Data))
+	copy(data, *fi.Data)
+	name := fi.Name
+
+	var err error
+	lname := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lname, ".tgs") || strings.HasSuffix(lname, ".tgs.webp"):
+		name, err = gw.transcodeSticker(name, &data, dest)
+	case helper.AudioFormat(name) != "":
+		name, err = gw.transcodeAudio(name, &data, dest)
+	default:
+		if format := helper.DetectImageFormat(data); format != "" {
+			name, err = gw.transcodeImage(name, format, &data, dest)
+		}
+	}
+	if err != nil {
+		gw.logger.Errorf("transcoding %s for %s failed: %s", fi.Name, dest.Account, err)
+		return fi
+	}
+	if name != fi.Name {
+		gw.logger.Debugf("transcoded %s to %s for %s", fi.Name, name, dest.Account)
+	}
+	if name == fi.Name && bytes.Equal(data, *fi.Data) {
+		return fi
+	}
+	fi.Name = name
+	fi.Data = &data
+	fi.Size = int64(len(data))
+
+	// the URL and SHA of the original don't describe the transcoded file, store it too
+	fi.URL, fi.SHA = "", ""
+	if gw.mediaServerEnabled() {
+		if fi.URL, fi.SHA, err = gw.storeFile(fi); err != nil {
+			gw.logger.Errorf("storing %s transcoded for %s failed: %s", name, dest.Account, err)
+		}
+	}
+	return fi
+}
+
+// transcodeImage converts images in a format not listed in MediaImageFormats
+// to the first listed format we can encode, downscales images exceeding
+// MediaMaxImageSize and strips metadata if MediaStripMetadata is set.
+func (gw *Gateway) transcodeImage(name, format string, data *[]byte, dest *bridge.Bridge) (string, error) {
+	accepted := dest.GetStringSlice("MediaImageFormats")
+	maxSize := dest.GetInt("MediaMaxImageSize")
+
+	target := format
+	if len(accepted) > 0 && !containsFormat(accepted, format) {
+		target = ""
+		for _, f := range accepted {
+			f = normalizeImageFormat(f)
+			if helper.CanEncodeImage(f) {
+				target = f
+				break
+			}
+		}
+		if target == "" {
+			gw.logger.Warnf("%s: none of MediaImageFormats %v can be encoded, keeping %s", dest.Account, accepted, format)
+			target = format
+		}
+	}
+
+	original := format
+	// there is no HEIC decoder in Go, let ffmpeg make a png out of it first.
+	if format == helper.ImageFormatHEIC && target != format {
+		if err := helper.ConvertWithFFmpeg(data, filepath.Ext(name), helper.ImageFormatPNG, gw.logger); err != nil {
+			return name, err
+		}
+		format = helper.ImageFormatPNG
+	}
+
+	// animated gifs would lose their animation, only convert them when asked to.
+	resize := helper.NeedsScaling(*data, maxSize) && format != helper.ImageFormatGIF
+	switch {
+	case target != format || (resize && helper.CanEncodeImage(format)):
+		if err := helper.ConvertImage(data, target, maxSize); err != nil {
+			return name, err
+		}
+		format = target
+	case dest.GetBool("MediaStripMetadata"):
+		if err := helper.StripImageMetadata(data); err != nil {
+			return name, err
+		}
+	}
+
+	if format != original {
+		return replaceExt(name, helper.ImageExtension(format)), nil
+	}
+	return name, nil
+}
+
+// transcodeAudio converts audio files in a format not listed in MediaAudioFormats
+// to the first listed format.
+func (gw *Gateway) transcodeAudio(name string, data *[]byte, dest *bridge.Bridge) (string, error) {
+	accepted := dest.GetStringSlice("MediaAudioFormats")
+	format := helper.AudioFormat(name)
+	if len(accepted) == 0 || containsFormat(accepted, format) {
+		return name, nil
+	}
+	target := strings.ToLower(accepted[0])
+	if err := helper.ConvertWithFFmpeg(data, filepath.Ext(name), target, gw.logger); err != nil {
+		return name, err
+	}
+	return replaceExt(name, "."+target), nil
+}
+
+// transcodeSticker converts animated (lottie) stickers to MediaStickerFormat.
+func (gw *Gateway) transcodeSticker(name string, data *[]byte, dest *bridge.Bridge) (string, error) {
+	format := dest.GetString("MediaStickerFormat")
+	if format == "" || !helper.SupportsFormat(format) {
+		return name, nil
+	}
+	if err := helper.ConvertTgsToX(data, format, gw.logger); err != nil {
+		return name, err
+	}
+	name = strings.TrimSuffix(name, ".webp")
+	return replaceExt(name, "."+format), nil
+}
+
+func normalizeImageFormat(format string) string {
+	format = strings.ToLower(strings.TrimPrefix(format, "."))
+	if format == "jpg" {
+		return helper.ImageFormatJPEG
+	}
+	return format
+}
+
+func containsFormat(formats []string, format string) bool {
+	for _, f := range formats {
+		if normalizeImageFormat(f) == format {
+			return true
+		}
+	}
+	return false
+}
+
+func replaceExt(name, ext string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ext
+}